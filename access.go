@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// AccessConfig filters connections by source address before the SSH
+// handshake. Entries are CIDR ranges or single IPs.
+type AccessConfig struct {
+	// Allow, if non-empty, is the only set of ranges that may connect.
+	Allow []string `yaml:"allow"`
+	// Deny ranges are rejected even if they are also allowed.
+	Deny []string `yaml:"deny"`
+}
+
+// accessList is a parsed AccessConfig.
+type accessList struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newAccessList(cfg AccessConfig) (*accessList, error) {
+	allow, err := parsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %v", err)
+	}
+	deny, err := parsePrefixes(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %v", err)
+	}
+	return &accessList{allow: allow, deny: deny}, nil
+}
+
+// parsePrefixes parses CIDR ranges, treating a bare IP as a single-address
+// range.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		if !strings.Contains(e, "/") {
+			addr, err := netip.ParseAddr(e)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// permits reports whether ip may connect.
+func (a *accessList) permits(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	// Match IPv4-mapped IPv6 addresses against IPv4 ranges
+	addr = addr.Unmap()
+	if containsAddr(a.deny, addr) {
+		return false
+	}
+	return len(a.allow) == 0 || containsAddr(a.allow, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
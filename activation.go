@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// activatedSocket is a listening socket passed by systemd socket activation,
+// named by its unit's FileDescriptorName or its descriptor.
+type activatedSocket struct {
+	name   string
+	socket net.Listener
+}
+
+// activated pairs the sockets systemd passed with the listeners configured
+// for their addresses. Sockets no listener is configured for are served
+// with the server-wide settings only, as listen_address is; configured
+// addresses systemd passed no socket for are not listened on, as binding is
+// left to systemd.
+func activated(listeners []*listener, sockets []activatedSocket) ([]*listener, []net.Listener) {
+	var ls []*listener
+	var serving []net.Listener
+	used := make([]bool, len(listeners))
+	for _, as := range sockets {
+		l := &listener{address: as.socket.Addr().String(), socketMode: 0o666}
+		for i, cl := range listeners {
+			if !used[i] && sameAddress(cl.address, as.socket.Addr()) {
+				l, used[i] = cl, true
+				break
+			}
+		}
+		infof("SSH server listening on %s (%s, from systemd)", l.address, as.name)
+		ls = append(ls, l)
+		serving = append(serving, as.socket)
+	}
+	for i, l := range listeners {
+		if !used[i] {
+			infof("Not listening on %s: systemd passed no socket for it", l.address)
+		}
+	}
+	return ls, serving
+}
+
+// sameAddress reports whether addr, that of an inherited socket, is the
+// listener address address. Unspecified addresses such as 0.0.0.0 and ::
+// are all the same, as systemd listens on both for ListenStream=22.
+func sameAddress(address string, addr net.Addr) bool {
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		return addr.Network() == "unix" && addr.String() == path
+	}
+	got, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	want, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil || want.Port != got.Port {
+		return false
+	}
+	unspecified := func(ip net.IP) bool { return len(ip) == 0 || ip.IsUnspecified() }
+	return want.IP.Equal(got.IP) || unspecified(want.IP) && unspecified(got.IP)
+}
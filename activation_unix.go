@@ -0,0 +1,58 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first descriptor systemd passes, SD_LISTEN_FDS_START.
+const listenFDsStart = 3
+
+// systemdSockets returns the listening sockets passed by systemd socket
+// activation, described by LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, or
+// none if the server was not started that way. The variables are cleared
+// so sessions do not see them.
+func systemdSockets() ([]activatedSocket, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(v)
+	}
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS is not a number of sockets")
+	}
+	return fileListeners(n, names)
+}
+
+// fileListeners returns the n listening sockets inherited from descriptor
+// listenFDsStart on, named by names where they are given.
+func fileListeners(n int, names []string) ([]activatedSocket, error) {
+	sockets := make([]activatedSocket, 0, n)
+	for i := range n {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("fd %d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		socket, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			// Accept=yes passes a connection rather than a listening socket
+			return nil, fmt.Errorf("%s: not a listening stream socket (the unit needs Accept=no): %v", name, err)
+		}
+		sockets = append(sockets, activatedSocket{name: name, socket: socket})
+	}
+	return sockets, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// adminCommand is an operation available on the admin socket.
+type adminCommand struct {
+	usage string
+	help  string
+	run   func(s *server, args []string, w io.Writer) error
+}
+
+var adminCommands = map[string]adminCommand{}
+
+// registerAdminCommand adds an admin socket command. It is meant to be
+// called from init functions.
+func registerAdminCommand(name, usage, help string, run func(s *server, args []string, w io.Writer) error) {
+	if _, dup := adminCommands[name]; dup {
+		panic("duplicate admin command " + name)
+	}
+	adminCommands[name] = adminCommand{usage: usage, help: help, run: run}
+}
+
+func init() {
+	registerAdminCommand("help", "help", "list admin commands", func(s *server, args []string, w io.Writer) error {
+		names := make([]string, 0, len(adminCommands))
+		for name := range adminCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%-24s %s\n", adminCommands[name].usage, adminCommands[name].help)
+		}
+		return nil
+	})
+}
+
+// serveAdmin accepts admin connections on a unix socket at path. Each
+// connection sends one command line and receives its output.
+func (s *server) serveAdmin(path string) error {
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				warnf("Admin socket: %v", err)
+				return
+			}
+			go s.handleAdmin(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *server) handleAdmin(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+	if err := s.runAdminCommand(args, conn); err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+	}
+}
+
+// runAdminCommand runs the admin command named by args[0], writing its
+// output to w.
+func (s *server) runAdminCommand(args []string, w io.Writer) error {
+	cmd, ok := adminCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	return cmd.run(s, args[1:], w)
+}
+
+// permAdmin marks a login that may run admin commands in its sessions.
+const permAdmin = "admin"
+
+// parseAdminCommand recognises "admin <command> [args]" exec commands,
+// returning the admin command's words.
+func parseAdminCommand(command string) ([]string, bool) {
+	args := strings.Fields(command)
+	if len(args) < 2 || args[0] != "admin" {
+		return nil, false
+	}
+	return args[1:], true
+}
+
+// runAdmin serves an admin command run in a session by an admin login,
+// with errors on stderr and exit status 1 as from the admin subcommand.
+func (sess *session) runAdmin(req *ssh.Request, args []string) bool {
+	infof("Admin command for %s: %s", sess.user.Name, strings.Join(args, " "))
+	req.Reply(true, nil)
+	sess.background(nil, func() {
+		var out io.Writer = sess.ch
+		if sess.ptyRequested {
+			out = crlfWriter{sess.ch}
+		}
+		if err := sess.admin(args, out); err != nil {
+			fmt.Fprintf(sess.ch.Stderr(), "error: %v\r\n", err)
+			sendExitStatus(sess.ch, 1)
+			return
+		}
+		sendExitStatus(sess.ch, 0)
+	})
+	return true
+}
+
+// crlfWriter ends lines with CRLF, for a client's terminal in raw mode.
+type crlfWriter struct{ w io.Writer }
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// runAdminClient sends args to the admin socket at path and copies the
+// reply to stdout. It returns false if the command reported an error.
+func runAdminClient(path string, args []string) (bool, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, strings.Join(args, " ")); err != nil {
+		return false, err
+	}
+
+	ok := true
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "error: ") {
+			ok = false
+			fmt.Fprintln(os.Stderr, line)
+			continue
+		}
+		fmt.Println(line)
+	}
+	return ok, scanner.Err()
+}
+
+// adminMain implements the "admin" subcommand.
+func adminMain(args []string) {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config (%s): %v", configFile, err)
+	}
+	if cfg.AdminSocket == "" {
+		log.Fatalf("admin_socket is not set in %s", configFile)
+	}
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+	ok, err := runAdminClient(cfg.AdminSocket, args)
+	if err != nil {
+		log.Fatalf("Admin command failed: %v", err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
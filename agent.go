@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// agentChannelType is the channel the server opens back to the client for
+// each connection to a forwarded agent.
+const agentChannelType = "auth-agent@openssh.com"
+
+// handleAgentRequest handles an "auth-agent-req@openssh.com" request: it
+// listens on a unix socket in a private directory and forwards each
+// connection to the client's agent. The shell or command finds the socket
+// through SSH_AUTH_SOCK.
+func (sess *session) handleAgentRequest(req *ssh.Request) {
+	// The socket would be outside a chroot or container, out of the
+	// session's reach
+	if sess.agent != nil || sess.chroot != "" || sess.container != "" || !permitted(sess.conn.Permissions, permAllowAgentForwarding) {
+		req.Reply(false, nil)
+		return
+	}
+	dir, err := os.MkdirTemp("", "ssh-agent-")
+	if err != nil {
+		warnf("Failed to create agent socket directory for %s: %v", sess.user.Name, err)
+		req.Reply(false, nil)
+		return
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		warnf("Failed to listen for agent forwarding for %s: %v", sess.user.Name, err)
+		os.RemoveAll(dir)
+		req.Reply(false, nil)
+		return
+	}
+	sess.agent = l.(*net.UnixListener)
+	if sess.account != nil {
+		// Only the session's account may use the agent
+		if err := sess.account.chown(dir); err == nil {
+			err = sess.account.chown(filepath.Join(dir, "agent.sock"))
+		}
+		if err != nil {
+			warnf("Failed to hand the agent socket to %s: %v", sess.account.name, err)
+		}
+	}
+	go sess.serveAgent(sess.agent)
+	infof("Agent forwarding enabled for %s", sess.user.Name)
+	req.Reply(true, nil)
+}
+
+// serveAgent forwards connections to the agent socket until it is closed.
+func (sess *session) serveAgent(l *net.UnixListener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			ch, reqs, err := sess.conn.OpenChannel(agentChannelType, nil)
+			if err != nil {
+				warnf("Failed to open agent channel to %s: %v", sess.user.Name, err)
+				return
+			}
+			defer ch.Close()
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				_, _ = copyData(ch, conn)
+				_ = ch.CloseWrite()
+			}()
+			_, _ = copyData(conn, ch)
+		}()
+	}
+}
+
+// agentSocket returns the path of the forwarded agent socket, if any.
+func (sess *session) agentSocket() (string, bool) {
+	if sess.agent == nil {
+		return "", false
+	}
+	return sess.agent.Addr().String(), true
+}
+
+// stopAgent removes the forwarded agent socket when the session ends.
+func (sess *session) stopAgent() {
+	if path, ok := sess.agentSocket(); ok {
+		sess.agent.Close()
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AlgorithmsConfig overrides the algorithms the server negotiates, to
+// enforce a hardened policy or to let old clients in. Each list, like
+// OpenSSH's Ciphers and friends, either replaces the defaults or, with
+// every entry starting with + or -, adds to or removes from the algorithms
+// x/crypto/ssh supports and considers secure.
+//
+//	algorithms:
+//	  kex: [mlkem768x25519-sha256, curve25519-sha256]
+//	  ciphers: [+aes128-cbc]
+//	  macs: [-hmac-sha1]
+type AlgorithmsConfig struct {
+	KeyExchanges []string `yaml:"kex"`
+	Ciphers      []string `yaml:"ciphers"`
+	MACs         []string `yaml:"macs"`
+	// PublicKeys are the signature algorithms accepted for client keys.
+	PublicKeys []string `yaml:"public_keys"`
+}
+
+// applyAlgorithms sets the algorithm lists of cfg on config. Insecure
+// algorithms are allowed, with a warning.
+func applyAlgorithms(config *ssh.ServerConfig, cfg AlgorithmsConfig) error {
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	for _, a := range []struct {
+		setting             string
+		names               []string
+		supported, insecure []string
+		list                *[]string
+	}{
+		{"kex", cfg.KeyExchanges, supported.KeyExchanges, insecure.KeyExchanges, &config.KeyExchanges},
+		{"ciphers", cfg.Ciphers, supported.Ciphers, insecure.Ciphers, &config.Ciphers},
+		{"macs", cfg.MACs, supported.MACs, insecure.MACs, &config.MACs},
+		{"public_keys", cfg.PublicKeys, supported.PublicKeyAuths, insecure.PublicKeyAuths, &config.PublicKeyAuthAlgorithms},
+	} {
+		list, err := algorithmList(a.names, a.supported, a.insecure)
+		if err != nil {
+			return fmt.Errorf("%s: %v", a.setting, err)
+		}
+		for _, name := range list {
+			if slices.Contains(a.insecure, name) {
+				warnf("Allowing insecure %s algorithm %s", a.setting, name)
+			}
+		}
+		*a.list = list
+	}
+	return nil
+}
+
+// algorithmList resolves one setting's names against the supported and
+// insecure algorithms. Empty keeps the defaults.
+func algorithmList(names, supported, insecure []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	edits := strings.HasPrefix(names[0], "+") || strings.HasPrefix(names[0], "-")
+	var list []string
+	if edits {
+		list = slices.Clone(supported)
+	}
+	for _, name := range names {
+		op := ""
+		if strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-") {
+			op, name = name[:1], name[1:]
+		}
+		if (op != "") != edits {
+			return nil, fmt.Errorf("either list algorithms or change the defaults with + and -, not both")
+		}
+		if !slices.Contains(supported, name) && !slices.Contains(insecure, name) {
+			return nil, fmt.Errorf("unknown algorithm %q", name)
+		}
+		switch {
+		case op == "-":
+			list = slices.DeleteFunc(list, func(n string) bool { return n == name })
+		case !slices.Contains(list, name):
+			list = append(list, name)
+		}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no algorithm left")
+	}
+	return list, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AnonymousConfig enables logins without credentials (the "none" auth
+// method) for demo instances. Anonymous sessions only get an interactive
+// restricted shell with a clean environment.
+type AnonymousConfig struct {
+	// Users are the login names accepted without credentials; defaults to
+	// "guest". They may not also be configured users.
+	Users []string `yaml:"users"`
+	// Shell is the restricted shell; defaults to /bin/rbash.
+	Shell string `yaml:"shell"`
+	// Home is the shell's working directory and $HOME; defaults to a
+	// fresh temporary directory.
+	Home string `yaml:"home"`
+	// Path is the only $PATH available to the restricted shell, and so
+	// names every command its users can run: directories of hand-picked
+	// commands, which they must not be able to write to. It is required.
+	Path string `yaml:"path"`
+
+	// Ephemeral accepts every name starting with EphemeralPrefix (default
+	// "guest-") that is not a configured user or system account, and gives
+	// each connection a throwaway home under EphemeralRoot (default
+	// /dev/shm, a tmpfs), destroyed with its processes on disconnect. The
+	// prefix keeps the users of other auth providers, whose names the
+	// server cannot know before they authenticate, from being taken for
+	// guests. It needs the server to run as root, so that each guest runs
+	// as a uid of its own.
+	Ephemeral       bool   `yaml:"ephemeral"`
+	EphemeralPrefix string `yaml:"ephemeral_prefix"`
+	EphemeralRoot   string `yaml:"ephemeral_root"`
+	// MaxGuests limits concurrent ephemeral accounts; defaults to 10.
+	MaxGuests int `yaml:"max_guests"`
+}
+
+const (
+	// permSandbox marks an anonymous login; its value is the sandbox $PATH.
+	permSandbox = "sandbox"
+	// permEphemeral marks an ephemeral login; its value is the directory
+	// its home is created in.
+	permEphemeral = "ephemeral"
+)
+
+type anonymousAuth struct {
+	cfg   AnonymousConfig
+	users *userDB
+
+	mu     sync.Mutex
+	guests int
+}
+
+func newAnonymousAuth(cfg AnonymousConfig, users *userDB) (*anonymousAuth, error) {
+	if len(cfg.Users) == 0 {
+		cfg.Users = []string{"guest"}
+	}
+	for _, name := range cfg.Users {
+		if _, ok := users.lookup(name); ok {
+			return nil, fmt.Errorf("anonymous: %q is a configured user", name)
+		}
+		if _, err := lookupSystemAccount(name); err == nil {
+			return nil, fmt.Errorf("anonymous: %q is a system account", name)
+		}
+	}
+	if cfg.Shell == "" {
+		cfg.Shell = "/bin/rbash"
+	}
+	if _, err := os.Stat(cfg.Shell); err != nil {
+		return nil, fmt.Errorf("anonymous: shell: %v", err)
+	}
+	if cfg.Ephemeral {
+		if cfg.EphemeralPrefix == "" {
+			cfg.EphemeralPrefix = "guest-"
+		}
+		if cfg.EphemeralRoot == "" {
+			cfg.EphemeralRoot = os.TempDir()
+			if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+				cfg.EphemeralRoot = "/dev/shm"
+			}
+		}
+		if cfg.MaxGuests <= 0 {
+			cfg.MaxGuests = 10
+		}
+	} else if cfg.Home == "" {
+		dir, err := os.MkdirTemp("", "ssh-anonymous-")
+		if err != nil {
+			return nil, fmt.Errorf("anonymous: %v", err)
+		}
+		// Shared by logins running as different uids, so read-only to them
+		if err := os.Chmod(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("anonymous: %v", err)
+		}
+		cfg.Home = dir
+	}
+	if err := checkSandboxPath(cfg.Path); err != nil {
+		return nil, fmt.Errorf("anonymous: path: %v", err)
+	}
+	return &anonymousAuth{cfg: cfg, users: users}, nil
+}
+
+// checkSandboxPath makes sure path lists directories that exist and that
+// only their owner can write to, so that guests cannot add commands.
+func checkSandboxPath(path string) error {
+	if path == "" {
+		return errors.New("required: a directory of the commands guests may run, such as /srv/demo/bin")
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("%q is not an absolute path", dir)
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		if fi.Mode().Perm()&0o022 != 0 {
+			return fmt.Errorf("%s is writable by others than its owner", dir)
+		}
+	}
+	return nil
+}
+
+// authenticate accepts the "none" method for the anonymous login names, or
+// for guest names in ephemeral mode. Other names fail, so their clients
+// move on to real credentials.
+func (a *anonymousAuth) authenticate(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+	perms := &ssh.Permissions{}
+	switch {
+	case a.cfg.Ephemeral && a.isGuest(c.User()):
+		// The home is created once the connection is established
+		setExtension(perms, permEphemeral, a.cfg.EphemeralRoot)
+	case slices.Contains(a.cfg.Users, c.User()):
+		setExtension(perms, permHome, a.cfg.Home)
+	default:
+		return nil, fmt.Errorf("%q is not an anonymous login", c.User())
+	}
+	setExtension(perms, permAllowPTY, "")
+	setExtension(perms, permAllowShell, "")
+	setExtension(perms, permShell, a.cfg.Shell)
+	setExtension(perms, permSandbox, a.cfg.Path)
+	return perms, nil
+}
+
+// isGuest reports whether name is one for an ephemeral login: one with the
+// guest prefix that no configured user or system account has.
+func (a *anonymousAuth) isGuest(name string) bool {
+	if !strings.HasPrefix(name, a.cfg.EphemeralPrefix) {
+		return false
+	}
+	if _, configured := a.users.lookup(name); configured {
+		return false
+	}
+	_, err := lookupSystemAccount(name)
+	return errors.Is(err, errUnknownUser)
+}
+
+// guestAccount is an ephemeral account: a private home, destroyed when the
+// connection closes. Its processes run as the login's own uid, which are
+// all killed before then.
+type guestAccount struct {
+	a    *anonymousAuth
+	home string
+}
+
+// newGuest creates the throwaway home for an ephemeral login to u.
+func (a *anonymousAuth) newGuest(u *user, root string) (*guestAccount, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.guests >= a.cfg.MaxGuests {
+		return nil, fmt.Errorf("%d ephemeral accounts already active", a.guests)
+	}
+	home, err := os.MkdirTemp(root, "ssh-guest-")
+	if err != nil {
+		return nil, err
+	}
+	a.guests++
+	u.Home = home
+	return &guestAccount{a: a, home: home}, nil
+}
+
+// destroy removes the account's home.
+func (g *guestAccount) destroy() {
+	if err := os.RemoveAll(g.home); err != nil {
+		warnf("Failed to remove ephemeral home %s: %v", g.home, err)
+	}
+	g.a.mu.Lock()
+	g.a.guests--
+	g.a.mu.Unlock()
+}
+
+func (s *server) noClientAuthCallback(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+	perms, err := s.anonymous.authenticate(c)
+	if err != nil {
+		return nil, err
+	}
+	return s.applyPolicy(c, perms)
+}
+
+// sandboxPath returns the $PATH of an anonymous login's sandbox.
+func sandboxPath(perms *ssh.Permissions) (string, bool) {
+	if perms == nil {
+		return "", false
+	}
+	path, ok := perms.Extensions[permSandbox]
+	return path, ok
+}
+
+// ephemeralRoot returns the directory an ephemeral login's home is created
+// in.
+func ephemeralRoot(perms *ssh.Permissions) (string, bool) {
+	if perms == nil {
+		return "", false
+	}
+	root, ok := perms.Extensions[permEphemeral]
+	return root, ok
+}
+
+// sandboxCommand confines cmd for an anonymous login: no login profile
+// (which could reset $PATH) and none of the server's environment.
+func sandboxCommand(cmd *exec.Cmd, u *user, path string) {
+	if strings.HasPrefix(cmd.Args[0], "-") {
+		cmd.Args[0] = cmd.Args[0][1:]
+	}
+	cmd.Dir = u.Home
+	cmd.Env = []string{
+		"PATH=" + path,
+		"HOME=" + u.Home,
+		"USER=" + u.Name,
+		"SHELL=" + u.Shell,
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// APITokenConfig enables token logins: CI systems and other automation
+// send a token minted with "admin token-create" as the password.
+type APITokenConfig struct {
+	// File stores the tokens (hashed); it is created if missing.
+	File string `yaml:"file"`
+}
+
+// tokenPrefix starts every token, so tokens are never mistaken for
+// passwords.
+const tokenPrefix = "sshtok_"
+
+// Token scopes limit what a token login may do.
+const (
+	scopeShell       = "shell"        // everything the account allows
+	scopeSFTPOnly    = "sftp-only"    // file transfer only
+	scopeForwardOnly = "forward-only" // port forwarding only, no sessions
+)
+
+var tokenScopes = []string{scopeShell, scopeSFTPOnly, scopeForwardOnly}
+
+// apiToken is one stored token. Only the SHA-256 of its secret is kept;
+// tokens are long and random, so a slow hash adds nothing.
+type apiToken struct {
+	ID      string     `json:"id"`
+	User    string     `json:"user"`
+	Scope   string     `json:"scope"`
+	Hash    string     `json:"sha256"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// tokenStore validates tokens against the token file.
+type tokenStore struct {
+	cfg APITokenConfig
+
+	mu     sync.Mutex
+	tokens map[string]*apiToken // by ID
+}
+
+func newTokenStore(cfg APITokenConfig) (*tokenStore, error) {
+	if cfg.File == "" {
+		return nil, errors.New("api_tokens: file is required")
+	}
+	st := &tokenStore{cfg: cfg, tokens: make(map[string]*apiToken)}
+	data, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("api_tokens: %v", err)
+	}
+	var tokens []*apiToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("api_tokens: %s: %v", cfg.File, err)
+	}
+	for _, t := range tokens {
+		st.tokens[t.ID] = t
+	}
+	return st, nil
+}
+
+// save writes the tokens to the token file. Callers hold st.mu.
+func (st *tokenStore) save() error {
+	tokens := make([]*apiToken, 0, len(st.tokens))
+	for _, t := range st.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := st.cfg.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.cfg.File)
+}
+
+// create mints a token for user and returns it; it cannot be shown again.
+func (st *tokenStore) create(user, scope string, ttl time.Duration) (string, *apiToken, error) {
+	var id, secret [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", nil, err
+	}
+	t := &apiToken{
+		ID:      hex.EncodeToString(id[:4]),
+		User:    user,
+		Scope:   scope,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	token := tokenPrefix + t.ID + "_" + base64.RawURLEncoding.EncodeToString(secret[:])
+	sum := sha256.Sum256([]byte(token))
+	t.Hash = hex.EncodeToString(sum[:])
+	if ttl > 0 {
+		expires := t.Created.Add(ttl)
+		t.Expires = &expires
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, dup := st.tokens[t.ID]; dup {
+		return "", nil, errors.New("token ID collision, try again")
+	}
+	st.tokens[t.ID] = t
+	if err := st.save(); err != nil {
+		delete(st.tokens, t.ID)
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+// revoke deletes the token with the given ID.
+func (st *tokenStore) revoke(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.tokens[id]
+	if !ok {
+		return fmt.Errorf("no token %s", id)
+	}
+	delete(st.tokens, id)
+	if err := st.save(); err != nil {
+		st.tokens[id] = t
+		return err
+	}
+	return nil
+}
+
+// lookup returns the stored token matching token.
+func (st *tokenStore) lookup(token string) (*apiToken, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), "_")
+	if !ok {
+		return nil, errors.New("malformed token")
+	}
+	st.mu.Lock()
+	t, found := st.tokens[id]
+	st.mu.Unlock()
+	sum := sha256.Sum256([]byte(token))
+	if !found || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(t.Hash)) != 1 {
+		return nil, errors.New("unknown token")
+	}
+	if t.Expires != nil && time.Now().After(*t.Expires) {
+		return nil, fmt.Errorf("token %s expired", t.ID)
+	}
+	return t, nil
+}
+
+// authenticatePassword accepts tokens in place of passwords. Anything
+// without the token prefix is left to the other providers.
+func (st *tokenStore) authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	if !strings.HasPrefix(string(pass), tokenPrefix) {
+		return nil, errUnknownUser
+	}
+	t, err := st.lookup(string(pass))
+	if err != nil {
+		return nil, err
+	}
+	if t.User != c.User() {
+		return nil, fmt.Errorf("token %s belongs to %q", t.ID, t.User)
+	}
+	infof("Token %s (%s) used for %q", t.ID, t.Scope, c.User())
+	return scopePermissions(t.Scope), nil
+}
+
+// scopePermissions returns the session permissions for a token scope.
+// sftp-only forces internal-sftp, like OpenSSH's "ForceCommand
+// internal-sftp"; forward-only grants neither shells nor commands, so its
+// sessions can do nothing but hold the forwards open, as with "ssh -N".
+func scopePermissions(scope string) *ssh.Permissions {
+	switch scope {
+	case scopeSFTPOnly:
+		perms := &ssh.Permissions{}
+		setExtension(perms, permAllowExec, "")
+		setExtension(perms, permForcedCommand, "internal-sftp")
+		return perms
+	case scopeForwardOnly:
+		perms := &ssh.Permissions{}
+		setExtension(perms, permAllowPortForwarding, "")
+		return perms
+	}
+	return fullPermissions()
+}
+
+func init() {
+	registerAdminCommand("tokens", "tokens", "list API tokens", func(s *server, args []string, w io.Writer) error {
+		if s.tokens == nil {
+			return errors.New("API tokens are not enabled")
+		}
+		s.tokens.mu.Lock()
+		defer s.tokens.mu.Unlock()
+		ids := make([]string, 0, len(s.tokens.tokens))
+		for id := range s.tokens.tokens {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			t := s.tokens.tokens[id]
+			expires := "never expires"
+			if t.Expires != nil {
+				expires = "expires " + t.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\tcreated %s, %s\n", t.ID, t.User, t.Scope, t.Created.Format(time.RFC3339), expires)
+		}
+		return nil
+	})
+	registerAdminCommand("token-create", "token-create <user> [scope] [ttl]", "mint an API token (scope shell, sftp-only or forward-only)", func(s *server, args []string, w io.Writer) error {
+		if s.tokens == nil {
+			return errors.New("API tokens are not enabled")
+		}
+		if len(args) < 1 || len(args) > 3 {
+			return errors.New("usage: token-create <user> [scope] [ttl]")
+		}
+		scope := scopeShell
+		if len(args) > 1 {
+			scope = args[1]
+		}
+		valid := false
+		for _, sc := range tokenScopes {
+			valid = valid || sc == scope
+		}
+		if !valid {
+			return fmt.Errorf("unknown scope %q (known: %s)", scope, strings.Join(tokenScopes, ", "))
+		}
+		var ttl time.Duration
+		if len(args) > 2 {
+			var err error
+			if ttl, err = time.ParseDuration(args[2]); err != nil {
+				return err
+			}
+		}
+		token, t, err := s.tokens.create(args[0], scope, ttl)
+		if err != nil {
+			return err
+		}
+		infof("Admin created API token %s (%s) for %q", t.ID, t.Scope, t.User)
+		fmt.Fprintln(w, token)
+		return nil
+	})
+	registerAdminCommand("token-revoke", "token-revoke <id>", "revoke an API token", func(s *server, args []string, w io.Writer) error {
+		if s.tokens == nil {
+			return errors.New("API tokens are not enabled")
+		}
+		if len(args) != 1 {
+			return errors.New("usage: token-revoke <id>")
+		}
+		if err := s.tokens.revoke(args[0]); err != nil {
+			return err
+		}
+		infof("Admin revoked API token %s", args[0])
+		fmt.Fprintf(w, "revoked %s\n", args[0])
+		return nil
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is one line of the auth audit log.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	RemoteIP    string    `json:"remote_ip"`
+	User        string    `json:"user"`
+	Method      string    `json:"method"`
+	KeyType     string    `json:"key_type,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Success     bool      `json:"success"`
+	// Partial marks a method that passed but left further required ones
+	Partial bool   `json:"partial,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// auditLog appends JSON lines to a dedicated file.
+type auditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (a *auditLog) write(rec auditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(rec); err != nil {
+		warnf("Failed to write audit record: %v", err)
+	}
+}
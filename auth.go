@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errUnknownUser is returned by an auth provider that has no record of the
+// user, letting the next provider in the chain have a go.
+var errUnknownUser = errors.New("unknown user")
+
+// passwordProvider verifies password credentials.
+type passwordProvider interface {
+	authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error)
+}
+
+// publicKeyProvider verifies public key credentials.
+type publicKeyProvider interface {
+	authenticatePublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+}
+
+// keyboardInteractiveProvider verifies users through a challenge/response
+// exchange.
+type keyboardInteractiveProvider interface {
+	authenticateKeyboardInteractive(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+}
+
+// authChain is the ordered list of providers consulted for each method. The
+// first provider to accept the credentials wins.
+type authChain struct {
+	password            []passwordProvider
+	publicKey           []publicKeyProvider
+	keyboardInteractive []keyboardInteractiveProvider
+}
+
+// add registers p for every method it implements.
+func (a *authChain) add(p any) {
+	if pp, ok := p.(passwordProvider); ok {
+		a.password = append(a.password, pp)
+	}
+	if kp, ok := p.(publicKeyProvider); ok {
+		a.publicKey = append(a.publicKey, kp)
+	}
+	if kip, ok := p.(keyboardInteractiveProvider); ok {
+		a.keyboardInteractive = append(a.keyboardInteractive, kip)
+	}
+}
+
+// connAuth is the auth state of a single connection.
+type connAuth struct {
+	// lastKey is the public key most recently offered by the client, and
+	// authKey the one that was accepted
+	lastKey ssh.PublicKey
+	authKey ssh.PublicKey
+	// preAuth sends banners to the client before auth completes
+	preAuth ssh.ServerPreAuthConn
+	// listener is the one the connection arrived on
+	listener *listener
+
+	// steps are the required methods passed so far, stepPerms their
+	// combined permissions, and next the callbacks later steps use
+	steps     []string
+	stepPerms *ssh.Permissions
+	next      ssh.ServerAuthCallbacks
+}
+
+// connConfig returns the ssh.ServerConfig for one connection: a copy of the
+// shared config whose callbacks also track that connection's auth state.
+func (s *server) connConfig(state *connAuth) *ssh.ServerConfig {
+	cfg := *s.config
+	cfg.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		state.lastKey = key
+		return s.publicKeyCallback(c, key)
+	}
+	cfg.AuthLogCallback = func(c ssh.ConnMetadata, method string, err error) {
+		var partial *ssh.PartialSuccessError
+		if method == "publickey" && (err == nil || errors.As(err, &partial)) {
+			state.authKey = state.lastKey
+		}
+		s.logAuth(c, state, method, err)
+	}
+	if s.gssapi != nil {
+		// The GSS-API context is per connection
+		cfg.GSSAPIWithMICConfig = &ssh.GSSAPIWithMICConfig{
+			AllowLogin: s.gssapiAllowLogin,
+			Server:     s.gssapi.newContext(),
+		}
+	}
+	s.withListener(&cfg, state.listener)
+	if s.steps.Load().active() {
+		s.withAuthSteps(&cfg, state)
+	}
+	if s.approval != nil {
+		cfg.PreAuthConnCallback = func(conn ssh.ServerPreAuthConn) {
+			state.preAuth = conn
+		}
+		s.withSecondFactor(&cfg, state)
+	}
+	// Last, so the change is only asked for once every other check passed
+	s.withPasswordChange(&cfg)
+	state.next = ssh.ServerAuthCallbacks{
+		PasswordCallback:            cfg.PasswordCallback,
+		PublicKeyCallback:           cfg.PublicKeyCallback,
+		KeyboardInteractiveCallback: cfg.KeyboardInteractiveCallback,
+		GSSAPIWithMICConfig:         cfg.GSSAPIWithMICConfig,
+	}
+	return &cfg
+}
+
+// logAuth records an auth attempt in the audit log. The initial "none"
+// probe that every client sends is only recorded when it succeeds.
+func (s *server) logAuth(c ssh.ConnMetadata, state *connAuth, method string, err error) {
+	if s.audit == nil || (method == "none" && err != nil) {
+		return
+	}
+	rec := auditRecord{
+		Time:     time.Now().UTC(),
+		RemoteIP: remoteIP(c.RemoteAddr()),
+		User:     c.User(),
+		Method:   method,
+		Success:  err == nil,
+	}
+	var partial *ssh.PartialSuccessError
+	if errors.As(err, &partial) {
+		rec.Partial, err = true, nil
+	}
+	if method == "publickey" && state.lastKey != nil {
+		rec.KeyType = state.lastKey.Type()
+		rec.Fingerprint = ssh.FingerprintSHA256(state.lastKey)
+	}
+	if err != nil {
+		rec.Reason = err.Error()
+	}
+	s.audit.write(rec)
+}
+
+// guardAuth wraps a credential check with the brute-force defences: it
+// delays and refuses rate-limited IPs, refuses locked accounts without
+// checking the credential, and records failures for rate limiting, banning
+// and account lockout.
+func (s *server) guardAuth(c ssh.ConnMetadata, check func() (*ssh.Permissions, error)) (*ssh.Permissions, error) {
+	ip := remoteIP(c.RemoteAddr())
+	if s.limiter != nil {
+		time.Sleep(s.limiter.delay(ip))
+		if s.limiter.blocked(ip) {
+			return nil, fmt.Errorf("too many failed attempts from %s", ip)
+		}
+	}
+
+	if s.lockout != nil && s.lockout.isLocked(c.User()) {
+		return nil, fmt.Errorf("account %q is locked", c.User())
+	}
+
+	perms, err := check()
+	if err != nil {
+		if s.limiter != nil && s.limiter.failure(ip) {
+			infof("Blocking %s for %v after repeated auth failures", ip, s.limiter.cfg.BlockDuration)
+		}
+		if s.bans != nil && s.bans.failure(ip) {
+			infof("Banned %s for %v after repeated auth failures", ip, s.bans.cfg.BanTime)
+		}
+		if s.lockout != nil && s.lockout.failure(c.User()) {
+			infof("Locked account %q after %d consecutive auth failures", c.User(), s.lockout.cfg.MaxFailures)
+		}
+		return nil, err
+	}
+	if s.limiter != nil {
+		s.limiter.success(ip)
+	}
+	if s.lockout != nil {
+		s.lockout.success(c.User())
+	}
+	return perms, nil
+}
+
+func (s *server) passwordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	perms, err := s.guardAuth(c, func() (*ssh.Permissions, error) {
+		return s.checkPassword(c, pass)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.applyPolicy(c, perms)
+}
+
+// checkPassword consults the password providers in order.
+func (s *server) checkPassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	reason := errUnknownUser
+	for _, p := range s.auth.password {
+		perms, err := p.authenticatePassword(c, pass)
+		if err == nil {
+			return perms, nil
+		}
+		if !errors.Is(err, errUnknownUser) {
+			infof("Password auth for %q: %v", c.User(), err)
+			reason = err
+		}
+	}
+	return nil, fmt.Errorf("password rejected for %q: %w", c.User(), reason)
+}
+
+func (s *server) publicKeyCallback(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	fp := ssh.FingerprintSHA256(key)
+	debugf("Public key offered for %q: %s %s", c.User(), key.Type(), fp)
+	perms, err := s.checkPublicKey(c, key)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := s.users.lookup(c.User()); ok && !u.pinned(key) {
+		infof("Rejecting unpinned key %s for %q; add it to pinned_keys to allow it", fp, c.User())
+		return nil, fmt.Errorf("key %s is not pinned for %q", fp, c.User())
+	}
+	return s.applyPolicy(c, perms)
+}
+
+// checkPublicKey consults the public key providers in order.
+func (s *server) checkPublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	reason := errUnknownUser
+	for _, p := range s.auth.publicKey {
+		perms, err := p.authenticatePublicKey(c, key)
+		if err == nil {
+			return perms, nil
+		}
+		if !errors.Is(err, errUnknownUser) {
+			infof("Public key auth for %q: %v", c.User(), err)
+			reason = err
+		}
+	}
+	return nil, fmt.Errorf("unknown public key for %q: %w", c.User(), reason)
+}
+
+func (s *server) keyboardInteractiveCallback(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	perms, err := s.guardAuth(c, func() (*ssh.Permissions, error) {
+		return s.checkKeyboardInteractive(c, challenge)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.applyPolicy(c, perms)
+}
+
+// checkKeyboardInteractive consults the keyboard-interactive providers in
+// order.
+func (s *server) checkKeyboardInteractive(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	reason := errUnknownUser
+	for _, p := range s.auth.keyboardInteractive {
+		perms, err := p.authenticateKeyboardInteractive(c, challenge)
+		if err == nil {
+			return perms, nil
+		}
+		if !errors.Is(err, errUnknownUser) {
+			infof("Keyboard-interactive auth for %q: %v", c.User(), err)
+			reason = err
+		}
+	}
+	return nil, fmt.Errorf("keyboard-interactive rejected for %q: %w", c.User(), reason)
+}
+
+// bannerCallback shows the configured banner before authentication and
+// warns users who are outside their login windows, and everyone during
+// maintenance.
+func (s *server) bannerCallback(c ssh.ConnMetadata) string {
+	var banner string
+	if b := s.banner.Load(); b != nil {
+		banner = b.render(c)
+	}
+	banner += s.maintenance.notice()
+	if u, ok := s.users.lookup(c.User()); ok && !u.loginAllowed(time.Now()) {
+		banner += u.windowNotice()
+	}
+	return banner
+}
+
+func (s *server) gssapiAllowLogin(c ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+	perms, err := s.gssapi.allowLogin(c, srcName)
+	if err != nil {
+		return nil, err
+	}
+	return s.applyPolicy(c, perms)
+}
+
+// authenticatePassword checks pass against the local user database.
+func (db *userDB) authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	u, ok := db.lookup(c.User())
+	if !ok {
+		return nil, errUnknownUser
+	}
+	if !u.checkPassword(pass) {
+		return nil, errors.New("wrong password")
+	}
+	if u.needsPasswordChange() {
+		perms := fullPermissions()
+		setExtension(perms, permChangePassword, "")
+		return perms, nil
+	}
+	return nil, nil
+}
+
+// authenticatePublicKey checks key against the local user database.
+func (db *userDB) authenticatePublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if _, ok := key.(*ssh.Certificate); ok {
+		// Certificates are left to the CA provider
+		return nil, errUnknownUser
+	}
+	u, ok := db.lookup(c.User())
+	if !ok {
+		return nil, errUnknownUser
+	}
+	entry, ok := u.findKey(key)
+	if !ok {
+		return nil, errors.New("key not authorized")
+	}
+	return entry.permissions(c)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is a single entry from an authorized_keys file.
+type authorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+	Options []string
+
+	opts keyOptions
+}
+
+// keyOptions are the authorized_keys options this server enforces.
+type keyOptions struct {
+	command           string   // command="..."
+	from              []string // from="pattern-list"
+	environment       []string // environment="NAME=value"
+	noPTY             bool     // no-pty or restrict
+	noPortForwarding  bool     // no-port-forwarding or restrict
+	noAgentForwarding bool     // no-agent-forwarding or restrict
+
+	// noTouchRequired lets security keys (sk-ssh-ed25519@openssh.com,
+	// sk-ecdsa-sha2-nistp256@openssh.com) sign without a touch.
+	noTouchRequired bool
+}
+
+// loadAuthorizedKeys reads an OpenSSH authorized_keys file from path.
+func loadAuthorizedKeys(path string) ([]authorizedKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthorizedKeys(data)
+}
+
+// parseAuthorizedKeys parses every key in data. Blank lines and lines starting
+// with '#' are skipped; key options and trailing comments are preserved.
+func parseAuthorizedKeys(data []byte) ([]authorizedKey, error) {
+	var keys []authorizedKey
+	line := 0
+	for len(data) > 0 {
+		line++
+		var current []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			current, data = data[:i], data[i+1:]
+		} else {
+			current, data = data, nil
+		}
+		current = bytes.TrimSpace(current)
+		if len(current) == 0 || current[0] == '#' {
+			continue
+		}
+
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(current)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		opts, err := parseKeyOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		keys = append(keys, authorizedKey{Key: key, Comment: comment, Options: options, opts: opts})
+	}
+	return keys, nil
+}
+
+// parseKeyOptions interprets the options of one authorized_keys entry.
+// Options for features this server does not offer (agent and X11 forwarding,
+// user rc)
+// are accepted and ignored; anything else is an error.
+func parseKeyOptions(options []string) (keyOptions, error) {
+	var opts keyOptions
+	for _, o := range options {
+		name, value, hasValue := strings.Cut(o, "=")
+		if hasValue {
+			var err error
+			if value, err = unquoteOption(value); err != nil {
+				return opts, fmt.Errorf("option %s: %v", name, err)
+			}
+		}
+
+		switch strings.ToLower(name) {
+		case "command":
+			opts.command = value
+		case "from":
+			opts.from = strings.Split(value, ",")
+		case "environment":
+			if !strings.Contains(value, "=") {
+				return opts, fmt.Errorf("option environment: %q is not NAME=value", value)
+			}
+			opts.environment = append(opts.environment, value)
+		case "restrict":
+			opts.noPTY = true
+			opts.noPortForwarding = true
+			opts.noAgentForwarding = true
+		case "no-pty":
+			opts.noPTY = true
+		case "pty":
+			opts.noPTY = false
+		case "no-port-forwarding":
+			opts.noPortForwarding = true
+		case "port-forwarding":
+			opts.noPortForwarding = false
+		case "no-agent-forwarding":
+			opts.noAgentForwarding = true
+		case "agent-forwarding":
+			opts.noAgentForwarding = false
+		case "no-touch-required":
+			opts.noTouchRequired = true
+		case "verify-required":
+			// x/crypto/ssh does not expose the signature's user
+			// verification flag, so the option cannot be enforced
+			return opts, fmt.Errorf("option %q is not supported", name)
+		case "no-x11-forwarding", "no-user-rc", "x11-forwarding", "user-rc":
+		default:
+			return opts, fmt.Errorf("unsupported option %q", name)
+		}
+	}
+	return opts, nil
+}
+
+// unquoteOption strips the double quotes around an option value, undoing
+// backslash-escaped quotes.
+func unquoteOption(v string) (string, error) {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return "", fmt.Errorf("value %s is not quoted", v)
+	}
+	return strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`), nil
+}
+
+// permissions checks the entry's source restriction against the connecting
+// client and returns the restrictions to apply to the session.
+func (k *authorizedKey) permissions(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+	if len(k.opts.from) > 0 && !matchAddressList(remoteIP(c.RemoteAddr()), k.opts.from) {
+		return nil, fmt.Errorf("key not allowed from %s", remoteIP(c.RemoteAddr()))
+	}
+
+	perms := fullPermissions()
+	if k.opts.command != "" {
+		setExtension(perms, permForcedCommand, k.opts.command)
+	}
+	if k.opts.noPTY {
+		delete(perms.Extensions, permAllowPTY)
+	}
+	if k.opts.noPortForwarding {
+		delete(perms.Extensions, permAllowPortForwarding)
+	}
+	if k.opts.noAgentForwarding {
+		delete(perms.Extensions, permAllowAgentForwarding)
+	}
+	if k.opts.noTouchRequired {
+		setExtension(perms, permNoTouchRequired, "")
+	}
+	for _, kv := range k.opts.environment {
+		name, value, _ := strings.Cut(kv, "=")
+		setExtension(perms, permEnvPrefix+name, value)
+	}
+	return perms, nil
+}
+
+// matchAddressList matches ip against an OpenSSH pattern list: entries may
+// use * and ? wildcards or CIDR notation, and a leading ! negates an entry.
+// Any negated match rejects the address. Host names are not resolved.
+func matchAddressList(ip string, patterns []string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	matched := false
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		var ok bool
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			ok = err == nil && prefix.Contains(addr)
+		} else {
+			ok, _ = path.Match(p, addr.String())
+		}
+		if ok && negate {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// findAuthorizedKey returns the entry in keys matching key, if any.
+func findAuthorizedKey(keys []authorizedKey, key ssh.PublicKey) (*authorizedKey, bool) {
+	marshaled := key.Marshal()
+	for i := range keys {
+		if bytes.Equal(keys[i].Key.Marshal(), marshaled) {
+			return &keys[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Extensions carrying the bandwidth_limit and user_bandwidth_limit of a
+// login, in bytes per second.
+const (
+	permBandwidth     = "bandwidth"
+	permUserBandwidth = "user-bandwidth"
+)
+
+var byteRate = regexp.MustCompile(`^([0-9]+)([KMG]?)$`)
+
+// parseByteRate parses a bandwidth limit: bytes per second with an optional
+// K, M or G suffix, in powers of 1024. Empty is no limit, returned as zero.
+func parseByteRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m := byteRate.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("%q is not a number of bytes with an optional K, M or G suffix", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("%q is not a positive rate", s)
+	}
+	shift := map[string]uint{"": 0, "K": 10, "M": 20, "G": 30}[m[2]]
+	if n > 1<<(62-shift) {
+		return 0, fmt.Errorf("%q is too large", s)
+	}
+	return n << shift, nil
+}
+
+// checkBandwidth validates the bandwidth limits of a permissions policy.
+func checkBandwidth(p PermissionsConfig) error {
+	if _, err := parseByteRate(p.BandwidthLimit); err != nil {
+		return fmt.Errorf("bandwidth_limit: %v", err)
+	}
+	if _, err := parseByteRate(p.UserBandwidthLimit); err != nil {
+		return fmt.Errorf("user_bandwidth_limit: %v", err)
+	}
+	return nil
+}
+
+// bandwidthLimit returns the rate carried in extension name, or zero.
+func bandwidthLimit(perms *ssh.Permissions, name string) int64 {
+	if perms == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(perms.Extensions[name], 10, 64)
+	return n
+}
+
+// throttle is a token bucket of rate bytes per second holding up to a
+// second's worth. Callers taking more than there is wait their turn.
+type throttle struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take waits until n bytes may pass.
+func (t *throttle) take(n int) {
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens = min(t.rate, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	// Going into debt queues later callers behind this one
+	t.tokens -= float64(n)
+	wait := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	t.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// throttles are the buckets data in one direction passes through.
+type throttles []*throttle
+
+// chunk is how much to move at once: at most a second's worth of the
+// slowest bucket, so a large buffer does not pass as one burst.
+func (ts throttles) chunk(n int) int {
+	for _, t := range ts {
+		n = min(n, max(1, int(t.rate)))
+	}
+	return n
+}
+
+func (ts throttles) take(n int) {
+	for _, t := range ts {
+		t.take(n)
+	}
+}
+
+// throttledWriter passes writes to w at the rate of its throttles.
+type throttledWriter struct {
+	w  io.Writer
+	ts throttles
+}
+
+func (tw throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := tw.ts.chunk(len(p))
+		tw.ts.take(n)
+		m, err := tw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledChannel is a session channel whose data from the client passes
+// through in and whose data to it, stdout and stderr together, through
+// out.
+type throttledChannel struct {
+	ssh.Channel
+	in, out throttles
+}
+
+// throttleChannel returns ch limited by in and out, or ch if both are empty.
+func throttleChannel(ch ssh.Channel, in, out throttles) ssh.Channel {
+	if len(in) == 0 && len(out) == 0 {
+		return ch
+	}
+	return &throttledChannel{Channel: ch, in: in, out: out}
+}
+
+func (c *throttledChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p[:c.in.chunk(len(p))])
+	c.in.take(n)
+	return n, err
+}
+
+func (c *throttledChannel) Write(p []byte) (int, error) {
+	return throttledWriter{c.Channel, c.out}.Write(p)
+}
+
+func (c *throttledChannel) Stderr() io.ReadWriter {
+	return &throttledStream{ReadWriter: c.Channel.Stderr(), out: c.out}
+}
+
+type throttledStream struct {
+	io.ReadWriter
+	out throttles
+}
+
+func (s *throttledStream) Write(p []byte) (int, error) {
+	return throttledWriter{s.ReadWriter, s.out}.Write(p)
+}
+
+// userThrottles are the buckets shared by the sessions of each user with
+// a user_bandwidth_limit, kept while any is open.
+type userThrottles struct {
+	mu     sync.Mutex
+	byUser map[string]*userThrottle
+}
+
+type userThrottle struct {
+	in, out *throttle
+	open    int
+}
+
+// acquire returns the buckets of user, created at rate if the user has no
+// other session, and the function to call once the session has closed.
+func (u *userThrottles) acquire(user string, rate int64) (in, out *throttle, release func()) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.byUser == nil {
+		u.byUser = make(map[string]*userThrottle)
+	}
+	t, ok := u.byUser[user]
+	if !ok {
+		t = &userThrottle{in: newThrottle(rate), out: newThrottle(rate)}
+		u.byUser[user] = t
+	}
+	t.open++
+	return t.in, t.out, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if t.open--; t.open == 0 {
+			delete(u.byUser, user)
+		}
+	}
+}
+
+// sessionThrottles returns the buckets a new session of user passes
+// its data through, and the function to call once it has closed.
+func (s *server) sessionThrottles(user string, perms *ssh.Permissions) (in, out throttles, release func()) {
+	release = func() {}
+	if rate := bandwidthLimit(perms, permBandwidth); rate > 0 {
+		in, out = append(in, newThrottle(rate)), append(out, newThrottle(rate))
+	}
+	if rate := bandwidthLimit(perms, permUserBandwidth); rate > 0 {
+		userIn, userOut, done := s.bandwidth.acquire(user, rate)
+		in, out, release = append(in, userIn), append(out, userOut), done
+	}
+	return in, out, release
+}
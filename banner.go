@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BannerConfig is the pre-auth banner shown to clients before they
+// authenticate. Texts are text/template templates, e.g.
+//
+//	banner:
+//	  vars:
+//	    environment: production
+//	  text: |
+//	    {{.Vars.environment}} - authorized use only.
+//	  rules:
+//	    - sources: [10.0.0.0/8]
+//	      text: "Welcome, {{.User}}, to the {{.Vars.environment}} network."
+//
+// The first rule matching the connection replaces text.
+type BannerConfig struct {
+	Text  string            `yaml:"text"`
+	Vars  map[string]string `yaml:"vars"`
+	Rules []BannerRule      `yaml:"rules"`
+}
+
+// BannerRule selects a banner by requested username and source address.
+// Empty lists match everything.
+type BannerRule struct {
+	Users   []string `yaml:"users"`
+	Sources []string `yaml:"sources"`
+	Text    string   `yaml:"text"`
+}
+
+// bannerData is what banner templates can refer to.
+type bannerData struct {
+	User     string
+	IP       string
+	Hostname string
+	Time     time.Time
+	Vars     map[string]string
+}
+
+type bannerRule struct {
+	users   map[string]bool
+	sources []netip.Prefix
+	tmpl    *template.Template
+}
+
+// banners is a parsed BannerConfig.
+type banners struct {
+	text     *template.Template
+	rules    []bannerRule
+	vars     map[string]string
+	hostname string
+}
+
+func newBanners(cfg BannerConfig) (*banners, error) {
+	b := &banners{vars: cfg.Vars}
+	b.hostname, _ = os.Hostname()
+	var err error
+	if b.text, err = parseBanner("text", cfg.Text); err != nil {
+		return nil, err
+	}
+	for i, r := range cfg.Rules {
+		rule := bannerRule{users: make(map[string]bool, len(r.Users))}
+		for _, name := range r.Users {
+			rule.users[name] = true
+		}
+		if rule.sources, err = parsePrefixes(r.Sources); err != nil {
+			return nil, fmt.Errorf("rule %d: sources: %v", i+1, err)
+		}
+		if rule.tmpl, err = parseBanner(fmt.Sprintf("rule %d", i+1), r.Text); err != nil {
+			return nil, err
+		}
+		b.rules = append(b.rules, rule)
+	}
+	return b, nil
+}
+
+func parseBanner(name, text string) (*template.Template, error) {
+	// Unset vars render as empty strings rather than "<no value>"
+	return template.New(name).Option("missingkey=zero").Parse(text)
+}
+
+// matches reports whether the rule applies to user connecting from addr.
+func (r *bannerRule) matches(user string, addr netip.Addr) bool {
+	if len(r.users) > 0 && !r.users[user] {
+		return false
+	}
+	return len(r.sources) == 0 || containsAddr(r.sources, addr)
+}
+
+// render returns the banner for the connection, or "" if none applies.
+func (b *banners) render(c ssh.ConnMetadata) string {
+	ip := remoteIP(c.RemoteAddr())
+	addr, _ := netip.ParseAddr(ip)
+	tmpl := b.text
+	for _, r := range b.rules {
+		if r.matches(c.User(), addr.Unmap()) {
+			tmpl = r.tmpl
+			break
+		}
+	}
+
+	var sb strings.Builder
+	data := bannerData{User: c.User(), IP: ip, Hostname: b.hostname, Time: time.Now(), Vars: b.vars}
+	if err := tmpl.Execute(&sb, data); err != nil {
+		warnf("Failed to render banner %s: %v", tmpl.Name(), err)
+		return ""
+	}
+	text := sb.String()
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BanConfig configures fail2ban-style banning of IPs with repeated auth
+// failures.
+type BanConfig struct {
+	// MaxFailures within FindTime bans the IP for BanTime. Defaults are 5,
+	// 10m and 1h.
+	MaxFailures int           `yaml:"max_failures"`
+	FindTime    time.Duration `yaml:"find_time"`
+	BanTime     time.Duration `yaml:"ban_time"`
+	// StateFile persists active bans across restarts.
+	StateFile string `yaml:"state_file"`
+}
+
+// banList tracks auth failures and active bans per IP.
+type banList struct {
+	cfg BanConfig
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	bans     map[string]time.Time // IP -> ban expiry
+}
+
+func newBanList(cfg BanConfig) (*banList, error) {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 5
+	}
+	if cfg.FindTime <= 0 {
+		cfg.FindTime = 10 * time.Minute
+	}
+	if cfg.BanTime <= 0 {
+		cfg.BanTime = time.Hour
+	}
+	b := &banList{
+		cfg:      cfg,
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]time.Time),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// load restores unexpired bans from the state file.
+func (b *banList) load() error {
+	if b.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(b.cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans map[string]time.Time
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("%s: %v", b.cfg.StateFile, err)
+	}
+	now := time.Now()
+	for ip, until := range bans {
+		if until.After(now) {
+			b.bans[ip] = until
+		}
+	}
+	return nil
+}
+
+// save writes the active bans to the state file. Callers hold b.mu.
+func (b *banList) save() {
+	if b.cfg.StateFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(b.bans, "", "  ")
+	if err == nil {
+		tmp := b.cfg.StateFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, b.cfg.StateFile)
+		}
+	}
+	if err != nil {
+		warnf("Failed to save bans to %s: %v", b.cfg.StateFile, err)
+	}
+}
+
+// banned reports whether ip is currently banned.
+func (b *banList) banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.bans[ip]
+	if ok && time.Now().After(until) {
+		delete(b.bans, ip)
+		b.save()
+		return false
+	}
+	return ok
+}
+
+// failure records a failed attempt and reports whether it banned ip.
+func (b *banList) failure(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	cutoff := now.Add(-b.cfg.FindTime)
+	recent := b.failures[ip][:0]
+	for _, t := range b.failures[ip] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < b.cfg.MaxFailures {
+		b.failures[ip] = recent
+		return false
+	}
+	delete(b.failures, ip)
+	b.bans[ip] = now.Add(b.cfg.BanTime)
+	b.save()
+	return true
+}
+
+// unban lifts the ban on ip and reports whether there was one.
+func (b *banList) unban(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, ip)
+	if _, ok := b.bans[ip]; !ok {
+		return false
+	}
+	delete(b.bans, ip)
+	b.save()
+	return true
+}
+
+func init() {
+	registerAdminCommand("bans", "bans", "list banned IPs", func(s *server, args []string, w io.Writer) error {
+		if s.bans == nil {
+			return errors.New("banning is not enabled")
+		}
+		s.bans.mu.Lock()
+		defer s.bans.mu.Unlock()
+		ips := make([]string, 0, len(s.bans.bans))
+		for ip := range s.bans.bans {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		for _, ip := range ips {
+			fmt.Fprintf(w, "%s\tuntil %s\n", ip, s.bans.bans[ip].Format(time.RFC3339))
+		}
+		return nil
+	})
+	registerAdminCommand("unban", "unban <ip>", "lift the ban on an IP", func(s *server, args []string, w io.Writer) error {
+		if s.bans == nil {
+			return errors.New("banning is not enabled")
+		}
+		if len(args) != 1 || net.ParseIP(args[0]) == nil {
+			return errors.New("usage: unban <ip>")
+		}
+		if !s.bans.unban(args[0]) {
+			return fmt.Errorf("%s is not banned", args[0])
+		}
+		infof("Admin unbanned %s", args[0])
+		fmt.Fprintf(w, "unbanned %s\n", args[0])
+		return nil
+	})
+}
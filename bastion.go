@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BastionConfig defines the hosts and containers logins with
+// bastion_targets may jump to. Their shell is a menu of their targets, e.g.
+//
+//	bastion:
+//	  ssh_options: [-o, StrictHostKeyChecking=accept-new]
+//	  targets:
+//	    - name: web1
+//	      description: Production web server
+//	      host: deploy@10.0.1.10
+//	    - name: builder
+//	      container: ci-builder
+type BastionConfig struct {
+	// SSH is the ssh client jumps to hosts run; defaults to ssh in the
+	// server's PATH.
+	SSH string `yaml:"ssh"`
+	// SSHOptions are passed to it ahead of the destination.
+	SSHOptions []string `yaml:"ssh_options"`
+	// Docker is the docker client for jumps into containers; defaults to
+	// docker in the server's PATH.
+	Docker  string          `yaml:"docker"`
+	Targets []BastionTarget `yaml:"targets"`
+}
+
+// BastionTarget is a host or container to jump to.
+type BastionTarget struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Host is the ssh destination, as in user@host, with Port if not 22.
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// Container is a Docker container to run Shell in, /bin/sh by default.
+	Container string `yaml:"container"`
+	Shell     string `yaml:"shell"`
+}
+
+// bastion builds the jumps of bastion logins.
+type bastion struct {
+	cfg     BastionConfig
+	targets []BastionTarget
+}
+
+func newBastion(cfg BastionConfig) (*bastion, error) {
+	seen := make(map[string]bool)
+	needSSH, needDocker := false, false
+	for i, t := range cfg.Targets {
+		switch {
+		case t.Name == "" || strings.ContainsAny(t.Name, " \t\n"):
+			return nil, fmt.Errorf("bastion: target %d: name %q must be one word", i+1, t.Name)
+		case seen[t.Name]:
+			return nil, fmt.Errorf("bastion: target %q is defined twice", t.Name)
+		case (t.Host == "") == (t.Container == ""):
+			return nil, fmt.Errorf("bastion: target %q needs one of host or container", t.Name)
+		case strings.HasPrefix(t.Host, "-"):
+			return nil, fmt.Errorf("bastion: target %q: bad host %q", t.Name, t.Host)
+		}
+		seen[t.Name] = true
+		needSSH = needSSH || t.Host != ""
+		needDocker = needDocker || t.Container != ""
+	}
+	var err error
+	if needSSH {
+		if cfg.SSH, err = lookPathOr(cfg.SSH, "ssh"); err != nil {
+			return nil, fmt.Errorf("bastion: %v", err)
+		}
+	}
+	if needDocker {
+		if cfg.Docker, err = lookPathOr(cfg.Docker, "docker"); err != nil {
+			return nil, fmt.Errorf("bastion: %v", err)
+		}
+	}
+	return &bastion{cfg: cfg, targets: cfg.Targets}, nil
+}
+
+// lookPathOr resolves bin, or def if bin is empty, in the server's PATH.
+func lookPathOr(bin, def string) (string, error) {
+	if bin == "" {
+		bin = def
+	}
+	return exec.LookPath(bin)
+}
+
+// permBastionTargets carries the bastion_targets patterns of a login,
+// newline separated.
+const permBastionTargets = "bastion-targets"
+
+// bastionTargets returns the target name patterns of a bastion login.
+func bastionTargets(perms *ssh.Permissions) ([]string, bool) {
+	if perms == nil {
+		return nil, false
+	}
+	list, ok := perms.Extensions[permBastionTargets]
+	return strings.Split(list, "\n"), ok
+}
+
+// checkTargetPatterns validates bastion_targets patterns.
+func checkTargetPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return fmt.Errorf("bastion_targets: bad pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// jump is a target as the bastion-menu helper gets it: what to show and
+// the command connecting to it.
+type jump struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Argv        []string `json:"argv"`
+}
+
+// jumps returns the targets matching patterns, in configuration order.
+// Container shells get a TTY if the session has one.
+func (b *bastion) jumps(patterns []string, tty bool) []jump {
+	var jumps []jump
+	for _, t := range b.targets {
+		allowed := false
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, t.Name); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			continue
+		}
+		j := jump{Name: t.Name, Description: t.Description}
+		if t.Host != "" {
+			j.Argv = append([]string{b.cfg.SSH}, b.cfg.SSHOptions...)
+			if t.Port != 0 {
+				j.Argv = append(j.Argv, "-p", strconv.Itoa(t.Port))
+			}
+			j.Argv = append(j.Argv, "--", t.Host)
+		} else {
+			j.Argv = []string{b.cfg.Docker, "exec", "--interactive"}
+			if tty {
+				j.Argv = append(j.Argv, "--tty")
+			}
+			shell := t.Shell
+			if shell == "" {
+				shell = "/bin/sh"
+			}
+			j.Argv = append(j.Argv, t.Container, shell)
+		}
+		jumps = append(jumps, j)
+	}
+	return jumps
+}
+
+// runBastion serves the shell or exec request of a bastion login with the
+// bastion-menu helper: a menu of its targets, or straight to the target an
+// exec request names, or the only one it has. Any other command is
+// refused.
+func (sess *session) runBastion(req *ssh.Request, command string, patterns []string) bool {
+	if sess.bastion == nil {
+		infof("Refusing session for %s: bastion is not configured", sess.user.Name)
+		return sess.refuse(req, "No jump targets are available.")
+	}
+	if _, sandboxed := sandboxPath(sess.conn.Permissions); sandboxed || sess.chroot != "" || sess.container != "" {
+		infof("Refusing bastion session for %s: confined sessions cannot run the menu", sess.user.Name)
+		return sess.refuse(req, "No jump targets are available.")
+	}
+	jumps := sess.bastion.jumps(patterns, sess.ptyRequested)
+	if command != "" {
+		var chosen []jump
+		for _, j := range jumps {
+			if j.Name == command {
+				chosen = append(chosen, j)
+			}
+		}
+		if len(chosen) == 0 {
+			return sess.refuseCommand(req, command)
+		}
+		jumps = chosen
+	}
+	if len(jumps) == 0 {
+		return sess.refuse(req, "No jump targets are available.")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		warnf("Failed to start bastion menu for %s: %v", sess.user.Name, err)
+		req.Reply(false, nil)
+		return false
+	}
+	list, _ := json.Marshal(jumps)
+	infof("Bastion menu started for %s with %d targets", sess.user.Name, len(jumps))
+	cmd := sess.command("")
+	cmd.Path, cmd.Args = exe, []string{exe, "bastion-menu", string(list)}
+	if sess.ptyRequested {
+		return sess.runPTY(req, cmd, sess.welcome)
+	}
+	return sess.runCommand(req, cmd)
+}
+
+// bastionMenuMain implements the "bastion-menu" helper subcommand: given
+// its targets as JSON, it jumps to the only one, or lets the user pick
+// from a menu until they quit, returning to it after each jump.
+func bastionMenuMain(args []string) {
+	var jumps []jump
+	if len(args) != 1 || json.Unmarshal([]byte(args[0]), &jumps) != nil || len(jumps) == 0 {
+		log.Fatalf("usage: bastion-menu <targets as JSON>")
+	}
+	// Interrupts at the menu are for the jump running, if any; caught
+	// rather than ignored, so jumps still get them
+	signal.Notify(make(chan os.Signal, 1), os.Interrupt)
+	if len(jumps) == 1 {
+		os.Exit(runJump(jumps[0]))
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Println("\nAvailable targets:")
+		for i, j := range jumps {
+			fmt.Printf("  %2d) %-16s %s\n", i+1, j.Name, j.Description)
+		}
+		fmt.Print("Select a target (number or name, q to quit): ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		choice := strings.TrimSpace(in.Text())
+		if choice == "q" || choice == "quit" || choice == "exit" {
+			return
+		}
+		var chosen *jump
+		for i := range jumps {
+			if choice == jumps[i].Name || choice == strconv.Itoa(i+1) {
+				chosen = &jumps[i]
+			}
+		}
+		if chosen == nil {
+			if choice != "" {
+				fmt.Printf("No target %q.\n", choice)
+			}
+			continue
+		}
+		fmt.Printf("Connecting to %s...\n", chosen.Name)
+		if status := runJump(*chosen); status != 0 {
+			fmt.Printf("Connection to %s ended with status %d.\n", chosen.Name, status)
+		}
+	}
+}
+
+// runJump runs the command of j on the helper's terminal and returns its
+// exit status.
+func runJump(j jump) int {
+	cmd := exec.Command(j.Argv[0], j.Argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exit):
+		return max(exit.ExitCode(), 1)
+	default:
+		fmt.Fprintf(os.Stderr, "bastion-menu: %v\n", err)
+		return 1
+	}
+}
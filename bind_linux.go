@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice binds the socket c to the network interface iface.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("bind to interface %s: %v", iface, err)
+	}
+	return nil
+}
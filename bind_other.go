@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDevice(c syscall.RawConn, iface string) error {
+	return errors.New("binding to an interface is only supported on Linux")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certAuthorityProvider accepts user certificates signed by a trusted CA,
+// like OpenSSH's TrustedUserCAKeys. The certificate must list the requested
+// username as a principal, or one from the user's authorized principals
+// file, and be within its validity window.
+type certAuthorityProvider struct {
+	authorities []ssh.PublicKey
+	checker     ssh.CertChecker
+
+	// principalsFile is the AuthorizedPrincipalsFile pattern; users may
+	// override it with their own file
+	principalsFile string
+	users          *userDB
+}
+
+// newCertAuthorityProvider loads the CA public keys from an authorized_keys
+// style file at path.
+func newCertAuthorityProvider(path, principalsFile string, users *userDB) (*certAuthorityProvider, error) {
+	entries, err := loadAuthorizedKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no CA keys found")
+	}
+
+	p := &certAuthorityProvider{principalsFile: principalsFile, users: users}
+	for _, e := range entries {
+		p.authorities = append(p.authorities, e.Key)
+	}
+	p.checker.IsUserAuthority = p.isAuthority
+	// certPermissions turns force-command into a forced command; any other
+	// critical option is unknown and fails the certificate
+	p.checker.SupportedCriticalOptions = []string{"force-command"}
+	return p, nil
+}
+
+func (p *certAuthorityProvider) isAuthority(auth ssh.PublicKey) bool {
+	marshaled := auth.Marshal()
+	for _, ca := range p.authorities {
+		if bytes.Equal(ca.Marshal(), marshaled) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *certAuthorityProvider) authenticatePublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, errUnknownUser
+	}
+	path, err := p.principalsPath(c.User())
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		return p.authenticatePrincipals(c, cert, path)
+	}
+	// CheckCert lets a certificate without principals in as anyone, as
+	// OpenSSH does not
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+	// Authenticate checks the signing CA, principals and validity window;
+	// x/crypto/ssh checks the source-address critical option itself
+	certPerms, err := p.checker.Authenticate(c, key)
+	if err != nil {
+		return nil, err
+	}
+	return certPermissions(certPerms), nil
+}
+
+// certPermissions translates the OpenSSH certificate extensions. The
+// critical options are kept; x/crypto/ssh enforces source-address itself.
+func certPermissions(certPerms *ssh.Permissions) *ssh.Permissions {
+	perms := &ssh.Permissions{CriticalOptions: certPerms.CriticalOptions}
+	setExtension(perms, permAllowShell, "")
+	setExtension(perms, permAllowExec, "")
+	if _, ok := certPerms.Extensions["permit-pty"]; ok {
+		setExtension(perms, permAllowPTY, "")
+	}
+	if _, ok := certPerms.Extensions["permit-port-forwarding"]; ok {
+		setExtension(perms, permAllowPortForwarding, "")
+	}
+	if _, ok := certPerms.Extensions["permit-agent-forwarding"]; ok {
+		setExtension(perms, permAllowAgentForwarding, "")
+	}
+	if _, ok := certPerms.Extensions[permNoTouchRequired]; ok {
+		setExtension(perms, permNoTouchRequired, "")
+	}
+	if cmd, ok := certPerms.CriticalOptions["force-command"]; ok {
+		setExtension(perms, permForcedCommand, cmd)
+	}
+	return perms
+}
+
+// principalsPath returns the authorized principals file for user, or ""
+// if principals are matched against the username. The pattern expands %u
+// to the username, %h to the user's home and %% to a literal %. The home is
+// the configured one, or that of the user's system account; a pattern with
+// %h fails for users with neither, rather than naming a file under /.
+func (p *certAuthorityProvider) principalsPath(user string) (string, error) {
+	pattern, home := p.principalsFile, ""
+	if u, ok := p.users.lookup(user); ok {
+		if u.AuthorizedPrincipalsFile != "" {
+			pattern = u.AuthorizedPrincipalsFile
+		}
+		home = u.Home
+	}
+	if home == "" && strings.Contains(strings.ReplaceAll(pattern, "%%", ""), "%h") {
+		a, err := lookupSystemAccount(user)
+		if err != nil || a.home == "" {
+			return "", fmt.Errorf("authorized_principals_file %s needs the home of %q, which is not known", pattern, user)
+		}
+		home = a.home
+	}
+	return strings.NewReplacer("%%", "%", "%u", user, "%h", home).Replace(pattern), nil
+}
+
+// authenticatePrincipals accepts cert if one of its principals is listed in
+// the principals file at path. Options on the matching line restrict the
+// session like authorized_keys options.
+func (p *certAuthorityProvider) authenticatePrincipals(c ssh.ConnMetadata, cert *ssh.Certificate, path string) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("cert has type %d", cert.CertType)
+	}
+	if !p.isAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate signed by unrecognized authority")
+	}
+	entries, err := loadAuthorizedPrincipals(path)
+	if err != nil {
+		return nil, err
+	}
+	// Unlike CheckCert, a certificate without principals matches nothing
+	for _, principal := range cert.ValidPrincipals {
+		entry, ok := entries[principal]
+		if !ok {
+			continue
+		}
+		if err := p.checker.CheckCert(principal, cert); err != nil {
+			return nil, err
+		}
+		perms, err := entry.permissions(c)
+		if err != nil {
+			return nil, err
+		}
+		return intersectPermissions(certPermissions(&cert.Permissions), perms), nil
+	}
+	return nil, fmt.Errorf("certificate has no principal authorized in %s", path)
+}
+
+// loadAuthorizedPrincipals reads an OpenSSH authorized principals file:
+// one principal per line, optionally preceded by authorized_keys options.
+func loadAuthorizedPrincipals(path string) (map[string]*authorizedKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*authorizedKey)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var options []string
+		principal := line
+		if j := strings.LastIndexAny(line, " \t"); j >= 0 {
+			options, principal = splitOptions(strings.TrimSpace(line[:j])), line[j+1:]
+		}
+		opts, err := parseKeyOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, i+1, err)
+		}
+		entries[principal] = &authorizedKey{Options: options, opts: opts}
+	}
+	return entries, nil
+}
+
+// splitOptions splits a comma-separated option list, keeping commas inside
+// double-quoted values.
+func splitOptions(s string) []string {
+	var options []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted && i+1 < len(s):
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ',' && !quoted:
+			options = append(options, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(options, s[start:])
+}
+
+// loadHostCertSigner pairs the host certificate at path with its private
+// key, one of keys, so it can be offered to clients that trust the signing
+// CA.
+func loadHostCertSigner(path string, keys []ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", path)
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s is a user certificate, not a host certificate", path)
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.PublicKey().Marshal(), cert.Key.Marshal()) {
+			return ssh.NewCertSigner(cert, k)
+		}
+	}
+	return nil, fmt.Errorf("%s is not for any of the host keys", path)
+}
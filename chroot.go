@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// permChroot carries the directory a login's sessions are confined to, like
+// OpenSSH's ChrootDirectory.
+const permChroot = "chroot-directory"
+
+// chrootDirectory returns the directory the login is confined to, if any.
+func chrootDirectory(perms *ssh.Permissions) (string, bool) {
+	if perms == nil {
+		return "", false
+	}
+	dir, ok := perms.Extensions[permChroot]
+	return dir, ok
+}
+
+// expandChroot replaces %u in a chroot_directory setting with the username
+// and %% with a percent sign.
+func expandChroot(pattern, user string) string {
+	return strings.NewReplacer("%u", user, "%%", "%").Replace(pattern)
+}
+
+// chrootHome returns the directory inside root a confined session starts
+// in: home if it exists there, otherwise the root itself.
+func chrootHome(root, home string) string {
+	if home != "" {
+		if fi, err := os.Stat(filepath.Join(root, home)); err == nil && fi.IsDir() {
+			return home
+		}
+	}
+	return "/"
+}
@@ -0,0 +1,90 @@
+//go:build !windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// checkChroot applies OpenSSH's ownership rules to dir: it and every
+// directory above it must be owned by root and writable by no one else, so
+// the user cannot plant files, such as a fake /etc/passwd, that programs
+// run inside trust.
+func checkChroot(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("chroot directory %q is not an absolute path", dir)
+	}
+	for p := filepath.Clean(dir); ; p = filepath.Dir(p) {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		switch {
+		case !fi.IsDir():
+			return fmt.Errorf("chroot path %s is not a directory", p)
+		case !ok || st.Uid != 0:
+			return fmt.Errorf("bad ownership for chroot path %s: not owned by root", p)
+		case fi.Mode().Perm()&0o022 != 0:
+			return fmt.Errorf("bad permissions for chroot path %s: writable by group or others", p)
+		}
+		if p == "/" {
+			return nil
+		}
+	}
+}
+
+// confine makes cmd run inside the session's chroot, starting in the home
+// directory as seen from inside. The shell and anything it runs must exist
+// in the tree.
+func (sess *session) confine(cmd *exec.Cmd) {
+	cmd.SysProcAttr.Chroot = sess.chroot
+	cmd.Dir = chrootHome(sess.chroot, sess.home)
+	cmd.Env = append(cmd.Env, "HOME="+cmd.Dir)
+}
+
+// enterChroot handles the chroot flags of the helper subcommands, which run
+// as root for confined sessions: it chroots to -chroot, changes to -home
+// and switches to the -user account. It returns the remaining arguments.
+func enterChroot(args []string) []string {
+	fs := flag.NewFlagSet("helper", flag.ExitOnError)
+	root := fs.String("chroot", "", "directory to confine the session to")
+	name := fs.String("user", "", "account to run as")
+	home := fs.String("home", "", "starting directory inside the chroot")
+	fs.Parse(args)
+	if *root == "" {
+		return fs.Args()
+	}
+	// Look the account up while /etc/passwd is still the host's
+	a, err := lookupSystemAccount(*name)
+	if err != nil {
+		log.Fatalf("helper: %v", err)
+	}
+	groups := make([]int, len(a.groups))
+	for i, g := range a.groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Chroot(*root); err != nil {
+		log.Fatalf("helper: chroot %s: %v", *root, err)
+	}
+	if err := syscall.Chdir(chrootHome("/", *home)); err != nil {
+		log.Fatalf("helper: %v", err)
+	}
+	// Groups first: changing them needs the privileges the uid gives up
+	if err := syscall.Setgroups(groups); err != nil {
+		log.Fatalf("helper: %v", err)
+	}
+	if err := syscall.Setgid(int(a.gid)); err != nil {
+		log.Fatalf("helper: %v", err)
+	}
+	if err := syscall.Setuid(int(a.uid)); err != nil {
+		log.Fatalf("helper: %v", err)
+	}
+	return fs.Args()
+}
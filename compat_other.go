@@ -0,0 +1,61 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Versions of the Linux-only parts of other features for the other Unix
+// systems, such as macOS and the BSDs. Memory limits, which need cgroups,
+// and privilege separation are refused at startup; terminal modes from
+// pty-req are ignored, leaving the PTY's defaults.
+
+// The ioctls reading and setting a terminal's termios.
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
+
+func applyTermModes(t *unix.Termios, modes []termMode) {}
+
+// accessTime returns the file's modification time, as the fields holding
+// the access time differ between systems.
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+func newResourceLimits(cfg ResourceLimitsConfig) (*resourceLimits, error) {
+	if cfg.Memory != "" {
+		return nil, errors.New("resource_limits: memory limits need Linux cgroups")
+	}
+	return &resourceLimits{cfg: cfg}, nil
+}
+
+func (l *resourceLimits) newCgroup() (*os.File, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+func startInCgroup(cmd *exec.Cmd, f *os.File) {}
+
+func removeCgroup(f *os.File) {}
+
+func newPrivsep(subsystems map[string]string) (*privsep, error) {
+	return nil, errors.New("privilege_separation is only supported on Linux")
+}
+
+func (p *privsep) start(l login, spec *separatedLogin) (net.Conn, func(), error) {
+	return nil, nil, errors.New("privilege separation is only supported on Linux")
+}
+
+func privsepChildMain(args []string) {
+	log.Fatalf("privsep-child is only supported on Linux")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/windows"
+)
+
+// Windows versions of the Unix-only parts of other features. Resource limits
+// are refused at startup and chroot_directory at login; confined sessions
+// would need a system account anyway, which Windows sessions never have.
+
+func newResourceLimits(cfg ResourceLimitsConfig) (*resourceLimits, error) {
+	return nil, errors.New("resource_limits are not supported on Windows")
+}
+
+func (sess *session) limit(cmd *exec.Cmd) error {
+	return nil
+}
+
+func (sess *session) releaseCgroup() {}
+
+func runLimitedMain(args []string) {
+	log.Fatalf("run-limited is not supported on Windows")
+}
+
+func checkChroot(dir string) error {
+	return errors.New("chroot_directory is not supported on Windows")
+}
+
+func (sess *session) confine(cmd *exec.Cmd) {}
+
+// enterChroot handles the chroot flags of the helper subcommands, refusing
+// a chroot.
+func enterChroot(args []string) []string {
+	fs := flag.NewFlagSet("helper", flag.ExitOnError)
+	root := fs.String("chroot", "", "directory to confine the session to")
+	fs.String("user", "", "account to run as")
+	fs.String("home", "", "starting directory inside the chroot")
+	fs.Parse(args)
+	if *root != "" {
+		log.Fatalf("helper: chroot is not supported on Windows")
+	}
+	return fs.Args()
+}
+
+// lockFile takes a write lock on all of f. Closing f releases it.
+func lockFile(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, math.MaxUint32, math.MaxUint32, &windows.Overlapped{})
+}
+
+// accessTime returns the file's last access time.
+func accessTime(info fs.FileInfo) time.Time {
+	if d, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, d.LastAccessTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
+
+func newPrivsep(subsystems map[string]string) (*privsep, error) {
+	return nil, errors.New("privilege_separation is not supported on Windows")
+}
+
+func (p *privsep) start(l login, spec *separatedLogin) (net.Conn, func(), error) {
+	return nil, nil, errors.New("privilege separation is not supported on Windows")
+}
+
+func privsepChildMain(args []string) {
+	log.Fatalf("privsep-child is not supported on Windows")
+}
+
+func newDetachedSessions(cfg DetachConfig) (*detachedSessions, error) {
+	return nil, errors.New("detach is not supported on Windows")
+}
+
+func (sess *session) resumeDetached(req *ssh.Request) bool {
+	return false
+}
+
+// systemdSockets returns no sockets, as there is no systemd.
+func systemdSockets() ([]activatedSocket, error) {
+	return nil, nil
+}
+
+// handedOffSockets returns no sockets, as restarts need descriptor
+// inheritance and SIGUSR2.
+func handedOffSockets() ([]activatedSocket, func(), error) {
+	return nil, nil, nil
+}
+
+func (s *server) restartOnSignal() {}
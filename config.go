@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the on-disk server configuration. It is read as YAML, which also
+// accepts plain JSON documents.
+type Config struct {
+	// ListenAddress is the host:port the server accepts connections on, or
+	// unix: and a socket path; 0.0.0.0:2222 by default unless Listeners are
+	// set.
+	ListenAddress string `yaml:"listen_address"`
+	// Listeners are further addresses to accept connections on, each with
+	// its own restrictions.
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// Tor, if set, publishes the server as a Tor onion service.
+	Tor *TorConfig `yaml:"tor"`
+	// HostKey is the PEM or OpenSSH private key file the server identifies
+	// itself with, id_rsa by default unless HostKeys are set; relative to
+	// the working directory.
+	HostKey string `yaml:"host_key"`
+	// HostKeys are further host keys, of other types: ed25519, ecdsa or
+	// rsa. Clients pick the type they prefer.
+	HostKeys []string `yaml:"host_keys"`
+	// NextHostKeys are host keys being rotated in: not used yet, but
+	// announced with the others to clients that update their known_hosts
+	// (OpenSSH's UpdateHostKeys), so that they know them before the switch.
+	// Missing files are generated.
+	NextHostKeys []string `yaml:"next_host_keys"`
+	// AuthorizedKeysFile is the authorized_keys file of users without
+	// authorized_keys or an authorized_keys_file of their own, like
+	// OpenSSH's AuthorizedKeysFile; %u is replaced by the username. Users
+	// for whom it does not exist have no keys.
+	AuthorizedKeysFile string `yaml:"authorized_keys_file"`
+	// LogLevel is debug, info (the default) or warn.
+	LogLevel string `yaml:"log_level"`
+
+	Users []UserConfig `yaml:"users"`
+	// Groups apply settings to several users, which may come from any auth
+	// provider.
+	Groups []GroupConfig `yaml:"groups"`
+	// DefaultPermissions applies to users without their own permissions
+	// settings, including users from external auth providers.
+	DefaultPermissions PermissionsConfig `yaml:"default_permissions"`
+	// AcceptEnv lists the variables clients may set with env requests, like
+	// OpenSSH's AcceptEnv; * and ? are wildcards. Defaults to LANG and
+	// LC_*; an empty list accepts none. Variables such as LD_PRELOAD and
+	// PATH are always refused.
+	AcceptEnv []string `yaml:"accept_env"`
+	// DefaultTerm is TERM for PTY sessions whose client sent none in its
+	// pty-req; defaults to xterm.
+	DefaultTerm string `yaml:"default_term"`
+	// BreakAction is the signal a break request (RFC 4335), like a break on
+	// a serial console, sends to the running command: a name such as INT,
+	// the default, or QUIT. "none" refuses breaks.
+	BreakAction string `yaml:"break_action"`
+	// IdleTimeout disconnects clients whose channels carry no data for
+	// this long, hanging up their shells and commands. Zero disables it.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ClientAliveInterval sends a keepalive request this often, like
+	// OpenSSH's ClientAliveInterval, and disconnects clients that leave
+	// ClientAliveCountMax of them in a row unanswered (default 3). Zero
+	// disables it.
+	ClientAliveInterval time.Duration `yaml:"client_alive_interval"`
+	ClientAliveCountMax int           `yaml:"client_alive_count_max"`
+	// MaxSessionDuration ends each session this long after it opened,
+	// warning the client five minutes before. Zero disables it.
+	MaxSessionDuration time.Duration `yaml:"max_session_duration"`
+	// MaxSessions caps the session channels open at once on a connection,
+	// like OpenSSH's MaxSessions, and MaxUserSessions those of a user over
+	// all their connections. Zero means no limit.
+	MaxSessions     int `yaml:"max_sessions"`
+	MaxUserSessions int `yaml:"max_user_sessions"`
+	// MaxConnections caps the connections open at once, authenticated or
+	// not, and MaxConnectionsPerIP those from one address. Connections over
+	// MaxConnections wait up to ConnectionQueueTimeout for one to close,
+	// and are dropped without it. Zero means no limit.
+	MaxConnections         int           `yaml:"max_connections"`
+	MaxConnectionsPerIP    int           `yaml:"max_connections_per_ip"`
+	ConnectionQueueTimeout time.Duration `yaml:"connection_queue_timeout"`
+	// DrainTimeout is how long SIGTERM waits for open sessions to end
+	// before closing them; 30s by default.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// CopyBuffer is how much each copy between a channel and a process,
+	// PTY or socket reads at a time, with an optional K or M suffix; 32K by
+	// default. Larger buffers help bulk transfers over fast links.
+	CopyBuffer string `yaml:"copy_buffer"`
+	// RequireSystemUser, on by default, refuses sessions for users without
+	// a system account when the server runs as root. Turned off, their
+	// sessions run as root, giving every such login, from LDAP or a
+	// certificate say, a root shell. Sessions of users with an account
+	// always run as it.
+	RequireSystemUser *bool `yaml:"require_system_user"`
+	// LoginUIDs are the uids, as first-last, that logins without a system
+	// account of their own, such as anonymous ones, run as when the server
+	// runs as root: each holds one, with the gid of the same number, for as
+	// long as it lasts. No /etc/passwd entry may use them; 60000-60999 by
+	// default.
+	LoginUIDs string `yaml:"login_uids"`
+	// Container runs sessions in a Docker container per user.
+	Container *ContainerConfig `yaml:"container"`
+	// ResourceLimits caps the processes, files, CPU time and memory of
+	// each session.
+	ResourceLimits *ResourceLimitsConfig `yaml:"resource_limits"`
+	// Detach keeps PTY sessions running for their user to reattach to
+	// after the client disconnects.
+	Detach *DetachConfig `yaml:"detach"`
+	// SessionRecording records the sessions of logins with
+	// record_sessions, input and output, for auditing.
+	SessionRecording *SessionRecordingConfig `yaml:"session_recording"`
+	// PrivilegeSeparation serves each connection of a server running as
+	// root from an unprivileged child process once it has authenticated.
+	PrivilegeSeparation *PrivilegeSeparationConfig `yaml:"privilege_separation"`
+	// Git serves Git repositories to logins with git_repositories.
+	Git *GitConfig `yaml:"git"`
+	// Bastion defines the jump targets of logins with bastion_targets.
+	Bastion *BastionConfig `yaml:"bastion"`
+	// Subsystems maps subsystem names to the commands serving them, like
+	// OpenSSH's Subsystem directive; sftp is built in unless listed.
+	Subsystems map[string]string `yaml:"subsystems"`
+
+	// Htpasswd is a flat credentials file consulted after Users.
+	Htpasswd *HtpasswdConfig `yaml:"htpasswd"`
+
+	// PasswordChange configures forced password changes.
+	PasswordChange PasswordChangeConfig `yaml:"password_change"`
+
+	// Shadow authenticates system accounts from /etc/shadow.
+	Shadow *ShadowConfig `yaml:"shadow"`
+
+	// APITokens accepts scoped tokens in place of passwords.
+	APITokens *APITokenConfig `yaml:"api_tokens"`
+
+	// Vault supplies the host key and credentials from HashiCorp Vault.
+	Vault *VaultConfig `yaml:"vault"`
+
+	LDAP *LDAPConfig `yaml:"ldap"`
+	OIDC *OIDCConfig `yaml:"oidc"`
+
+	// OSLogin fetches public keys from Google Cloud OS Login.
+	OSLogin *OSLoginConfig `yaml:"oslogin"`
+
+	Webhook *WebhookConfig `yaml:"webhook"`
+	SQL     *SQLConfig     `yaml:"sql"`
+	GSSAPI  *GSSAPIConfig  `yaml:"gssapi"`
+
+	// Anonymous, if set, lets the listed names log in without credentials.
+	Anonymous *AnonymousConfig `yaml:"anonymous"`
+
+	// KeyboardInteractive is the ordered list of steps for the
+	// keyboard-interactive auth method.
+	KeyboardInteractive []KIStepConfig `yaml:"keyboard_interactive"`
+
+	// SecondFactor, if set, must approve every login after its primary
+	// authentication succeeds.
+	SecondFactor *SecondFactorConfig `yaml:"second_factor"`
+
+	// Banner is shown to clients before they authenticate.
+	Banner *BannerConfig `yaml:"banner"`
+
+	// ServerVersion is the identification string sent to clients, like
+	// SSH-2.0-OpenSSH_9.6 or a product name; SSH-2.0- is added if missing.
+	// x/crypto/ssh's SSH-2.0-Go by default.
+	ServerVersion string `yaml:"server_version"`
+	// RekeyLimit renews the session keys after this much data in either
+	// direction, like the first half of OpenSSH's RekeyLimit: a size with
+	// an optional K, M or G suffix. By default x/crypto/ssh picks one
+	// suited to the cipher; it cannot rekey on a timer.
+	RekeyLimit string `yaml:"rekey_limit"`
+
+	// MaxAuthTries failed authentication attempts disconnect the client.
+	// Zero means the library default of 6; negative means unlimited.
+	MaxAuthTries int `yaml:"max_auth_tries"`
+	// LoginGraceTime disconnects clients that have not completed the
+	// handshake and authenticated this long after starting, like OpenSSH's
+	// LoginGraceTime. Zero means its default of 2m; negative means no
+	// limit.
+	LoginGraceTime time.Duration `yaml:"login_grace_time"`
+
+	// Algorithms overrides the key exchange, cipher, MAC and client key
+	// algorithms.
+	Algorithms *AlgorithmsConfig `yaml:"algorithms"`
+	// TCPKeepAlive tunes the TCP keepalive of accepted connections.
+	TCPKeepAlive *TCPKeepAliveConfig `yaml:"tcp_keepalive"`
+
+	Access    *AccessConfig    `yaml:"access"`
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+	Ban       *BanConfig       `yaml:"ban"`
+	Lockout   *LockoutConfig   `yaml:"lockout"`
+
+	// DeviceTracking alerts on logins from new keys or networks.
+	DeviceTracking *DeviceTrackingConfig `yaml:"device_tracking"`
+
+	// LoginMessage is shown when interactive shells start.
+	LoginMessage *LoginMessageConfig `yaml:"login_message"`
+	// Utmp records PTY sessions in the host's utmp, wtmp and lastlog.
+	Utmp *UtmpConfig `yaml:"utmp"`
+
+	// AuditLog is a file receiving one JSON record per auth attempt.
+	AuditLog string `yaml:"audit_log"`
+
+	// Maintenance configures maintenance mode, in which only admins may
+	// start new sessions.
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+
+	// AdminSocket is the unix socket path for admin commands; empty
+	// disables it.
+	AdminSocket string `yaml:"admin_socket"`
+
+	// TrustedUserCAKeys is an authorized_keys style file of CA keys whose
+	// user certificates are accepted.
+	TrustedUserCAKeys string `yaml:"trusted_user_ca_keys"`
+	// AuthorizedPrincipalsFile, if set, lists the certificate principals
+	// accepted for a user instead of the username, like OpenSSH's option
+	// of the same name. %u expands to the username and %h to the home.
+	AuthorizedPrincipalsFile string `yaml:"authorized_principals_file"`
+	// HostCertificate is an OpenSSH host certificate for one of the host
+	// keys, presented alongside the plain key.
+	HostCertificate string `yaml:"host_certificate"`
+}
+
+// UserConfig describes a single account allowed to log in.
+type UserConfig struct {
+	Name               string   `yaml:"name"`
+	Password           string   `yaml:"password"`
+	PasswordHash       string   `yaml:"password_hash"`
+	AuthorizedKeys     []string `yaml:"authorized_keys"`
+	AuthorizedKeysFile string   `yaml:"authorized_keys_file"`
+	Shell              string   `yaml:"shell"`
+	Home               string   `yaml:"home"`
+	TOTPSecret         string   `yaml:"totp_secret"`
+
+	// ShellArgs come before the shell's own -c, as busybox needs its sh
+	// applet named: shell /bin/busybox with shell_args [sh].
+	ShellArgs []string `yaml:"shell_args"`
+	// LoginShell starts interactive shells as login shells, with a "-"
+	// before the name in argv[0] as login(1) and OpenSSH do, so they read
+	// the login profile. Defaults to true. Commands always run through a
+	// non-login shell.
+	LoginShell *bool `yaml:"login_shell"`
+
+	// MustChangePassword makes the user set a new password at their next
+	// password login.
+	MustChangePassword bool `yaml:"must_change_password"`
+
+	// AuthorizedPrincipalsFile overrides the global authorized principals
+	// file for this user.
+	AuthorizedPrincipalsFile string `yaml:"authorized_principals_file"`
+
+	Permissions PermissionsConfig `yaml:"permissions"`
+	// LoginWindows, if set, restrict when the user may log in.
+	LoginWindows []LoginWindow `yaml:"login_windows"`
+	// PinnedKeys, if set, are the SHA256 fingerprints ("SHA256:...") of
+	// the only keys the user may log in with, wherever the key is
+	// authorized. New keys need to be added here to be accepted.
+	PinnedKeys []string `yaml:"pinned_keys"`
+	// AuthMethods, if set, are the only auth methods the user may use.
+	AuthMethods []string `yaml:"auth_methods"`
+	// RequiredMethods, if set, must all succeed in this order, e.g.
+	// [publickey, password].
+	RequiredMethods []string `yaml:"required_methods"`
+}
+
+const (
+	defaultListenAddress = "0.0.0.0:2222"
+	defaultHostKey       = "id_rsa"
+)
+
+// loadConfig reads and decodes the configuration file at path, applies the
+// SSHDEMO_ environment variables and fills in defaults. Unknown settings
+// are errors, as they are most often typos.
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg Config
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parse %s: %v", path, configError(err))
+	}
+	if err := applyEnv(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg.ListenAddress == "" && len(cfg.Listeners) == 0 {
+		cfg.ListenAddress = defaultListenAddress
+	}
+	if cfg.HostKey == "" && len(cfg.HostKeys) == 0 {
+		cfg.HostKey = defaultHostKey
+	}
+	if err := checkListenAddresses(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// parseServerVersion validates server_version, adding the SSH-2.0- prefix
+// if missing. RFC 4253 allows printable ASCII and, after the software
+// version, a space and comments, up to 253 characters.
+func parseServerVersion(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(v, "SSH-") {
+		v = "SSH-2.0-" + v
+	}
+	software, _, _ := strings.Cut(strings.TrimPrefix(v, "SSH-2.0-"), " ")
+	if !strings.HasPrefix(v, "SSH-2.0-") || software == "" || strings.Contains(software, "-") {
+		return "", fmt.Errorf("server_version: %q is not SSH-2.0- and a software version without dashes", v)
+	}
+	if len(v) > 253 {
+		return "", fmt.Errorf("server_version: longer than 253 characters")
+	}
+	for _, c := range v {
+		if c < ' ' || c > '~' {
+			return "", fmt.Errorf("server_version: %q has characters that are not printable ASCII", v)
+		}
+	}
+	return v, nil
+}
+
+// yamlKinds names what Go types expect, for decoding errors that name the
+// type instead.
+var yamlKinds = []struct{ goType, want string }{
+	{"time.Duration", "a duration such as 30s or 1h"},
+	{"bool", "true or false"},
+	{"int", "a whole number"},
+	{"int64", "a whole number"},
+	{"uint32", "a whole number"},
+	{"float64", "a number"},
+	{"string", "a string"},
+}
+
+var unmarshalInto = regexp.MustCompile(`cannot unmarshal (!!\w+) (.*) into (\S+)$`)
+
+// configError rewords a YAML decoding error in terms of the file rather
+// than of Go types: "line 3: field listen_adress not found in type
+// main.Config" becomes "line 3: unknown setting listen_adress", and
+// "cannot unmarshal !!str `abc` into time.Duration" says a duration was
+// expected.
+func configError(err error) error {
+	var te *yaml.TypeError
+	if !errors.As(err, &te) {
+		return err
+	}
+	msgs := make([]string, len(te.Errors))
+	for i, m := range te.Errors {
+		if name, ok := strings.CutSuffix(m, " not found in type "+m[strings.LastIndex(m, " ")+1:]); ok {
+			m = strings.Replace(name, ": field ", ": unknown setting ", 1)
+		} else if sm := unmarshalInto.FindStringSubmatchIndex(m); sm != nil {
+			goType, want := m[sm[6]:sm[7]], "a mapping of settings"
+			switch {
+			case strings.HasPrefix(goType, "[]"):
+				want = "a list"
+			case strings.HasPrefix(goType, "map["):
+				want = "a mapping"
+			}
+			for _, k := range yamlKinds {
+				if strings.TrimPrefix(goType, "*") == k.goType {
+					want = k.want
+				}
+			}
+			m = m[:sm[0]] + "expected " + want + ", not " + m[sm[4]:sm[5]]
+		}
+		msgs[i] = m
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variables that override settings of the
+// configuration file: SSHDEMO_ and the setting's name in capitals, as
+// SSHDEMO_MAX_SESSIONS=4.
+const envPrefix = "SSHDEMO_"
+
+// envAliases are shorter names for settings, matching the flags.
+var envAliases = map[string]string{
+	"LISTEN":          "listen_address",
+	"HOSTKEY":         "host_key",
+	"AUTHORIZED_KEYS": "authorized_keys_file",
+}
+
+// envSettings returns the environment variables that can override settings,
+// as pairs of variable and setting names: one per top-level setting that is
+// a string, number, duration or boolean, then the aliases, which win.
+func envSettings() [][2]string {
+	var vars [][2]string
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			// Optional settings, such as a boolean on by default
+			ft = ft.Elem()
+		}
+		switch k := ft.Kind(); {
+		case k == reflect.String, k == reflect.Bool, k == reflect.Int, ft == reflect.TypeOf(time.Duration(0)):
+		default:
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		vars = append(vars, [2]string{envPrefix + strings.ToUpper(name), name})
+	}
+	aliases := make([]string, 0, len(envAliases))
+	for alias := range envAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		vars = append(vars, [2]string{envPrefix + alias, envAliases[alias]})
+	}
+	return vars
+}
+
+// applyEnv overrides the settings of cfg that environment variables set.
+// Values are read as YAML scalars, like the file's.
+func applyEnv(cfg *Config) error {
+	for _, v := range envSettings() {
+		value, ok := os.LookupEnv(v[0])
+		if !ok {
+			continue
+		}
+		doc := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Value: v[1]},
+			{Kind: yaml.ScalarNode, Value: value},
+		}}
+		if err := doc.Decode(cfg); err != nil {
+			return fmt.Errorf("%s: %v", v[0], strings.TrimPrefix(configError(err).Error(), "line 0: "))
+		}
+	}
+	return nil
+}
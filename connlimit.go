@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// connLimits caps the connections open at once, from accept to close, in
+// all and from each source address, for max_connections and
+// max_connections_per_ip.
+type connLimits struct {
+	max, perIP int
+	// queue is how long a connection over max waits for one to close
+	queue time.Duration
+	// slots holds a token per open connection when max is set
+	slots chan struct{}
+
+	mu   sync.Mutex
+	byIP map[string]int
+}
+
+func newConnLimits(max, perIP int, queue time.Duration) (*connLimits, error) {
+	if max < 0 || perIP < 0 || queue < 0 {
+		return nil, fmt.Errorf("max_connections, max_connections_per_ip and connection_queue_timeout must not be negative")
+	}
+	if queue > 0 && max == 0 {
+		return nil, fmt.Errorf("connection_queue_timeout is set without max_connections")
+	}
+	c := &connLimits{max: max, perIP: perIP, queue: queue, byIP: make(map[string]int)}
+	if max > 0 {
+		c.slots = make(chan struct{}, max)
+	}
+	return c, nil
+}
+
+// admit counts a new connection from ip, returning the function to call
+// once it has closed. Over max_connections it waits up to the queue
+// timeout for another to close; it fails with the reason to log if no
+// slot comes free or ip already has max_connections_per_ip.
+func (c *connLimits) admit(ip string) (release func(), err error) {
+	c.mu.Lock()
+	if c.perIP > 0 && c.byIP[ip] >= c.perIP {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("too many connections from %s (at most %d)", ip, c.perIP)
+	}
+	c.byIP[ip]++
+	c.mu.Unlock()
+	unclaim := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.byIP[ip]--; c.byIP[ip] <= 0 {
+			delete(c.byIP, ip)
+		}
+	}
+
+	if c.slots == nil {
+		return unclaim, nil
+	}
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		if !c.wait() {
+			unclaim()
+			return nil, fmt.Errorf("too many connections (at most %d)", c.max)
+		}
+	}
+	return func() {
+		<-c.slots
+		unclaim()
+	}, nil
+}
+
+// wait waits up to the queue timeout for a slot.
+func (c *connLimits) wait() bool {
+	if c.queue == 0 {
+		return false
+	}
+	t := time.NewTimer(c.queue)
+	defer t.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
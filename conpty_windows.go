@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/windows"
+)
+
+// ptyState is the pseudo console a session's shell or command runs on.
+type ptyState struct {
+	console *conPTY
+}
+
+// conPTY is a Windows pseudo console (ConPTY) and the pipes carrying its
+// input and output.
+type conPTY struct {
+	handle windows.Handle
+	in     *os.File // keyboard input of the console
+	out    *os.File // what the console displays, as VT sequences
+	once   sync.Once
+}
+
+// newConPTY creates a pseudo console of cols by rows, 80 by 24 if unknown.
+func newConPTY(cols, rows uint32) (*conPTY, error) {
+	var inRead, inWrite, outRead, outWrite windows.Handle
+	if err := windows.CreatePipe(&inRead, &inWrite, nil, 0); err != nil {
+		return nil, err
+	}
+	if err := windows.CreatePipe(&outRead, &outWrite, nil, 0); err != nil {
+		windows.CloseHandle(inRead)
+		windows.CloseHandle(inWrite)
+		return nil, err
+	}
+	c := &conPTY{in: os.NewFile(uintptr(inWrite), "conpty-in"), out: os.NewFile(uintptr(outRead), "conpty-out")}
+	err := windows.CreatePseudoConsole(consoleSize(cols, rows), inRead, outWrite, 0, &c.handle)
+	// The console keeps its own references to its ends of the pipes
+	windows.CloseHandle(inRead)
+	windows.CloseHandle(outWrite)
+	if err != nil {
+		c.in.Close()
+		c.out.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func consoleSize(cols, rows uint32) windows.Coord {
+	if cols == 0 || rows == 0 {
+		cols, rows = 80, 24
+	}
+	return windows.Coord{X: int16(min(cols, math.MaxInt16)), Y: int16(min(rows, math.MaxInt16))}
+}
+
+func (c *conPTY) resize(cols, rows uint32) error {
+	return windows.ResizePseudoConsole(c.handle, consoleSize(cols, rows))
+}
+
+// Close closes the console, which ends the processes still attached to it,
+// and its input. Its output can be read until what it displayed last.
+func (c *conPTY) Close() {
+	c.once.Do(func() {
+		windows.ClosePseudoConsole(c.handle)
+		c.in.Close()
+	})
+}
+
+// start starts cmd attached to the console, which os/exec cannot do, and
+// sets cmd.Process so cmd.Wait works as after cmd.Start. The console is
+// closed when the process exits, ending its output.
+func (c *conPTY) start(cmd *exec.Cmd) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return err
+	}
+	defer attrs.Delete()
+	// The attribute's value is the console handle itself
+	if err := attrs.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE, *(*unsafe.Pointer)(unsafe.Pointer(&c.handle)), unsafe.Sizeof(c.handle)); err != nil {
+		return err
+	}
+	si := &windows.StartupInfoEx{ProcThreadAttributeList: attrs.List()}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+	// Otherwise the process may inherit the server's standard handles
+	// rather than use the console
+	si.Flags = windows.STARTF_USESTDHANDLES
+
+	line := windows.ComposeCommandLine(cmd.Args)
+	flags := uint32(windows.EXTENDED_STARTUPINFO_PRESENT | windows.CREATE_UNICODE_ENVIRONMENT)
+	if attr := cmd.SysProcAttr; attr != nil {
+		if attr.CmdLine != "" {
+			line = attr.CmdLine
+		}
+		flags |= attr.CreationFlags
+	}
+	path, err := windows.UTF16PtrFromString(cmd.Path)
+	if err != nil {
+		return err
+	}
+	args, err := windows.UTF16PtrFromString(line)
+	if err != nil {
+		return err
+	}
+	var dir *uint16
+	if cmd.Dir != "" {
+		if dir, err = windows.UTF16PtrFromString(cmd.Dir); err != nil {
+			return err
+		}
+	}
+	env := cmd.Env
+	if env == nil {
+		env = sessionEnviron()
+	}
+	var pi windows.ProcessInformation
+	if err := windows.CreateProcess(path, args, nil, nil, false, flags, envBlock(env), dir, &si.StartupInfo, &pi); err != nil {
+		return &os.PathError{Op: "CreateProcess", Path: cmd.Path, Err: err}
+	}
+	windows.CloseHandle(pi.Thread)
+	// Holding the process handle keeps its pid from being reused until
+	// os/exec has its own
+	p, err := os.FindProcess(int(pi.ProcessId))
+	if err != nil {
+		windows.TerminateProcess(pi.Process, 1)
+		windows.CloseHandle(pi.Process)
+		return err
+	}
+	cmd.Process = p
+	go func() {
+		_, _ = windows.WaitForSingleObject(pi.Process, windows.INFINITE)
+		windows.CloseHandle(pi.Process)
+		c.Close()
+	}()
+	return nil
+}
+
+// envBlock encodes env for CreateProcess. Of variables set more than once
+// the last wins, with names compared without case as Windows does.
+func envBlock(env []string) *uint16 {
+	seen := make(map[string]bool)
+	var kept []string
+	for i := len(env) - 1; i >= 0; i-- {
+		kv := env[i]
+		// Names of the hidden per-drive variables start with "="
+		name := kv
+		if n := strings.IndexByte(kv[min(1, len(kv)):], '='); n >= 0 {
+			name = kv[:n+1]
+		}
+		if name = strings.ToUpper(name); !seen[name] && !strings.ContainsRune(kv, 0) {
+			seen[name] = true
+			kept = append(kept, kv)
+		}
+	}
+	var block []uint16
+	for i := len(kept) - 1; i >= 0; i-- {
+		block = append(block, utf16.Encode([]rune(kept[i]))...)
+		block = append(block, 0)
+	}
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+	block = append(block, 0)
+	return &block[0]
+}
+
+// runPTY starts cmd on a new pseudo console of the size the pty-req asked,
+// copying between it and the channel after writing welcome, if any. The
+// console has no termios, so the pty-req's terminal modes are not applied. It
+// reports whether the request was accepted.
+func (sess *session) runPTY(req *ssh.Request, cmd *exec.Cmd, welcome string) bool {
+	c, err := newConPTY(sess.ptyCols, sess.ptyRows)
+	if err == nil {
+		if err = c.start(cmd); err != nil {
+			c.Close()
+			c.out.Close()
+		}
+	}
+	if err != nil {
+		warnf("Failed to start console for %s: %v", sess.user.Name, err)
+		req.Reply(false, nil)
+		return false
+	}
+	sess.console = c
+
+	req.Reply(true, nil)
+	sess.onTerminal.Store(true)
+	sess.setTTY("console")
+	_, _ = io.WriteString(sess.ch, welcome)
+
+	output := make(chan struct{})
+	go func() { _, _ = copyData(c.in, sess.ch) }()
+	go func() {
+		_, _ = copyData(sess.ch, c.out)
+		c.out.Close()
+		_ = sess.ch.CloseWrite()
+		close(output)
+	}()
+
+	sess.background(cmd, func() { sess.wait(cmd, output) })
+	return true
+}
+
+// resizePTY gives the console, if started, the size of the last
+// window-change.
+func (sess *session) resizePTY() {
+	if sess.console != nil {
+		_ = sess.console.resize(sess.ptyCols, sess.ptyRows)
+	}
+}
+
+// closePTY closes the console, if started, ending what still runs on it.
+func (sess *session) closePTY() {
+	if sess.console != nil {
+		sess.console.Close()
+	}
+}
+
+// readingSecret reports false: consoles do not tell when echo is off.
+func (sess *session) readingSecret() bool { return false }
+
+// breakPTY delivers a break to the console as the Ctrl-C it stands for,
+// which is the only signal a console has. It reports false if the session
+// has no console.
+func (sess *session) breakPTY() (bool, error) {
+	if sess.console == nil {
+		return false, nil
+	}
+	if sess.breakSignal != syscall.SIGINT {
+		return true, errors.New("only INT breaks are supported on Windows")
+	}
+	_, err := sess.console.in.Write([]byte{0x03})
+	return true, err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ContainerConfig runs sessions in a Docker container per user instead of
+// on the host. The container is created on the user's first login and kept
+// for later ones.
+type ContainerConfig struct {
+	// Image the containers are created from; required.
+	Image string `yaml:"image"`
+	// Docker is the docker CLI; defaults to docker. Any CLI taking the
+	// same arguments, such as podman, works.
+	Docker string `yaml:"docker"`
+	// Name is the container name; %u expands to the username. Defaults
+	// to ssh-demo-%u.
+	Name string `yaml:"name"`
+	// Shell runs in the container; defaults to /bin/sh.
+	Shell string `yaml:"shell"`
+	// User the shell and commands run as inside; defaults to the image's.
+	User string `yaml:"user"`
+	// RunArgs are added to docker run, such as --memory 512m or -v.
+	RunArgs []string `yaml:"run_args"`
+}
+
+var badContainerChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// containers creates and finds the users' containers.
+type containers struct {
+	cfg ContainerConfig
+	mu  sync.Mutex // held while checking for and creating a container
+}
+
+func newContainers(cfg ContainerConfig) (*containers, error) {
+	if cfg.Image == "" {
+		return nil, errors.New("container: image is required")
+	}
+	if cfg.Docker == "" {
+		cfg.Docker = "docker"
+	}
+	if cfg.Name == "" {
+		cfg.Name = "ssh-demo-%u"
+	}
+	if cfg.Shell == "" {
+		cfg.Shell = "/bin/sh"
+	}
+	if _, err := exec.LookPath(cfg.Docker); err != nil {
+		return nil, fmt.Errorf("container: %v", err)
+	}
+	return &containers{cfg: cfg}, nil
+}
+
+// name returns the container of user. Characters Docker does not allow in
+// names become underscores.
+func (c *containers) name(user string) string {
+	name := strings.NewReplacer("%u", user, "%%", "%").Replace(c.cfg.Name)
+	return badContainerChars.ReplaceAllString(name, "_")
+}
+
+// docker runs the docker CLI, returning its trimmed output or an error
+// quoting what it printed.
+func (c *containers) docker(args ...string) (string, error) {
+	out, err := exec.Command(c.cfg.Docker, args...).CombinedOutput()
+	msg := strings.TrimSpace(string(out))
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", c.cfg.Docker, args[0], err, msg)
+	}
+	return msg, nil
+}
+
+// ensure returns the container of user, starting it if it is stopped and
+// creating it if there is none.
+func (c *containers) ensure(user string) (string, error) {
+	name := c.name(user)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	running, err := c.docker("inspect", "--format", "{{.State.Running}}", name)
+	switch {
+	case err == nil && running == "true":
+		return name, nil
+	case err == nil:
+		_, err = c.docker("start", name)
+		return name, err
+	}
+	// Not found, most likely; if the daemon is down, run fails too
+	args := []string{"run", "--detach", "--name", name, "--hostname", name, "--label", "ssh-demo.user=" + user}
+	args = append(args, c.cfg.RunArgs...)
+	// Something has to keep the container running between sessions
+	args = append(args, c.cfg.Image, "tail", "-f", "/dev/null")
+	if _, err := c.docker(args...); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// containerCommand builds the docker exec process for a shell (command ==
+// "") or command in the session's container, with env set inside.
+func (sess *session) containerCommand(command string, env []string) *exec.Cmd {
+	c := sess.containers
+	args := []string{"exec", "--interactive"}
+	if sess.ptyRequested {
+		args = append(args, "--tty")
+	}
+	if c.cfg.User != "" {
+		args = append(args, "--user", c.cfg.User)
+	}
+	for _, kv := range env {
+		args = append(args, "--env", kv)
+	}
+	args = append(args, sess.container, c.cfg.Shell)
+	switch {
+	case command == "" && (sess.user.LoginShell == nil || *sess.user.LoginShell):
+		args = append(args, "-l")
+	case command != "":
+		args = append(args, "-c", command)
+	}
+	return exec.Command(c.cfg.Docker, args...)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Channel windows and packets are fixed by x/crypto/ssh, at 2M and 32K;
+// what the server tunes is how much each copy between a channel and a
+// process, PTY or socket moves at a time.
+const defaultCopyBuffer = 32 << 10
+
+// copyBufferSize is the copy_buffer setting, set before serving.
+var copyBufferSize = defaultCopyBuffer
+
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}}
+
+// parseCopyBuffer parses copy_buffer: a size with an optional K or M
+// suffix, from 1K to 16M. Empty is the default.
+func parseCopyBuffer(s string) (int, error) {
+	if s == "" {
+		return defaultCopyBuffer, nil
+	}
+	n, err := parseByteRate(s)
+	if err != nil || n < 1<<10 || n > 16<<20 {
+		return 0, fmt.Errorf("copy_buffer: %q is not a size from 1K to 16M", s)
+	}
+	return int(n), nil
+}
+
+// copyData is io.Copy through a copy_buffer sized buffer.
+func copyData(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// Hidden, as files and TCP connections would bring 32K buffers of
+	// their own
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
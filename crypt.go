@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Pure Go implementations of the glibc crypt(3) formats found in
+// /etc/shadow: MD5-crypt ("$1$"), SHA-256-crypt ("$5$") and SHA-512-crypt
+// ("$6$"). yescrypt ("$y$") has a file of its own.
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptEncode appends the crypt base64 encoding of three bytes, least
+// significant six bits first.
+func cryptEncode(out []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
+
+// unixCrypt hashes pass with the algorithm, salt and rounds of setting (a
+// full hash or just its "$id$salt" prefix) and returns the full hash.
+func unixCrypt(pass []byte, setting string) (string, error) {
+	switch {
+	case strings.HasPrefix(setting, "$1$"):
+		return md5Crypt(pass, setting), nil
+	case strings.HasPrefix(setting, "$5$"):
+		return shaCrypt(sha256.New, "$5$", sha256Order, pass, setting)
+	case strings.HasPrefix(setting, "$6$"):
+		return shaCrypt(sha512.New, "$6$", sha512Order, pass, setting)
+	case strings.HasPrefix(setting, "$y$"):
+		return yescryptCrypt(pass, setting)
+	}
+	return "", errUnsupportedHash
+}
+
+func md5Crypt(pass []byte, setting string) string {
+	salt := strings.TrimPrefix(setting, "$1$")
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.New()
+	alt.Write(pass)
+	alt.Write([]byte(salt))
+	alt.Write(pass)
+	final := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pass)
+	h.Write([]byte("$1$"))
+	h.Write([]byte(salt))
+	for n := len(pass); n > 0; n -= 16 {
+		h.Write(final[:min(n, 16)])
+	}
+	for n := len(pass); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pass[:1])
+		}
+	}
+	final = h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pass)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pass)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pass)
+		}
+		final = h.Sum(nil)
+	}
+
+	out := []byte("$1$" + salt + "$")
+	for _, t := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		out = cryptEncode(out, final[t[0]], final[t[1]], final[t[2]], 4)
+	}
+	return string(cryptEncode(out, 0, 0, final[11], 2))
+}
+
+// The byte order in which SHA-crypt encodes its digest, three bytes at a
+// time; a trailing pair of -1 marks a short final group.
+var (
+	sha256Order = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+		{-1, 31, 30},
+	}
+	sha512Order = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41}, {-1, -1, 63},
+	}
+)
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+)
+
+// shaCrypt implements SHA-256-crypt and SHA-512-crypt as specified by
+// Ulrich Drepper.
+func shaCrypt(newHash func() hash.Hash, magic string, order [][3]int, pass []byte, setting string) (string, error) {
+	rest := strings.TrimPrefix(setting, magic)
+	rounds, customRounds := shaCryptDefaultRounds, false
+	if r, ok := strings.CutPrefix(rest, "rounds="); ok {
+		n, after, found := strings.Cut(r, "$")
+		if !found {
+			return "", fmt.Errorf("malformed rounds in %q", magic)
+		}
+		v, err := strconv.Atoi(n)
+		if err != nil {
+			return "", fmt.Errorf("bad rounds %q", n)
+		}
+		rounds = min(max(v, shaCryptMinRounds), shaCryptMaxRounds)
+		customRounds, rest = true, after
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	h := newHash()
+	h.Write(pass)
+	h.Write([]byte(salt))
+	h.Write(pass)
+	b := h.Sum(nil)
+
+	h = newHash()
+	h.Write(pass)
+	h.Write([]byte(salt))
+	for n := len(pass); n > 0; n -= len(b) {
+		h.Write(b[:min(n, len(b))])
+	}
+	for n := len(pass); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(pass)
+		}
+	}
+	a := h.Sum(nil)
+
+	h = newHash()
+	for range pass {
+		h.Write(pass)
+	}
+	p := repeatTo(h.Sum(nil), len(pass))
+
+	h = newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write([]byte(salt))
+	}
+	s := repeatTo(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := []byte(magic)
+	if customRounds {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt+"$"...)
+	for _, t := range order {
+		switch {
+		case t[0] >= 0:
+			out = cryptEncode(out, c[t[0]], c[t[1]], c[t[2]], 4)
+		case t[1] >= 0:
+			out = cryptEncode(out, 0, c[t[1]], c[t[2]], 3)
+		default:
+			out = cryptEncode(out, 0, 0, c[t[2]], 2)
+		}
+	}
+	return string(out), nil
+}
+
+// repeatTo repeats digest up to n bytes.
+func repeatTo(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, digest[:min(n-len(out), len(digest))]...)
+	}
+	return out
+}
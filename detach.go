@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DetachConfig keeps PTY sessions running after their client disconnects,
+// like a tmux or screen session: the next interactive login of the same
+// user within the grace period reattaches to it, with the screen redrawn.
+//
+//	detach:
+//	  grace: 30m
+//	  scrollback: 64K
+type DetachConfig struct {
+	// Grace is how long a detached session waits for its user, 10m by
+	// default; it is then hung up.
+	Grace time.Duration `yaml:"grace"`
+	// Scrollback is how much of the latest output is replayed on
+	// reattaching, with an optional K or M suffix; 64K by default.
+	Scrollback string `yaml:"scrollback"`
+}
+
+const (
+	defaultDetachGrace      = 10 * time.Minute
+	defaultDetachScrollback = 64 << 10
+)
+
+// detachedSessions are the terminals that may outlive their channels.
+type detachedSessions struct {
+	grace      time.Duration
+	scrollback int
+
+	mu     sync.Mutex
+	nextID int
+	all    map[int]*terminalSession
+}
+
+// terminalSession is a PTY and the process on it, attached to the channel
+// of at most one session at a time.
+type terminalSession struct {
+	id   int
+	user string
+	// perms identifies the permissions of the login that started it, which
+	// a login must share to reattach
+	perms   string
+	command string
+	pty     *os.File
+	cmd     *exec.Cmd
+	started time.Time
+	d       *detachedSessions
+	// release frees what the process needed, once it has exited
+	release func()
+
+	mu       sync.Mutex
+	ch       ssh.Channel // nil while detached
+	screen   []byte      // the latest output, up to the scrollback
+	detached time.Time
+	expiry   *time.Timer
+	exited   bool
+}
+
+// start registers a terminal for cmd, which runs on pty, attached to ch,
+// and copies its output until it exits. release runs after.
+func (d *detachedSessions) start(user string, perms *ssh.Permissions, command string, pty *os.File, cmd *exec.Cmd, ch ssh.Channel, release func()) *terminalSession {
+	d.mu.Lock()
+	d.nextID++
+	t := &terminalSession{
+		id: d.nextID, user: user, perms: permissionsKey(perms), command: command, pty: pty, cmd: cmd,
+		started: time.Now(), d: d, release: release, ch: ch,
+	}
+	d.all[t.id] = t
+	d.mu.Unlock()
+
+	output := make(chan struct{})
+	go t.pump(output)
+	go t.wait(output)
+	return t
+}
+
+// take returns the most recently detached terminal of user started by a
+// login with the same permissions as perms, attached to ch, or nil if it has
+// none. A login with fewer rights, such as one by a key restricted in
+// authorized_keys, does not take over a shell started with more.
+func (d *detachedSessions) take(user string, perms *ssh.Permissions, ch ssh.Channel) *terminalSession {
+	key := permissionsKey(perms)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var latest *terminalSession
+	for _, t := range d.all {
+		t.mu.Lock()
+		if t.user == user && t.perms == key && t.ch == nil && !t.exited && (latest == nil || t.detached.After(latest.detached)) {
+			latest = t
+		}
+		t.mu.Unlock()
+	}
+	if latest == nil {
+		return nil
+	}
+	latest.mu.Lock()
+	defer latest.mu.Unlock()
+	latest.expiry.Stop()
+	latest.ch = ch
+	return latest
+}
+
+// permissionsKey is perms in a form that compares equal for equal
+// permissions.
+func permissionsKey(perms *ssh.Permissions) string {
+	if perms == nil {
+		return ""
+	}
+	var fields []string
+	for k, v := range perms.CriticalOptions {
+		fields = append(fields, "option "+k+"="+v)
+	}
+	for k, v := range perms.Extensions {
+		fields = append(fields, "extension "+k+"="+v)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, "\x00")
+}
+
+// detachable reports whether the session's terminal may outlive its
+// channel. Guests, sandboxed logins, forced commands and timed commands end
+// with their connection.
+func (sess *session) detachable() bool {
+	if sess.detach == nil || sess.guest != nil || sess.execTimeout != 0 {
+		return false
+	}
+	if _, sandboxed := sandboxPath(sess.conn.Permissions); sandboxed {
+		return false
+	}
+	_, forced := forcedCommand(sess.conn.Permissions)
+	return !forced
+}
+
+// list returns the terminals, oldest first.
+func (d *detachedSessions) list() []*terminalSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]*terminalSession, 0, len(d.all))
+	for _, t := range d.all {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// pump copies the terminal's output to the attached channel, if any,
+// keeping the latest for a reattach to replay.
+func (t *terminalSession) pump(output chan<- struct{}) {
+	defer close(output)
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := t.pty.Read(buf)
+		if n > 0 {
+			t.mu.Lock()
+			t.screen = append(t.screen, buf[:n]...)
+			if over := len(t.screen) - t.d.scrollback; over > 0 {
+				t.screen = append(t.screen[:0], t.screen[over:]...)
+			}
+			if t.ch != nil {
+				_, _ = t.ch.Write(buf[:n])
+			}
+			t.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wait waits for the process to exit and reports its status to the
+// attached channel, if any, which it then closes.
+func (t *terminalSession) wait(output <-chan struct{}) {
+	err := t.cmd.Wait()
+	// Processes left running may hold the terminal open
+	select {
+	case <-output:
+	case <-time.After(time.Second):
+	}
+	t.d.mu.Lock()
+	delete(t.d.all, t.id)
+	t.d.mu.Unlock()
+
+	t.mu.Lock()
+	ch := t.ch
+	t.exited = true
+	if t.expiry != nil {
+		t.expiry.Stop()
+	}
+	t.mu.Unlock()
+	t.pty.Close()
+	t.release()
+	if ch != nil {
+		_ = ch.CloseWrite()
+		reportExit(ch, err)
+		ch.Close()
+	}
+}
+
+// detach lets the process keep running without ch, which was attached,
+// until the grace period is over. It reports false if it has exited.
+func (t *terminalSession) detach(ch ssh.Channel) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exited || t.ch != ch {
+		return false
+	}
+	t.ch, t.detached = nil, time.Now()
+	t.expiry = time.AfterFunc(t.d.grace, t.expire)
+	infof("Detached session %d of %s, kept for %v", t.id, t.user, t.d.grace)
+	return true
+}
+
+// expire hangs up a terminal left detached for the grace period.
+func (t *terminalSession) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ch != nil || t.exited {
+		return
+	}
+	infof("Ending detached session %d of %s: not reattached in %v", t.id, t.user, t.d.grace)
+	_ = t.cmd.Process.Signal(syscall.SIGHUP)
+	t.pty.Close()
+}
+
+// replay writes the latest output to the attached channel, after clearing
+// the screen, so the client starts where the last one left off.
+func (t *terminalSession) replay() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ch == nil {
+		return
+	}
+	fmt.Fprintf(t.ch, "\x1b[H\x1b[2J[Reattached to session %d, detached %v ago]\r\n", t.id, time.Since(t.detached).Round(time.Second))
+	_, _ = t.ch.Write(t.screen)
+}
+
+// reportExit sends ch the exit status or signal of a process that ended
+// with err, as returned by Wait.
+func reportExit(ch ssh.Channel, err error) {
+	if err == nil {
+		sendExitStatus(ch, 0)
+		return
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				sendExitSignal(ch, status.Signal(), status.CoreDump())
+			} else {
+				sendExitStatus(ch, status.ExitStatus())
+			}
+		}
+	}
+}
+
+func init() {
+	registerAdminCommand("detached", "detached", "list sessions kept for reattaching", func(s *server, args []string, w io.Writer) error {
+		if len(args) != 0 {
+			return errors.New("usage: detached")
+		}
+		if s.detach == nil {
+			return errors.New("detach is not configured")
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSER\tSTARTED\tDETACHED\tCOMMAND")
+		for _, t := range s.detach.list() {
+			t.mu.Lock()
+			detached := "attached"
+			if t.ch == nil {
+				detached = time.Since(t.detached).Round(time.Second).String() + " ago"
+			}
+			t.mu.Unlock()
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", t.id, t.user, t.started.Format(time.RFC3339), detached, t.command)
+		}
+		return tw.Flush()
+	})
+}
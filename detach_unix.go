@@ -0,0 +1,78 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+func newDetachedSessions(cfg DetachConfig) (*detachedSessions, error) {
+	d := &detachedSessions{grace: cfg.Grace, scrollback: defaultDetachScrollback, all: make(map[int]*terminalSession)}
+	if d.grace <= 0 {
+		d.grace = defaultDetachGrace
+	}
+	if cfg.Scrollback != "" {
+		n, err := parseByteRate(cfg.Scrollback)
+		if err != nil || n > 1<<30 {
+			return nil, fmt.Errorf("detach: scrollback: %q is not a size up to 1G", cfg.Scrollback)
+		}
+		d.scrollback = int(n)
+	}
+	return d, nil
+}
+
+// runDetachable runs cmd, started on the PTY f, as a terminal that
+// outlives the session's channel. It takes over the session's cgroup and
+// login record, which last until the process exits.
+func (sess *session) runDetachable(f *os.File, cmd *exec.Cmd) {
+	logout := sess.recordLogin(f, cmd.Process.Pid)
+	cgroup := sess.cgroup
+	sess.cgroup = nil
+	t := sess.detach.start(sess.user.Name, sess.conn.Permissions, strings.Join(cmd.Args, " "), f, cmd, sess.ch, func() {
+		removeCgroup(cgroup)
+		logout()
+	})
+	sess.attach(t)
+}
+
+// attach makes t, attached to the session's channel, its terminal.
+func (sess *session) attach(t *terminalSession) {
+	sess.terminal = t
+	sess.ptyFile = t.pty
+	sess.process = t.cmd.Process
+	go func() { _, _ = copyData(t.pty, sess.ch) }()
+}
+
+// resumeDetached serves a shell request on a PTY by reattaching to the
+// user's most recently detached terminal, if any, replaying its screen and
+// making what runs on it redraw at the new size. It reports whether it did.
+func (sess *session) resumeDetached(req *ssh.Request) bool {
+	if !sess.detachable() {
+		return false
+	}
+	t := sess.detach.take(sess.user.Name, sess.conn.Permissions, sess.ch)
+	if t == nil {
+		return false
+	}
+	req.Reply(true, nil)
+	infof("Reattached %s to detached session %d", sess.user.Name, t.id)
+	sess.attach(t)
+	sess.onTerminal.Store(true)
+	if tty, err := ptsName(t.pty); err == nil {
+		sess.setTTY(tty)
+	}
+	t.replay()
+	sess.resizePTY()
+	// Also when the size is the same
+	if pgrp, err := unix.IoctlGetInt(int(t.pty.Fd()), unix.TIOCGPGRP); err == nil {
+		_ = syscall.Kill(-pgrp, syscall.SIGWINCH)
+	}
+	return true
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DeviceTrackingConfig enables trust-on-first-use tracking of the keys and
+// networks each user logs in from. The first login of a user is trusted;
+// later logins with a key or from a network not seen before raise an alert.
+type DeviceTrackingConfig struct {
+	// StateFile keeps the seen devices; defaults to devices.json.
+	StateFile string `yaml:"state_file"`
+	// IPv4Prefix and IPv6Prefix group source addresses into networks;
+	// defaults are 24 and 64.
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+	// WebhookURL, if set, receives each alert as a JSON POST in addition
+	// to the log.
+	WebhookURL string            `yaml:"webhook_url"`
+	Headers    map[string]string `yaml:"headers"`
+	// Timeout for the webhook; defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// deviceRecord is one (key, network) pair a user has logged in with. Key is
+// empty for logins without a public key.
+type deviceRecord struct {
+	Key       string    `json:"key,omitempty"`
+	Network   string    `json:"network"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// deviceAlert is logged and POSTed for a login with a new key or network.
+type deviceAlert struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	RemoteIP    string    `json:"remote_ip"`
+	Network     string    `json:"network"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	NewKey      bool      `json:"new_key"`
+	NewNetwork  bool      `json:"new_network"`
+}
+
+// deviceTracker records the devices of each user and raises alerts.
+type deviceTracker struct {
+	cfg    DeviceTrackingConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	devices map[string][]*deviceRecord // by user
+}
+
+func newDeviceTracker(cfg DeviceTrackingConfig) (*deviceTracker, error) {
+	if cfg.StateFile == "" {
+		cfg.StateFile = "devices.json"
+	}
+	if cfg.IPv4Prefix <= 0 {
+		cfg.IPv4Prefix = 24
+	}
+	if cfg.IPv6Prefix <= 0 {
+		cfg.IPv6Prefix = 64
+	}
+	if cfg.IPv4Prefix > 32 || cfg.IPv6Prefix > 128 {
+		return nil, errors.New("device_tracking: prefix length out of range")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	t := &deviceTracker{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		devices: make(map[string][]*deviceRecord),
+	}
+	data, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.devices); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.StateFile, err)
+	}
+	return t, nil
+}
+
+// save writes the devices to the state file. Callers hold t.mu.
+func (t *deviceTracker) save() error {
+	data, err := json.MarshalIndent(t.devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.cfg.StateFile)
+}
+
+// network returns the network ip belongs to, e.g. "192.0.2.0/24".
+func (t *deviceTracker) network(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := t.cfg.IPv6Prefix
+	if addr.Is4() {
+		bits = t.cfg.IPv4Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// login records a successful login of user from ip, with key if it was a
+// public key login, and alerts if the key or network is new for a user
+// who has logged in before.
+func (t *deviceTracker) login(user, ip string, key ssh.PublicKey) {
+	alert := deviceAlert{Time: time.Now().UTC(), User: user, RemoteIP: ip, Network: t.network(ip)}
+	if key != nil {
+		alert.Fingerprint = ssh.FingerprintSHA256(key)
+	}
+
+	t.mu.Lock()
+	known := t.devices[user]
+	alert.NewKey, alert.NewNetwork = alert.Fingerprint != "", true
+	var record *deviceRecord
+	for _, d := range known {
+		if d.Key == alert.Fingerprint {
+			alert.NewKey = false
+		}
+		if d.Network == alert.Network {
+			alert.NewNetwork = false
+		}
+		if d.Key == alert.Fingerprint && d.Network == alert.Network {
+			record = d
+		}
+	}
+	if record == nil {
+		record = &deviceRecord{Key: alert.Fingerprint, Network: alert.Network, FirstSeen: alert.Time}
+		t.devices[user] = append(known, record)
+	}
+	record.LastSeen = alert.Time
+	if err := t.save(); err != nil {
+		warnf("Failed to save devices: %v", err)
+	}
+	t.mu.Unlock()
+
+	switch {
+	case len(known) == 0:
+		infof("Trusting first device of %q (%s)", user, describeDevice(alert.Fingerprint, alert.Network))
+	case alert.NewKey || alert.NewNetwork:
+		t.alert(alert)
+	}
+}
+
+func describeDevice(fingerprint, network string) string {
+	if fingerprint == "" {
+		return "no key, network " + network
+	}
+	return "key " + fingerprint + ", network " + network
+}
+
+// alert logs a and sends it to the webhook in the background, so the login
+// is not held up.
+func (t *deviceTracker) alert(a deviceAlert) {
+	var what string
+	switch {
+	case a.NewKey && a.NewNetwork:
+		what = "new key and network"
+	case a.NewKey:
+		what = "new key"
+	default:
+		what = "new network"
+	}
+	infof("Device alert: %q logged in from %s with %s (%s)", a.User, a.RemoteIP, what, describeDevice(a.Fingerprint, a.Network))
+	if t.cfg.WebhookURL == "" {
+		return
+	}
+	go func() {
+		if err := t.post(a); err != nil {
+			warnf("Failed to send device alert: %v", err)
+		}
+	}()
+}
+
+func (t *deviceTracker) post(a deviceAlert) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.cfg.WebhookURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func init() {
+	registerAdminCommand("devices", "devices [user]", "list the keys and networks users logged in from", func(s *server, args []string, w io.Writer) error {
+		if s.devices == nil {
+			return errors.New("device tracking is not enabled")
+		}
+		s.devices.mu.Lock()
+		defer s.devices.mu.Unlock()
+		var users []string
+		for name := range s.devices.devices {
+			if len(args) == 0 || args[0] == name {
+				users = append(users, name)
+			}
+		}
+		sort.Strings(users)
+		for _, name := range users {
+			for _, d := range s.devices.devices[name] {
+				key := d.Key
+				if key == "" {
+					key = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\tfirst %s, last %s\n", name, key, d.Network,
+					d.FirstSeen.Format(time.RFC3339), d.LastSeen.Format(time.RFC3339))
+			}
+		}
+		return nil
+	})
+	registerAdminCommand("forget-devices", "forget-devices <user>", "forget a user's devices; the next login is trusted", func(s *server, args []string, w io.Writer) error {
+		if s.devices == nil {
+			return errors.New("device tracking is not enabled")
+		}
+		if len(args) != 1 {
+			return errors.New("usage: forget-devices <user>")
+		}
+		s.devices.mu.Lock()
+		defer s.devices.mu.Unlock()
+		if _, ok := s.devices.devices[args[0]]; !ok {
+			return fmt.Errorf("no devices recorded for %q", args[0])
+		}
+		delete(s.devices.devices, args[0])
+		if err := s.devices.save(); err != nil {
+			return err
+		}
+		infof("Admin cleared the devices of %q", args[0])
+		fmt.Fprintf(w, "forgot devices of %s\n", args[0])
+		return nil
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultAcceptEnv is what clients may set without accept_env: the locale,
+// which OpenSSH clients send by default.
+var defaultAcceptEnv = []string{"LANG", "LC_*"}
+
+// protectedEnv patterns can never be set by clients, whatever accept_env
+// says: they change how programs load or how the shell starts, or identify
+// the account or the connection.
+var protectedEnv = []string{
+	"LD_*", "DYLD_*", "GCONV_PATH",
+	"BASH_ENV", "ENV", "BASH_FUNC_*", "SHELLOPTS", "BASHOPTS", "IFS", "PS4",
+	"PATH", "HOME", "SHELL", "USER", "LOGNAME",
+	"SSH_CONNECTION", "SSH_CLIENT", "SSH_TTY", "SSH_ORIGINAL_COMMAND", "SSH_AUTH_SOCK",
+}
+
+// checkEnvPatterns validates accept_env patterns.
+func checkEnvPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return fmt.Errorf("accept_env: bad pattern %q", p)
+		}
+	}
+	return nil
+}
+
+func matchEnv(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionEnv returns the variables describing the connection that
+// OpenSSH sets: SSH_CONNECTION, the client's address and port and the
+// server's, and the older SSH_CLIENT, with the server's port only.
+func (sess *session) connectionEnv() []string {
+	client, clientPort, err := net.SplitHostPort(sess.conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	server, serverPort, err := net.SplitHostPort(sess.conn.LocalAddr().String())
+	if err != nil {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("SSH_CONNECTION=%s %s %s %s", client, clientPort, server, serverPort),
+		fmt.Sprintf("SSH_CLIENT=%s %s %s", client, clientPort, serverPort),
+	}
+}
+
+// acceptEnv reports whether a client may set the variable name.
+func (sess *session) acceptEnv(name string) bool {
+	if name == "" || strings.ContainsAny(name, "=\x00") || matchEnv(protectedEnv, name) {
+		return false
+	}
+	if _, git := gitRepositories(sess.conn.Permissions); git && name == "GIT_PROTOCOL" {
+		return true // selects protocol v2
+	}
+	return matchEnv(sess.acceptEnvPatterns, name)
+}
+
+// handleEnv handles an "env" request, recording the variable for the shell
+// or command the session runs.
+func (sess *session) handleEnv(req *ssh.Request) {
+	var env struct{ Name, Value string }
+	if err := ssh.Unmarshal(req.Payload, &env); err != nil || strings.ContainsRune(env.Value, 0) {
+		req.Reply(false, nil)
+		return
+	}
+	if !sess.acceptEnv(env.Name) {
+		debugf("Ignoring environment variable %s from %s", env.Name, sess.user.Name)
+		req.Reply(false, nil)
+		return
+	}
+	sess.env = append(sess.env, env.Name+"="+env.Value)
+	req.Reply(true, nil)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwarder handles TCP port forwarding for one connection: direct-tcpip
+// channels (ssh -L) and tcpip-forward requests (ssh -R). Both require the
+// allow-port-forwarding permission; remote forwards listen on loopback and
+// unprivileged ports only, unless gateway-ports lets them listen on the
+// requested address.
+type forwarder struct {
+	conn *ssh.ServerConn
+	act  *activity // channel data counts towards idle_timeout
+
+	mu        sync.Mutex
+	listeners map[string]net.Listener // by requested host and bound port
+}
+
+func newForwarder(conn *ssh.ServerConn, act *activity) *forwarder {
+	return &forwarder{conn: conn, act: act, listeners: make(map[string]net.Listener)}
+}
+
+func (f *forwarder) allowed() bool {
+	return permitted(f.conn.Permissions, permAllowPortForwarding)
+}
+
+// handleDirectTCPIP connects a direct-tcpip channel to the requested
+// address.
+func (f *forwarder) handleDirectTCPIP(newChannel ssh.NewChannel) {
+	if !f.allowed() {
+		newChannel.Reject(ssh.Prohibited, "port forwarding is not permitted")
+		return
+	}
+	// RFC 4254 section 7.2
+	var p struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &p); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+
+	addr := net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port)))
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	infof("Forwarding %s for %s to %s", f.conn.RemoteAddr(), f.conn.User(), addr)
+	pipe(f.act.track(ch), target)
+}
+
+// handleGlobalRequests serves connection-level requests.
+func (f *forwarder) handleGlobalRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			f.handleTCPIPForward(req)
+		case "cancel-tcpip-forward":
+			f.handleCancel(req)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+type forwardRequest struct {
+	Host string
+	Port uint32
+}
+
+func (f *forwarder) handleTCPIPForward(req *ssh.Request) {
+	var p forwardRequest
+	if !f.allowed() || ssh.Unmarshal(req.Payload, &p) != nil {
+		req.Reply(false, nil)
+		return
+	}
+	if p.Port != 0 && p.Port < 1024 || p.Port > 65535 {
+		warnf("Refusing remote forward of port %d for %s: not an unprivileged port", p.Port, f.conn.User())
+		req.Reply(false, nil)
+		return
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(f.bindHost(p.Host), strconv.Itoa(int(p.Port))))
+	if err != nil {
+		warnf("Remote forward for %s failed: %v", f.conn.User(), err)
+		req.Reply(false, nil)
+		return
+	}
+
+	// Port 0 asks the server to pick one, which is returned in the reply,
+	// and which the client cancels the forward with
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	key := net.JoinHostPort(p.Host, strconv.Itoa(int(port)))
+	f.mu.Lock()
+	f.listeners[key] = l
+	f.mu.Unlock()
+
+	var reply []byte
+	if p.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{port})
+	}
+	req.Reply(true, reply)
+	infof("Remote forward %s opened for %s", l.Addr(), f.conn.User())
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.forwardIncoming(c, p.Host, port)
+		}
+	}()
+}
+
+// bindHost returns the address a remote forward requested for host listens
+// on: loopback, unless the login has gateway-ports. As with OpenSSH, "" and
+// "*" then mean every address.
+func (f *forwarder) bindHost(host string) string {
+	if !permitted(f.conn.Permissions, permGatewayPorts) {
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return host
+		}
+		return "127.0.0.1"
+	}
+	if host == "*" {
+		return ""
+	}
+	return host
+}
+
+// forwardIncoming opens a forwarded-tcpip channel for a connection accepted
+// on a remote-forward listener.
+func (f *forwarder) forwardIncoming(c net.Conn, host string, port uint32) {
+	origin := c.RemoteAddr().(*net.TCPAddr)
+	payload := ssh.Marshal(struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}{host, port, origin.IP.String(), uint32(origin.Port)})
+
+	ch, reqs, err := f.conn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	pipe(f.act.track(ch), c)
+}
+
+func (f *forwarder) handleCancel(req *ssh.Request) {
+	var p forwardRequest
+	if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	key := net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port)))
+	f.mu.Lock()
+	l, ok := f.listeners[key]
+	delete(f.listeners, key)
+	f.mu.Unlock()
+	if ok {
+		l.Close()
+	}
+	req.Reply(ok, nil)
+}
+
+// close stops every remote-forward listener of the connection.
+func (f *forwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, l := range f.listeners {
+		l.Close()
+		delete(f.listeners, key)
+	}
+}
+
+// pipe copies data both ways between an SSH channel and a TCP connection,
+// passing on EOF in each direction, and closes both once both directions are
+// done.
+func pipe(ch ssh.Channel, c net.Conn) {
+	defer ch.Close()
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = copyData(ch, c)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = copyData(c, ch)
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GitConfig serves Git repositories over SSH to logins with
+// git_repositories, like an account whose shell is git-shell.
+type GitConfig struct {
+	// Root is the directory repositories are served from; the paths
+	// clients give, as in host:team/app.git, are taken relative to it.
+	Root string `yaml:"root"`
+	// Git is the git binary; defaults to git in the server's PATH.
+	Git string `yaml:"git"`
+}
+
+// gitHost runs the git commands of git logins.
+type gitHost struct {
+	cfg GitConfig
+}
+
+func newGitHost(cfg GitConfig) (*gitHost, error) {
+	if cfg.Root == "" {
+		return nil, errors.New("git: root is required")
+	}
+	if cfg.Git == "" {
+		cfg.Git = "git"
+	}
+	bin, err := exec.LookPath(cfg.Git)
+	if err != nil {
+		return nil, fmt.Errorf("git: %v", err)
+	}
+	cfg.Git = bin
+	return &gitHost{cfg: cfg}, nil
+}
+
+// permGitRepositories carries the git_repositories patterns of a login,
+// newline separated.
+const permGitRepositories = "git-repositories"
+
+// gitRepositories returns the repository patterns a git login may use.
+func gitRepositories(perms *ssh.Permissions) ([]string, bool) {
+	if perms == nil {
+		return nil, false
+	}
+	list, ok := perms.Extensions[permGitRepositories]
+	return strings.Split(list, "\n"), ok
+}
+
+// checkRepositoryPatterns validates git_repositories patterns.
+func checkRepositoryPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil || strings.Trim(p, "/") == "" {
+			return fmt.Errorf("git_repositories: bad pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// gitServices are the commands git clients run over SSH, and the git
+// subcommand serving each.
+var gitServices = map[string]string{
+	"git-upload-pack":    "upload-pack",
+	"git-receive-pack":   "receive-pack",
+	"git-upload-archive": "upload-archive",
+}
+
+// parseGitCommand recognises the commands git clients run, such as
+// git-upload-pack 'team/app.git', or git upload-pack, returning the git
+// subcommand and the repository as the client gave it.
+func parseGitCommand(command string) (service, repo string, ok bool) {
+	args, err := shellSplit(command)
+	if err != nil {
+		return "", "", false
+	}
+	if len(args) == 3 && args[0] == "git" {
+		args = []string{"git-" + args[1], args[2]}
+	}
+	service, ok = gitServices[path.Base(args[0])]
+	if len(args) != 2 || !ok {
+		return "", "", false
+	}
+	return service, args[1], true
+}
+
+// errNoRepository hides whether a repository exists from logins that may
+// not use it.
+var errNoRepository = errors.New("repository not found")
+
+// repository returns the directory of repo under the root, if one of
+// patterns allows it. Patterns and names are compared without a .git
+// suffix, which the directory may have or not, as with git daemon.
+func (g *gitHost) repository(repo string, patterns []string) (string, error) {
+	name := strings.Trim(strings.TrimPrefix(repo, "~"), "/")
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return "", errNoRepository
+		}
+	}
+	name = strings.TrimSuffix(name, ".git")
+	allowed := false
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.TrimSuffix(strings.Trim(p, "/"), ".git"), name); ok {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", errNoRepository
+	}
+	for _, dir := range []string{name + ".git", name} {
+		dir = filepath.Join(g.cfg.Root, filepath.FromSlash(dir))
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", errNoRepository
+}
+
+// runGit serves an exec request of a git login, refusing anything but a
+// git command for an allowed repository. git runs directly with the
+// repository as one argument, so no shell sees the client's quoting.
+func (sess *session) runGit(req *ssh.Request, command string, patterns []string) bool {
+	if sess.git == nil {
+		infof("Refusing git for %s: git hosting is not configured", sess.user.Name)
+		return sess.refuse(req, "fatal: git is not available")
+	}
+	service, repo, ok := parseGitCommand(command)
+	if !ok {
+		return sess.refuseCommand(req, command)
+	}
+	dir, err := sess.git.repository(repo, patterns)
+	if err != nil {
+		infof("Refusing git %s of %q for %s: %v", service, repo, sess.user.Name, err)
+		return sess.refuse(req, fmt.Sprintf("fatal: '%s' does not appear to be a git repository", repo))
+	}
+	infof("git %s of %s for %s", service, dir, sess.user.Name)
+	cmd := sess.command(command)
+	cmd.Path, cmd.Args = sess.git.cfg.Git, []string{"git", service, dir}
+	return sess.runCommand(req, cmd)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// GSSAPIConfig enables gssapi-with-mic logins with Kerberos tickets.
+type GSSAPIConfig struct {
+	// Keytab holds the service key, usually for host/<fqdn>@REALM.
+	Keytab string `yaml:"keytab"`
+	// ServicePrincipal picks the keytab entry (e.g. "host/ssh.example.com");
+	// by default the service named in the client's ticket is used.
+	ServicePrincipal string `yaml:"service_principal"`
+	// Realms whose principals may log in; alice@REALM logs in as alice.
+	// Defaults to the realms in the keytab.
+	Realms       []string      `yaml:"realms"`
+	MaxClockSkew time.Duration `yaml:"max_clock_skew"`
+}
+
+// gssapiProvider verifies Kerberos AP-REQs from the client against a keytab.
+// Unlike the other providers it is not part of the auth chain: x/crypto/ssh
+// drives the GSS-API exchange itself through a per-connection krb5Context.
+type gssapiProvider struct {
+	settings *service.Settings
+	realms   map[string]bool
+}
+
+func newGSSAPIProvider(cfg GSSAPIConfig) (*gssapiProvider, error) {
+	if cfg.Keytab == "" {
+		return nil, errors.New("gssapi: keytab is required")
+	}
+	kt, err := keytab.Load(cfg.Keytab)
+	if err != nil {
+		return nil, fmt.Errorf("gssapi: %v", err)
+	}
+
+	opts := []func(*service.Settings){service.DecodePAC(false)}
+	if cfg.ServicePrincipal != "" {
+		opts = append(opts, service.KeytabPrincipal(cfg.ServicePrincipal))
+	}
+	if cfg.MaxClockSkew > 0 {
+		opts = append(opts, service.MaxClockSkew(cfg.MaxClockSkew))
+	}
+
+	p := &gssapiProvider{settings: service.NewSettings(kt, opts...), realms: make(map[string]bool)}
+	for _, r := range cfg.Realms {
+		p.realms[r] = true
+	}
+	if len(p.realms) == 0 {
+		for _, e := range kt.Entries {
+			p.realms[e.Principal.Realm] = true
+		}
+	}
+	if len(p.realms) == 0 {
+		return nil, fmt.Errorf("gssapi: keytab %s has no entries", cfg.Keytab)
+	}
+	return p, nil
+}
+
+// allowLogin maps the authenticated principal to the login user: a
+// single-component principal in an accepted realm may log in as itself.
+func (p *gssapiProvider) allowLogin(c ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+	name, realm, _ := strings.Cut(srcName, "@")
+	if !p.realms[realm] {
+		return nil, fmt.Errorf("principal %s is not in an accepted realm", srcName)
+	}
+	if name != c.User() {
+		return nil, fmt.Errorf("principal %s may not log in as %q", srcName, c.User())
+	}
+	return nil, nil
+}
+
+// newContext returns the GSS-API acceptor state for one connection.
+func (p *gssapiProvider) newContext() *krb5Context {
+	return &krb5Context{p: p}
+}
+
+// GSS-API context flags from the authenticator checksum (RFC 4121 4.1.1).
+const (
+	gssChecksumType = 0x8003
+	gssMutualFlag   = 2
+)
+
+// krb5Context implements ssh.GSSAPIServer for the Kerberos V5 mechanism. Only
+// RFC 4121 tokens are handled, i.e. AES (and newer) session keys.
+type krb5Context struct {
+	p *gssapiProvider
+	// key signs the initiator's MIC: its authenticator subkey, or else the
+	// ticket session key
+	key types.EncryptionKey
+}
+
+func (k *krb5Context) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
+	var mt spnego.KRB5Token
+	if err := mt.Unmarshal(token); err != nil {
+		return nil, "", false, err
+	}
+	if !mt.IsAPReq() {
+		return nil, "", false, errors.New("gssapi: expected a KRB_AP_REQ token")
+	}
+	ok, creds, err := service.VerifyAPREQ(&mt.APReq, k.p.settings)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("gssapi: %v", err)
+	}
+	if !ok {
+		return nil, "", false, errors.New("gssapi: ticket rejected")
+	}
+
+	auth := mt.APReq.Authenticator
+	if auth.Cksum.CksumType != gssChecksumType || len(auth.Cksum.Checksum) < 24 {
+		return nil, "", false, errors.New("gssapi: authenticator lacks the GSS-API checksum")
+	}
+	k.key = mt.APReq.Ticket.DecryptedEncPart.Key
+	if len(auth.SubKey.KeyValue) > 0 {
+		k.key = auth.SubKey
+	}
+	srcName := creds.CName().PrincipalNameString() + "@" + creds.Realm()
+
+	var reply []byte
+	if binary.LittleEndian.Uint32(auth.Cksum.Checksum[20:24])&gssMutualFlag != 0 {
+		if reply, err = k.apRep(mt.APReq); err != nil {
+			return nil, "", false, fmt.Errorf("gssapi: building AP-REP: %v", err)
+		}
+	}
+	return reply, srcName, false, nil
+}
+
+// apRep builds the mechanism token answering a client that asked for mutual
+// authentication. gokrb5 only parses AP-REPs, so it is encoded here.
+func (k *krb5Context) apRep(req messages.APReq) ([]byte, error) {
+	seq, err := rand.Int(rand.Reader, big.NewInt(1<<30))
+	if err != nil {
+		return nil, err
+	}
+	part, err := asn1.Marshal(messages.EncAPRepPart{
+		CTime:          req.Authenticator.CTime,
+		Cusec:          req.Authenticator.Cusec,
+		SequenceNumber: seq.Int64(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	part = asn1tools.AddASNAppTag(part, asnAppTag.EncAPRepPart)
+	encPart, err := crypto.GetEncryptedData(part, req.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := asn1.Marshal(messages.APRep{PVNO: 5, MsgType: msgtype.KRB_AP_REP, EncPart: encPart})
+	if err != nil {
+		return nil, err
+	}
+	rep = asn1tools.AddASNAppTag(rep, asnAppTag.APREP)
+
+	oid, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	tok := append(oid, 0x02, 0x00) // TOK_ID_KRB_AP_REP
+	return asn1tools.AddASNAppTag(append(tok, rep...), 0), nil
+}
+
+func (k *krb5Context) VerifyMIC(micField, micToken []byte) error {
+	if len(k.key.KeyValue) == 0 {
+		return errors.New("gssapi: no security context")
+	}
+	var mic gssapi.MICToken
+	if err := mic.Unmarshal(micToken, false); err != nil {
+		return fmt.Errorf("gssapi: %v", err)
+	}
+	if mic.Flags&gssapi.MICTokenFlagAcceptorSubkey != 0 {
+		return errors.New("gssapi: MIC uses an acceptor subkey that was never sent")
+	}
+	mic.Payload = micField
+	if ok, err := mic.Verify(k.key, keyusage.GSSAPI_INITIATOR_SIGN); !ok {
+		return fmt.Errorf("gssapi: MIC rejected: %v", err)
+	}
+	return nil
+}
+
+func (k *krb5Context) DeleteSecContext() error {
+	k.key = types.EncryptionKey{}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// adoptSockets returns the sockets to serve listeners on after a restart:
+// those the previous server handed over for their addresses, and new ones
+// for addresses added since. Handed-over sockets no listener is configured
+// for any more are closed.
+func adoptSockets(listeners []*listener, inherited []activatedSocket) ([]net.Listener, error) {
+	sockets := make([]net.Listener, len(listeners))
+	used := make([]bool, len(inherited))
+	for i, l := range listeners {
+		for j, as := range inherited {
+			if !used[j] && sameAddress(l.address, as.socket.Addr()) {
+				sockets[i], used[j] = as.socket, true
+				infof("SSH server listening on %s (from the previous server)", l.address)
+				break
+			}
+		}
+		if sockets[i] != nil {
+			continue
+		}
+		var err error
+		if sockets[i], err = l.listen(); err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %v", l.address, err)
+		}
+		infof("SSH server listening on %s", l.address)
+	}
+	for j, as := range inherited {
+		if used[j] {
+			continue
+		}
+		infof("No longer listening on %s", as.socket.Addr())
+		if u, ok := as.socket.(*net.UnixListener); ok {
+			u.SetUnlinkOnClose(true)
+		}
+		as.socket.Close()
+	}
+	return sockets, nil
+}
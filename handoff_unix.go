@@ -0,0 +1,191 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// handoffFDsEnv tells a server started by a restart how many listening
+// sockets it inherited, from descriptor listenFDsStart on. The descriptor
+// after them is a pipe it reports on once it is serving.
+const handoffFDsEnv = "SSHDEMO_HANDOFF_FDS"
+
+// handoffTimeout bounds how long a restart waits for the new server to
+// start serving before giving up on it.
+const handoffTimeout = time.Minute
+
+// handedOffSockets returns the listening sockets the previous server handed
+// over on a restart, and the function telling it the new server is serving,
+// or nothing if the server was not started by a restart.
+func handedOffSockets() ([]activatedSocket, func(), error) {
+	v, ok := os.LookupEnv(handoffFDsEnv)
+	if !ok {
+		return nil, nil, nil
+	}
+	os.Unsetenv(handoffFDsEnv)
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return nil, nil, fmt.Errorf("%s is not a number of sockets", handoffFDsEnv)
+	}
+	syscall.CloseOnExec(listenFDsStart + n)
+	ready := os.NewFile(uintptr(listenFDsStart+n), "handoff")
+	sockets, err := fileListeners(n, nil)
+	if err != nil {
+		ready.Close()
+		return nil, nil, err
+	}
+	return sockets, func() {
+		_, _ = io.WriteString(ready, "ready\n")
+		ready.Close()
+	}, nil
+}
+
+// restart starts a new server from the current binary, with the same
+// arguments, and hands it the listening sockets, then stops accepting
+// connections once it is serving; the connections open keep being served
+// until they end, then the server exits. Connections are never refused in
+// between, as both servers hold the sockets. If the new server fails to
+// start, this one carries on.
+func (s *server) restart() (int, error) {
+	s.handoffMu.Lock()
+	defer s.handoffMu.Unlock()
+	switch {
+	case s.sockets == nil:
+		return 0, errors.New("not serving yet")
+	case s.handedOff:
+		return 0, errors.New("already handed over to a new server")
+	}
+	pid, err := startSuccessor(s.sockets)
+	if err != nil {
+		return 0, err
+	}
+	s.handedOff = true
+	go s.retire(s.sockets)
+	return pid, nil
+}
+
+// startSuccessor starts the new server of a restart and waits for it to
+// serve. The sockets are passed as raw descriptors: exec.Cmd would take
+// them from os.Files, whose Fd puts them, shared with ours, in blocking
+// mode, and our accepts could then no longer be interrupted.
+func startSuccessor(sockets []net.Listener) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	fds := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	defer func() {
+		for _, fd := range fds[3:] {
+			syscall.Close(int(fd))
+		}
+	}()
+	for _, socket := range sockets {
+		sc, ok := socket.(syscall.Conn)
+		if !ok {
+			return 0, fmt.Errorf("cannot hand over %s", socket.Addr())
+		}
+		fd, err := dupSocket(sc)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", socket.Addr(), err)
+		}
+		fds = append(fds, uintptr(fd))
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	pid, err := syscall.ForkExec(exe, os.Args, &syscall.ProcAttr{
+		Env:   append(append(os.Environ(), vaultEnviron()...), fmt.Sprintf("%s=%d", handoffFDsEnv, len(sockets))),
+		Files: append(fds, w.Fd()),
+	})
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	proc, _ := os.FindProcess(pid)
+	go func() { _, _ = proc.Wait() }()
+
+	r.SetReadDeadline(time.Now().Add(handoffTimeout))
+	msg, err := io.ReadAll(r)
+	if string(msg) != "ready\n" {
+		proc.Kill()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("the new server (pid %d) was not serving after %v", pid, handoffTimeout)
+		}
+		return 0, fmt.Errorf("the new server (pid %d) exited before serving", pid)
+	}
+	return pid, nil
+}
+
+// dupSocket returns a close-on-exec duplicate of the descriptor of sc.
+func dupSocket(sc syscall.Conn) (int, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	dup := -1
+	var dupErr error
+	if err := rc.Control(func(fd uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if dup, dupErr = syscall.Dup(int(fd)); dupErr == nil {
+			syscall.CloseOnExec(dup)
+		}
+	}); err != nil {
+		return -1, err
+	}
+	return dup, dupErr
+}
+
+// retire stops accepting connections, leaving them to the new server, and
+// signals s.retired once those open have ended.
+func (s *server) retire(sockets []net.Listener) {
+	for _, socket := range sockets {
+		// The socket file is the new server's now
+		if u, ok := socket.(*net.UnixListener); ok {
+			u.SetUnlinkOnClose(false)
+		}
+		socket.Close()
+	}
+	s.conns.done.Wait()
+	close(s.retired)
+}
+
+// restartOnSignal restarts the server on SIGUSR2.
+func (s *server) restartOnSignal() {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		pid, err := s.restart()
+		if err != nil {
+			warnf("Restart failed, carrying on: %v", err)
+			continue
+		}
+		infof("Handed the listening sockets over to a new server (pid %d); exiting once the %d open connections end", pid, s.conns.len())
+	}
+}
+
+func init() {
+	registerAdminCommand("restart", "restart", "hand the listening sockets to a new server, as SIGUSR2 does", func(s *server, args []string, w io.Writer) error {
+		if len(args) != 0 {
+			return errors.New("usage: restart")
+		}
+		pid, err := s.restart()
+		if err != nil {
+			return err
+		}
+		infof("Handed the listening sockets over to a new server (pid %d) by admin command", pid)
+		fmt.Fprintf(w, "New server (pid %d) serving; this one exits once its %d connections end\n", pid, s.conns.len())
+		return nil
+	})
+}
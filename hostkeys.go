@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loadHostKeys reads the host private keys at paths, PEM or OpenSSH files
+// of any type x/crypto/ssh supports. Missing ones are generated, as on the
+// first run of a container.
+func loadHostKeys(paths []string) ([]ssh.Signer, error) {
+	keys := make([]ssh.Signer, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			key, err := generateHostKey(path)
+			if err != nil {
+				return nil, fmt.Errorf("generate %s: %v", path, err)
+			}
+			infof("Generated host key %s: %s %s", path, key.PublicKey().Type(), ssh.FingerprintSHA256(key.PublicKey()))
+			keys = append(keys, key)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// generateHostKey creates an ed25519 host key at path, readable only by
+// the server's user, with its public key next to it in path.pub.
+func generateHostKey(path string) (ssh.Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// O_EXCL, so that a key another process just wrote is not overwritten
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0o644); err != nil {
+		warnf("Failed to write %s.pub: %v", path, err)
+	}
+	return signer, nil
+}
+
+// checkHostKeyTypes refuses two host keys of the same type, of which
+// clients would only ever be shown the last.
+func checkHostKeyTypes(keys []ssh.Signer) error {
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		t := k.PublicKey().Type()
+		if seen[t] {
+			return fmt.Errorf("more than one %s host key", t)
+		}
+		seen[t] = true
+	}
+	return nil
+}
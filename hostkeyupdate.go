@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyUpdates implements OpenSSH's host key update extension: once a
+// client has authenticated, the server lists all its host keys in a
+// hostkeys-00@openssh.com request, and clients with UpdateHostKeys ask it
+// to prove it holds those they do not know yet, with
+// hostkeys-prove-00@openssh.com, before adding them to known_hosts. Keys
+// no longer listed are removed from it.
+type hostKeyUpdates struct {
+	keys []ssh.Signer // the host keys, then next_host_keys
+}
+
+// announce lists the host keys to the client.
+func (h *hostKeyUpdates) announce(conn *ssh.ServerConn) {
+	var payload []byte
+	for _, k := range h.keys {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{k.PublicKey().Marshal()})...)
+	}
+	if _, _, err := conn.SendRequest("hostkeys-00@openssh.com", false, payload); err != nil {
+		debugf("Failed to announce host keys to %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// intercept answers the connection's hostkeys-prove-00@openssh.com
+// requests and passes on the others.
+func (h *hostKeyUpdates) intercept(conn *ssh.ServerConn, reqs <-chan *ssh.Request) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		for req := range reqs {
+			if req.Type != "hostkeys-prove-00@openssh.com" {
+				out <- req
+				continue
+			}
+			proofs, err := h.prove(conn.SessionID(), req.Payload)
+			if err != nil {
+				infof("Refusing host key proof for %s: %v", conn.RemoteAddr(), err)
+			}
+			if req.WantReply {
+				req.Reply(err == nil, proofs)
+			}
+		}
+	}()
+	return out
+}
+
+// prove signs, for each key blob in payload, the request name, the session
+// identifier and the blob with that host key.
+func (h *hostKeyUpdates) prove(sessionID, payload []byte) ([]byte, error) {
+	var proofs []byte
+	for len(payload) > 0 {
+		var blob struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &blob); err != nil {
+			return nil, errors.New("malformed request")
+		}
+		payload = blob.Rest
+		key := h.find(blob.Key)
+		if key == nil {
+			return nil, errors.New("asked about a key that is not a host key")
+		}
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{"hostkeys-prove-00@openssh.com", sessionID, blob.Key})
+		sig, err := signHostKeyProof(key, data)
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, ssh.Marshal(struct{ Sig []byte }{ssh.Marshal(sig)})...)
+	}
+	return proofs, nil
+}
+
+func (h *hostKeyUpdates) find(blob []byte) ssh.Signer {
+	for _, k := range h.keys {
+		if string(k.PublicKey().Marshal()) == string(blob) {
+			return k
+		}
+	}
+	return nil
+}
+
+// signHostKeyProof signs data with key; RSA keys sign with SHA-512, as
+// clients no longer accept SHA-1 and OpenSSH's prefer rsa-sha2-512.
+func signHostKeyProof(key ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if as, ok := key.(ssh.AlgorithmSigner); ok && key.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+	}
+	return key.Sign(rand.Reader, data)
+}
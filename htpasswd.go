@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HtpasswdConfig points at a flat "username:hash" credentials file.
+type HtpasswdConfig struct {
+	File string `yaml:"file"`
+	// PollInterval is how often the file is checked for changes; defaults
+	// to 2s.
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// htpasswdProvider checks passwords against an htpasswd-style file, reloading
+// it whenever it changes on disk. Hashes use the same bcrypt and argon2id
+// formats as password_hash (so "htpasswd -B" output works).
+type htpasswdProvider struct {
+	cfg HtpasswdConfig
+
+	mu      sync.RWMutex
+	hashes  map[string]*passwordHash
+	modTime time.Time
+	size    int64
+}
+
+func newHtpasswdProvider(cfg HtpasswdConfig) (*htpasswdProvider, error) {
+	if cfg.File == "" {
+		return nil, errors.New("htpasswd: file is required")
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 2 * time.Second
+	}
+	p := &htpasswdProvider{cfg: cfg}
+	if _, err := p.reload(); err != nil {
+		return nil, fmt.Errorf("htpasswd: %v", err)
+	}
+	go p.watch()
+	return p, nil
+}
+
+// reload reads the file if it changed since the last load and reports
+// whether it did. A file that fails to parse leaves the old credentials
+// in place.
+func (p *htpasswdProvider) reload() (bool, error) {
+	fi, err := os.Stat(p.cfg.File)
+	if err != nil {
+		return false, err
+	}
+	p.mu.RLock()
+	unchanged := fi.ModTime().Equal(p.modTime) && fi.Size() == p.size
+	p.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(p.cfg.File)
+	if err != nil {
+		return false, err
+	}
+	hashes, err := parseHtpasswd(data)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A broken file is remembered too, so it is reported once per change
+	p.modTime, p.size = fi.ModTime(), fi.Size()
+	if err != nil {
+		return false, err
+	}
+	p.hashes = hashes
+	return true, nil
+}
+
+// watch polls the file for changes for the life of the server.
+func (p *htpasswdProvider) watch() {
+	for range time.Tick(p.cfg.PollInterval) {
+		changed, err := p.reload()
+		if err != nil {
+			warnf("Keeping previous credentials from %s: %v", p.cfg.File, err)
+			continue
+		}
+		if changed {
+			infof("Reloaded %d credential(s) from %s", p.count(), p.cfg.File)
+		}
+	}
+}
+
+// count returns the number of loaded credentials.
+func (p *htpasswdProvider) count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.hashes)
+}
+
+// parseHtpasswd parses "username:hash" lines; blank lines and lines starting
+// with '#' are skipped.
+func parseHtpasswd(data []byte) (map[string]*passwordHash, error) {
+	hashes := make(map[string]*passwordHash)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		name, encoded, ok := bytes.Cut(line, []byte(":"))
+		if !ok || len(name) == 0 {
+			return nil, fmt.Errorf("line %d: expected username:hash", i+1)
+		}
+		h, err := parsePasswordHash(string(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: user %q: %v", i+1, name, err)
+		}
+		if _, dup := hashes[string(name)]; dup {
+			return nil, fmt.Errorf("line %d: user %q listed more than once", i+1, name)
+		}
+		hashes[string(name)] = h
+	}
+	return hashes, nil
+}
+
+func (p *htpasswdProvider) authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	p.mu.RLock()
+	h, ok := p.hashes[c.User()]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, errUnknownUser
+	}
+	if !h.verify(pass) {
+		return nil, errors.New("wrong password")
+	}
+	return nil, nil
+}
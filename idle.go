@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// activity records when a connection last carried channel data, for
+// idle_timeout. A nil *activity tracks nothing.
+type activity struct {
+	last atomic.Int64 // UnixNano
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() { a.last.Store(time.Now().UnixNano()) }
+
+// idle returns how long the connection has carried no channel data.
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// track returns ch with its data in either direction counted as activity.
+func (a *activity) track(ch ssh.Channel) ssh.Channel {
+	if a == nil {
+		return ch
+	}
+	return &trackedChannel{Channel: ch, act: a}
+}
+
+type trackedChannel struct {
+	ssh.Channel
+	act *activity
+}
+
+func (c *trackedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.act.touch()
+	}
+	return n, err
+}
+
+func (c *trackedChannel) Write(p []byte) (int, error) {
+	c.act.touch()
+	return c.Channel.Write(p)
+}
+
+func (c *trackedChannel) Stderr() io.ReadWriter {
+	return &trackedStream{ReadWriter: c.Channel.Stderr(), act: c.act}
+}
+
+type trackedStream struct {
+	io.ReadWriter
+	act *activity
+}
+
+func (s *trackedStream) Write(p []byte) (int, error) {
+	s.act.touch()
+	return s.ReadWriter.Write(p)
+}
+
+// watchIdle disconnects conn once its channels have carried no data for
+// timeout. Closing the connection ends its sessions, which hang up their
+// processes.
+func watchIdle(conn *ssh.ServerConn, act *activity, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		_ = conn.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(min(timeout/4, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if act.idle() >= timeout {
+				infof("Disconnecting %s (%s): idle for %v", conn.User(), conn.RemoteAddr(), timeout)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// defaultAliveCountMax is OpenSSH's ClientAliveCountMax default.
+const defaultAliveCountMax = 3
+
+// watchAlive sends conn a keepalive@openssh.com request every interval,
+// waiting for the reply before sending the next, and disconnects it once
+// countMax intervals in a row pass without one. Clients answer, if only
+// with a failure, whether or not they know the request.
+func watchAlive(conn *ssh.ServerConn, interval time.Duration, countMax int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	replies := make(chan error, 1)
+	pending, missed := false, 0
+	for {
+		select {
+		case err := <-replies:
+			if err != nil {
+				// The connection is closed
+				return
+			}
+			pending, missed = false, 0
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+					replies <- err
+				}()
+				continue
+			}
+			if missed++; missed >= countMax {
+				infof("Disconnecting %s (%s): no reply to keepalives for %v", conn.User(), conn.RemoteAddr(), time.Duration(countMax)*interval)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// defaultLoginGrace is OpenSSH's LoginGraceTime default.
+const defaultLoginGrace = 2 * time.Minute
+
+// limitLogin closes conn unless it has completed the SSH handshake and
+// authentication within timeout, when the returned function must be
+// called, so that clients stalling before login cannot hold connections.
+func limitLogin(conn net.Conn, timeout time.Duration) (loggedIn func()) {
+	if timeout <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(timeout, func() {
+		infof("Dropping connection from %s: not logged in within %v", conn.RemoteAddr(), timeout)
+		conn.Close()
+	})
+	return func() { t.Stop() }
+}
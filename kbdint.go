@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// kiChallenge is one round of keyboard-interactive prompts, built with
+// newChallenge and the ask methods:
+//
+//	answers, err := conv.send(newChallenge("Login").
+//		withInstruction("Second factor required").
+//		askSecret("One-time code: "))
+type kiChallenge struct {
+	name        string
+	instruction string
+	questions   []string
+	echos       []bool
+}
+
+func newChallenge(name string) *kiChallenge {
+	return &kiChallenge{name: name}
+}
+
+// withInstruction sets the text shown above the prompts.
+func (c *kiChallenge) withInstruction(text string) *kiChallenge {
+	c.instruction = text
+	return c
+}
+
+// ask adds a prompt whose answer is echoed back to the user.
+func (c *kiChallenge) ask(question string) *kiChallenge {
+	c.questions = append(c.questions, question)
+	c.echos = append(c.echos, true)
+	return c
+}
+
+// askSecret adds a prompt whose answer is not echoed.
+func (c *kiChallenge) askSecret(question string) *kiChallenge {
+	c.questions = append(c.questions, question)
+	c.echos = append(c.echos, false)
+	return c
+}
+
+// kiConversation sends challenges to the client during a single
+// keyboard-interactive attempt, and collects the permissions its steps
+// grant.
+type kiConversation struct {
+	challenge ssh.KeyboardInteractiveChallenge
+	perms     *ssh.Permissions
+}
+
+// send presents ch and returns one answer per prompt.
+func (conv *kiConversation) send(ch *kiChallenge) ([]string, error) {
+	answers, err := conv.challenge(ch.name, ch.instruction, ch.questions, ch.echos)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != len(ch.questions) {
+		return nil, fmt.Errorf("got %d answers to %d prompts", len(answers), len(ch.questions))
+	}
+	return answers, nil
+}
+
+// grant narrows the permissions of the login to those of a credential a
+// step checked, nil standing for full permissions as it does for the auth
+// providers.
+func (conv *kiConversation) grant(perms *ssh.Permissions) {
+	if perms == nil {
+		perms = fullPermissions()
+	}
+	conv.perms = intersectPermissions(conv.perms, perms)
+}
+
+// kiStep is a single stage of a keyboard-interactive flow such as a
+// password prompt, an OTP check or an EULA. Returning an error rejects the
+// login; steps that check a credential pass its permissions to conv.grant.
+type kiStep interface {
+	run(c ssh.ConnMetadata, conv *kiConversation) error
+}
+
+// kiStepFunc adapts a function to kiStep.
+type kiStepFunc func(c ssh.ConnMetadata, conv *kiConversation) error
+
+func (f kiStepFunc) run(c ssh.ConnMetadata, conv *kiConversation) error { return f(c, conv) }
+
+// kiStepFactory builds a configured step. Factories get the server so steps
+// can reuse other auth providers.
+type kiStepFactory func(s *server, cfg *KIStepConfig) (kiStep, error)
+
+var kiStepTypes = map[string]kiStepFactory{}
+
+// registerKIStep makes a step type available to the keyboard_interactive
+// config section. It is meant to be called from init functions.
+func registerKIStep(name string, factory kiStepFactory) {
+	if _, dup := kiStepTypes[name]; dup {
+		panic("duplicate keyboard-interactive step " + name)
+	}
+	kiStepTypes[name] = factory
+}
+
+// KIStepConfig is one entry of the keyboard_interactive config section. The
+// type field selects the step; its other fields are step-specific.
+type KIStepConfig struct {
+	Type string
+	node yaml.Node
+}
+
+func (c *KIStepConfig) UnmarshalYAML(n *yaml.Node) error {
+	var head struct {
+		Type string `yaml:"type"`
+	}
+	if err := n.Decode(&head); err != nil {
+		return err
+	}
+	c.Type = head.Type
+	c.node = *n
+	return nil
+}
+
+// decode decodes the step-specific options into v.
+func (c *KIStepConfig) decode(v any) error {
+	return c.node.Decode(v)
+}
+
+// kiFlow runs its steps in order; every step must pass. The login gets the
+// permissions every step granted, and none if no step granted any.
+type kiFlow struct {
+	steps []kiStep
+}
+
+func newKIFlow(s *server, cfgs []KIStepConfig) (*kiFlow, error) {
+	flow := &kiFlow{}
+	for i := range cfgs {
+		factory, ok := kiStepTypes[cfgs[i].Type]
+		if !ok {
+			return nil, fmt.Errorf("step %d: unknown type %q (known: %s)", i+1, cfgs[i].Type, knownKISteps())
+		}
+		step, err := factory(s, &cfgs[i])
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %v", i+1, cfgs[i].Type, err)
+		}
+		flow.steps = append(flow.steps, step)
+	}
+	if len(flow.steps) == 0 {
+		return nil, errors.New("no steps configured")
+	}
+	return flow, nil
+}
+
+func knownKISteps() string {
+	names := make([]string, 0, len(kiStepTypes))
+	for name := range kiStepTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (f *kiFlow) authenticateKeyboardInteractive(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	conv := &kiConversation{challenge: challenge}
+	for _, step := range f.steps {
+		if err := step.run(c, conv); err != nil {
+			return nil, err
+		}
+	}
+	if conv.perms == nil {
+		return &ssh.Permissions{}, nil
+	}
+	return conv.perms, nil
+}
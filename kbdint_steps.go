@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Built-in keyboard-interactive steps.
+func init() {
+	registerKIStep("password", newPasswordStep)
+	registerKIStep("totp", newTOTPStep)
+	registerKIStep("eula", newEULAStep)
+}
+
+// newPasswordStep prompts for a password and checks it with the regular
+// password providers, granting the permissions they return.
+func newPasswordStep(s *server, cfg *KIStepConfig) (kiStep, error) {
+	opts := struct {
+		Prompt string `yaml:"prompt"`
+	}{Prompt: "Password: "}
+	if err := cfg.decode(&opts); err != nil {
+		return nil, err
+	}
+	return kiStepFunc(func(c ssh.ConnMetadata, conv *kiConversation) error {
+		answers, err := conv.send(newChallenge("").askSecret(opts.Prompt))
+		if err != nil {
+			return err
+		}
+		perms, err := s.checkPassword(c, []byte(answers[0]))
+		if err != nil {
+			return err
+		}
+		conv.grant(perms)
+		return nil
+	}), nil
+}
+
+// newTOTPStep asks for an RFC 6238 one-time code. The shared secret is the
+// user's totp_secret; users without one fail the step.
+func newTOTPStep(s *server, cfg *KIStepConfig) (kiStep, error) {
+	opts := struct {
+		Prompt string `yaml:"prompt"`
+	}{Prompt: "Verification code: "}
+	if err := cfg.decode(&opts); err != nil {
+		return nil, err
+	}
+	return kiStepFunc(func(c ssh.ConnMetadata, conv *kiConversation) error {
+		u, ok := s.users.lookup(c.User())
+		if !ok || u.TOTPSecret == "" {
+			return errors.New("no totp_secret configured")
+		}
+		answers, err := conv.send(newChallenge("").askSecret(opts.Prompt))
+		if err != nil {
+			return err
+		}
+		valid, err := verifyTOTP(u.TOTPSecret, strings.TrimSpace(answers[0]), time.Now())
+		if err != nil {
+			return fmt.Errorf("totp_secret: %v", err)
+		}
+		if !valid {
+			return errors.New("wrong verification code")
+		}
+		return nil
+	}), nil
+}
+
+// verifyTOTP checks a 6-digit, 30-second TOTP code, allowing one step of
+// clock skew either way.
+func verifyTOTP(secret, code string, now time.Time) (bool, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return false, err
+	}
+	counter := uint64(now.Unix() / 30)
+	for _, c := range []uint64{counter - 1, counter, counter + 1} {
+		want := fmt.Sprintf("%06d", hotp(key, c))
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hotp computes an RFC 4226 6-digit code.
+func hotp(key []byte, counter uint64) uint32 {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return (binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff) % 1000000
+}
+
+// newEULAStep shows a notice and requires the user to type "yes".
+func newEULAStep(s *server, cfg *KIStepConfig) (kiStep, error) {
+	opts := struct {
+		Text string `yaml:"text"`
+	}{}
+	if err := cfg.decode(&opts); err != nil {
+		return nil, err
+	}
+	if opts.Text == "" {
+		return nil, errors.New("text is required")
+	}
+	return kiStepFunc(func(c ssh.ConnMetadata, conv *kiConversation) error {
+		answers, err := conv.send(newChallenge("Terms of use").
+			withInstruction(opts.Text).
+			ask(`Type "yes" to accept: `))
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(strings.TrimSpace(answers[0]), "yes") {
+			return errors.New("terms not accepted")
+		}
+		return nil
+	}), nil
+}
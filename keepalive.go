@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// TCPKeepAliveConfig tunes the TCP keepalive probes of accepted
+// connections, which notice clients that vanished behind a NAT or a
+// dropped link so that their sessions end. Without it Go's defaults apply:
+// probes after 15s idle, every 15s.
+//
+//	tcp_keepalive:
+//	  idle: 60s
+//	  interval: 10s
+//	  count: 3
+type TCPKeepAliveConfig struct {
+	// Enabled is true by default; false sends no probes.
+	Enabled *bool `yaml:"enabled"`
+	// Idle is how long a connection is quiet before the first probe.
+	Idle time.Duration `yaml:"idle"`
+	// Interval is the time between unanswered probes.
+	Interval time.Duration `yaml:"interval"`
+	// Count unanswered probes drop the connection.
+	Count int `yaml:"count"`
+}
+
+// newKeepAlive returns the keepalive settings of cfg. Settings left at
+// zero keep Go's defaults, or the system's where it has no say.
+func newKeepAlive(cfg TCPKeepAliveConfig) (*net.KeepAliveConfig, error) {
+	if cfg.Idle < 0 || cfg.Interval < 0 || cfg.Count < 0 {
+		return nil, fmt.Errorf("idle, interval and count must not be negative")
+	}
+	if cfg.Enabled != nil && !*cfg.Enabled {
+		return &net.KeepAliveConfig{Enable: false}, nil
+	}
+	return &net.KeepAliveConfig{Enable: true, Idle: cfg.Idle, Interval: cfg.Interval, Count: cfg.Count}, nil
+}
+
+// keepAlive applies the tcp_keepalive settings to an accepted connection.
+func (s *server) keepAlive(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if s.tcpKeepAlive == nil || !ok {
+		return
+	}
+	if err := tc.SetKeepAliveConfig(*s.tcpKeepAlive); err != nil {
+		debugf("Failed to set TCP keepalive for %s: %v", conn.RemoteAddr(), err)
+	}
+}
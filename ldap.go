@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// LDAPConfig configures authentication against an LDAP or Active Directory
+// server.
+type LDAPConfig struct {
+	URL                string `yaml:"url"`
+	StartTLS           bool   `yaml:"start_tls"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	// Service account used to search for users; empty means anonymous.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+
+	BaseDN string `yaml:"base_dn"`
+	// UserFilter selects the user entry; %s is replaced by the escaped
+	// username. Defaults to "(uid=%s)"; use "(sAMAccountName=%s)" for AD.
+	UserFilter string `yaml:"user_filter"`
+	// PublicKeyAttribute, if set, holds authorized_keys lines for the user
+	// (e.g. "sshPublicKey").
+	PublicKeyAttribute string `yaml:"public_key_attribute"`
+}
+
+// ldapProvider authenticates users by binding as them against an LDAP
+// directory, optionally reading their public keys from an attribute.
+type ldapProvider struct {
+	cfg LDAPConfig
+}
+
+func newLDAPProvider(cfg LDAPConfig) (*ldapProvider, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("ldap: url is required")
+	}
+	if cfg.BaseDN == "" {
+		return nil, errors.New("ldap: base_dn is required")
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid=%s)"
+	}
+	if !strings.Contains(cfg.UserFilter, "%s") {
+		return nil, fmt.Errorf("ldap: user_filter %q has no %%s placeholder", cfg.UserFilter)
+	}
+	return &ldapProvider{cfg: cfg}, nil
+}
+
+// dial connects to the directory and performs the service-account bind.
+func (p *ldapProvider) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.cfg.InsecureSkipVerify}
+	conn, err := ldap.DialURL(p.cfg.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if p.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if p.cfg.BindDN != "" {
+		err = conn.Bind(p.cfg.BindDN, p.cfg.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("service bind: %v", err)
+	}
+	return conn, nil
+}
+
+// findUser looks up the single entry for username.
+func (p *ldapProvider) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	var attrs []string
+	if p.cfg.PublicKeyAttribute != "" {
+		attrs = append(attrs, p.cfg.PublicKeyAttribute)
+	}
+	req := ldap.NewSearchRequest(
+		p.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(p.cfg.UserFilter, ldap.EscapeFilter(username)),
+		attrs, nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, fmt.Errorf("search: %v", err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, errUnknownUser
+	case 1:
+		return res.Entries[0], nil
+	}
+	return nil, fmt.Errorf("filter matched %d entries", len(res.Entries))
+}
+
+func (p *ldapProvider) authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	// An empty password would turn the bind into an unauthenticated one
+	if len(pass) == 0 {
+		return nil, errors.New("ldap: empty password")
+	}
+	conn, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %v", err)
+	}
+	defer conn.Close()
+
+	entry, err := p.findUser(conn, c.User())
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(entry.DN, string(pass)); err != nil {
+		return nil, fmt.Errorf("ldap: bind as %s: %v", entry.DN, err)
+	}
+	return nil, nil
+}
+
+func (p *ldapProvider) authenticatePublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if p.cfg.PublicKeyAttribute == "" {
+		return nil, errUnknownUser
+	}
+	conn, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %v", err)
+	}
+	defer conn.Close()
+
+	entry, err := p.findUser(conn, c.User())
+	if err != nil {
+		return nil, err
+	}
+	values := entry.GetAttributeValues(p.cfg.PublicKeyAttribute)
+	keys, err := parseAuthorizedKeys([]byte(strings.Join(values, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %s of %s: %v", p.cfg.PublicKeyAttribute, entry.DN, err)
+	}
+	authorized, ok := findAuthorizedKey(keys, key)
+	if !ok {
+		return nil, errors.New("ldap: key not authorized")
+	}
+	return authorized.permissions(c)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ResourceLimitsConfig caps what the shells and commands of each session
+// may use, so one user cannot exhaust the host.
+type ResourceLimitsConfig struct {
+	// MaxProcesses is RLIMIT_NPROC: how many processes the session's
+	// account may have running, which root ignores.
+	MaxProcesses uint64 `yaml:"max_processes"`
+	// MaxOpenFiles is RLIMIT_NOFILE, per process.
+	MaxOpenFiles uint64 `yaml:"max_open_files"`
+	// CPUTime is RLIMIT_CPU, per process; it is rounded up to seconds.
+	CPUTime time.Duration `yaml:"cpu_time"`
+	// Memory caps each session as a whole, all its processes together, in
+	// a cgroup v2 memory.max: bytes with an optional K, M, G or T suffix.
+	Memory string `yaml:"memory"`
+	// Cgroup is the cgroup v2 directory sessions' cgroups are created
+	// in; defaults to /sys/fs/cgroup/ssh-demo.
+	Cgroup string `yaml:"cgroup"`
+}
+
+var memoryLimit = regexp.MustCompile(`^[0-9]+[KMGT]?$`)
+
+// resourceLimits applies a ResourceLimitsConfig to sessions.
+type resourceLimits struct {
+	cfg ResourceLimitsConfig
+	seq atomic.Uint64 // names session cgroups
+}
+
+// rlimitFlags returns the run-limited flags setting the configured
+// rlimits, if any.
+func (l *resourceLimits) rlimitFlags() []string {
+	var flags []string
+	if l.cfg.MaxProcesses > 0 {
+		flags = append(flags, "-nproc", strconv.FormatUint(l.cfg.MaxProcesses, 10))
+	}
+	if l.cfg.MaxOpenFiles > 0 {
+		flags = append(flags, "-nofile", strconv.FormatUint(l.cfg.MaxOpenFiles, 10))
+	}
+	if l.cfg.CPUTime > 0 {
+		secs := (l.cfg.CPUTime + time.Second - 1) / time.Second
+		flags = append(flags, "-cpu", strconv.FormatInt(int64(secs), 10))
+	}
+	return flags
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func newResourceLimits(cfg ResourceLimitsConfig) (*resourceLimits, error) {
+	l := &resourceLimits{cfg: cfg}
+	if cfg.Memory == "" {
+		return l, nil
+	}
+	if !memoryLimit.MatchString(cfg.Memory) {
+		return nil, fmt.Errorf("resource_limits: bad memory limit %q", cfg.Memory)
+	}
+	if l.cfg.Cgroup == "" {
+		l.cfg.Cgroup = "/sys/fs/cgroup/ssh-demo"
+	}
+	// Session cgroups can only use the memory controller if their parent
+	// hands it down
+	if err := os.Mkdir(l.cfg.Cgroup, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	control := filepath.Join(l.cfg.Cgroup, "cgroup.subtree_control")
+	if err := os.WriteFile(control, []byte("+memory"), 0); err != nil {
+		return nil, fmt.Errorf("enabling the memory controller in %s: %v", l.cfg.Cgroup, err)
+	}
+	return l, nil
+}
+
+// newCgroup creates a cgroup for one session with its memory limit and
+// returns it open, for starting processes in.
+func (l *resourceLimits) newCgroup() (*os.File, error) {
+	dir := filepath.Join(l.cfg.Cgroup, "session-"+strconv.FormatUint(l.seq.Add(1), 10))
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(l.cfg.Memory), 0); err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	return f, nil
+}
+
+// startInCgroup makes cmd start inside the cgroup opened as f.
+func startInCgroup(cmd *exec.Cmd, f *os.File) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+}
+
+// removeCgroup kills the processes of the cgroup opened as f, if any, and
+// removes it.
+func removeCgroup(f *os.File) {
+	if f == nil {
+		return
+	}
+	dir := f.Name()
+	f.Close()
+	_ = os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0)
+	// Killed processes leave the cgroup once they have exited
+	for range 20 {
+		if err := os.Remove(dir); err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	warnf("Failed to remove session cgroup %s", dir)
+}
@@ -0,0 +1,95 @@
+//go:build !windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// limit prepares cmd, before it starts, to run with the session's limits:
+// inside the session's cgroup, creating it for the first process, and
+// through the run-limited helper, which sets the rlimits on itself and
+// then runs the command. Setting them from outside would need privileges
+// and race with the command.
+func (sess *session) limit(cmd *exec.Cmd) error {
+	// Containers are limited by their run_args; cmd is only the docker CLI
+	if sess.limits == nil || sess.container != "" {
+		return nil
+	}
+	if flags := sess.limits.rlimitFlags(); len(flags) > 0 {
+		if err := wrapLimited(cmd, flags, sess.account); err != nil {
+			return err
+		}
+	}
+	if sess.limits.cfg.Memory == "" {
+		return nil
+	}
+	if sess.cgroup == nil {
+		cg, err := sess.limits.newCgroup()
+		if err != nil {
+			return fmt.Errorf("creating session cgroup: %v", err)
+		}
+		sess.cgroup = cg
+	}
+	startInCgroup(cmd, sess.cgroup)
+	return nil
+}
+
+// wrapLimited makes cmd run through the run-limited helper with flags. A
+// confined command is started by the helper instead, as the binary is not
+// inside the chroot, so the helper starts as root and enters it itself.
+func wrapLimited(cmd *exec.Cmd, flags []string, account *systemAccount) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := append([]string{exe, "run-limited"}, flags...)
+	args = append(args, "--")
+	if attr := cmd.SysProcAttr; attr != nil && attr.Chroot != "" {
+		args = append(args, "-chroot", attr.Chroot, "-user", account.name, "-home", cmd.Dir, "--")
+		attr.Chroot, attr.Credential, cmd.Dir = "", nil, ""
+	}
+	// The path and argv apart, keeping argv[0] of login shells
+	cmd.Args = append(append(args, cmd.Path), cmd.Args...)
+	cmd.Path = exe
+	return nil
+}
+
+// runLimitedMain is the run-limited helper: it lowers its own rlimits to the
+// flags, enters the chroot given by the flags that follow, if any, and
+// replaces itself with the command.
+func runLimitedMain(args []string) {
+	fs := flag.NewFlagSet("run-limited", flag.ExitOnError)
+	nproc := fs.Uint64("nproc", 0, "RLIMIT_NPROC")
+	nofile := fs.Uint64("nofile", 0, "RLIMIT_NOFILE")
+	cpu := fs.Uint64("cpu", 0, "RLIMIT_CPU in seconds")
+	fs.Parse(args)
+	for resource, value := range map[int]uint64{unix.RLIMIT_NPROC: *nproc, unix.RLIMIT_NOFILE: *nofile, unix.RLIMIT_CPU: *cpu} {
+		if value == 0 {
+			continue
+		}
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: value, Max: value}); err != nil {
+			log.Fatalf("run-limited: %v", err)
+		}
+	}
+	args = enterChroot(fs.Args())
+	if len(args) < 2 {
+		log.Fatalf("usage: run-limited [flags] -- path argv0 [args]")
+	}
+	if err := syscall.Exec(args[0], args[1:], os.Environ()); err != nil {
+		log.Fatalf("run-limited: %s: %v", args[0], err)
+	}
+}
+
+// releaseCgroup kills whatever the session left running in its cgroup and
+// removes it.
+func (sess *session) releaseCgroup() {
+	removeCgroup(sess.cgroup)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ListenerConfig is an address the server accepts connections on besides
+// listen_address, with restrictions of its own on top of the server-wide
+// ones: a public port that only takes keys and forwards nothing, say, next
+// to an internal one for administrators.
+//
+//	listeners:
+//	  - address: 0.0.0.0:22
+//	    auth_methods: [publickey]
+//	    permissions:
+//	      allow_port_forwarding: false
+//	  - address: 10.0.0.5:2200
+//	    access:
+//	      allow: [10.0.0.0/8]
+//	    users: [alice, bob]
+//	    permissions:
+//	      admin: true
+type ListenerConfig struct {
+	// Address is the host:port to listen on, or unix: and the path of a
+	// Unix socket.
+	Address string `yaml:"address"`
+	// SocketMode is the octal file mode of a Unix socket, 0666 by default:
+	// the SSH login is what protects it, as with a TCP port.
+	SocketMode string `yaml:"socket_mode"`
+	// Family is ipv4 or ipv6 to accept connections of that IP version
+	// only, with IPV6_V6ONLY set for ipv6. Otherwise 0.0.0.0 and [::]
+	// alike accept both, as Go listens on them dual-stack.
+	Family string `yaml:"family"`
+	// Interface binds the listener to a network interface such as eth0,
+	// with SO_BINDTODEVICE, so it only takes connections arriving on it
+	// whatever the address. Linux only.
+	Interface string `yaml:"interface"`
+	// Access, if set, filters the listener's connections by source address,
+	// after the server-wide access list.
+	Access *AccessConfig `yaml:"access"`
+	// Users, if set, are the only users who may log in on the listener.
+	Users []string `yaml:"users"`
+	// AuthMethods, if set, are the only auth methods accepted on the
+	// listener, whatever the users' own auth_methods allow.
+	AuthMethods []string `yaml:"auth_methods"`
+	// Permissions override those of users and default_permissions for
+	// logins on the listener.
+	Permissions PermissionsConfig `yaml:"permissions"`
+	// ProxyProtocol reads the PROXY protocol header, version 1 or 2, that
+	// load balancers such as HAProxy and AWS NLB send ahead of each
+	// connection, so that the client's address is the one access lists,
+	// rate limits, logs and auth see.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// ProxyFrom, if set, are the only addresses the header is accepted
+	// from: those of the load balancers. Other connections are refused.
+	ProxyFrom []string `yaml:"proxy_from"`
+	// TLS, if set, wraps the listener's SSH in TLS.
+	TLS *ListenerTLSConfig `yaml:"tls"`
+}
+
+// unixPrefix starts the addresses of Unix sockets.
+const unixPrefix = "unix:"
+
+// checkListenAddresses checks that listen_address and the listeners'
+// addresses are host:port pairs or Unix socket paths, each listened on
+// once.
+func checkListenAddresses(cfg *Config) error {
+	seen := make(map[string]bool)
+	check := func(setting, addr string) error {
+		if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+			if path == "" {
+				return fmt.Errorf("%s: %q has no socket path", setting, addr)
+			}
+		} else if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return fmt.Errorf("%s: %q is not a host:port or unix:path", setting, addr)
+		}
+		if seen[addr] {
+			return fmt.Errorf("%s: %s is listened on twice", setting, addr)
+		}
+		seen[addr] = true
+		return nil
+	}
+	if cfg.ListenAddress != "" {
+		if err := check("listen_address", cfg.ListenAddress); err != nil {
+			return err
+		}
+	}
+	for i, l := range cfg.Listeners {
+		if err := check(fmt.Sprintf("listeners[%d]: address", i), l.Address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listener is one address the server accepts connections on. That of
+// listen_address has no restrictions of its own.
+type listener struct {
+	address     string
+	access      *accessList
+	users       map[string]bool
+	methods     map[string]bool
+	permissions PermissionsConfig
+	restricted  bool
+	socketMode  os.FileMode
+	network     string // tcp, tcp4 or tcp6
+	iface       string
+	proxy       bool
+	proxyFrom   []netip.Prefix
+	tls         *tlsFront
+}
+
+func newListener(cfg ListenerConfig) (*listener, error) {
+	l := &listener{address: cfg.Address, permissions: cfg.Permissions, restricted: true, socketMode: 0o666, proxy: cfg.ProxyProtocol}
+	if cfg.SocketMode != "" {
+		mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("socket_mode: %q is not an octal mode such as 0660", cfg.SocketMode)
+		}
+		l.socketMode = os.FileMode(mode)
+	}
+	switch cfg.Family {
+	case "":
+	case "ipv4":
+		l.network = "tcp4"
+	case "ipv6":
+		l.network = "tcp6"
+	default:
+		return nil, fmt.Errorf("family: %q is not ipv4 or ipv6", cfg.Family)
+	}
+	if cfg.Interface != "" {
+		if _, err := net.InterfaceByName(cfg.Interface); err != nil {
+			return nil, fmt.Errorf("interface: %v", err)
+		}
+		l.iface = cfg.Interface
+	}
+	if strings.HasPrefix(cfg.Address, unixPrefix) && (l.network != "" || l.iface != "") {
+		return nil, fmt.Errorf("family and interface do not apply to Unix sockets")
+	}
+	if cfg.Access != nil {
+		var err error
+		if l.access, err = newAccessList(*cfg.Access); err != nil {
+			return nil, fmt.Errorf("access: %v", err)
+		}
+	}
+	if len(cfg.Users) > 0 {
+		l.users = make(map[string]bool, len(cfg.Users))
+		for _, u := range cfg.Users {
+			l.users[u] = true
+		}
+	}
+	if err := checkMethodNames(cfg.AuthMethods); err != nil {
+		return nil, fmt.Errorf("auth_methods: %v", err)
+	}
+	if len(cfg.AuthMethods) > 0 {
+		l.methods = make(map[string]bool, len(cfg.AuthMethods))
+		for _, m := range cfg.AuthMethods {
+			l.methods[m] = true
+		}
+	}
+	if err := checkPermissions(cfg.Permissions); err != nil {
+		return nil, fmt.Errorf("permissions: %v", err)
+	}
+	if len(cfg.ProxyFrom) > 0 && !cfg.ProxyProtocol {
+		return nil, fmt.Errorf("proxy_from is set without proxy_protocol")
+	}
+	var err error
+	if l.proxyFrom, err = parsePrefixes(cfg.ProxyFrom); err != nil {
+		return nil, fmt.Errorf("proxy_from: %v", err)
+	}
+	if cfg.TLS != nil {
+		if l.tls, err = newTLSFront(*cfg.TLS); err != nil {
+			return nil, fmt.Errorf("tls: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// newListeners returns the server's listeners: listen_address, if set, then
+// those of the listeners setting.
+func newListeners(cfg *Config) ([]*listener, error) {
+	var ls []*listener
+	if cfg.ListenAddress != "" {
+		ls = append(ls, &listener{address: cfg.ListenAddress, socketMode: 0o666})
+	}
+	for _, lc := range cfg.Listeners {
+		l, err := newListener(lc)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", lc.Address, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// listen opens the listener's socket. A Unix socket left behind by an
+// earlier run is replaced.
+func (l *listener) listen() (net.Listener, error) {
+	path, ok := strings.CutPrefix(l.address, unixPrefix)
+	if !ok {
+		network := l.network
+		if network == "" {
+			network = "tcp"
+		}
+		var lc net.ListenConfig
+		if l.iface != "" {
+			lc.Control = func(_, _ string, c syscall.RawConn) error {
+				return bindToDevice(c, l.iface)
+			}
+		}
+		return lc.Listen(context.Background(), network, l.address)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	socket, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, l.socketMode); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+// localAddr is where connections over Unix sockets appear to come from and
+// arrive at, so that access lists, rate limits, logs and SSH_CONNECTION
+// treat them as local.
+const localAddr = tcpAddr("127.0.0.1:0")
+
+// accepted returns conn as the rest of the server sees it.
+func (l *listener) accepted(conn net.Conn) net.Conn {
+	if _, ok := conn.(*net.UnixConn); ok {
+		return addrConn{Conn: conn, remote: localAddr, local: localAddr}
+	}
+	return conn
+}
+
+// trustsProxy reports whether the PROXY header may come from ip.
+func (l *listener) trustsProxy(ip string) bool {
+	if len(l.proxyFrom) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && containsAddr(l.proxyFrom, addr.Unmap())
+}
+
+// permits reports whether ip may connect to the listener.
+func (l *listener) permits(ip string) bool {
+	return l.access == nil || l.access.permits(ip)
+}
+
+// check refuses user logging in with method if the listener does not
+// accept them, before any credential is checked. Anonymous logins, by the
+// "none" method, are only subject to users.
+func (l *listener) check(c ssh.ConnMetadata, method string) error {
+	if l.users != nil && !l.users[c.User()] {
+		return fmt.Errorf("%q may not log in on %s", c.User(), l.address)
+	}
+	if l.methods != nil && method != "none" && !l.methods[method] {
+		return fmt.Errorf("%s is not accepted on %s", method, l.address)
+	}
+	return nil
+}
+
+// withListener wraps the connection's credential checks to apply the
+// restrictions of the listener it arrived on. It wraps them first, so the
+// auth method policies, second factors and password changes all see the
+// listener's permissions.
+func (s *server) withListener(cfg *ssh.ServerConfig, l *listener) {
+	if !l.restricted {
+		return
+	}
+	grant := func(c ssh.ConnMetadata, method string, check func() (*ssh.Permissions, error)) (*ssh.Permissions, error) {
+		if err := l.check(c, method); err != nil {
+			return nil, err
+		}
+		perms, err := check()
+		if err != nil || perms == nil {
+			return perms, err
+		}
+		applyPermissions(perms, l.permissions, c.User())
+		return perms, nil
+	}
+
+	if password := cfg.PasswordCallback; password != nil {
+		cfg.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return grant(c, "password", func() (*ssh.Permissions, error) { return password(c, pass) })
+		}
+	}
+	if publicKey := cfg.PublicKeyCallback; publicKey != nil {
+		cfg.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return grant(c, "publickey", func() (*ssh.Permissions, error) { return publicKey(c, key) })
+		}
+	}
+	if ki := cfg.KeyboardInteractiveCallback; ki != nil {
+		cfg.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return grant(c, "keyboard-interactive", func() (*ssh.Permissions, error) { return ki(c, challenge) })
+		}
+	}
+	if gssapi := cfg.GSSAPIWithMICConfig; gssapi != nil {
+		allow := gssapi.AllowLogin
+		cfg.GSSAPIWithMICConfig = &ssh.GSSAPIWithMICConfig{
+			AllowLogin: func(c ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+				return grant(c, "gssapi-with-mic", func() (*ssh.Permissions, error) { return allow(c, srcName) })
+			},
+			Server: gssapi.Server,
+		}
+	}
+	if none := cfg.NoClientAuthCallback; none != nil {
+		cfg.NoClientAuthCallback = func(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+			return grant(c, "none", func() (*ssh.Permissions, error) { return none(c) })
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LockoutConfig configures locking accounts (rather than IPs) after
+// repeated auth failures.
+type LockoutConfig struct {
+	// MaxFailures consecutive failed attempts lock the account; defaults
+	// to 10. A successful login resets the count, as does a pause of
+	// LockTime (15 minutes if that is zero) after the last failure.
+	MaxFailures int `yaml:"max_failures"`
+	// LockTime is how long the account stays locked; zero means until an
+	// admin unlocks it.
+	LockTime time.Duration `yaml:"lock_time"`
+	// StateFile persists locked accounts across restarts.
+	StateFile string `yaml:"state_file"`
+}
+
+// defaultFailureWindow is how long failures count towards a lock when
+// locks do not expire.
+const defaultFailureWindow = 15 * time.Minute
+
+// accountLockout tracks consecutive failures and locks per username.
+// Failures are forgotten after the failure window, so names tried once,
+// such as those of a spraying client, do not pile up.
+type accountLockout struct {
+	cfg    LockoutConfig
+	window time.Duration
+
+	mu       sync.Mutex
+	failures map[string]failureCount
+	locked   map[string]time.Time // user -> lock expiry; zero never expires
+	swept    time.Time
+}
+
+// failureCount is the consecutive failures of a username and when the last
+// one was.
+type failureCount struct {
+	n    int
+	last time.Time
+}
+
+func newAccountLockout(cfg LockoutConfig) (*accountLockout, error) {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 10
+	}
+	l := &accountLockout{
+		cfg:      cfg,
+		window:   cfg.LockTime,
+		failures: make(map[string]failureCount),
+		locked:   make(map[string]time.Time),
+	}
+	if l.window <= 0 {
+		l.window = defaultFailureWindow
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load restores unexpired locks from the state file.
+func (l *accountLockout) load() error {
+	if l.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var locked map[string]time.Time
+	if err := json.Unmarshal(data, &locked); err != nil {
+		return fmt.Errorf("%s: %v", l.cfg.StateFile, err)
+	}
+	now := time.Now()
+	for name, until := range locked {
+		if until.IsZero() || until.After(now) {
+			l.locked[name] = until
+		}
+	}
+	return nil
+}
+
+// save writes the locked accounts to the state file. Callers hold l.mu.
+func (l *accountLockout) save() {
+	if l.cfg.StateFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(l.locked, "", "  ")
+	if err == nil {
+		tmp := l.cfg.StateFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, l.cfg.StateFile)
+		}
+	}
+	if err != nil {
+		warnf("Failed to save account locks to %s: %v", l.cfg.StateFile, err)
+	}
+}
+
+// isLocked reports whether the account is currently locked.
+func (l *accountLockout) isLocked(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.locked[name]
+	if ok && !until.IsZero() && time.Now().After(until) {
+		delete(l.locked, name)
+		l.save()
+		return false
+	}
+	return ok
+}
+
+// failure records a failed attempt and reports whether it locked the
+// account.
+func (l *accountLockout) failure(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	f := l.failures[name]
+	if now.Sub(f.last) > l.window {
+		f.n = 0
+	}
+	f.n++
+	f.last = now
+	if f.n < l.cfg.MaxFailures {
+		l.failures[name] = f
+		return false
+	}
+	delete(l.failures, name)
+	var until time.Time
+	if l.cfg.LockTime > 0 {
+		until = now.Add(l.cfg.LockTime)
+	}
+	l.locked[name] = until
+	l.save()
+	return true
+}
+
+// sweep forgets, once per failure window, the failures older than it and
+// the locks that have expired. Callers hold l.mu.
+func (l *accountLockout) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+	for name, f := range l.failures {
+		if now.Sub(f.last) > l.window {
+			delete(l.failures, name)
+		}
+	}
+	expired := false
+	for name, until := range l.locked {
+		if !until.IsZero() && now.After(until) {
+			delete(l.locked, name)
+			expired = true
+		}
+	}
+	if expired {
+		l.save()
+	}
+}
+
+// success resets the failure count after a successful login.
+func (l *accountLockout) success(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, name)
+}
+
+// unlock lifts the lock on an account and reports whether there was one.
+func (l *accountLockout) unlock(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, name)
+	if _, ok := l.locked[name]; !ok {
+		return false
+	}
+	delete(l.locked, name)
+	l.save()
+	return true
+}
+
+func init() {
+	registerAdminCommand("locked", "locked", "list locked accounts", func(s *server, args []string, w io.Writer) error {
+		if s.lockout == nil {
+			return errors.New("account lockout is not enabled")
+		}
+		s.lockout.mu.Lock()
+		defer s.lockout.mu.Unlock()
+		names := make([]string, 0, len(s.lockout.locked))
+		for name := range s.lockout.locked {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			until := "until unlocked"
+			if t := s.lockout.locked[name]; !t.IsZero() {
+				until = "until " + t.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\n", name, until)
+		}
+		return nil
+	})
+	registerAdminCommand("unlock", "unlock <user>", "unlock a locked account", func(s *server, args []string, w io.Writer) error {
+		if s.lockout == nil {
+			return errors.New("account lockout is not enabled")
+		}
+		if len(args) != 1 {
+			return errors.New("usage: unlock <user>")
+		}
+		if !s.lockout.unlock(args[0]) {
+			return fmt.Errorf("%s is not locked", args[0])
+		}
+		infof("Admin unlocked account %q", args[0])
+		fmt.Fprintf(w, "unlocked %s\n", args[0])
+		return nil
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// logLevel is how much the server logs: warnings only, activity as well
+// (the default), or also the details of each authentication attempt.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+)
+
+// currentLogLevel is the log_level setting, set before serving.
+var currentLogLevel = levelInfo
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "debug":
+		return levelDebug, nil
+	case "", "info":
+		return levelInfo, nil
+	case "warn":
+		return levelWarn, nil
+	}
+	return 0, fmt.Errorf("log_level: %q is not debug, info or warn", s)
+}
+
+func (l logLevel) String() string {
+	return [...]string{"debug", "info", "warn"}[l]
+}
+
+func logf(level logLevel, format string, args ...any) {
+	if level >= currentLogLevel {
+		_ = log.Output(3, fmt.Sprintf(format, args...))
+	}
+}
+
+// debugf logs what is only of interest when tracking down a problem.
+func debugf(format string, args ...any) { logf(levelDebug, format, args...) }
+
+// infof logs what the server and its clients do.
+func infof(format string, args ...any) { logf(levelInfo, format, args...) }
+
+// warnf logs failures and settings that do not work out; log.Fatalf is
+// for those the server cannot start with.
+func warnf(format string, args ...any) { logf(levelWarn, format, args...) }
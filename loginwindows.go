@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LoginWindow is a weekly period during which a user may log in, e.g.
+//
+//	login_windows:
+//	  - days: [mon-fri]
+//	    from: "08:00"
+//	    to: "18:00"
+//	    timezone: Europe/Berlin
+//
+// A window whose to is earlier than from runs past midnight into the next
+// day.
+type LoginWindow struct {
+	// Days are day names ("mon", "tuesday") or ranges ("mon-fri"); empty
+	// means every day.
+	Days []string `yaml:"days"`
+	// From and To are HH:MM; To may be "24:00".
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// Timezone is an IANA zone name; defaults to the server's local time.
+	Timezone string `yaml:"timezone"`
+}
+
+// loginWindow is a parsed LoginWindow; times are minutes after midnight.
+type loginWindow struct {
+	cfg      LoginWindow
+	days     [7]bool
+	from, to int
+	loc      *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseLoginWindow(cfg LoginWindow) (*loginWindow, error) {
+	w := &loginWindow{cfg: cfg, loc: time.Local}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		w.loc = loc
+	}
+
+	var err error
+	if w.from, err = parseClock(cfg.From, "00:00"); err != nil {
+		return nil, fmt.Errorf("from: %v", err)
+	}
+	if w.to, err = parseClock(cfg.To, "24:00"); err != nil {
+		return nil, fmt.Errorf("to: %v", err)
+	}
+	if w.from == w.to {
+		return nil, fmt.Errorf("window %s-%s is empty", cfg.From, cfg.To)
+	}
+
+	if len(cfg.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, d := range cfg.Days {
+		first, last, isRange := strings.Cut(d, "-")
+		start, err := parseWeekday(first)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = parseWeekday(last); err != nil {
+				return nil, err
+			}
+		}
+		for day := start; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == end {
+				break
+			}
+		}
+	}
+	return w, nil
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) >= 3 {
+		if d, ok := weekdays[name[:3]]; ok && strings.HasPrefix(strings.ToLower(d.String()), name) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q", name)
+}
+
+// parseClock parses HH:MM into minutes after midnight.
+func parseClock(s, def string) (int, error) {
+	if s == "" {
+		s = def
+	}
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("%q is not a HH:MM time", s)
+	}
+	return h*60 + m, nil
+}
+
+// allows reports whether t falls inside the window.
+func (w *loginWindow) allows(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	if w.from < w.to {
+		return w.days[t.Weekday()] && minute >= w.from && minute < w.to
+	}
+	// Past midnight: the evening part belongs to today, the early morning
+	// part to the day before
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && minute >= w.from) || (w.days[yesterday] && minute < w.to)
+}
+
+func (w *loginWindow) String() string {
+	days := "every day"
+	if len(w.cfg.Days) > 0 {
+		days = strings.Join(w.cfg.Days, ",")
+	}
+	from, to := w.cfg.From, w.cfg.To
+	if from == "" {
+		from = "00:00"
+	}
+	if to == "" {
+		to = "24:00"
+	}
+	return fmt.Sprintf("%s %s-%s (%s)", days, from, to, w.loc)
+}
+
+// loginAllowed reports whether u may log in at t. Users without windows may
+// always log in.
+func (u *user) loginAllowed(t time.Time) bool {
+	if len(u.windows) == 0 {
+		return true
+	}
+	for _, w := range u.windows {
+		if w.allows(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// windowNotice describes u's login windows for the pre-auth banner.
+func (u *user) windowNotice() string {
+	names := make([]string, len(u.windows))
+	for i, w := range u.windows {
+		names[i] = w.String()
+	}
+	return fmt.Sprintf("Logins for %s are only allowed %s.\n", u.Name, strings.Join(names, "; "))
+}
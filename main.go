@@ -1,266 +1,834 @@
 package main
 
 import (
-	"fmt"
-	"io"
+	"errors"
+	"flag"
 	"log"
 	"net"
 	"os"
-	"os/exec"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	pty "github.com/creack/pty"
 	"golang.org/x/crypto/ssh"
 )
 
-const (
-	serverAddr      = "0.0.0.0:2222"
-	allowedUser     = "testuser"
-	allowedPassword = "secret123"
-)
+// configFile is the configuration file, set by -config.
+var configFile = "config.yaml"
+
+// server holds the state shared by every connection.
+type server struct {
+	config *ssh.ServerConfig
+	users  *userDB
+	auth   authChain
+	gssapi *gssapiProvider
+	tokens *tokenStore
+
+	anonymous *anonymousAuth
+	approval  *approvalGate
+	passwords *passwordChanges
+
+	maintenance *maintenanceMode
+
+	// cfg is the configuration last read, by readConfig, and reloadMu
+	// serializes reloads
+	cfg        *Config
+	readConfig func() (*Config, error)
+	reloadMu   sync.Mutex
+	// policy holds the settings a reload replaces, steps the auth method
+	// policies and banner the pre-auth banner, if any
+	policy atomic.Pointer[serverPolicy]
+	steps  atomic.Pointer[authSteps]
+	banner atomic.Pointer[banners]
+
+	subsystems        map[string]subsystemHandler
+	sessions          sessionCounts
+	live              liveSessions
+	conns             openConns
+	handoffMu         sync.Mutex
+	sockets           []net.Listener // those handed over on a restart
+	handedOff         bool
+	retired           chan struct{} // closed once a restart leaves no connections
+	bandwidth         userThrottles
+	runAsUsers        bool // sessions run as the users' system accounts
+	requireSystemUser bool
+	loginUIDs         *uidPool
+
+	tcpKeepAlive *net.KeepAliveConfig
+	connLimits   *connLimits
+	hostKeys     *hostKeyUpdates
+
+	access  *accessList
+	limiter *rateLimiter
+	bans    *banList
+	lockout *accountLockout
+	audit   *auditLog
+	devices *deviceTracker
+	motd    *loginMessages
+	utmp    *loginRecorder
+	detach  *detachedSessions
+	limits  *resourceLimits
+
+	containers *containers
+	git        *gitHost
+	bastion    *bastion
+	privsep    *privsep
+	recordings *sessionRecordings
+}
 
 func main() {
-	// Load server's private key (generate one if needed)
-	privateBytes, err := os.ReadFile("id_rsa")
+	if path, ok := os.LookupEnv(envPrefix + "CONFIG"); ok {
+		configFile = path
+	}
+	flag.StringVar(&configFile, "config", configFile, "configuration `file` ("+envPrefix+"CONFIG)")
+	// These override the configuration file's settings of the same name,
+	// and the environment's
+	listen := flag.String("listen", "", "`address` to listen on, as host:port (listen_address)")
+	hostKey := flag.String("host-key", "", "host private key `file` (host_key)")
+	authorizedKeys := flag.String("authorized-keys", "", "authorized_keys `file` of users without keys, %u for the username (authorized_keys_file)")
+	level := flag.String("log-level", "", "log `level`: debug, info or warn (log_level)")
+	flag.Parse()
+	args := flag.Args()
+
+	// "admin <command>" talks to a running server instead of starting one
+	if len(args) > 0 && args[0] == "admin" {
+		adminMain(args[1:])
+		return
+	}
+	// Helpers serve file transfers with a session account's privileges
+	if len(args) > 0 && args[0] == "sftp-server" {
+		sftpServerMain(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "scp-server" {
+		scpServerMain(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "run-limited" {
+		runLimitedMain(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "bastion-menu" {
+		bastionMenuMain(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == internalShell {
+		internalShellMain(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "privsep-child" {
+		privsepChildMain(args[1:])
+		return
+	}
+
+	load := func() (*Config, error) {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range []struct{ flag, setting *string }{
+			{listen, &cfg.ListenAddress}, {hostKey, &cfg.HostKey},
+			{authorizedKeys, &cfg.AuthorizedKeysFile}, {level, &cfg.LogLevel},
+		} {
+			if *o.flag != "" {
+				*o.setting = *o.flag
+			}
+		}
+		return cfg, nil
+	}
+	cfg, err := load()
 	if err != nil {
-		log.Fatalf("Failed to load private key (id_rsa): %v", err)
+		log.Fatalf("Failed to load config (%s): %v", configFile, err)
+	}
+	if currentLogLevel, err = parseLogLevel(cfg.LogLevel); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	var vault *vaultClient
+	if cfg.Vault != nil {
+		vault, err = newVaultClient(*cfg.Vault)
+		if err != nil {
+			log.Fatalf("Invalid Vault configuration: %v", err)
+		}
+		go vault.renewToken()
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
+	// Load the server's host keys; one from Vault replaces host_key
+	var hostKeys []ssh.Signer
+	keyFiles := cfg.HostKeys
+	if vault != nil && cfg.Vault.HostKeyPath != "" {
+		private, err := vault.hostKey()
+		if err != nil {
+			log.Fatalf("Failed to load host key from Vault: %v", err)
+		}
+		infof("Loaded host key from Vault (%s)", cfg.Vault.HostKeyPath)
+		hostKeys = append(hostKeys, private)
+	} else if cfg.HostKey != "" {
+		keyFiles = append([]string{cfg.HostKey}, keyFiles...)
+	}
+	fileKeys, err := loadHostKeys(keyFiles)
 	if err != nil {
-		log.Fatalf("Failed to parse private key: %v", err)
+		log.Fatalf("Failed to load host key: %v", err)
+	}
+	hostKeys = append(hostKeys, fileKeys...)
+	if err := checkHostKeyTypes(hostKeys); err != nil {
+		log.Fatalf("Invalid host keys: %v", err)
+	}
+	for _, k := range hostKeys {
+		infof("Host key %s %s", k.PublicKey().Type(), ssh.FingerprintSHA256(k.PublicKey()))
+	}
+	nextKeys, err := loadHostKeys(cfg.NextHostKeys)
+	if err != nil {
+		log.Fatalf("Failed to load next host key: %v", err)
+	}
+	if err := checkHostKeyTypes(nextKeys); err != nil {
+		log.Fatalf("Invalid next host keys: %v", err)
+	}
+	for _, k := range nextKeys {
+		infof("Announcing next host key %s %s", k.PublicKey().Type(), ssh.FingerprintSHA256(k.PublicKey()))
 	}
 
-	// Load allowed public key for key-based auth
-	authorizedKeyBytes, err := os.ReadFile("id_rsa.pub")
+	// Load the user database
+	users, err := newUserDB(cfg.Users, cfg.AuthorizedKeysFile)
 	if err != nil {
-		log.Printf("Public key not found, key-based auth will be disabled: %v", err)
+		log.Fatalf("Invalid user configuration: %v", err)
 	}
+	infof("Loaded %d user(s) from %s", len(users.names()), configFile)
 
-	// SSH server config
-	config := &ssh.ServerConfig{
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			if c.User() == allowedUser && string(pass) == allowedPassword {
-				return nil, nil
+	steps, err := newAuthSteps(cfg.Users, cfg.Groups)
+	if err != nil {
+		log.Fatalf("Invalid auth method configuration: %v", err)
+	}
+
+	srv := &server{users: users, cfg: cfg, readConfig: load, retired: make(chan struct{})}
+	srv.hostKeys = &hostKeyUpdates{keys: append(hostKeys, nextKeys...)}
+	srv.steps.Store(steps)
+	policy, err := newServerPolicy(cfg)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	srv.policy.Store(policy)
+	if copyBufferSize, err = parseCopyBuffer(cfg.CopyBuffer); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if srv.subsystems, err = newSubsystems(cfg.Subsystems); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if os.Geteuid() == 0 {
+		srv.runAsUsers, srv.requireSystemUser = true, cfg.RequireSystemUser == nil || *cfg.RequireSystemUser
+		infof("Running as root: sessions run as the users' system accounts")
+		if !srv.requireSystemUser {
+			warnf("require_system_user is off: sessions of users without a system account run as root")
+		}
+		if cfg.Anonymous != nil || cfg.PrivilegeSeparation != nil {
+			if srv.loginUIDs, err = newUIDPool(cfg.LoginUIDs); err != nil {
+				log.Fatalf("Invalid configuration: %v", err)
 			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
-		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			if authorizedKeyBytes == nil {
-				return nil, fmt.Errorf("no public key auth configured")
+		}
+	}
+	srv.passwords, err = newPasswordChanges(cfg.PasswordChange, users)
+	if err != nil {
+		log.Fatalf("Failed to load password changes: %v", err)
+	}
+	srv.maintenance = newMaintenanceMode(cfg.Maintenance, &srv.live)
+	if cfg.Maintenance.Enabled {
+		infof("Starting in maintenance mode")
+	}
+	if cfg.AuditLog != "" {
+		srv.audit, err = openAuditLog(cfg.AuditLog)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		infof("Writing auth audit records to %s", cfg.AuditLog)
+	}
+	if cfg.Access != nil {
+		srv.access, err = newAccessList(*cfg.Access)
+		if err != nil {
+			log.Fatalf("Invalid access configuration: %v", err)
+		}
+	}
+	if cfg.MaxConnections != 0 || cfg.MaxConnectionsPerIP != 0 || cfg.ConnectionQueueTimeout != 0 {
+		srv.connLimits, err = newConnLimits(cfg.MaxConnections, cfg.MaxConnectionsPerIP, cfg.ConnectionQueueTimeout)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+	}
+	if cfg.TCPKeepAlive != nil {
+		srv.tcpKeepAlive, err = newKeepAlive(*cfg.TCPKeepAlive)
+		if err != nil {
+			log.Fatalf("Invalid TCP keepalive configuration: %v", err)
+		}
+	}
+	if cfg.RateLimit != nil {
+		srv.limiter = newRateLimiter(*cfg.RateLimit)
+	}
+	if cfg.Ban != nil {
+		srv.bans, err = newBanList(*cfg.Ban)
+		if err != nil {
+			log.Fatalf("Failed to load bans: %v", err)
+		}
+	}
+	if cfg.Lockout != nil {
+		srv.lockout, err = newAccountLockout(*cfg.Lockout)
+		if err != nil {
+			log.Fatalf("Failed to load account locks: %v", err)
+		}
+	}
+	if cfg.DeviceTracking != nil {
+		srv.devices, err = newDeviceTracker(*cfg.DeviceTracking)
+		if err != nil {
+			log.Fatalf("Failed to load device tracking state: %v", err)
+		}
+		infof("Tracking login devices in %s", srv.devices.cfg.StateFile)
+	}
+	if cfg.Container != nil {
+		srv.containers, err = newContainers(*cfg.Container)
+		if err != nil {
+			log.Fatalf("Invalid container configuration: %v", err)
+		}
+		infof("Sessions run in %s containers", cfg.Container.Image)
+	}
+	if cfg.Git != nil {
+		srv.git, err = newGitHost(*cfg.Git)
+		if err != nil {
+			log.Fatalf("Invalid git configuration: %v", err)
+		}
+		infof("Serving git repositories from %s", cfg.Git.Root)
+	}
+	if cfg.Bastion != nil {
+		srv.bastion, err = newBastion(*cfg.Bastion)
+		if err != nil {
+			log.Fatalf("Invalid bastion configuration: %v", err)
+		}
+		infof("Bastion serving %d jump targets", len(cfg.Bastion.Targets))
+	}
+	if cfg.ResourceLimits != nil {
+		srv.limits, err = newResourceLimits(*cfg.ResourceLimits)
+		if err != nil {
+			log.Fatalf("Invalid resource limits: %v", err)
+		}
+	}
+	if cfg.Utmp != nil {
+		srv.utmp = newLoginRecorder(*cfg.Utmp)
+	}
+	if cfg.Detach != nil {
+		srv.detach, err = newDetachedSessions(*cfg.Detach)
+		if err != nil {
+			log.Fatalf("Invalid detach configuration: %v", err)
+		}
+	}
+	if cfg.SessionRecording != nil {
+		srv.recordings, err = newSessionRecordings(*cfg.SessionRecording)
+		if err != nil {
+			log.Fatalf("Invalid session_recording configuration: %v", err)
+		}
+	}
+	if cfg.PrivilegeSeparation != nil {
+		if !srv.runAsUsers {
+			warnf("privilege_separation has no effect: the server does not run as root")
+		} else {
+			if err := privsepConflicts(cfg); err != nil {
+				log.Fatalf("Invalid privilege separation configuration: %v", err)
 			}
-			authorizedKey, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKeyBytes)
+			srv.privsep, err = newPrivsep(cfg.Subsystems)
 			if err != nil {
-				return nil, fmt.Errorf("invalid public key format")
+				log.Fatalf("Invalid privilege separation configuration: %v", err)
 			}
-			if string(key.Marshal()) == string(authorizedKey.Marshal()) {
-				return nil, nil
+			infof("Privilege separation: sessions are served by unprivileged children")
+		}
+	}
+	if cfg.LoginMessage != nil {
+		srv.motd, err = newLoginMessages(*cfg.LoginMessage)
+		if err != nil {
+			log.Fatalf("Failed to load last logins: %v", err)
+		}
+	}
+	if cfg.APITokens != nil {
+		// Ahead of the user database, which would reject a token as a
+		// wrong password
+		srv.tokens, err = newTokenStore(*cfg.APITokens)
+		if err != nil {
+			log.Fatalf("Invalid API token configuration: %v", err)
+		}
+		srv.auth.add(srv.tokens)
+		infof("Accepting %d API token(s) from %s", len(srv.tokens.tokens), cfg.APITokens.File)
+	}
+	srv.auth.add(users)
+	if cfg.Htpasswd != nil {
+		p, err := newHtpasswdProvider(*cfg.Htpasswd)
+		if err != nil {
+			log.Fatalf("Invalid htpasswd configuration: %v", err)
+		}
+		srv.auth.add(p)
+		infof("Loaded %d credential(s) from %s", p.count(), cfg.Htpasswd.File)
+	}
+	if cfg.Shadow != nil {
+		p, err := newShadowProvider(*cfg.Shadow)
+		if err != nil {
+			log.Fatalf("Invalid shadow configuration: %v", err)
+		}
+		srv.auth.add(p)
+		infof("Authenticating system accounts from %s", p.cfg.ShadowFile)
+	}
+	if vault != nil && cfg.Vault.UsersPath != "" {
+		p, err := newVaultProvider(vault)
+		if err != nil {
+			log.Fatalf("Failed to load credentials from Vault: %v", err)
+		}
+		srv.auth.add(p)
+		infof("Loaded %d credential(s) from Vault (%s)", p.count(), cfg.Vault.UsersPath)
+	}
+	if cfg.TrustedUserCAKeys != "" {
+		p, err := newCertAuthorityProvider(cfg.TrustedUserCAKeys, cfg.AuthorizedPrincipalsFile, users)
+		if err != nil {
+			log.Fatalf("Failed to load trusted user CA keys (%s): %v", cfg.TrustedUserCAKeys, err)
+		}
+		srv.auth.add(p)
+		infof("Accepting user certificates from %d CA key(s)", len(p.authorities))
+	}
+	if cfg.LDAP != nil {
+		p, err := newLDAPProvider(*cfg.LDAP)
+		if err != nil {
+			log.Fatalf("Invalid LDAP configuration: %v", err)
+		}
+		srv.auth.add(p)
+		infof("LDAP authentication enabled (%s)", cfg.LDAP.URL)
+	}
+	if cfg.OSLogin != nil {
+		p, err := newOSLoginProvider(*cfg.OSLogin)
+		if err != nil {
+			log.Fatalf("Invalid OS Login configuration: %v", err)
+		}
+		srv.auth.add(p)
+		infof("OS Login public keys enabled (%s)", p.cfg.URL)
+	}
+	if cfg.SQL != nil {
+		p, err := newSQLProvider(*cfg.SQL)
+		if err != nil {
+			log.Fatalf("Invalid SQL configuration: %v", err)
+		}
+		srv.auth.add(p)
+		infof("SQL authentication enabled (%s, table %s)", cfg.SQL.Driver, p.table)
+	}
+	if cfg.Webhook != nil {
+		p, err := newWebhookProvider(*cfg.Webhook)
+		if err != nil {
+			log.Fatalf("Invalid webhook configuration: %v", err)
+		}
+		srv.auth.add(p)
+		infof("Webhook authentication enabled (%s)", cfg.Webhook.URL)
+	}
+	if cfg.OIDC != nil {
+		p, err := newOIDCProvider(*cfg.OIDC)
+		if err != nil {
+			log.Fatalf("Invalid OIDC configuration: %v", err)
+		}
+		srv.auth.add(p)
+		infof("OIDC device-code login enabled (%s)", cfg.OIDC.Issuer)
+	}
+	if cfg.GSSAPI != nil {
+		srv.gssapi, err = newGSSAPIProvider(*cfg.GSSAPI)
+		if err != nil {
+			log.Fatalf("Invalid GSSAPI configuration: %v", err)
+		}
+		infof("GSSAPI (Kerberos) authentication enabled (%s)", cfg.GSSAPI.Keytab)
+	}
+	if cfg.Anonymous != nil {
+		srv.anonymous, err = newAnonymousAuth(*cfg.Anonymous, users)
+		if err != nil {
+			log.Fatalf("Invalid anonymous configuration: %v", err)
+		}
+		if cfg.Anonymous.Ephemeral {
+			if srv.loginUIDs == nil {
+				log.Fatalf("Invalid anonymous configuration: ephemeral guests need the server to run as root, so that each runs as a uid of its own")
 			}
-			return nil, fmt.Errorf("unknown public key for %q", c.User())
-		},
+			infof("Ephemeral guest accounts enabled for %s* names (homes in %s)", srv.anonymous.cfg.EphemeralPrefix, srv.anonymous.cfg.EphemeralRoot)
+		} else {
+			infof("Anonymous logins enabled for %v (sandbox in %s)", srv.anonymous.cfg.Users, srv.anonymous.cfg.Home)
+		}
+	}
+	if len(cfg.KeyboardInteractive) > 0 {
+		flow, err := newKIFlow(srv, cfg.KeyboardInteractive)
+		if err != nil {
+			log.Fatalf("Invalid keyboard_interactive configuration: %v", err)
+		}
+		srv.auth.add(flow)
+		infof("Keyboard-interactive flow enabled (%d step(s))", len(flow.steps))
+	}
+
+	if cfg.SecondFactor != nil {
+		srv.approval, err = newApprovalGate(cfg.SecondFactor)
+		if err != nil {
+			log.Fatalf("Invalid second_factor configuration: %v", err)
+		}
+		infof("Second factor approval required (%s, timeout %v)", cfg.SecondFactor.Type, srv.approval.timeout)
+	}
+	if cfg.Banner != nil {
+		b, err := newBanners(*cfg.Banner)
+		if err != nil {
+			log.Fatalf("Invalid banner configuration: %v", err)
+		}
+		srv.banner.Store(b)
+	}
+
+	// SSH server config
+	srv.config = &ssh.ServerConfig{
+		PasswordCallback:  srv.passwordCallback,
+		PublicKeyCallback: srv.publicKeyCallback,
+		MaxAuthTries:      cfg.MaxAuthTries,
+		BannerCallback:    srv.bannerCallback,
+	}
+	if len(srv.auth.keyboardInteractive) > 0 {
+		srv.config.KeyboardInteractiveCallback = srv.keyboardInteractiveCallback
+	}
+	if srv.anonymous != nil {
+		srv.config.NoClientAuth = true
+		srv.config.NoClientAuthCallback = srv.noClientAuthCallback
+	}
+	if srv.config.ServerVersion, err = parseServerVersion(cfg.ServerVersion); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	rekey, err := parseByteRate(cfg.RekeyLimit)
+	if err != nil {
+		log.Fatalf("Invalid configuration: rekey_limit: %v", err)
+	}
+	srv.config.RekeyThreshold = uint64(rekey)
+	if cfg.Algorithms != nil {
+		if err := applyAlgorithms(srv.config, *cfg.Algorithms); err != nil {
+			log.Fatalf("Invalid algorithms configuration: %v", err)
+		}
+	}
+	for _, k := range hostKeys {
+		srv.config.AddHostKey(k)
+	}
+	if cfg.HostCertificate != "" {
+		certSigner, err := loadHostCertSigner(cfg.HostCertificate, hostKeys)
+		if err != nil {
+			log.Fatalf("Failed to load host certificate (%s): %v", cfg.HostCertificate, err)
+		}
+		srv.config.AddHostKey(certSigner)
+		infof("Presenting host certificate %s", cfg.HostCertificate)
+	}
+
+	if cfg.AdminSocket != "" {
+		if err := srv.serveAdmin(cfg.AdminSocket); err != nil {
+			log.Fatalf("Failed to listen on admin socket %s: %v", cfg.AdminSocket, err)
+		}
+		infof("Admin socket listening on %s", cfg.AdminSocket)
 	}
-	config.AddHostKey(private)
 
-	// Start listening
-	listener, err := net.Listen("tcp", serverAddr)
+	// Start listening, on every address before serving any
+	listeners, err := newListeners(cfg)
+	if err != nil {
+		log.Fatalf("Invalid listeners configuration: %v", err)
+	}
+	inherited, err := systemdSockets()
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", serverAddr, err)
+		log.Fatalf("Failed to use the sockets passed by systemd: %v", err)
 	}
-	log.Printf("SSH server listening on %s", serverAddr)
+	handedOver, ready, err := handedOffSockets()
+	if err != nil {
+		log.Fatalf("Failed to use the sockets handed over by the previous server: %v", err)
+	}
+	var sockets []net.Listener
+	switch {
+	case len(inherited) > 0:
+		listeners, sockets = activated(listeners, inherited)
+	case handedOver != nil:
+		if sockets, err = adoptSockets(listeners, handedOver); err != nil {
+			log.Fatalf("%v", err)
+		}
+	default:
+		sockets = make([]net.Listener, len(listeners))
+		for i, l := range listeners {
+			if sockets[i], err = l.listen(); err != nil {
+				log.Fatalf("Failed to listen on %s: %v", l.address, err)
+			}
+			infof("SSH server listening on %s", l.address)
+		}
+	}
+	if cfg.Tor != nil {
+		onion, err := newOnionService(*cfg.Tor, listeners)
+		if err != nil {
+			log.Fatalf("Invalid tor configuration: %v", err)
+		}
+		go onion.publish()
+	}
+	go srv.reloadOnHangup()
 
+	for i, l := range listeners {
+		go srv.serve(sockets[i], l)
+	}
+	srv.handoffMu.Lock()
+	srv.sockets = sockets
+	srv.handoffMu.Unlock()
+	go srv.restartOnSignal()
+	if ready != nil {
+		ready()
+	}
+	drain := cfg.DrainTimeout
+	if drain <= 0 {
+		drain = defaultDrainTimeout
+	}
+	srv.drainOnTerm(sockets, drain)
+}
+
+// serve accepts the connections of l until its socket is closed on shutdown.
+func (s *server) serve(socket net.Listener, l *listener) {
 	for {
-		conn, err := listener.Accept()
+		conn, err := socket.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// Shutting down
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to accept incoming connection: %v", err)
+			warnf("Failed to accept incoming connection on %s: %v", l.address, err)
 			continue
 		}
 
-		go handleConn(conn, config)
+		s.keepAlive(conn)
+		go s.handleConn(l.accepted(conn), l)
 	}
 }
 
-func handleConn(conn net.Conn, config *ssh.ServerConfig) {
+func (s *server) handleConn(conn net.Conn, ln *listener) {
 	defer conn.Close()
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	accepted := conn
+	defer s.conns.add(accepted)()
+	if ln.proxy {
+		if !ln.trustsProxy(remoteIP(conn.RemoteAddr())) {
+			infof("Rejecting connection from %s: not a proxy trusted on %s", conn.RemoteAddr(), ln.address)
+			return
+		}
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			infof("Rejecting connection from %s on %s: %v", conn.RemoteAddr(), ln.address, err)
+			return
+		}
+		debugf("Connection from %s proxied for %s", conn.RemoteAddr(), proxied.RemoteAddr())
+		conn = proxied
+	}
+	ip := remoteIP(conn.RemoteAddr())
+	if s.access != nil && !s.access.permits(ip) {
+		infof("Rejecting connection from %s: not permitted by access list", conn.RemoteAddr())
+		return
+	}
+	if !ln.permits(ip) {
+		infof("Rejecting connection from %s: not permitted on %s", conn.RemoteAddr(), ln.address)
+		return
+	}
+	if ln.tls != nil {
+		inner, err := ln.tls.accept(conn)
+		if err != nil {
+			infof("Rejecting connection from %s on %s: %v", conn.RemoteAddr(), ln.address, err)
+			return
+		}
+		if inner == nil {
+			return
+		}
+		conn = inner
+	}
+	if s.connLimits != nil {
+		release, err := s.connLimits.admit(ip)
+		if err != nil {
+			infof("Rejecting connection from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		defer release()
+	}
+	if s.bans != nil && s.bans.banned(ip) {
+		infof("Rejecting connection from banned address %s", conn.RemoteAddr())
+		return
+	}
+	if s.limiter != nil && s.limiter.blocked(ip) {
+		infof("Rejecting connection from blocked address %s", conn.RemoteAddr())
+		return
+	}
+	state := &connAuth{listener: ln}
+	loggedIn := limitLogin(conn, s.policy.Load().loginGrace)
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.connConfig(state))
+	loggedIn()
 	if err != nil {
-		log.Printf("Handshake failed: %v", err)
+		// This includes exceeding MaxAuthTries; the deferred Close drops
+		// the TCP connection
+		infof("Handshake failed: %v", err)
+		return
+	}
+	infof("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
+	s.conns.authenticated(accepted)
+	s.hostKeys.announce(sshConn)
+	reqs = s.hostKeys.intercept(sshConn, reqs)
+	if s.devices != nil {
+		s.devices.login(sshConn.User(), ip, state.authKey)
+	}
+
+	// Users authenticated by an external provider get the settings it
+	// supplied, or defaults
+	u, ok := s.users.lookup(sshConn.User())
+	if !ok {
+		u = externalUser(sshConn.User(), sshConn.Permissions)
+	}
+	var guest *guestAccount
+	if root, ok := ephemeralRoot(sshConn.Permissions); ok {
+		guest, err = s.anonymous.newGuest(u, root)
+		if err != nil {
+			infof("Refusing ephemeral login for %q: %v", u.Name, err)
+			return
+		}
+		defer guest.destroy()
+		infof("Created ephemeral account %q (home %s)", u.Name, guest.home)
+	}
+	// Container sessions run as a user of the container, not of the host
+	var container string
+	if s.containers != nil {
+		container, err = s.containers.ensure(u.Name)
+		if err != nil {
+			infof("Refusing sessions for %q: %v", u.Name, err)
+			return
+		}
+	}
+	var account *systemAccount
+	_, sandboxed := sandboxPath(sshConn.Permissions)
+	switch {
+	case container != "":
+	case sandboxed && s.loginUIDs != nil:
+		// Anonymous logins and guests each run as a uid of their own
+		account, err = s.loginUIDs.take(u.Name, u.Home)
+		if err != nil {
+			infof("Refusing sessions for %q: %v", u.Name, err)
+			return
+		}
+		defer s.loginUIDs.release(account)
+		if guest != nil {
+			if err := account.chown(guest.home); err != nil {
+				infof("Refusing sessions for %q: %v", u.Name, err)
+				return
+			}
+		}
+	case sandboxed:
+		// The server runs unprivileged, as they then do
+	default:
+		account, err = s.sessionAccount(u)
+		if err != nil {
+			infof("Refusing sessions for %q: %v", u.Name, err)
+			return
+		}
+		if account == nil && s.privsep != nil {
+			// Separated children never run as root, nor share a uid
+			account, err = s.loginUIDs.take(u.Name, u.Home)
+			if err != nil {
+				infof("Refusing sessions for %q: %v", u.Name, err)
+				return
+			}
+			defer s.loginUIDs.release(account)
+		}
+	}
+	chroot, confined := chrootDirectory(sshConn.Permissions)
+	if confined {
+		if account == nil {
+			infof("Refusing sessions for %q: chroot_directory needs the server to run as root and a system account", u.Name)
+			return
+		}
+		if err := checkChroot(chroot); err != nil {
+			infof("Refusing sessions for %q: %v", u.Name, err)
+			return
+		}
+	}
+
+	home := homeDirectory(u, account)
+
+	var welcome string
+	if s.motd != nil {
+		welcome = s.motd.login(u.Name, ip)
+	}
+
+	var act *activity
+	if timeout := s.policy.Load().idleTimeout; timeout > 0 {
+		act = newActivity()
+		go watchIdle(sshConn, act, timeout)
+	}
+	if policy := s.policy.Load(); policy.aliveInterval > 0 {
+		go watchAlive(sshConn, policy.aliveInterval, policy.aliveCountMax)
+	}
+
+	l := login{user: u, guest: guest, account: account, chroot: chroot, home: home, welcome: welcome, container: container}
+	if s.privsep != nil {
+		s.serveSeparated(sshConn, chans, reqs, l, act)
 		return
 	}
-	log.Printf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
+	s.serveChannels(sshConn, chans, reqs, l, act)
+}
+
+// login is what the sessions of an authenticated connection share.
+type login struct {
+	user    *user
+	guest   *guestAccount
+	account *systemAccount
+	chroot  string
+	home    string
+	welcome string
+	// container is the Docker container sessions run in, if any
+	container string
+}
 
-	go ssh.DiscardRequests(reqs)
+// serveChannels serves the channels and global requests of an
+// authenticated connection until it closes and its sessions have ended.
+func (s *server) serveChannels(sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, l login, act *activity) {
+	u := l.user
+	var open atomic.Int32 // sessions of this connection
+	var running sync.WaitGroup
+	defer running.Wait()
+	fwd := newForwarder(sshConn, act)
+	defer fwd.close()
+	go fwd.handleGlobalRequests(reqs)
 
 	for newChannel := range chans {
-		if newChannel.ChannelType() != "session" {
-			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+		switch newChannel.ChannelType() {
+		case "session":
+		case "direct-tcpip":
+			go fwd.handleDirectTCPIP(newChannel)
+			continue
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "only session and direct-tcpip channels are supported")
 			continue
 		}
 
+		if msg, refused := s.maintenance.refuses(u.Name); refused {
+			infof("Rejecting session for %s (%s): maintenance", u.Name, sshConn.RemoteAddr())
+			newChannel.Reject(ssh.Prohibited, msg)
+			continue
+		}
+		release, err := s.claimSession(u.Name, &open)
+		if err != nil {
+			infof("Rejecting session for %s (%s): %v", u.Name, sshConn.RemoteAddr(), err)
+			newChannel.Reject(ssh.ResourceShortage, err.Error())
+			continue
+		}
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			log.Printf("Could not accept channel: %v", err)
+			warnf("Could not accept channel: %v", err)
+			release()
 			continue
 		}
+		channel = act.track(channel)
+		in, out, releaseBandwidth := s.sessionThrottles(u.Name, sshConn.Permissions)
+		channel = throttleChannel(channel, in, out)
+		channel, recorded := s.recordChannel(channel, sshConn.Permissions)
 
-		go func(ch ssh.Channel, reqs <-chan *ssh.Request) {
-			defer ch.Close()
-
-			var (
-				ptyRequested bool
-				ptyCols      uint32
-				ptyRows      uint32
-				ptyFile      *os.File
-			)
-
-			for req := range reqs {
-				switch req.Type {
-				case "pty-req":
-					// Parse PTY request payload: term, cols, rows, width, height, modes
-					var p struct {
-						Term   string
-						Cols   uint32
-						Rows   uint32
-						Width  uint32
-						Height uint32
-						Modes  []byte
-					}
-					if err := ssh.Unmarshal(req.Payload, &p); err != nil {
-						req.Reply(false, nil)
-						continue
-					}
-					ptyRequested = true
-					ptyCols = p.Cols
-					ptyRows = p.Rows
-					req.Reply(true, nil)
-
-				case "window-change":
-					// cols, rows, width, height
-					var wc struct {
-						Cols   uint32
-						Rows   uint32
-						Width  uint32
-						Height uint32
-					}
-					if err := ssh.Unmarshal(req.Payload, &wc); err == nil {
-						ptyCols = wc.Cols
-						ptyRows = wc.Rows
-						if ptyFile != nil {
-							_ = pty.Setsize(ptyFile, &pty.Winsize{Cols: uint16(ptyCols), Rows: uint16(ptyRows)})
-						}
-					}
-					// do not send a reply to window-change per RFC
-
-				case "shell":
-					if len(req.Payload) != 0 {
-						// We only support default shell (no command payload)
-						req.Reply(false, nil)
-						continue
-					}
-
-					// Start a real shell
-					// Prefer bash if available, fall back to sh
-					shellPath := "/bin/bash"
-					if _, err := os.Stat(shellPath); err != nil {
-						shellPath = "/bin/sh"
-					}
-
-					cmd := exec.Command(shellPath, "-l")
-
-					if ptyRequested {
-						f, err := pty.Start(cmd)
-						if err != nil {
-							req.Reply(false, nil)
-							continue
-						}
-						ptyFile = f
-						// Set initial window size if provided
-						if ptyCols > 0 && ptyRows > 0 {
-							_ = pty.Setsize(f, &pty.Winsize{Cols: uint16(ptyCols), Rows: uint16(ptyRows)})
-						}
-
-						req.Reply(true, nil)
-
-						// Pipe data between SSH channel and PTY
-						go func() { _, _ = io.Copy(f, ch) }()
-						go func() { _, _ = io.Copy(ch, f) }()
-
-						// Wait for the shell to exit
-						if err := cmd.Wait(); err != nil {
-							// send exit status if possible
-							if exitErr, ok := err.(*exec.ExitError); ok {
-								if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-									sendExitStatus(ch, status.ExitStatus())
-								}
-							}
-						} else {
-							sendExitStatus(ch, 0)
-						}
-						return
-					}
-
-					// Non-PTY fallback: run interactive sh and connect pipes
-					stdin, _ := cmd.StdinPipe()
-					stdout, _ := cmd.StdoutPipe()
-					stderr, _ := cmd.StderrPipe()
-					if err := cmd.Start(); err != nil {
-						req.Reply(false, nil)
-						continue
-					}
-					req.Reply(true, nil)
-					go func() { _, _ = io.Copy(stdin, ch) }()
-					go func() { _, _ = io.Copy(ch, stdout) }()
-					go func() { _, _ = io.Copy(ch.Stderr(), stderr) }()
-					if err := cmd.Wait(); err != nil {
-						if exitErr, ok := err.(*exec.ExitError); ok {
-							if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-								sendExitStatus(ch, status.ExitStatus())
-							}
-						}
-					} else {
-						sendExitStatus(ch, 0)
-					}
-					return
-
-				case "exec":
-					// Execute a specific command without PTY
-					var ex struct{ Command string }
-					if err := ssh.Unmarshal(req.Payload, &ex); err != nil {
-						req.Reply(false, nil)
-						continue
-					}
-					cmd := exec.Command("/bin/sh", "-c", ex.Command)
-					cmd.Stdin = ch
-					cmd.Stdout = ch
-					cmd.Stderr = ch.Stderr()
-					if err := cmd.Start(); err != nil {
-						req.Reply(false, nil)
-						continue
-					}
-					req.Reply(true, nil)
-					if err := cmd.Wait(); err != nil {
-						if exitErr, ok := err.(*exec.ExitError); ok {
-							if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-								sendExitStatus(ch, status.ExitStatus())
-							}
-						}
-					} else {
-						sendExitStatus(ch, 0)
-					}
-					return
-
-				default:
-					req.Reply(false, nil)
-				}
-			}
-		}(channel, requests)
+		policy := s.policy.Load()
+		sess := &session{
+			conn: sshConn, user: u, guest: l.guest, account: l.account, chroot: l.chroot, home: l.home, ch: channel,
+			acceptEnvPatterns: policy.acceptEnv, defaultTerm: policy.defaultTerm, breakSignal: policy.breakSignal, subsystems: s.subsystems,
+			maxDuration: policy.maxSession, welcome: l.welcome, logins: s.utmp, detach: s.detach, limits: s.limits,
+			containers: s.containers, container: l.container, git: s.git, bastion: s.bastion, admin: s.runAdminCommand,
+			recordings: s.recordings, recorded: recorded, started: time.Now(),
+		}
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer release()
+			defer releaseBandwidth()
+			defer s.live.add(sess)()
+			sess.serve(requests)
+		}()
 	}
 }
-
-// sendExitStatus sends the SSH-specific exit-status request on the channel.
-func sendExitStatus(ch ssh.Channel, status int) {
-	// Per RFC 4254, exit-status uses a uint32 payload
-	type exitStatus struct{ Status uint32 }
-	payload := ssh.Marshal(exitStatus{Status: uint32(status)})
-	// Ignore reply; it's a one-way notification
-	_, _ = ch.SendRequest("exit-status", false, payload)
-}
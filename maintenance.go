@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceConfig configures maintenance mode, in which only admins may
+// start new sessions. It is switched on and off on the admin socket:
+//
+//	maintenance:
+//	  message: "Upgrading to the new storage backend until 14:00 UTC."
+//	  admins: [alice]
+//	  disconnect: false
+type MaintenanceConfig struct {
+	// Enabled starts the server in maintenance mode.
+	Enabled bool `yaml:"enabled"`
+	// Message is shown in the banner and to refused clients while
+	// maintenance is on; "maintenance on <message>" replaces it.
+	Message string `yaml:"message"`
+	// Admins may still log in and open sessions during maintenance.
+	Admins []string `yaml:"admins"`
+	// Disconnect ends the sessions of other users when maintenance starts,
+	// rather than letting them drain out.
+	Disconnect bool `yaml:"disconnect"`
+}
+
+const defaultMaintenanceMessage = "The server is down for maintenance. Please try again later."
+
+// maintenanceMode is the current maintenance state. live are the sessions
+// it may have to end.
+type maintenanceMode struct {
+	cfg    MaintenanceConfig
+	admins map[string]bool
+	live   *liveSessions
+
+	mu      sync.Mutex
+	on      bool
+	since   time.Time
+	message string
+}
+
+func newMaintenanceMode(cfg MaintenanceConfig, live *liveSessions) *maintenanceMode {
+	if cfg.Message == "" {
+		cfg.Message = defaultMaintenanceMessage
+	}
+	m := &maintenanceMode{cfg: cfg, admins: make(map[string]bool, len(cfg.Admins)), live: live}
+	for _, name := range cfg.Admins {
+		m.admins[name] = true
+	}
+	if cfg.Enabled {
+		m.on, m.since, m.message = true, time.Now(), cfg.Message
+	}
+	return m
+}
+
+// notice returns the banner line for maintenance, or "" while it is off.
+func (m *maintenanceMode) notice() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.on {
+		return ""
+	}
+	return strings.TrimSuffix(m.message, "\n") + "\n"
+}
+
+// refuses returns the message refusing user a new session, if maintenance
+// is on and user is not an admin.
+func (m *maintenanceMode) refuses(user string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.on || m.admins[user] {
+		return "", false
+	}
+	return m.message, true
+}
+
+// enable starts maintenance with message, or the configured one if empty,
+// and with disconnect set ends the sessions of users who are not admins. It
+// returns how many it ended.
+func (m *maintenanceMode) enable(message string) int {
+	if message == "" {
+		message = m.cfg.Message
+	}
+	m.mu.Lock()
+	if !m.on {
+		m.on, m.since = true, time.Now()
+	}
+	m.message = message
+	m.mu.Unlock()
+
+	var ending []*session
+	if m.cfg.Disconnect {
+		for _, sess := range m.live.list() {
+			if !m.admins[sess.user.Name] {
+				ending = append(ending, sess)
+			}
+		}
+	}
+
+	for _, sess := range ending {
+		infof("Ending session of %s: maintenance", sess.user.Name)
+		fmt.Fprintf(sess.ch.Stderr(), "\r\n*** %s ***\r\n", message)
+		sess.ending.Store(true)
+		sess.conn.Close()
+	}
+	return len(ending)
+}
+
+// disable ends maintenance, reporting whether it was on.
+func (m *maintenanceMode) disable() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wasOn := m.on
+	m.on = false
+	return wasOn
+}
+
+// status writes the state and the number of sessions still open, which
+// is what draining waits on.
+func (m *maintenanceMode) status(w io.Writer) {
+	live := m.live.list()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.on {
+		fmt.Fprintf(w, "maintenance off\t%d sessions\n", len(live))
+		return
+	}
+	others := 0
+	for _, sess := range live {
+		if !m.admins[sess.user.Name] {
+			others++
+		}
+	}
+	fmt.Fprintf(w, "maintenance on since %s\t%d sessions, %d of non-admins\n", m.since.Format(time.RFC3339), len(live), others)
+	fmt.Fprintf(w, "message: %s\n", m.message)
+}
+
+func init() {
+	registerAdminCommand("maintenance", "maintenance [on [message]|off]", "show or switch maintenance mode", func(s *server, args []string, w io.Writer) error {
+		switch {
+		case len(args) == 0:
+		case args[0] == "on":
+			ended := s.maintenance.enable(strings.Join(args[1:], " "))
+			infof("Admin started maintenance, ending %d sessions", ended)
+		case args[0] == "off" && len(args) == 1:
+			if s.maintenance.disable() {
+				infof("Admin ended maintenance")
+			}
+		default:
+			return errors.New("usage: maintenance [on [message]|off]")
+		}
+		s.maintenance.status(w)
+		return nil
+	})
+}
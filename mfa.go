@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// approvalRequest describes a login waiting for second-factor approval.
+type approvalRequest struct {
+	User       string `json:"username"`
+	RemoteAddr string `json:"remote_addr"`
+	Method     string `json:"method"`
+	// Fingerprint is the SHA256 fingerprint of the key for publickey logins
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// secondFactor approves a login after its primary authentication
+// succeeded, e.g. by sending a push notification and waiting for the user
+// to accept it. It should return once ctx is done; any error rejects the
+// login.
+type secondFactor interface {
+	approve(ctx context.Context, req approvalRequest) error
+}
+
+// secondFactorFactory builds a configured second factor.
+type secondFactorFactory func(cfg *SecondFactorConfig) (secondFactor, error)
+
+var secondFactorTypes = map[string]secondFactorFactory{}
+
+// registerSecondFactor makes a second factor type available to the
+// second_factor config section. It is meant to be called from init
+// functions.
+func registerSecondFactor(name string, factory secondFactorFactory) {
+	if _, dup := secondFactorTypes[name]; dup {
+		panic("duplicate second factor " + name)
+	}
+	secondFactorTypes[name] = factory
+}
+
+// SecondFactorConfig is the second_factor config section. The type field
+// selects the implementation; its other fields are type-specific.
+type SecondFactorConfig struct {
+	Type string
+	// Timeout bounds the wait for approval; defaults to 60s.
+	Timeout time.Duration
+	node    yaml.Node
+}
+
+func (c *SecondFactorConfig) UnmarshalYAML(n *yaml.Node) error {
+	var head struct {
+		Type    string        `yaml:"type"`
+		Timeout time.Duration `yaml:"timeout"`
+	}
+	if err := n.Decode(&head); err != nil {
+		return err
+	}
+	c.Type, c.Timeout = head.Type, head.Timeout
+	c.node = *n
+	return nil
+}
+
+// decode decodes the type-specific options into v.
+func (c *SecondFactorConfig) decode(v any) error {
+	return c.node.Decode(v)
+}
+
+// approvalGate runs the configured second factor with a deadline. It fails
+// closed: errors and timeouts both reject the login.
+type approvalGate struct {
+	factor  secondFactor
+	timeout time.Duration
+}
+
+func newApprovalGate(cfg *SecondFactorConfig) (*approvalGate, error) {
+	factory, ok := secondFactorTypes[cfg.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q (known: %s)", cfg.Type, knownSecondFactors())
+	}
+	factor, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	return &approvalGate{factor: factor, timeout: timeout}, nil
+}
+
+func knownSecondFactors() string {
+	names := make([]string, 0, len(secondFactorTypes))
+	for name := range secondFactorTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// approve asks for approval of a login that passed method, telling the
+// client what it is waiting for. It returns perms once approved.
+func (g *approvalGate) approve(c ssh.ConnMetadata, state *connAuth, method string, key ssh.PublicKey, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	req := approvalRequest{User: c.User(), RemoteAddr: c.RemoteAddr().String(), Method: method}
+	if key != nil {
+		req.Fingerprint = ssh.FingerprintSHA256(key)
+	}
+	if state.preAuth != nil {
+		_ = state.preAuth.SendAuthBanner(fmt.Sprintf("Approve this login on your device (waiting up to %v)...\n", g.timeout))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	err := g.factor.approve(ctx, req)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("second factor for %q timed out after %v", c.User(), g.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("second factor for %q: %w", c.User(), err)
+	}
+	return perms, nil
+}
+
+// withSecondFactor wraps the connection's auth callbacks so that every
+// successful login except the anonymous "none" also needs approval. Methods
+// that end in partial success are approved only with the final step.
+func (s *server) withSecondFactor(cfg *ssh.ServerConfig, state *connAuth) {
+	gate := s.approval
+	if password := cfg.PasswordCallback; password != nil {
+		cfg.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			perms, err := password(c, pass)
+			if err != nil {
+				return nil, err
+			}
+			return gate.approve(c, state, "password", nil, perms)
+		}
+	}
+	// PublicKeyCallback also answers key queries from the client, so the
+	// approval waits until the key's signature has been verified
+	verified := cfg.VerifiedPublicKeyCallback
+	cfg.VerifiedPublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey, perms *ssh.Permissions, algo string) (*ssh.Permissions, error) {
+		if verified != nil {
+			var err error
+			if perms, err = verified(c, key, perms, algo); err != nil {
+				return nil, err
+			}
+		}
+		return gate.approve(c, state, "publickey", key, perms)
+	}
+	if ki := cfg.KeyboardInteractiveCallback; ki != nil {
+		cfg.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			perms, err := ki(c, challenge)
+			if err != nil {
+				return nil, err
+			}
+			return gate.approve(c, state, "keyboard-interactive", nil, perms)
+		}
+	}
+	if g := cfg.GSSAPIWithMICConfig; g != nil {
+		allow := g.AllowLogin
+		cfg.GSSAPIWithMICConfig = &ssh.GSSAPIWithMICConfig{
+			Server: g.Server,
+			AllowLogin: func(c ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+				perms, err := allow(c, srcName)
+				if err != nil {
+					return nil, err
+				}
+				return gate.approve(c, state, "gssapi-with-mic", nil, perms)
+			},
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Built-in second factors.
+func init() {
+	registerSecondFactor("http_push", newHTTPPush)
+}
+
+// httpPush POSTs the approval request as JSON to a push service and waits
+// for its verdict, {"approved": true} or {"approved": false, "reason": "..."}.
+// The service is expected to hold the request open until the user answers
+// the push on their device.
+type httpPush struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPPush(cfg *SecondFactorConfig) (secondFactor, error) {
+	opts := struct {
+		URL     string            `yaml:"url"`
+		Headers map[string]string `yaml:"headers"`
+	}{}
+	if err := cfg.decode(&opts); err != nil {
+		return nil, err
+	}
+	if opts.URL == "" {
+		return nil, errors.New("url is required")
+	}
+	// The approval deadline comes from the request context
+	return &httpPush{url: opts.URL, headers: opts.Headers, client: &http.Client{}}, nil
+}
+
+func (p *httpPush) approve(ctx context.Context, req approvalRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range p.headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("push service: unexpected status %s", resp.Status)
+	}
+	var verdict struct {
+		Approved bool   `json:"approved"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return fmt.Errorf("push service: %v", err)
+	}
+	if !verdict.Approved {
+		if verdict.Reason == "" {
+			verdict.Reason = "denied"
+		}
+		return errors.New(verdict.Reason)
+	}
+	return nil
+}
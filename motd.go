@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginMessageConfig sets what interactive shells show when they start: a
+// message of the day and when and where the user last logged in.
+type LoginMessageConfig struct {
+	// MOTDFile is read at each login, so it can be changed without a
+	// restart. A missing file shows nothing.
+	MOTDFile string `yaml:"motd_file"`
+	// PrintLastLogin shows the previous login; defaults to true.
+	PrintLastLogin *bool `yaml:"print_last_login"`
+	// StateFile keeps the last login of each user; defaults to
+	// lastlogin.json.
+	StateFile string `yaml:"state_file"`
+}
+
+// lastLogin is the most recent login of a user.
+type lastLogin struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+}
+
+// loginMessages records logins and builds the message shells start with.
+type loginMessages struct {
+	cfg LoginMessageConfig
+
+	mu   sync.Mutex
+	last map[string]lastLogin // by user
+}
+
+func newLoginMessages(cfg LoginMessageConfig) (*loginMessages, error) {
+	if cfg.StateFile == "" {
+		cfg.StateFile = "lastlogin.json"
+	}
+	m := &loginMessages{cfg: cfg, last: make(map[string]lastLogin)}
+	data, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.last); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.StateFile, err)
+	}
+	return m, nil
+}
+
+// save writes the last logins to the state file. Callers hold m.mu.
+func (m *loginMessages) save() error {
+	data, err := json.MarshalIndent(m.last, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.cfg.StateFile)
+}
+
+// login records a login of user from ip and returns the message for its
+// shells: the MOTD, then the login before this one, if any. Lines end in
+// CRLF for the client's terminal.
+func (m *loginMessages) login(user, ip string) string {
+	m.mu.Lock()
+	prev, seen := m.last[user]
+	m.last[user] = lastLogin{Time: time.Now(), From: ip}
+	if err := m.save(); err != nil {
+		warnf("Failed to save last logins: %v", err)
+	}
+	m.mu.Unlock()
+
+	var b strings.Builder
+	if m.cfg.MOTDFile != "" {
+		motd, err := os.ReadFile(m.cfg.MOTDFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			warnf("Failed to read MOTD: %v", err)
+		}
+		b.Write(motd)
+		if len(motd) > 0 && motd[len(motd)-1] != '\n' {
+			b.WriteByte('\n')
+		}
+	}
+	if seen && (m.cfg.PrintLastLogin == nil || *m.cfg.PrintLastLogin) {
+		fmt.Fprintf(&b, "Last login: %s from %s\n", prev.Time.Local().Format(time.ANSIC), prev.From)
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n", "\r\n")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GroupConfig names a set of users that share auth requirements. Members
+// may also be users of external auth providers.
+type GroupConfig struct {
+	Name    string   `yaml:"name"`
+	Members []string `yaml:"members"`
+	// AuthMethods and RequiredMethods apply to members without settings
+	// of their own.
+	AuthMethods     []string `yaml:"auth_methods"`
+	RequiredMethods []string `yaml:"required_methods"`
+}
+
+// authMethodNames are the methods that can be allowed or required.
+var authMethodNames = map[string]bool{
+	"password":             true,
+	"publickey":            true,
+	"keyboard-interactive": true,
+	"gssapi-with-mic":      true,
+}
+
+// authSteps holds the per-user method policy: the only methods a user may
+// use, and the methods they must pass in order, like OpenSSH's
+// AuthenticationMethods.
+type authSteps struct {
+	allowed  map[string]map[string]bool
+	required map[string][]string
+}
+
+func newAuthSteps(users []UserConfig, groups []GroupConfig) (*authSteps, error) {
+	st := &authSteps{
+		allowed:  make(map[string]map[string]bool),
+		required: make(map[string][]string),
+	}
+	for _, u := range users {
+		if err := st.set(u.Name, u.AuthMethods, u.RequiredMethods); err != nil {
+			return nil, fmt.Errorf("user %q: %v", u.Name, err)
+		}
+	}
+	for _, g := range groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("group entry without a name")
+		}
+		for _, name := range g.Members {
+			// A user's own settings and earlier groups take precedence
+			_, hasAllowed := st.allowed[name]
+			_, hasRequired := st.required[name]
+			if hasAllowed || hasRequired {
+				continue
+			}
+			if err := st.set(name, g.AuthMethods, g.RequiredMethods); err != nil {
+				return nil, fmt.Errorf("group %q: %v", g.Name, err)
+			}
+		}
+	}
+	return st, nil
+}
+
+// set records the policy for one user after validating it.
+func (st *authSteps) set(name string, allowed, required []string) error {
+	if err := checkMethodNames(allowed); err != nil {
+		return fmt.Errorf("auth_methods: %v", err)
+	}
+	if err := checkMethodNames(required); err != nil {
+		return fmt.Errorf("required_methods: %v", err)
+	}
+	if len(allowed) > 0 {
+		set := make(map[string]bool, len(allowed))
+		for _, m := range allowed {
+			set[m] = true
+		}
+		for _, m := range required {
+			if !set[m] {
+				return fmt.Errorf("required method %s is not in auth_methods", m)
+			}
+		}
+		st.allowed[name] = set
+	}
+	if len(required) > 0 {
+		st.required[name] = required
+	}
+	return nil
+}
+
+func checkMethodNames(methods []string) error {
+	seen := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		if !authMethodNames[m] {
+			return fmt.Errorf("unknown auth method %q", m)
+		}
+		if seen[m] {
+			return fmt.Errorf("%s listed twice", m)
+		}
+		seen[m] = true
+	}
+	return nil
+}
+
+// active reports whether any user has a method policy.
+func (st *authSteps) active() bool {
+	return len(st.allowed) > 0 || len(st.required) > 0
+}
+
+// offered returns the methods the user may try next, or nil if the user
+// has no policy.
+func (st *authSteps) offered(user string, state *connAuth) []string {
+	if required := st.required[user]; len(required) > 0 {
+		return required[min(len(state.steps), len(required)-1):][:1]
+	}
+	var methods []string
+	for m := range st.allowed[user] {
+		methods = append(methods, m)
+	}
+	return methods
+}
+
+// nextMethod checks that the user may attempt method now, before any
+// credential is checked.
+func (s *server) nextMethod(c ssh.ConnMetadata, state *connAuth, method string) error {
+	steps := s.steps.Load()
+	if allowed, ok := steps.allowed[c.User()]; ok && !allowed[method] {
+		return fmt.Errorf("%q may not authenticate with %s", c.User(), method)
+	}
+	required := steps.required[c.User()]
+	if done := len(state.steps); len(required) > 0 && (done >= len(required) || required[done] != method) {
+		return fmt.Errorf("%q must authenticate with %s next, not %s", c.User(), required[min(done, len(required)-1)], method)
+	}
+	return nil
+}
+
+// callbacksFor returns the connection's callbacks for just the given
+// methods.
+func callbacksFor(state *connAuth, methods []string) ssh.ServerAuthCallbacks {
+	var next ssh.ServerAuthCallbacks
+	for _, m := range methods {
+		switch m {
+		case "password":
+			next.PasswordCallback = state.next.PasswordCallback
+		case "publickey":
+			next.PublicKeyCallback = state.next.PublicKeyCallback
+		case "keyboard-interactive":
+			next.KeyboardInteractiveCallback = state.next.KeyboardInteractiveCallback
+		case "gssapi-with-mic":
+			next.GSSAPIWithMICConfig = state.next.GSSAPIWithMICConfig
+		}
+	}
+	return next
+}
+
+// step records that method succeeded for the connection. Once every
+// required method has passed it returns the combined permissions; until
+// then it returns a PartialSuccessError offering only the next method.
+func (s *server) step(c ssh.ConnMetadata, state *connAuth, method string, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	required := s.steps.Load().required[c.User()]
+	if len(required) == 0 {
+		return perms, nil
+	}
+	state.steps = append(state.steps, method)
+	state.stepPerms = intersectPermissions(state.stepPerms, perms)
+	if len(state.steps) == len(required) {
+		return state.stepPerms, nil
+	}
+	return nil, &ssh.PartialSuccessError{Next: callbacksFor(state, s.steps.Load().offered(c.User(), state))}
+}
+
+// intersectPermissions combines the permissions of two auth steps: a
+// feature is allowed only if both steps allow it, and restrictions such as
+// a forced command or source-address from either step are kept.
+func intersectPermissions(prev, perms *ssh.Permissions) *ssh.Permissions {
+	if prev == nil {
+		return perms
+	}
+	for _, f := range allowFeatures {
+		if _, ok := prev.Extensions[f]; !ok {
+			delete(perms.Extensions, f)
+		}
+	}
+	for k, v := range prev.Extensions {
+		if _, ok := perms.Extensions[k]; !ok && !isAllowFeature(k) {
+			setExtension(perms, k, v)
+		}
+	}
+	for k, v := range prev.CriticalOptions {
+		if _, ok := perms.CriticalOptions[k]; !ok {
+			if perms.CriticalOptions == nil {
+				perms.CriticalOptions = make(map[string]string)
+			}
+			perms.CriticalOptions[k] = v
+		}
+	}
+	return perms
+}
+
+func isAllowFeature(name string) bool {
+	for _, f := range allowFeatures {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withAuthSteps wraps the connection's auth callbacks to enforce the
+// per-user method policy. The client's initial "none" request is answered
+// with a partial success that lists only the methods the user may try, so
+// clients do not offer the others.
+func (s *server) withAuthSteps(cfg *ssh.ServerConfig, state *connAuth) {
+	none := cfg.NoClientAuthCallback
+	cfg.NoClientAuth = true
+	cfg.NoClientAuthCallback = func(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+		if methods := s.steps.Load().offered(c.User(), state); len(methods) > 0 {
+			return nil, &ssh.PartialSuccessError{Next: callbacksFor(state, methods)}
+		}
+		if none == nil {
+			return nil, errors.New("no credentials offered")
+		}
+		return none(c)
+	}
+
+	if password := cfg.PasswordCallback; password != nil {
+		cfg.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if err := s.nextMethod(c, state, "password"); err != nil {
+				return nil, err
+			}
+			perms, err := password(c, pass)
+			if err != nil {
+				return nil, err
+			}
+			return s.step(c, state, "password", perms)
+		}
+	}
+	// PublicKeyCallback also answers key queries, and may not return
+	// partial success once VerifiedPublicKeyCallback is set, so the step
+	// is taken after the signature has been verified
+	if publicKey := cfg.PublicKeyCallback; publicKey != nil {
+		cfg.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if err := s.nextMethod(c, state, "publickey"); err != nil {
+				return nil, err
+			}
+			return publicKey(c, key)
+		}
+	}
+	cfg.VerifiedPublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey, perms *ssh.Permissions, _ string) (*ssh.Permissions, error) {
+		return s.step(c, state, "publickey", perms)
+	}
+	if ki := cfg.KeyboardInteractiveCallback; ki != nil {
+		cfg.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if err := s.nextMethod(c, state, "keyboard-interactive"); err != nil {
+				return nil, err
+			}
+			perms, err := ki(c, challenge)
+			if err != nil {
+				return nil, err
+			}
+			return s.step(c, state, "keyboard-interactive", perms)
+		}
+	}
+	if g := cfg.GSSAPIWithMICConfig; g != nil {
+		allow := g.AllowLogin
+		cfg.GSSAPIWithMICConfig = &ssh.GSSAPIWithMICConfig{
+			Server: g.Server,
+			AllowLogin: func(c ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+				if err := s.nextMethod(c, state, "gssapi-with-mic"); err != nil {
+					return nil, err
+				}
+				perms, err := allow(c, srcName)
+				if err != nil {
+					return nil, err
+				}
+				return s.step(c, state, "gssapi-with-mic", perms)
+			},
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OIDCConfig configures the OAuth 2.0 device authorization grant (RFC 8628)
+// against an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+	// UsernameClaim is the userinfo claim that must equal the SSH username.
+	// Defaults to "preferred_username".
+	UsernameClaim string `yaml:"username_claim"`
+}
+
+// oidcProvider implements keyboard-interactive login with the device-code
+// flow: the user is shown a URL and code, completes login in a browser, and
+// the server polls the IdP until it is done.
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	deviceEndpoint   string
+	tokenEndpoint    string
+	userinfoEndpoint string
+}
+
+func newOIDCProvider(cfg OIDCConfig) (*oidcProvider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("oidc: issuer and client_id are required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	p := &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := p.discover(); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %v", err)
+	}
+	return p, nil
+}
+
+// discover fetches the provider's endpoints from its discovery document.
+func (p *oidcProvider) discover() error {
+	resp, err := p.client.Get(strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var doc struct {
+		DeviceEndpoint   string `json:"device_authorization_endpoint"`
+		TokenEndpoint    string `json:"token_endpoint"`
+		UserinfoEndpoint string `json:"userinfo_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+	if doc.DeviceEndpoint == "" || doc.TokenEndpoint == "" || doc.UserinfoEndpoint == "" {
+		return errors.New("provider does not advertise device authorization, token and userinfo endpoints")
+	}
+	p.deviceEndpoint = doc.DeviceEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.userinfoEndpoint = doc.UserinfoEndpoint
+	return nil
+}
+
+// postForm sends an authenticated form request and decodes a JSON reply.
+// OAuth error responses are decoded too, so callers inspect the error field.
+func (p *oidcProvider) postForm(endpoint string, form url.Values, v any) error {
+	form.Set("client_id", p.cfg.ClientID)
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+	resp, err := p.client.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", resp.Status, err)
+	}
+	return nil
+}
+
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+	Error                   string `json:"error"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+}
+
+func (p *oidcProvider) authenticateKeyboardInteractive(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	var da deviceAuthorization
+	err := p.postForm(p.deviceEndpoint, url.Values{"scope": {strings.Join(p.cfg.Scopes, " ")}}, &da)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: device authorization: %v", err)
+	}
+	if da.Error != "" || da.DeviceCode == "" {
+		return nil, fmt.Errorf("oidc: device authorization: %s", da.Error)
+	}
+
+	link := da.VerificationURIComplete
+	if link == "" {
+		link = da.VerificationURI
+	}
+	conv := &kiConversation{challenge: challenge}
+	_, err = conv.send(newChallenge("Single sign-on").
+		withInstruction(fmt.Sprintf("To log in, visit %s and enter code %s", link, da.UserCode)).
+		ask("Press Enter once you have logged in in your browser"))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := p.pollToken(&da)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %v", err)
+	}
+	username, err := p.username(token)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: userinfo: %v", err)
+	}
+	if username != c.User() {
+		return nil, fmt.Errorf("oidc: logged in as %q, not %q", username, c.User())
+	}
+	return nil, nil
+}
+
+// pollToken polls the token endpoint until the user finishes logging in, the
+// request is denied, or the device code expires.
+func (p *oidcProvider) pollToken(da *deviceAuthorization) (string, error) {
+	interval := time.Duration(da.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	expires := time.Duration(da.ExpiresIn) * time.Second
+	if expires <= 0 {
+		expires = 5 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), expires)
+	defer cancel()
+
+	form := url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {da.DeviceCode},
+	}
+	for {
+		var tr tokenResponse
+		if err := p.postForm(p.tokenEndpoint, form, &tr); err != nil {
+			return "", fmt.Errorf("token: %v", err)
+		}
+		switch tr.Error {
+		case "":
+			return tr.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return "", fmt.Errorf("token: %s", tr.Error)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", errors.New("device code expired")
+		case <-time.After(interval):
+		}
+	}
+}
+
+// username fetches the configured username claim for the access token.
+func (p *oidcProvider) username(token string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, p.userinfoEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var claims map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return "", err
+	}
+	username, _ := claims[p.cfg.UsernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("claim %q missing", p.cfg.UsernameClaim)
+	}
+	return username, nil
+}
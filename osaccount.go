@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	osuser "os/user"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// systemAccount is the OS account whose privileges a session's processes
+// run with. Accounts are only used when the server runs as root.
+type systemAccount struct {
+	name   string
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	home   string
+	shell  string
+}
+
+// lookupSystemAccount finds name in /etc/passwd and its supplementary
+// groups, returning errUnknownUser if there is no such account.
+func lookupSystemAccount(name string) (*systemAccount, error) {
+	entry, err := findEntry("/etc/passwd", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry) < 7 {
+		return nil, fmt.Errorf("malformed /etc/passwd entry for %q", name)
+	}
+	uid, err := strconv.ParseUint(entry[2], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad uid for %q: %v", name, err)
+	}
+	gid, err := strconv.ParseUint(entry[3], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad gid for %q: %v", name, err)
+	}
+	a := &systemAccount{name: name, uid: uint32(uid), gid: uint32(gid), home: entry[5], shell: entry[6]}
+	if u, err := osuser.Lookup(name); err == nil {
+		ids, _ := u.GroupIds()
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				a.groups = append(a.groups, uint32(g))
+			}
+		}
+	}
+	return a, nil
+}
+
+// sessionAccount returns the account the sessions of u run as, or nil to
+// run them as the server's own user: when it does not run as root, or, if
+// require_system_user is turned off, for users without an account.
+func (s *server) sessionAccount(u *user) (*systemAccount, error) {
+	if !s.runAsUsers {
+		return nil, nil
+	}
+	a, err := lookupSystemAccount(u.Name)
+	switch {
+	case errors.Is(err, errUnknownUser) && s.requireSystemUser:
+		return nil, fmt.Errorf("no system account %q, and require_system_user is on", u.Name)
+	case errors.Is(err, errUnknownUser):
+		return nil, nil
+	}
+	return a, err
+}
+
+// homeDirectory returns the directory the sessions of u start in: its
+// configured home, otherwise the home of its system account. The account
+// is looked up even when sessions do not run as it, so they still start at
+// home rather than where the server was started.
+func homeDirectory(u *user, account *systemAccount) string {
+	if u.Home != "" {
+		return u.Home
+	}
+	if account == nil {
+		account, _ = lookupSystemAccount(u.Name)
+	}
+	if account == nil {
+		return ""
+	}
+	return account.home
+}
+
+// apply makes cmd run with a's uid, gid and groups, and sets the variables
+// identifying the account.
+func (a *systemAccount) apply(cmd *exec.Cmd) {
+	runAs(cmd, a)
+	if cmd.Env == nil {
+		cmd.Env = sessionEnviron()
+	}
+	cmd.Env = append(cmd.Env, "USER="+a.name, "LOGNAME="+a.name)
+	if cmd.Dir == "" && a.home != "" {
+		cmd.Dir = a.home
+		cmd.Env = append(cmd.Env, "HOME="+a.home)
+	}
+}
+
+// chown gives a the file at path, such as the PTY or agent socket of its
+// session.
+func (a *systemAccount) chown(path string) error {
+	return os.Chown(path, int(a.uid), int(a.gid))
+}
+
+// helperCommand returns a command re-running this binary as the helper
+// subcommand name, for in-process handlers such as SFTP that must run with
+// the privileges of the session's account rather than the server's. For
+// confined sessions the helper starts as root and enters the chroot itself,
+// as the binary is not inside it.
+func (sess *session) helperCommand(name string, args ...string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if sess.chroot != "" {
+		args = append([]string{"-chroot", sess.chroot, "-user", sess.account.name, "-home", sess.home, "--"}, args...)
+	}
+	cmd := exec.Command(exe, append([]string{name}, args...)...)
+	cmd.Env = []string{"PATH=/usr/bin:/bin"}
+	if sess.chroot != "" {
+		return cmd, nil
+	}
+	sess.startAtHome(cmd)
+	sess.account.apply(cmd)
+	return cmd, nil
+}
+
+// sessionShell returns the shell for the session: the configured one,
+// otherwise the system account's.
+func (sess *session) sessionShell() string {
+	if sess.user.Shell == "" && sess.account != nil && sess.account.shell != "" {
+		return sess.account.shell
+	}
+	return sess.user.shell()
+}
+
+// runHelper serves req with a helperCommand instead of in-process.
+func (sess *session) runHelper(req *ssh.Request, name string, args ...string) bool {
+	cmd, err := sess.helperCommand(name, args...)
+	if err != nil {
+		req.Reply(false, nil)
+		return false
+	}
+	return sess.runCommand(req, cmd)
+}
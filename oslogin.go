@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OSLoginConfig looks up users' public keys in Google Cloud OS Login at auth
+// time, the way google_authorized_keys does for the system sshd, so keys
+// are managed in the cloud console or with "gcloud compute os-login".
+type OSLoginConfig struct {
+	// URL is the OS Login endpoint; defaults to the GCE metadata server,
+	// http://metadata.google.internal/computeMetadata/v1/oslogin.
+	URL string `yaml:"url"`
+	// Headers are added to every request; the metadata server requires
+	// "Metadata-Flavor: Google", which is always sent.
+	Headers map[string]string `yaml:"headers"`
+	// SkipAuthorization only checks keys, without asking OS Login whether
+	// the user holds the login role on this instance.
+	SkipAuthorization bool `yaml:"skip_authorization"`
+	// Timeout defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+	// CacheTTL is how long a user's profile is reused; defaults to 30s,
+	// which covers the key query and signature check of one login.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+const defaultOSLoginURL = "http://metadata.google.internal/computeMetadata/v1/oslogin"
+
+// osLoginProfile is the part of an OS Login profile the server uses.
+type osLoginProfile struct {
+	Name          string `json:"name"` // the account's email address
+	PosixAccounts []struct {
+		Username      string `json:"username"`
+		HomeDirectory string `json:"homeDirectory"`
+		Shell         string `json:"shell"`
+	} `json:"posixAccounts"`
+	SSHPublicKeys map[string]struct {
+		Key                string `json:"key"`
+		ExpirationTimeUsec string `json:"expirationTimeUsec"`
+	} `json:"sshPublicKeys"`
+}
+
+// osLoginUser is a looked-up user: their valid keys, account and whether
+// they may log in.
+type osLoginUser struct {
+	keys    []ssh.PublicKey
+	home    string
+	shell   string
+	allowed bool
+	fetched time.Time
+}
+
+// osLoginProvider authenticates public keys against OS Login.
+type osLoginProvider struct {
+	cfg    OSLoginConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*osLoginUser
+}
+
+func newOSLoginProvider(cfg OSLoginConfig) (*osLoginProvider, error) {
+	if cfg.URL == "" {
+		cfg.URL = defaultOSLoginURL
+	}
+	if _, err := url.Parse(cfg.URL); err != nil {
+		return nil, fmt.Errorf("oslogin: url: %v", err)
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = 30 * time.Second
+	}
+	return &osLoginProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		cache:  make(map[string]*osLoginUser),
+	}, nil
+}
+
+func (p *osLoginProvider) authenticatePublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errUnknownUser
+	}
+	u, err := p.lookup(c.User())
+	if err != nil {
+		return nil, err
+	}
+	marshaled := key.Marshal()
+	found := false
+	for _, k := range u.keys {
+		if bytes.Equal(k.Marshal(), marshaled) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("oslogin: key not authorized")
+	}
+	if !u.allowed {
+		return nil, fmt.Errorf("oslogin: %q lacks the login role", c.User())
+	}
+	perms := fullPermissions()
+	setExtension(perms, permHome, u.home)
+	setExtension(perms, permShell, u.shell)
+	return perms, nil
+}
+
+// lookup returns the user's OS Login record, from the cache if fresh.
+func (p *osLoginProvider) lookup(name string) (*osLoginUser, error) {
+	p.mu.Lock()
+	u, ok := p.cache[name]
+	p.mu.Unlock()
+	if ok && time.Since(u.fetched) < p.cfg.CacheTTL {
+		return u, nil
+	}
+	u, err := p.fetch(name)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.cache[name] = u
+	p.mu.Unlock()
+	return u, nil
+}
+
+func (p *osLoginProvider) fetch(name string) (*osLoginUser, error) {
+	var reply struct {
+		LoginProfiles []osLoginProfile `json:"loginProfiles"`
+	}
+	status, err := p.get("users?username="+url.QueryEscape(name), &reply)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound || len(reply.LoginProfiles) == 0 {
+		return nil, errUnknownUser
+	}
+	profile := reply.LoginProfiles[0]
+
+	u := &osLoginUser{fetched: time.Now(), allowed: true}
+	account := false
+	for _, a := range profile.PosixAccounts {
+		if a.Username == name {
+			u.home, u.shell, account = a.HomeDirectory, a.Shell, true
+			break
+		}
+	}
+	if !account {
+		return nil, errUnknownUser
+	}
+	now := time.Now()
+	for fp, k := range profile.SSHPublicKeys {
+		if k.ExpirationTimeUsec != "" {
+			usec, err := strconv.ParseInt(k.ExpirationTimeUsec, 10, 64)
+			if err == nil && now.After(time.UnixMicro(usec)) {
+				continue
+			}
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Key))
+		if err != nil {
+			return nil, fmt.Errorf("oslogin: key %s: %v", fp, err)
+		}
+		u.keys = append(u.keys, key)
+	}
+
+	if !p.cfg.SkipAuthorization {
+		var auth struct {
+			Success bool `json:"success"`
+		}
+		status, err := p.get("authorize?policy=login&email="+url.QueryEscape(profile.Name), &auth)
+		if err != nil {
+			return nil, err
+		}
+		u.allowed = status == http.StatusOK && auth.Success
+	}
+	return u, nil
+}
+
+// get fetches path below the endpoint and decodes a 200 reply into v. A 404
+// is returned as a status, since OS Login uses it for unknown users and
+// denied authorizations.
+func (p *osLoginProvider) get(path string, v any) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, p.cfg.URL+"/"+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	for k, val := range p.cfg.Headers {
+		req.Header.Set(k, val)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("oslogin: %v", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return resp.StatusCode, nil
+	default:
+		return 0, fmt.Errorf("oslogin: unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return 0, fmt.Errorf("oslogin: bad reply: %v", err)
+	}
+	return resp.StatusCode, nil
+}
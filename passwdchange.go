@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PasswordChangeConfig configures the password change that users with
+// must_change_password go through at their next password login.
+type PasswordChangeConfig struct {
+	// StateFile keeps changed password hashes, which replace the configured
+	// ones; defaults to passwords.json.
+	StateFile string `yaml:"state_file"`
+	// MinLength is the shortest new password accepted; defaults to 8.
+	MinLength int `yaml:"min_length"`
+}
+
+// permChangePassword marks a password login whose user must set a new
+// password before the login completes. It never reaches the session.
+const permChangePassword = "change-password"
+
+// passwordRecord is the persisted password state of one user.
+type passwordRecord struct {
+	Hash       string    `json:"hash,omitempty"`
+	Changed    time.Time `json:"changed,omitzero"`
+	MustChange bool      `json:"must_change,omitempty"`
+}
+
+// passwordChanges runs forced password changes and persists their results.
+type passwordChanges struct {
+	cfg   PasswordChangeConfig
+	users *userDB
+
+	mu      sync.Mutex
+	records map[string]*passwordRecord
+}
+
+// newPasswordChanges loads the state file and applies it to users.
+func newPasswordChanges(cfg PasswordChangeConfig, users *userDB) (*passwordChanges, error) {
+	if cfg.StateFile == "" {
+		cfg.StateFile = "passwords.json"
+	}
+	if cfg.MinLength <= 0 {
+		cfg.MinLength = 8
+	}
+	pc := &passwordChanges{cfg: cfg, users: users, records: make(map[string]*passwordRecord)}
+	data, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return pc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &pc.records); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.StateFile, err)
+	}
+	if err := pc.apply(users); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// apply gives the accounts of users the passwords they changed to and the
+// changes they must make.
+func (pc *passwordChanges) apply(users *userDB) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for name, rec := range pc.records {
+		u, ok := users.lookup(name)
+		if !ok {
+			continue
+		}
+		var h *passwordHash
+		if rec.Hash != "" {
+			var err error
+			if h, err = parsePasswordHash(rec.Hash); err != nil {
+				return fmt.Errorf("%s: user %q: %v", pc.cfg.StateFile, name, err)
+			}
+		}
+		u.setPassword(h, rec.MustChange)
+	}
+	return nil
+}
+
+// save writes the records to the state file. Callers hold pc.mu.
+func (pc *passwordChanges) save() error {
+	data, err := json.MarshalIndent(pc.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := pc.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, pc.cfg.StateFile)
+}
+
+// record updates and persists name's password state.
+func (pc *passwordChanges) record(name string, update func(rec *passwordRecord)) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	rec, ok := pc.records[name]
+	if !ok {
+		rec = &passwordRecord{}
+		pc.records[name] = rec
+	}
+	update(rec)
+	return pc.save()
+}
+
+// change asks u for a new password, retrying a few times if it is
+// unacceptable, and stores it.
+func (pc *passwordChanges) change(u *user, conv *kiConversation) error {
+	instruction := "You are required to change your password."
+	for range 3 {
+		answers, err := conv.send(newChallenge("Password change").
+			withInstruction(instruction).
+			askSecret("New password: ").
+			askSecret("Retype new password: "))
+		if err != nil {
+			return err
+		}
+		switch pass := answers[0]; {
+		case pass != answers[1]:
+			instruction = "Passwords do not match, try again."
+		case len(pass) < pc.cfg.MinLength:
+			instruction = fmt.Sprintf("Password must be at least %d characters, try again.", pc.cfg.MinLength)
+		case u.checkPassword([]byte(pass)):
+			instruction = "New password must differ from the old one, try again."
+		default:
+			h, err := hashPassword([]byte(pass))
+			if err != nil {
+				return err
+			}
+			err = pc.record(u.Name, func(rec *passwordRecord) {
+				rec.Hash, rec.Changed, rec.MustChange = h.encoded, time.Now().UTC().Truncate(time.Second), false
+			})
+			if err != nil {
+				return fmt.Errorf("failed to save new password: %v", err)
+			}
+			u.setPassword(h, false)
+			infof("Password changed for %q", u.Name)
+			return nil
+		}
+	}
+	return errors.New("password not changed")
+}
+
+// withPasswordChange holds back logins marked with permChangePassword: the
+// client is sent on to a keyboard-interactive exchange that sets the new
+// password, and only then is the login granted.
+func (s *server) withPasswordChange(cfg *ssh.ServerConfig) {
+	gate := func(c ssh.ConnMetadata, perms *ssh.Permissions) (*ssh.Permissions, error) {
+		if !permitted(perms, permChangePassword) {
+			return perms, nil
+		}
+		delete(perms.Extensions, permChangePassword)
+		u, ok := s.users.lookup(c.User())
+		if !ok {
+			return nil, errors.New("password change for unknown user")
+		}
+		return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				if err := s.passwords.change(u, &kiConversation{challenge: challenge}); err != nil {
+					return nil, err
+				}
+				return perms, nil
+			},
+		}}
+	}
+
+	if password := cfg.PasswordCallback; password != nil {
+		cfg.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			perms, err := password(c, pass)
+			if err != nil {
+				return nil, err
+			}
+			return gate(c, perms)
+		}
+	}
+	// With multiple required methods the password step may not be the last
+	if verified := cfg.VerifiedPublicKeyCallback; verified != nil {
+		cfg.VerifiedPublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey, perms *ssh.Permissions, algo string) (*ssh.Permissions, error) {
+			perms, err := verified(c, key, perms, algo)
+			if err != nil {
+				return nil, err
+			}
+			return gate(c, perms)
+		}
+	}
+	if ki := cfg.KeyboardInteractiveCallback; ki != nil {
+		cfg.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			perms, err := ki(c, challenge)
+			if err != nil {
+				return nil, err
+			}
+			return gate(c, perms)
+		}
+	}
+}
+
+func init() {
+	// change_password lets keyboard-interactive flows, which do not go
+	// through the password method, force the change too
+	registerKIStep("change_password", func(s *server, cfg *KIStepConfig) (kiStep, error) {
+		return kiStepFunc(func(c ssh.ConnMetadata, conv *kiConversation) error {
+			u, ok := s.users.lookup(c.User())
+			if !ok || !u.needsPasswordChange() {
+				return nil
+			}
+			if err := s.passwords.change(u, conv); err != nil {
+				return err
+			}
+			// Changed here, the password step's mark is not to send the
+			// client through a second change
+			if conv.perms != nil {
+				delete(conv.perms.Extensions, permChangePassword)
+			}
+			return nil
+		}), nil
+	})
+
+	registerAdminCommand("expire-password", "expire-password <user>", "make a user change their password at next login", func(s *server, args []string, w io.Writer) error {
+		if len(args) != 1 {
+			return errors.New("usage: expire-password <user>")
+		}
+		u, ok := s.users.lookup(args[0])
+		if !ok {
+			return fmt.Errorf("no configured user %q", args[0])
+		}
+		if err := s.passwords.record(u.Name, func(rec *passwordRecord) { rec.MustChange = true }); err != nil {
+			return err
+		}
+		u.setPassword(nil, true)
+		infof("Admin expired the password of %q", u.Name)
+		fmt.Fprintf(w, "%s must change their password at next login\n", u.Name)
+		return nil
+	})
+	registerAdminCommand("password-changes", "password-changes", "list pending and past password changes", func(s *server, args []string, w io.Writer) error {
+		s.passwords.mu.Lock()
+		defer s.passwords.mu.Unlock()
+		var names []string
+		for _, name := range s.users.names() {
+			if u, _ := s.users.lookup(name); s.passwords.records[name] != nil || u.needsPasswordChange() {
+				names = append(names, name)
+			}
+		}
+		for _, name := range names {
+			status := "changed"
+			if u, _ := s.users.lookup(name); u.needsPasswordChange() {
+				status = "must change"
+			}
+			if rec, ok := s.passwords.records[name]; ok && !rec.Changed.IsZero() {
+				status += " (last changed " + rec.Changed.Format(time.RFC3339) + ")"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", name, status)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errUnsupportedHash is returned for password hashes in an unknown format.
+var errUnsupportedHash = errors.New("unsupported password hash format")
+
+// passwordHash is a parsed bcrypt, argon2id or crypt(3) password hash.
+type passwordHash struct {
+	encoded string
+	// crypt marks MD5-crypt, SHA-crypt and yescrypt hashes, as used in
+	// /etc/shadow
+	crypt bool
+
+	// argon2id parameters; unused for bcrypt
+	argon   bool
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parsePasswordHash accepts bcrypt ("$2a$", "$2b$", "$2y$"), argon2id
+// hashes in PHC string format ("$argon2id$v=19$m=65536,t=3,p=4$salt$key")
+// and the crypt(3) formats "$1$" (MD5), "$5$" (SHA-256), "$6$" (SHA-512) and
+// "$y$" (yescrypt).
+func parsePasswordHash(encoded string) (*passwordHash, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+			return nil, fmt.Errorf("bcrypt: %v", err)
+		}
+		return &passwordHash{encoded: encoded}, nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return parseArgon2id(encoded)
+	case strings.HasPrefix(encoded, "$1$"), strings.HasPrefix(encoded, "$5$"), strings.HasPrefix(encoded, "$6$"):
+		if _, err := unixCrypt(nil, encoded); err != nil {
+			return nil, fmt.Errorf("crypt: %v", err)
+		}
+		return &passwordHash{encoded: encoded, crypt: true}, nil
+	case strings.HasPrefix(encoded, "$y$"):
+		// Checked without hashing, which takes tens of megabytes
+		if _, _, _, err := parseYescrypt(encoded); err != nil {
+			return nil, fmt.Errorf("crypt: %v", err)
+		}
+		return &passwordHash{encoded: encoded, crypt: true}, nil
+	}
+	return nil, errUnsupportedHash
+}
+
+func parseArgon2id(encoded string) (*passwordHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("argon2id: expected 6 fields, got %d", len(parts))
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, fmt.Errorf("argon2id: bad version %q", parts[2])
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("argon2id: unsupported version %d", version)
+	}
+
+	h := &passwordHash{encoded: encoded, argon: true}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("argon2id: bad parameters %q", parts[3])
+	}
+	// argon2.IDKey panics on parameters outside these
+	if h.time < 1 || h.threads < 1 || h.memory < 8*uint32(h.threads) {
+		return nil, fmt.Errorf("argon2id: bad parameters %q", parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("argon2id: bad salt: %v", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("argon2id: bad key: %v", err)
+	}
+	if len(h.salt) == 0 || len(h.key) == 0 {
+		return nil, errors.New("argon2id: empty salt or key")
+	}
+	return h, nil
+}
+
+// hashPassword returns a new bcrypt hash of pass.
+func hashPassword(pass []byte) (*passwordHash, error) {
+	encoded, err := bcrypt.GenerateFromPassword(pass, bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &passwordHash{encoded: string(encoded)}, nil
+}
+
+// verify reports whether pass matches the hash.
+func (h *passwordHash) verify(pass []byte) bool {
+	if h.crypt {
+		computed, err := unixCrypt(pass, h.encoded)
+		return err == nil && subtle.ConstantTimeCompare([]byte(computed), []byte(h.encoded)) == 1
+	}
+	if !h.argon {
+		return bcrypt.CompareHashAndPassword([]byte(h.encoded), pass) == nil
+	}
+	key := argon2.IDKey(pass, h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Extensions used in ssh.Permissions to carry what a login may do from auth
+// time to the channel and request handlers. Auth providers return the
+// features their credential grants (nil meaning everything); applyPolicy
+// then narrows that by the account's policy. Features whose allow-*
+// extension is absent are refused.
+const (
+	permAllowPTY             = "allow-pty"
+	permAllowShell           = "allow-shell"
+	permAllowExec            = "allow-exec"
+	permAllowPortForwarding  = "allow-port-forwarding"
+	permAllowAgentForwarding = "allow-agent-forwarding"
+	permForcedCommand        = "forced-command" // command to run instead of the client's
+	permEnvPrefix            = "environment:"   // one per variable: "environment:NAME" = value
+
+	// Account settings from auth providers that keep their own user records
+	permShell = "user-shell"
+	permHome  = "user-home"
+
+	// permGatewayPorts lets remote forwards listen on other addresses
+	// than loopback.
+	permGatewayPorts = "gateway-ports"
+
+	// permNoTouchRequired is read by x/crypto/ssh itself: it accepts
+	// security-key signatures made without user presence (a touch).
+	permNoTouchRequired = "no-touch-required"
+)
+
+// allowFeatures lists the allow-* extensions credentials grant. Port
+// forwarding is only kept when the account's policy allows it.
+var allowFeatures = []string{permAllowPTY, permAllowShell, permAllowExec, permAllowPortForwarding, permAllowAgentForwarding}
+
+// PermissionsConfig is a per-user (or default) policy. Unset fields fall
+// back to default_permissions, then to allowed, except port forwarding,
+// which is refused unless allowed.
+type PermissionsConfig struct {
+	AllowPTY             *bool `yaml:"allow_pty"`
+	AllowExec            *bool `yaml:"allow_exec"`
+	AllowPortForwarding  *bool `yaml:"allow_port_forwarding"`
+	AllowAgentForwarding *bool `yaml:"allow_agent_forwarding"`
+	// GatewayPorts lets remote forwards (ssh -R) listen on the addresses
+	// clients ask for, like OpenSSH's GatewayPorts clientspecified;
+	// otherwise they only listen on loopback.
+	GatewayPorts  *bool  `yaml:"gateway_ports"`
+	ForcedCommand string `yaml:"forced_command"`
+	// ChrootDirectory confines sessions to a directory tree, like
+	// OpenSSH's ChrootDirectory; %u is replaced by the username.
+	ChrootDirectory string `yaml:"chroot_directory"`
+	// AllowedCommands, if set, are regular expressions that exec commands
+	// must match in full; shells get a built-in restricted shell that only
+	// runs matching lines.
+	AllowedCommands []string `yaml:"allowed_commands"`
+	// SFTPOnly makes a file-drop account: shells and commands are refused
+	// and only the SFTP subsystem is served, without PTYs or forwarding.
+	SFTPOnly *bool `yaml:"sftp_only"`
+	// RsyncOnly makes a backup account, like rrsync: only rsync runs, with
+	// its paths inside this directory; %u is replaced by the username.
+	RsyncOnly string `yaml:"rsync_only"`
+	// RsyncAccess limits rsync_only accounts to read-only or write-only.
+	RsyncAccess string `yaml:"rsync_access"`
+	// GitRepositories makes a Git hosting account, like one with
+	// git-shell: only git fetches and pushes run, for repositories under
+	// the git root whose path matches one of these patterns; %u is
+	// replaced by the username.
+	GitRepositories []string `yaml:"git_repositories"`
+	// ExecTimeout is how long commands of exec requests may run before
+	// they are killed; zero is no limit.
+	ExecTimeout time.Duration `yaml:"exec_timeout"`
+	// BastionTargets makes a jump account: its shell is a menu of the
+	// bastion targets whose name matches one of these patterns.
+	BastionTargets []string `yaml:"bastion_targets"`
+	// BandwidthLimit caps what each session sends and receives, in bytes
+	// per second in either direction with an optional K, M or G suffix;
+	// UserBandwidthLimit caps all the user's sessions together.
+	BandwidthLimit     string `yaml:"bandwidth_limit"`
+	UserBandwidthLimit string `yaml:"user_bandwidth_limit"`
+	// Admin lets the user run admin commands in a session, as
+	// "ssh host admin who".
+	Admin *bool `yaml:"admin"`
+	// RecordSessions records the user's shells and commands to the
+	// session_recording directory.
+	RecordSessions *bool `yaml:"record_sessions"`
+}
+
+// merge returns p with unset fields taken from def.
+func (p PermissionsConfig) merge(def PermissionsConfig) PermissionsConfig {
+	if p.AllowPTY == nil {
+		p.AllowPTY = def.AllowPTY
+	}
+	if p.AllowExec == nil {
+		p.AllowExec = def.AllowExec
+	}
+	if p.AllowPortForwarding == nil {
+		p.AllowPortForwarding = def.AllowPortForwarding
+	}
+	if p.AllowAgentForwarding == nil {
+		p.AllowAgentForwarding = def.AllowAgentForwarding
+	}
+	if p.GatewayPorts == nil {
+		p.GatewayPorts = def.GatewayPorts
+	}
+	if p.ForcedCommand == "" {
+		p.ForcedCommand = def.ForcedCommand
+	}
+	if p.ChrootDirectory == "" {
+		p.ChrootDirectory = def.ChrootDirectory
+	}
+	if p.AllowedCommands == nil {
+		p.AllowedCommands = def.AllowedCommands
+	}
+	if p.SFTPOnly == nil {
+		p.SFTPOnly = def.SFTPOnly
+	}
+	if p.RsyncOnly == "" {
+		p.RsyncOnly = def.RsyncOnly
+	}
+	if p.RsyncAccess == "" {
+		p.RsyncAccess = def.RsyncAccess
+	}
+	if p.GitRepositories == nil {
+		p.GitRepositories = def.GitRepositories
+	}
+	if p.ExecTimeout == 0 {
+		p.ExecTimeout = def.ExecTimeout
+	}
+	if p.BastionTargets == nil {
+		p.BastionTargets = def.BastionTargets
+	}
+	if p.BandwidthLimit == "" {
+		p.BandwidthLimit = def.BandwidthLimit
+	}
+	if p.UserBandwidthLimit == "" {
+		p.UserBandwidthLimit = def.UserBandwidthLimit
+	}
+	if p.Admin == nil {
+		p.Admin = def.Admin
+	}
+	if p.RecordSessions == nil {
+		p.RecordSessions = def.RecordSessions
+	}
+	return p
+}
+
+// checkPermissions validates the settings of a permissions policy that are
+// parsed when logins use them.
+func checkPermissions(p PermissionsConfig) error {
+	if err := checkCommandPatterns(p.AllowedCommands); err != nil {
+		return err
+	}
+	if err := checkRsyncAccess(p.RsyncAccess); err != nil {
+		return err
+	}
+	if err := checkRepositoryPatterns(p.GitRepositories); err != nil {
+		return err
+	}
+	if err := checkBandwidth(p); err != nil {
+		return err
+	}
+	return checkTargetPatterns(p.BastionTargets)
+}
+
+// fullPermissions grants every feature.
+func fullPermissions() *ssh.Permissions {
+	perms := &ssh.Permissions{}
+	for _, f := range allowFeatures {
+		setExtension(perms, f, "")
+	}
+	return perms
+}
+
+// applyPolicy narrows the permissions returned by an auth provider with the
+// policy for the user, or rejects the login for locked accounts, outside
+// the user's login windows and of non-admins during maintenance. A forced
+// command from the policy overrides one from the credential, like OpenSSH's
+// ForceCommand.
+func (s *server) applyPolicy(c ssh.ConnMetadata, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	if perms == nil {
+		perms = fullPermissions()
+	}
+	if s.lockout != nil && s.lockout.isLocked(c.User()) {
+		return nil, fmt.Errorf("account %q is locked", c.User())
+	}
+	if _, refused := s.maintenance.refuses(c.User()); refused {
+		return nil, fmt.Errorf("login for %q during maintenance", c.User())
+	}
+	policy := s.policy.Load().defaultPermissions
+	if u, ok := s.users.lookup(c.User()); ok {
+		if !u.loginAllowed(time.Now()) {
+			return nil, fmt.Errorf("login for %q outside its allowed hours", c.User())
+		}
+		policy = u.Permissions.merge(policy)
+	}
+	applyPermissions(perms, policy, c.User())
+	return perms, nil
+}
+
+// applyPermissions narrows perms, the permissions of user's login, with
+// policy.
+func applyPermissions(perms *ssh.Permissions, policy PermissionsConfig, user string) {
+	deny := func(flag *bool, feature string) {
+		if flag != nil && !*flag {
+			delete(perms.Extensions, feature)
+		}
+	}
+	deny(policy.AllowPTY, permAllowPTY)
+	deny(policy.AllowExec, permAllowExec)
+	deny(policy.AllowAgentForwarding, permAllowAgentForwarding)
+	if policy.AllowPortForwarding == nil || !*policy.AllowPortForwarding {
+		delete(perms.Extensions, permAllowPortForwarding)
+	}
+	if policy.ForcedCommand != "" {
+		setExtension(perms, permForcedCommand, policy.ForcedCommand)
+	}
+	if policy.ChrootDirectory != "" {
+		setExtension(perms, permChroot, expandChroot(policy.ChrootDirectory, user))
+	}
+	if len(policy.AllowedCommands) > 0 {
+		setExtension(perms, permAllowedCommands, strings.Join(policy.AllowedCommands, "\n"))
+		// Forwards would reach what the allowlist keeps the account from
+		delete(perms.Extensions, permAllowPortForwarding)
+		delete(perms.Extensions, permAllowAgentForwarding)
+	}
+	fileTransfer := func() {
+		for _, f := range []string{permAllowPTY, permAllowPortForwarding, permAllowAgentForwarding} {
+			delete(perms.Extensions, f)
+		}
+	}
+	if policy.SFTPOnly != nil && *policy.SFTPOnly {
+		setExtension(perms, permSFTPAccount, "")
+		fileTransfer()
+	}
+	if policy.RsyncOnly != "" {
+		setExtension(perms, permRsyncOnly, expandChroot(policy.RsyncOnly, user))
+		setExtension(perms, permRsyncAccess, policy.RsyncAccess)
+		fileTransfer()
+	}
+	if len(policy.GitRepositories) > 0 {
+		repos := make([]string, len(policy.GitRepositories))
+		for i, p := range policy.GitRepositories {
+			repos[i] = expandChroot(p, user)
+		}
+		setExtension(perms, permGitRepositories, strings.Join(repos, "\n"))
+		fileTransfer()
+	}
+	if policy.ExecTimeout > 0 {
+		setExtension(perms, permExecTimeout, policy.ExecTimeout.String())
+	}
+	if len(policy.BastionTargets) > 0 {
+		setExtension(perms, permBastionTargets, strings.Join(policy.BastionTargets, "\n"))
+	}
+	// Both were validated when the configuration was loaded
+	if rate, _ := parseByteRate(policy.BandwidthLimit); rate > 0 {
+		setExtension(perms, permBandwidth, strconv.FormatInt(rate, 10))
+	}
+	if rate, _ := parseByteRate(policy.UserBandwidthLimit); rate > 0 {
+		setExtension(perms, permUserBandwidth, strconv.FormatInt(rate, 10))
+	}
+	grant := func(flag *bool, feature string) {
+		switch {
+		case flag == nil:
+		case *flag:
+			setExtension(perms, feature, "")
+		default:
+			delete(perms.Extensions, feature)
+		}
+	}
+	grant(policy.GatewayPorts, permGatewayPorts)
+	grant(policy.Admin, permAdmin)
+	grant(policy.RecordSessions, permRecordSessions)
+}
+
+// permitted reports whether the login was granted an allow-* feature.
+func permitted(perms *ssh.Permissions, feature string) bool {
+	if perms == nil {
+		return false
+	}
+	_, ok := perms.Extensions[feature]
+	return ok
+}
+
+// forcedCommand returns the command the login is restricted to, if any.
+func forcedCommand(perms *ssh.Permissions) (string, bool) {
+	if perms == nil {
+		return "", false
+	}
+	cmd, ok := perms.Extensions[permForcedCommand]
+	return cmd, ok
+}
+
+// permittedEnv returns the NAME=value pairs set for the login.
+func permittedEnv(perms *ssh.Permissions) []string {
+	if perms == nil {
+		return nil
+	}
+	var env []string
+	for k, v := range perms.Extensions {
+		if name, ok := strings.CutPrefix(k, permEnvPrefix); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// setExtension sets an extension, allocating the map if needed.
+func setExtension(perms *ssh.Permissions, key, value string) {
+	if perms.Extensions == nil {
+		perms.Extensions = make(map[string]string)
+	}
+	perms.Extensions[key] = value
+}
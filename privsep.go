@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PrivilegeSeparationConfig makes a server running as root serve each
+// authenticated connection from a child process running as the login's
+// system account, like OpenSSH's privilege separation: everything the
+// client sends after authentication, from channel requests to SFTP and scp
+// streams, is parsed without root privileges. The server keeps the
+// transport, authentication and the state shared between connections.
+// Logins without a system account are served as a uid of their own from
+// login_uids.
+type PrivilegeSeparationConfig struct{}
+
+// privsepConflicts rejects the features the children cannot serve: those
+// needing root in the session handlers, and detached sessions, which would
+// end with their child.
+func privsepConflicts(cfg *Config) error {
+	switch {
+	case cfg.Container != nil:
+		return errors.New("container sessions are not supported with privilege_separation")
+	case cfg.ResourceLimits != nil:
+		return errors.New("resource_limits are not supported with privilege_separation")
+	case cfg.Anonymous != nil:
+		return errors.New("anonymous logins are not supported with privilege_separation")
+	case cfg.Utmp != nil:
+		return errors.New("utmp records are not supported with privilege_separation")
+	case cfg.Detach != nil:
+		return errors.New("detach is not supported with privilege_separation")
+	}
+	return nil
+}
+
+// privsep starts the children serving separated connections.
+type privsep struct {
+	subsystems map[string]string
+}
+
+// separatedLogin is what the child serving a connection learns from the
+// server: the login, without its credentials, and the session settings.
+type separatedLogin struct {
+	User        UserConfig
+	Home        string
+	Welcome     string
+	Env         []string // the account's USER, LOGNAME, HOME and SHELL
+	Permissions map[string]string
+	RemoteAddr  string
+	LocalAddr   string
+
+	AcceptEnv   []string
+	DefaultTerm string
+	BreakSignal int
+	Subsystems  map[string]string
+	MaxSession  time.Duration
+	CopyBuffer  int
+	LogLevel    logLevel
+	Git         *GitConfig
+	Bastion     *BastionConfig
+}
+
+// separatedLogin describes l on sshConn for its child.
+func (s *server) separatedLogin(sshConn *ssh.ServerConn, l login) *separatedLogin {
+	u, account := l.user, l.account
+	shell := u.Shell
+	if shell == "" {
+		shell = account.shell
+	}
+	perms := make(map[string]string, len(sshConn.Permissions.Extensions))
+	for k, v := range sshConn.Permissions.Extensions {
+		perms[k] = v
+	}
+	// The server runs admin commands and enforces bandwidth limits, which
+	// need what all connections share
+	for _, k := range []string{permAdmin, permBandwidth, permUserBandwidth} {
+		delete(perms, k)
+	}
+	policy := s.policy.Load()
+	spec := &separatedLogin{
+		User:        UserConfig{Name: u.Name, Shell: shell, ShellArgs: u.ShellArgs, LoginShell: u.LoginShell, Home: u.Home},
+		Home:        l.home,
+		Welcome:     l.welcome,
+		Env:         []string{"USER=" + account.name, "LOGNAME=" + account.name},
+		Permissions: perms,
+		RemoteAddr:  sshConn.RemoteAddr().String(),
+		LocalAddr:   sshConn.LocalAddr().String(),
+		AcceptEnv:   policy.acceptEnv,
+		DefaultTerm: policy.defaultTerm,
+		BreakSignal: int(policy.breakSignal),
+		Subsystems:  s.privsep.subsystems,
+		MaxSession:  policy.maxSession,
+		CopyBuffer:  copyBufferSize,
+		LogLevel:    currentLogLevel,
+	}
+	if l.chroot != "" {
+		// The child starts in the home it has inside the chroot
+		spec.Home = chrootHome(l.chroot, l.home)
+	}
+	if spec.Home != "" {
+		spec.Env = append(spec.Env, "HOME="+spec.Home)
+	}
+	if shell != "" {
+		spec.Env = append(spec.Env, "SHELL="+shell)
+	}
+	if s.git != nil {
+		spec.Git = &s.git.cfg
+	}
+	if s.bastion != nil {
+		spec.Bastion = &s.bastion.cfg
+	}
+	return spec
+}
+
+// server returns the server state a child serves its connection with,
+// and the login. Session counts and limits are the parent's business.
+func (spec *separatedLogin) server() (*server, login, error) {
+	s := &server{}
+	s.policy.Store(&serverPolicy{
+		acceptEnv:   spec.AcceptEnv,
+		defaultTerm: spec.DefaultTerm,
+		breakSignal: syscall.Signal(spec.BreakSignal),
+		maxSession:  spec.MaxSession,
+	})
+	s.steps.Store(&authSteps{})
+	copyBufferSize, currentLogLevel = spec.CopyBuffer, spec.LogLevel
+	var err error
+	if s.subsystems, err = newSubsystems(spec.Subsystems); err != nil {
+		return nil, login{}, err
+	}
+	s.maintenance = newMaintenanceMode(MaintenanceConfig{}, &s.live)
+	if spec.Git != nil {
+		s.git = &gitHost{cfg: *spec.Git}
+	}
+	if spec.Bastion != nil {
+		s.bastion = &bastion{cfg: *spec.Bastion, targets: spec.Bastion.Targets}
+	}
+	u := &user{UserConfig: spec.User}
+	return s, login{user: u, home: spec.Home, welcome: spec.Welcome}, nil
+}
+
+// addrConn is the child's end of its socket, reporting the addresses of
+// the client's connection.
+type addrConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+
+// tcpAddr is an address as the server saw it.
+type tcpAddr string
+
+func (a tcpAddr) Network() string { return "tcp" }
+func (a tcpAddr) String() string  { return string(a) }
+
+// serveSeparated serves an authenticated connection from a child process
+// for the login, relaying channels and requests between the client and
+// the child, which the parent talks SSH to over a private socket so
+// neither side needs a protocol of its own. Session counts, maintenance,
+// bandwidth limits and idle tracking are applied here, as they span
+// connections.
+func (s *server) serveSeparated(sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, l login, act *activity) {
+	u := l.user
+	conn, wait, err := s.privsep.start(l, s.separatedLogin(sshConn, l))
+	if err != nil {
+		infof("Refusing sessions for %q: privilege separation: %v", u.Name, err)
+		return
+	}
+	defer wait()
+	// The child's host key is made up when it starts; only it has the
+	// other end of the socket
+	child, childChans, childReqs, err := ssh.NewClientConn(conn, "privsep", &ssh.ClientConfig{
+		User:            u.Name,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		conn.Close()
+		infof("Refusing sessions for %q: privilege separation: %v", u.Name, err)
+		return
+	}
+	defer child.Close()
+	go func() {
+		// The child exiting ends the connection
+		_ = child.Wait()
+		sshConn.Close()
+	}()
+	go relayGlobalRequests(child, reqs)
+	go relayGlobalRequests(sshConn, childReqs)
+	go func() {
+		// Remote forwards and agent forwarding open channels to the client
+		for nc := range childChans {
+			go relayChannel(nc, sshConn, act.track, nil)
+		}
+	}()
+
+	var open atomic.Int32 // sessions of this connection
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			go relayChannel(nc, child, act.track, nil)
+			continue
+		}
+		if msg, refused := s.maintenance.refuses(u.Name); refused {
+			infof("Rejecting session for %s (%s): maintenance", u.Name, sshConn.RemoteAddr())
+			nc.Reject(ssh.Prohibited, msg)
+			continue
+		}
+		release, err := s.claimSession(u.Name, &open)
+		if err != nil {
+			infof("Rejecting session for %s (%s): %v", u.Name, sshConn.RemoteAddr(), err)
+			nc.Reject(ssh.ResourceShortage, err.Error())
+			continue
+		}
+		// A stand-in for who, wall and maintenance, which know the
+		// session only by the requests the child accepted
+		sess := &session{conn: sshConn, user: u, recordings: s.recordings, started: time.Now()}
+		wrap := func(ch ssh.Channel) ssh.Channel {
+			in, out, releaseBandwidth := s.sessionThrottles(u.Name, sshConn.Permissions)
+			sess.ch, sess.recorded = s.recordChannel(throttleChannel(act.track(ch), in, out), sshConn.Permissions)
+			remove, claimed := s.live.add(sess), release
+			release = func() {
+				remove()
+				releaseBandwidth()
+				claimed()
+			}
+			return sess.ch
+		}
+		seen := func(req *ssh.Request, ok bool) {
+			switch req.Type {
+			case "pty-req":
+				var p struct {
+					Term       string
+					Cols, Rows uint32
+				}
+				// Only what recordings need; the child parses it all
+				if ok && ssh.Unmarshal(req.Payload, &p) == nil {
+					sess.ptyRequested = true
+					sess.ptyTerm, sess.ptyCols, sess.ptyRows = p.Term, p.Cols, p.Rows
+				}
+			case "shell", "exec", "subsystem":
+				sess.setCommand(ok, "("+req.Type+")")
+				if ok && sess.ptyRequested {
+					sess.onTerminal.Store(true)
+				}
+				// Recorded from acceptance, so secrets are only
+				// recognised by their prompts
+				var ex struct{ Command string }
+				switch {
+				case !ok:
+				case req.Type == "shell":
+					sess.startRecording("(shell)")
+				case req.Type == "exec" && ssh.Unmarshal(req.Payload, &ex) == nil:
+					sess.startRecording(ex.Command)
+				}
+			}
+		}
+		go func() {
+			defer func() { release() }()
+			relayChannel(nc, child, wrap, seen)
+			sess.recorded.stop(true)
+		}()
+	}
+}
+
+// relayGlobalRequests passes global requests to dst, and its replies back.
+func relayGlobalRequests(dst ssh.Conn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		ok, payload, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, payload)
+		}
+	}
+}
+
+// relayChannel opens nc on dst and, once dst accepts it, copies data,
+// EOFs and requests between the two until either closes. wrap, if set,
+// wraps nc's side, and seen learns of each request from nc's side with
+// the answer dst gave.
+func relayChannel(nc ssh.NewChannel, dst ssh.Conn, wrap func(ssh.Channel) ssh.Channel, seen func(req *ssh.Request, ok bool)) {
+	b, bReqs, err := dst.OpenChannel(nc.ChannelType(), nc.ExtraData())
+	if err != nil {
+		var open *ssh.OpenChannelError
+		if errors.As(err, &open) {
+			nc.Reject(open.Reason, open.Message)
+		} else {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	a, aReqs, err := nc.Accept()
+	if err != nil {
+		b.Close()
+		return
+	}
+	if wrap != nil {
+		a = wrap(a)
+	}
+
+	toA := copyChannel(a, b)
+	copyChannel(b, a)
+	go func() {
+		relayRequests(b, aReqs, nil, seen)
+		b.Close()
+	}()
+	// Exit statuses follow the output they end, as they did at the source
+	relayRequests(a, bReqs, toA, nil)
+	select {
+	case <-toA:
+	case <-time.After(time.Second):
+	}
+	a.Close()
+}
+
+// copyChannel copies the data and stderr of src to dst, then sends dst an
+// EOF, closing the returned channel once done.
+func copyChannel(dst, src ssh.Channel) <-chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = copyData(dst, src)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = copyData(dst.Stderr(), src.Stderr())
+	}()
+	go func() {
+		wg.Wait()
+		_ = dst.CloseWrite()
+		close(done)
+	}()
+	return done
+}
+
+// relayRequests passes channel requests to dst, and its replies back.
+// Exit statuses wait for output to be done.
+func relayRequests(dst ssh.Channel, reqs <-chan *ssh.Request, output <-chan struct{}, seen func(req *ssh.Request, ok bool)) {
+	for req := range reqs {
+		if output != nil && (req.Type == "exit-status" || req.Type == "exit-signal") {
+			select {
+			case <-output:
+			case <-time.After(time.Second):
+			}
+		}
+		ok, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		ok = ok && err == nil
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if seen != nil {
+			seen(req, ok)
+		}
+	}
+}
+
+// serveSeparatedChild serves the connection of a separated login on conn,
+// as the child process does once it runs as the login's account.
+func serveSeparatedChild(conn net.Conn, spec *separatedLogin) error {
+	s, l, err := spec.server()
+	if err != nil {
+		return err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	cfg := &ssh.ServerConfig{
+		NoClientAuth: true,
+		NoClientAuthCallback: func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: spec.Permissions}, nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	sshConn, chans, reqs, err := ssh.NewServerConn(addrConn{conn, tcpAddr(spec.RemoteAddr), tcpAddr(spec.LocalAddr)}, cfg)
+	if err != nil {
+		return fmt.Errorf("handshake with the server: %v", err)
+	}
+	s.serveChannels(sshConn, chans, reqs, l, nil)
+	return nil
+}
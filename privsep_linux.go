@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func newPrivsep(subsystems map[string]string) (*privsep, error) {
+	return &privsep{subsystems: subsystems}, nil
+}
+
+// start starts the privsep-child serving l, giving it spec on its stdin
+// and its end of a socket pair as fd 3. It returns the server's end and
+// the function reaping the child. Chroot logins start as root and enter
+// the chroot the way the helpers do; others run as the login's account.
+func (p *privsep) start(l login, spec *separatedLogin) (net.Conn, func(), error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	input, err := json.Marshal(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	ours, theirs := os.NewFile(uintptr(fds[0]), "privsep"), os.NewFile(uintptr(fds[1]), "privsep-child")
+	defer theirs.Close()
+	conn, err := net.FileConn(ours)
+	ours.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args := []string{"privsep-child"}
+	if l.chroot != "" {
+		args = append(args, "-chroot", l.chroot, "-user", l.account.name, "-home", l.home)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{theirs}
+	if l.chroot == "" {
+		runAs(cmd, l.account)
+	}
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, func() { _ = cmd.Wait() }, nil
+}
+
+// privsepChildMain implements the "privsep-child" subcommand, serving the
+// connection the server hands it on fd 3 with the login it reads from
+// stdin. It exits once the connection closes.
+func privsepChildMain(args []string) {
+	log.SetPrefix(fmt.Sprintf("privsep[%d]: ", os.Getpid()))
+	// Processes of the same account, such as the login's own shells, may
+	// not attach to the child or read its memory
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		log.Fatalf("prctl: %v", err)
+	}
+	var spec separatedLogin
+	if err := json.NewDecoder(os.Stdin).Decode(&spec); err != nil {
+		log.Fatalf("reading the login: %v", err)
+	}
+	enterChroot(args)
+	for _, kv := range spec.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		os.Setenv(name, value)
+	}
+	f := os.NewFile(3, "privsep")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := serveSeparatedChild(conn, &spec); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
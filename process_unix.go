@@ -0,0 +1,65 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// defaultPath is the PATH of sessions when the server has none, and
+// sessionEnvKept the variables of the server's environment they keep.
+const defaultPath = "/usr/local/bin:/usr/bin:/bin"
+
+var sessionEnvKept = []string{"TZ"}
+
+// defaultShell is the shell of users without one: bash if available,
+// falling back to sh, or the built-in shell where there is none.
+func defaultShell() string {
+	if _, err := os.Stat("/bin/bash"); err == nil {
+		return "/bin/bash"
+	}
+	if _, err := os.Stat("/bin/sh"); err == nil {
+		return "/bin/sh"
+	}
+	return internalShell
+}
+
+// shellCommand builds shell running command with "-c", or interactively if
+// command is empty, as a login shell when login is set: argv[0] is then the
+// shell's name with a leading dash.
+func shellCommand(shell string, args []string, command string, login bool) *exec.Cmd {
+	args = append([]string(nil), args...)
+	if command != "" {
+		return exec.Command(shell, append(args, "-c", command)...)
+	}
+	cmd := exec.Command(shell, args...)
+	if login {
+		cmd.Args[0] = "-" + filepath.Base(shell)
+	}
+	return cmd
+}
+
+// newProcessSession makes cmd start a new session, leaving the server's.
+func newProcessSession(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+}
+
+// killProcessGroup kills the process group p leads, as the first process
+// of a new session does.
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// runAs makes cmd run with a's uid, gid and groups.
+func runAs(cmd *exec.Cmd, a *systemAccount) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: a.uid, Gid: a.gid, Groups: a.groups}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// defaultPath is the PATH of sessions when the server has none, and
+// sessionEnvKept the variables of the server's environment they keep:
+// those Windows programs need to find the system and its temp directory.
+const defaultPath = `C:\Windows\system32;C:\Windows`
+
+var sessionEnvKept = []string{"TZ", "SystemRoot", "SystemDrive", "windir", "ComSpec", "PATHEXT", "TEMP", "TMP", "ProgramData", "ProgramFiles", "ProgramFiles(x86)", "CommonProgramFiles"}
+
+// defaultShell is the shell of users without one: the ComSpec interpreter,
+// normally cmd.exe. powershell.exe or pwsh.exe can be set as a user's shell.
+func defaultShell() string {
+	if shell := os.Getenv("ComSpec"); shell != "" {
+		return shell
+	}
+	return "cmd.exe"
+}
+
+// shellCommand builds shell running command the way the shell takes one:
+// cmd.exe with /c and the command line as given, PowerShell with -Command,
+// and others, such as Git for Windows' bash, with -c. If command is empty
+// the shell is interactive. Windows has no login shells, so login is
+// ignored.
+func shellCommand(shell string, args []string, command string, login bool) *exec.Cmd {
+	cmd := exec.Command(shell, args...)
+	if command == "" {
+		return cmd
+	}
+	switch strings.ToLower(strings.TrimSuffix(filepath.Base(shell), filepath.Ext(shell))) {
+	case "cmd":
+		// cmd.exe parses the rest of its command line itself, so quoting
+		// the command as one argument would change it
+		cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: windows.ComposeCommandLine(cmd.Args) + " /c " + command}
+	case "powershell", "pwsh":
+		cmd.Args = append(cmd.Args, "-Command", command)
+	default:
+		cmd.Args = append(cmd.Args, "-c", command)
+	}
+	return cmd
+}
+
+// newProcessSession makes cmd start a new process group, the nearest
+// Windows has to a session.
+func newProcessSession(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= windows.CREATE_NEW_PROCESS_GROUP
+}
+
+// killProcessGroup kills p. Windows has no way to signal a process group,
+// so what p started keeps running.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// runAs would make cmd run as a. Sessions only run as system accounts when
+// the server runs as root, which it never does on Windows.
+func runAs(cmd *exec.Cmd, a *systemAccount) {}
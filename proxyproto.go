@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a load balancer has to send the PROXY
+// protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts PROXY protocol version 2 headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose client and server addresses are those
+// its PROXY protocol header gave, with the data after the header.
+type proxyConn struct {
+	net.Conn
+	r             *bufio.Reader
+	remote, local net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+// readProxyHeader reads the PROXY protocol header, version 1 or 2, that a
+// load balancer sends before the client's data, and returns conn with the
+// client's address. Headers without one, such as those of health checks,
+// leave the load balancer's.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	pc := &proxyConn{Conn: conn, r: bufio.NewReader(conn), remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	start, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY header: %v", err)
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		err = pc.readV2()
+	} else {
+		err = pc.readV1()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("PROXY header: %v", err)
+	}
+	return pc, nil
+}
+
+// readV1 reads a text header, such as "PROXY TCP4 203.0.113.7 10.0.0.5
+// 51234 22\r\n".
+func (c *proxyConn) readV1() error {
+	// The longest header is 107 bytes
+	line, err := c.r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("not a PROXY protocol header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errors.New("not a PROXY protocol header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("malformed version 1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("bad address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readV2 reads a binary header: the signature, the version and command,
+// the address family and protocol, the length of the rest, then the
+// addresses and any TLVs, which are skipped.
+func (c *proxyConn) readV2() error {
+	var h [16]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return err
+	}
+	if h[12]>>4 != 2 {
+		return fmt.Errorf("unsupported version %d", h[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+	// LOCAL connections are the load balancer's own
+	if h[12]&0xf == 0 {
+		return nil
+	}
+	if h[12]&0xf != 1 {
+		return fmt.Errorf("unsupported command %d", h[12]&0xf)
+	}
+	var size int
+	switch h[13] {
+	case 0x11: // TCP over IPv4
+		size = 4
+	case 0x21: // TCP over IPv6
+		size = 16
+	default:
+		// Other families and protocols carry no address to use
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return errors.New("truncated version 2 addresses")
+	}
+	src, _ := netip.AddrFromSlice(body[:size])
+	dst, _ := netip.AddrFromSlice(body[size : 2*size])
+	ports := body[2*size:]
+	c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports)))
+	c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:])))
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptsName returns the path of the terminal behind the PTY master f.
+func ptsName(f *os.File) (string, error) {
+	var name [128]byte
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.TIOCPTYGNAME, uintptr(unsafe.Pointer(&name[0]))); errno != 0 {
+		return "", errno
+	}
+	n, _, _ := bytes.Cut(name[:], []byte{0})
+	return string(n), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// ptsName fails: finding the terminal of a PTY master differs between the
+// BSDs.
+func ptsName(f *os.File) (string, error) {
+	return "", errors.New("finding the terminal of a PTY is not supported on this system")
+}
@@ -0,0 +1,168 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// ptyState is the PTY a session's shell or command runs on.
+type ptyState struct {
+	ptyFile *os.File
+}
+
+// runPTY starts cmd on a new PTY set up as the pty-req asked, copying between
+// it and the channel after writing welcome, if any. It reports whether the
+// request was accepted.
+func (sess *session) runPTY(req *ssh.Request, cmd *exec.Cmd, welcome string) bool {
+	if err := sess.limit(cmd); err != nil {
+		warnf("Failed to start PTY for %s: %v", sess.user.Name, err)
+		req.Reply(false, nil)
+		return false
+	}
+	f, err := sess.startPTY(cmd)
+	if err != nil {
+		warnf("Failed to start PTY for %s: %v", sess.user.Name, err)
+		req.Reply(false, nil)
+		return false
+	}
+	sess.ptyFile = f
+	if sess.account != nil {
+		if err := sess.account.chownPTY(f); err != nil {
+			warnf("Failed to hand the PTY to %s: %v", sess.account.name, err)
+		}
+	}
+
+	req.Reply(true, nil)
+	sess.onTerminal.Store(true)
+	if tty, err := ptsName(f); err == nil {
+		sess.setTTY(tty)
+	}
+	// Ahead of the PTY's output, which waits in the terminal until copied
+	_, _ = io.WriteString(sess.ch, welcome)
+	if sess.detachable() {
+		sess.runDetachable(f, cmd)
+		return true
+	}
+
+	// Pipe data between SSH channel and PTY
+	output := make(chan struct{})
+	go func() { _, _ = copyData(f, sess.ch) }()
+	go func() {
+		_, _ = copyData(sess.ch, f)
+		_ = sess.ch.CloseWrite()
+		close(output)
+	}()
+
+	logout := sess.recordLogin(f, cmd.Process.Pid)
+	sess.background(cmd, func() {
+		sess.wait(cmd, output)
+		logout()
+	})
+	return true
+}
+
+// resizePTY gives the PTY, if started, the size of the last window-change.
+func (sess *session) resizePTY() {
+	if sess.ptyFile != nil {
+		_ = pty.Setsize(sess.ptyFile, &pty.Winsize{Cols: uint16(sess.ptyCols), Rows: uint16(sess.ptyRows)})
+	}
+}
+
+// closePTY closes the PTY, if started, hanging up what still runs on it.
+func (sess *session) closePTY() {
+	if sess.ptyFile != nil {
+		sess.ptyFile.Close()
+	}
+}
+
+// readingSecret reports whether what runs on the PTY reads lines with echo
+// off, as at password prompts.
+func (sess *session) readingSecret() bool {
+	if sess.ptyFile == nil {
+		return false
+	}
+	rc, err := sess.ptyFile.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var t *unix.Termios
+	// Not Fd, which would make the PTY blocking
+	_ = rc.Control(func(fd uintptr) { t, err = unix.IoctlGetTermios(int(fd), ioctlGetTermios) })
+	return err == nil && t.Lflag&unix.ECHO == 0 && t.Lflag&unix.ICANON != 0
+}
+
+// breakPTY delivers a break to the foreground process group of the PTY. It
+// reports false if the session has no PTY.
+func (sess *session) breakPTY() (bool, error) {
+	if sess.ptyFile == nil {
+		return false, nil
+	}
+	pgrp, err := unix.IoctlGetInt(int(sess.ptyFile.Fd()), unix.TIOCGPGRP)
+	if err == nil {
+		err = syscall.Kill(-pgrp, sess.breakSignal)
+	}
+	return true, err
+}
+
+// chownPTY gives a the terminal behind the PTY master f and makes it
+// writable by the owner only, as OpenSSH does.
+func (a *systemAccount) chownPTY(f *os.File) error {
+	tty, err := ptsName(f)
+	if err != nil {
+		return err
+	}
+	if err := a.chown(tty); err != nil {
+		return err
+	}
+	return os.Chmod(tty, 0o620)
+}
+
+// startPTY starts cmd on a new PTY, as pty.Start does, after giving its
+// terminal the size and modes of the pty-req so the command starts with
+// the client's settings, and SSH_TTY naming it.
+func (sess *session) startPTY(cmd *exec.Cmd) (*os.File, error) {
+	f, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+	if sess.ptyCols > 0 && sess.ptyRows > 0 {
+		_ = pty.Setsize(f, &pty.Winsize{Cols: uint16(sess.ptyCols), Rows: uint16(sess.ptyRows)})
+	}
+	if len(sess.ptyModes) > 0 {
+		t, err := unix.IoctlGetTermios(int(tty.Fd()), ioctlGetTermios)
+		if err == nil {
+			applyTermModes(t, sess.ptyModes)
+			err = unix.IoctlSetTermios(int(tty.Fd()), ioctlSetTermios, t)
+		}
+		if err != nil {
+			warnf("Failed to set terminal modes for %s: %v", sess.user.Name, err)
+		}
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	// The host's terminal means nothing inside a container
+	if sess.container == "" {
+		if cmd.Env == nil {
+			cmd.Env = sessionEnviron()
+		}
+		cmd.Env = append(cmd.Env, "SSH_TTY="+tty.Name())
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	if err := cmd.Start(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
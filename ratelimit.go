@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig throttles authentication attempts per source IP.
+type RateLimitConfig struct {
+	// MaxAttemptsPerMinute failed attempts from one IP block it for
+	// BlockDuration. Defaults to 10.
+	MaxAttemptsPerMinute int `yaml:"max_attempts_per_minute"`
+	// BaseDelay is the delay after the first failure; it doubles with every
+	// further consecutive failure up to MaxDelay. Defaults to 1s and 30s.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+	// BlockDuration defaults to 5m.
+	BlockDuration time.Duration `yaml:"block_duration"`
+}
+
+// rateLimiter tracks recent auth failures per source IP.
+type rateLimiter struct {
+	cfg RateLimitConfig
+
+	mu  sync.Mutex
+	ips map[string]*ipAttempts
+}
+
+type ipAttempts struct {
+	failures     []time.Time // within the last minute
+	consecutive  int
+	blockedUntil time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	if cfg.MaxAttemptsPerMinute <= 0 {
+		cfg.MaxAttemptsPerMinute = 10
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = time.Second
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = 30 * time.Second
+	}
+	if cfg.BlockDuration <= 0 {
+		cfg.BlockDuration = 5 * time.Minute
+	}
+	l := &rateLimiter{cfg: cfg, ips: make(map[string]*ipAttempts)}
+	go l.prune()
+	return l
+}
+
+// blocked reports whether ip is currently rejected.
+func (l *rateLimiter) blocked(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.ips[ip]
+	return ok && time.Now().Before(a.blockedUntil)
+}
+
+// delay returns how long to wait before evaluating the next attempt from ip.
+func (l *rateLimiter) delay(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.ips[ip]
+	if !ok || a.consecutive == 0 {
+		return 0
+	}
+	d := l.cfg.BaseDelay
+	for i := 1; i < a.consecutive && d < l.cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, l.cfg.MaxDelay)
+}
+
+// failure records a failed attempt and reports whether ip is now blocked.
+func (l *rateLimiter) failure(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	a, ok := l.ips[ip]
+	if !ok {
+		a = &ipAttempts{}
+		l.ips[ip] = a
+	}
+	a.failures = append(recentAttempts(a.failures, now), now)
+	a.consecutive++
+	if len(a.failures) >= l.cfg.MaxAttemptsPerMinute {
+		a.blockedUntil = now.Add(l.cfg.BlockDuration)
+		a.failures = nil
+		return true
+	}
+	return false
+}
+
+// success clears the backoff for ip.
+func (l *rateLimiter) success(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if a, ok := l.ips[ip]; ok {
+		a.consecutive = 0
+	}
+}
+
+// recentAttempts drops entries older than a minute.
+func recentAttempts(ts []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-time.Minute)
+	i := 0
+	for i < len(ts) && ts[i].Before(cutoff) {
+		i++
+	}
+	return ts[i:]
+}
+
+// prune periodically forgets IPs with no recent activity.
+func (l *rateLimiter) prune() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		l.mu.Lock()
+		for ip, a := range l.ips {
+			a.failures = recentAttempts(a.failures, now)
+			if len(a.failures) == 0 && now.After(a.blockedUntil) {
+				delete(l.ips, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// remoteIP returns the host part of addr.
+func remoteIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
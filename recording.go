@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SessionRecordingConfig records the shells and commands of logins with
+// record_sessions to a file per session, in asciinema's asciicast v2
+// format: a JSON header line, then a [seconds, "o" or "i", data] line per
+// chunk of output or input. "asciinema play" replays them.
+//
+//	session_recording:
+//	  dir: /var/log/ssh-sessions
+//	  redact_prompts: ["(?i)vault token: *$"]
+type SessionRecordingConfig struct {
+	// Dir receives the recordings, created if missing.
+	Dir string `yaml:"dir"`
+	// Input records what clients send, not only what sessions show them;
+	// on by default.
+	Input *bool `yaml:"input"`
+	// RedactPrompts are regular expressions for prompts, besides password
+	// ones, where the line typed next is replaced by [redacted]. Input on a
+	// PTY with echo off, as at most password prompts, is always redacted.
+	RedactPrompts []string `yaml:"redact_prompts"`
+}
+
+// defaultSecretPrompt matches the password prompts of sudo, su, ssh and
+// the like at the end of the output.
+var defaultSecretPrompt = regexp.MustCompile(`(?i)(password|passphrase|passcode|pin)[^\n]*: *$`)
+
+// permRecordSessions marks a login whose sessions are recorded.
+const permRecordSessions = "record-sessions"
+
+// sessionRecordings creates the recording files.
+type sessionRecordings struct {
+	dir     string
+	input   bool
+	prompts []*regexp.Regexp
+	n       atomic.Int64
+}
+
+func newSessionRecordings(cfg SessionRecordingConfig) (*sessionRecordings, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("session_recording: dir is required")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("session_recording: %v", err)
+	}
+	r := &sessionRecordings{dir: cfg.Dir, input: cfg.Input == nil || *cfg.Input, prompts: []*regexp.Regexp{defaultSecretPrompt}}
+	for _, p := range cfg.RedactPrompts {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("session_recording: redact_prompts: %v", err)
+		}
+		r.prompts = append(r.prompts, re)
+	}
+	return r, nil
+}
+
+// recordingHeader is the first line of an asciicast v2 file.
+type recordingHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// open starts the recording of a session of user from remote running
+// command, on a terminal of cols by rows if term is set. secret, if set,
+// reports whether the terminal is reading a secret.
+func (r *sessionRecordings) open(user, remote, command, term string, cols, rows uint32, secret func() bool) (*sessionRecording, error) {
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s-%d.cast", user, now.UTC().Format("20060102T150405Z"), r.n.Add(1))
+	f, err := os.OpenFile(filepath.Join(r.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if cols == 0 || rows == 0 {
+		cols, rows = 80, 24
+	}
+	h := recordingHeader{Version: 2, Width: cols, Height: rows, Timestamp: now.Unix(), Title: fmt.Sprintf("%s from %s: %s", user, remote, command)}
+	if term != "" {
+		h.Env = map[string]string{"TERM": term}
+	}
+	if err := json.NewEncoder(f).Encode(h); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &sessionRecording{f: f, start: now, input: r.input, prompts: r.prompts, secret: secret}, nil
+}
+
+// sessionRecording is the recording of one session.
+type sessionRecording struct {
+	f       *os.File
+	start   time.Time
+	input   bool
+	prompts []*regexp.Regexp
+	secret  func() bool
+
+	mu        sync.Mutex
+	closed    bool
+	prompted  bool // the output ends with a secret prompt
+	redacting bool // input is a secret until the end of the line
+}
+
+func (r *sessionRecording) event(kind string, data []byte) {
+	if r.closed {
+		return
+	}
+	line, _ := json.Marshal([]any{float64(time.Since(r.start).Microseconds()) / 1e6, kind, string(data)})
+	if _, err := r.f.Write(append(line, '\n')); err != nil {
+		warnf("Failed to write session recording %s: %v", r.f.Name(), err)
+		r.closed = true
+	}
+}
+
+func (r *sessionRecording) output(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("o", p)
+	last := p[bytes.LastIndexByte(p, '\n')+1:]
+	r.prompted = false
+	for _, re := range r.prompts {
+		if re.Match(last) {
+			r.prompted = true
+		}
+	}
+}
+
+// record records input, with secrets typed at prompts or with echo off
+// replaced up to the end of their line.
+func (r *sessionRecording) record(p []byte) {
+	if !r.input {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.redacting && !r.prompted && (r.secret == nil || !r.secret()) {
+		r.event("i", p)
+		return
+	}
+	end := bytes.IndexAny(p, "\r\n")
+	if end < 0 {
+		r.redacting = true
+		return
+	}
+	r.redacting, r.prompted = false, false
+	r.event("i", append([]byte("[redacted]"), p[end:]...))
+}
+
+func (r *sessionRecording) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.f.Close()
+}
+
+// discard closes and removes a recording of a session that did not start.
+func (r *sessionRecording) discard() {
+	r.close()
+	os.Remove(r.f.Name())
+}
+
+// recordedChannel is a session channel whose data is recorded once a
+// recording is set.
+type recordedChannel struct {
+	ssh.Channel
+	rec atomic.Pointer[sessionRecording]
+}
+
+func (c *recordedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if rec := c.rec.Load(); rec != nil && n > 0 {
+		rec.record(p[:n])
+	}
+	return n, err
+}
+
+func (c *recordedChannel) Write(p []byte) (int, error) {
+	if rec := c.rec.Load(); rec != nil {
+		rec.output(p)
+	}
+	return c.Channel.Write(p)
+}
+
+func (c *recordedChannel) Stderr() io.ReadWriter {
+	return &recordedStream{ReadWriter: c.Channel.Stderr(), c: c}
+}
+
+// recordedStream is the stderr of a recordedChannel, recorded as output
+// as asciicast has no stream for it.
+type recordedStream struct {
+	io.ReadWriter
+	c *recordedChannel
+}
+
+func (s *recordedStream) Write(p []byte) (int, error) {
+	if rec := s.c.rec.Load(); rec != nil {
+		rec.output(p)
+	}
+	return s.ReadWriter.Write(p)
+}
+
+// stop ends the channel's recording, if any. Recordings of sessions whose
+// shell or command was refused are removed.
+func (c *recordedChannel) stop(started bool) {
+	if c == nil {
+		return
+	}
+	rec := c.rec.Swap(nil)
+	switch {
+	case rec == nil:
+	case started:
+		rec.close()
+	default:
+		rec.discard()
+	}
+}
+
+// recordChannel returns ch, ready to be recorded if the login's sessions
+// are, and the recording channel or nil.
+func (s *server) recordChannel(ch ssh.Channel, perms *ssh.Permissions) (ssh.Channel, *recordedChannel) {
+	if s.recordings == nil || !permitted(perms, permRecordSessions) {
+		return ch, nil
+	}
+	rc := &recordedChannel{Channel: ch}
+	return rc, rc
+}
+
+// startRecording records the session from its shell or command on, if its
+// login is recorded.
+func (sess *session) startRecording(command string) {
+	if sess.recorded == nil {
+		return
+	}
+	term := ""
+	if sess.ptyRequested {
+		term = sess.ptyTerm
+	}
+	rec, err := sess.recordings.open(sess.user.Name, sess.conn.RemoteAddr().String(), command, term, sess.ptyCols, sess.ptyRows, sess.readingSecret)
+	if err != nil {
+		warnf("Failed to record session of %s: %v", sess.user.Name, err)
+		return
+	}
+	infof("Recording session of %s to %s", sess.user.Name, rec.f.Name())
+	sess.recorded.rec.Store(rec)
+}
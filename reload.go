@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// serverPolicy is the part of the configuration that applies to each new
+// connection or session, replaced as a whole by a reload.
+type serverPolicy struct {
+	defaultPermissions PermissionsConfig
+	acceptEnv          []string
+	defaultTerm        string
+	breakSignal        syscall.Signal
+	idleTimeout        time.Duration
+	loginGrace         time.Duration
+	aliveInterval      time.Duration
+	aliveCountMax      int
+	maxSession         time.Duration
+	maxSessions        int // per connection
+	maxUserSessions    int
+}
+
+func newServerPolicy(cfg *Config) (*serverPolicy, error) {
+	p := &serverPolicy{
+		defaultPermissions: cfg.DefaultPermissions, acceptEnv: cfg.AcceptEnv, defaultTerm: cfg.DefaultTerm,
+		idleTimeout: cfg.IdleTimeout, loginGrace: cfg.LoginGraceTime, maxSession: cfg.MaxSessionDuration,
+		aliveInterval: cfg.ClientAliveInterval, aliveCountMax: cfg.ClientAliveCountMax,
+		maxSessions: cfg.MaxSessions, maxUserSessions: cfg.MaxUserSessions,
+	}
+	if p.acceptEnv == nil {
+		p.acceptEnv = defaultAcceptEnv
+	}
+	if p.defaultTerm == "" {
+		p.defaultTerm = "xterm"
+	}
+	if p.aliveInterval < 0 || p.aliveCountMax < 0 {
+		return nil, errors.New("client_alive_interval and client_alive_count_max must not be negative")
+	}
+	if p.aliveCountMax == 0 {
+		p.aliveCountMax = defaultAliveCountMax
+	}
+	if p.loginGrace == 0 {
+		p.loginGrace = defaultLoginGrace
+	}
+	if err := checkEnvPatterns(p.acceptEnv); err != nil {
+		return nil, err
+	}
+	if err := checkPermissions(cfg.DefaultPermissions); err != nil {
+		return nil, fmt.Errorf("default_permissions: %v", err)
+	}
+	var err error
+	if p.breakSignal, err = parseBreakAction(cfg.BreakAction); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reloadable are the settings a reload applies; the others are only read
+// at startup.
+var reloadable = map[string]bool{
+	"users": true, "groups": true, "authorized_keys_file": true, "default_permissions": true,
+	"accept_env": true, "default_term": true, "break_action": true, "idle_timeout": true, "login_grace_time": true,
+	"client_alive_interval": true, "client_alive_count_max": true, "max_session_duration": true, "max_sessions": true, "max_user_sessions": true, "banner": true,
+}
+
+// reload rereads the configuration file and applies its users, their keys,
+// the auth method policies, the banner and the session policy to new
+// connections and sessions; those open keep what they started with. On
+// error nothing changes.
+func (s *server) reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	cfg, err := s.readConfig()
+	if err != nil {
+		return err
+	}
+	users, err := newUserDB(cfg.Users, cfg.AuthorizedKeysFile)
+	if err != nil {
+		return fmt.Errorf("users: %v", err)
+	}
+	steps, err := newAuthSteps(cfg.Users, cfg.Groups)
+	if err != nil {
+		return fmt.Errorf("auth methods: %v", err)
+	}
+	policy, err := newServerPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	var banner *banners
+	if cfg.Banner != nil {
+		if banner, err = newBanners(*cfg.Banner); err != nil {
+			return fmt.Errorf("banner: %v", err)
+		}
+	}
+	// Passwords changed since startup are not in the file
+	if err := s.passwords.apply(users); err != nil {
+		return err
+	}
+
+	applied, restart := configChanges(s.cfg, cfg, s.users, users)
+	s.users.replace(users)
+	s.steps.Store(steps)
+	s.policy.Store(policy)
+	s.banner.Store(banner)
+	s.cfg = withReloaded(s.cfg, cfg)
+
+	if len(applied) == 0 {
+		infof("Reloaded %s: no changes", configFile)
+	} else {
+		infof("Reloaded %s: %s", configFile, strings.Join(applied, "; "))
+	}
+	if len(restart) > 0 {
+		warnf("Changed in %s but only applied after a restart: %s", configFile, strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+// configChanges describes what differs between old, what the server runs
+// with, and next: the changes
+// a reload applies, with users added, removed or changed (including their
+// keys, from either the file or their authorized_keys), and the settings
+// that need a restart.
+func configChanges(old, next *Config, oldUsers, nextUsers *userDB) (applied, restart []string) {
+	was, is := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < was.NumField(); i++ {
+		name, _, _ := strings.Cut(was.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "users" || reflect.DeepEqual(was.Field(i).Interface(), is.Field(i).Interface()) {
+			continue
+		}
+		if reloadable[name] {
+			applied = append(applied, name+" changed")
+		} else {
+			restart = append(restart, name)
+		}
+	}
+
+	var added, removed, changed []string
+	for _, name := range nextUsers.names() {
+		u, _ := nextUsers.lookup(name)
+		prev, ok := oldUsers.lookup(name)
+		switch {
+		case !ok:
+			added = append(added, name)
+		case !reflect.DeepEqual(prev.UserConfig, u.UserConfig) || !sameKeys(prev.keys, u.keys):
+			changed = append(changed, name)
+		}
+	}
+	for _, name := range oldUsers.names() {
+		if _, ok := nextUsers.lookup(name); !ok {
+			removed = append(removed, name)
+		}
+	}
+	for _, c := range []struct {
+		what  string
+		names []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+		if len(c.names) > 0 {
+			applied = append(applied, fmt.Sprintf("users %s: %s", c.what, strings.Join(c.names, ", ")))
+		}
+	}
+	return applied, restart
+}
+
+// withReloaded returns cur with the reloadable settings of next, which is
+// what the server runs with after a reload.
+func withReloaded(cur, next *Config) *Config {
+	running := *cur
+	v, n := reflect.ValueOf(&running).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ","); reloadable[name] {
+			v.Field(i).Set(n.Field(i))
+		}
+	}
+	return &running
+}
+
+// sameKeys reports whether a and b authorize the same keys with the same
+// options, in the same order.
+func sameKeys(a, b []authorizedKey) bool {
+	return slices.EqualFunc(a, b, func(x, y authorizedKey) bool {
+		return string(x.Key.Marshal()) == string(y.Key.Marshal()) && slices.Equal(x.Options, y.Options)
+	})
+}
+
+// reloadOnHangup reloads the configuration on each SIGHUP, for the life
+// of the server.
+func (s *server) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := s.reload(); err != nil {
+			warnf("Keeping the previous configuration: %s: %v", configFile, err)
+		}
+	}
+}
+
+func init() {
+	registerAdminCommand("reload", "reload", "reread the configuration file, as SIGHUP does", func(s *server, args []string, w io.Writer) error {
+		if len(args) != 0 {
+			return errors.New("usage: reload")
+		}
+		if err := s.reload(); err != nil {
+			return fmt.Errorf("keeping the previous configuration: %v", err)
+		}
+		fmt.Fprintf(w, "Reloaded %s\n", configFile)
+		return nil
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// permAllowedCommands carries the allowed_commands patterns of a login,
+// one per line.
+const permAllowedCommands = "allowed-commands"
+
+// shellMetacharacters are what the shell running an allowed command would
+// treat as more than its arguments: separators, pipes, redirections,
+// expansions and subshells. Commands with any are refused whatever the
+// patterns, so that one such as "allowed .*" cannot also run "allowed; sh".
+const shellMetacharacters = ";&|<>$`(){}\n\r"
+
+// commandPatterns are the compiled allowed_commands patterns, anchored, by
+// pattern. They are compiled as the configuration is loaded.
+var commandPatterns sync.Map // string to *regexp.Regexp
+
+// checkCommandPatterns validates allowed_commands patterns, compiling them
+// for commandAllowed.
+func checkCommandPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("allowed_commands: %v", err)
+		}
+		commandPatterns.Store(p, regexp.MustCompile(`^(?:`+p+`)$`))
+	}
+	return nil
+}
+
+// allowedCommands returns the patterns the login's commands must match, if
+// it is restricted to them.
+func allowedCommands(perms *ssh.Permissions) ([]string, bool) {
+	if perms == nil {
+		return nil, false
+	}
+	list, ok := perms.Extensions[permAllowedCommands]
+	if !ok {
+		return nil, false
+	}
+	return strings.Split(list, "\n"), true
+}
+
+// commandAllowed reports whether command matches one of the patterns in
+// full and has no shell metacharacters. Patterns were checked, and
+// compiled, when the configuration was loaded.
+func commandAllowed(patterns []string, command string) bool {
+	if strings.ContainsAny(command, shellMetacharacters) {
+		return false
+	}
+	for _, p := range patterns {
+		if re, ok := commandPatterns.Load(p); ok && re.(*regexp.Regexp).MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// restricted reports whether the client's commands must pass the login's
+// allowlist. A forced command replaces them, so it is not checked.
+func (sess *session) restricted() ([]string, bool) {
+	if _, forced := forcedCommand(sess.conn.Permissions); forced {
+		return nil, false
+	}
+	return allowedCommands(sess.conn.Permissions)
+}
+
+// refuseCommand tells the client command is not allowed.
+func (sess *session) refuseCommand(req *ssh.Request, command string) bool {
+	infof("Refusing command for %s: %q is not allowed", sess.user.Name, command)
+	return sess.refuse(req, "Command not allowed: "+command)
+}
+
+// refuse accepts req only to print message and exit with status 1, which
+// clients show better than a failed request.
+func (sess *session) refuse(req *ssh.Request, message string) bool {
+	req.Reply(true, nil)
+	sess.background(nil, func() {
+		fmt.Fprintf(sess.ch.Stderr(), "%s\r\n", message)
+		sendExitStatus(sess.ch, 1)
+	})
+	return true
+}
+
+// runRestrictedShell serves the built-in shell of logins restricted to
+// allowed_commands: each line is checked against the allowlist and run
+// without input. With a PTY it offers line editing and a prompt.
+func (sess *session) runRestrictedShell(req *ssh.Request, patterns []string) bool {
+	req.Reply(true, nil)
+	infof("Restricted shell started for %s", sess.user.Name)
+	sess.background(nil, func() {
+		var (
+			out      io.Writer = sess.ch
+			readLine func() (string, error)
+		)
+		if sess.ptyRequested {
+			_, _ = io.WriteString(sess.ch, sess.welcome)
+			t := term.NewTerminal(sess.ch, sess.user.Name+"> ")
+			if sess.ptyCols > 0 && sess.ptyRows > 0 {
+				_ = t.SetSize(int(sess.ptyCols), int(sess.ptyRows))
+			}
+			out, readLine = t, t.ReadLine
+		} else {
+			sc := bufio.NewScanner(sess.ch)
+			readLine = func() (string, error) {
+				if !sc.Scan() {
+					return "", io.EOF
+				}
+				return sc.Text(), nil
+			}
+		}
+
+		status := 0
+		for {
+			line, err := readLine()
+			if err != nil {
+				break
+			}
+			switch line = strings.TrimSpace(line); line {
+			case "":
+				continue
+			case "exit", "logout":
+				sendExitStatus(sess.ch, status)
+				return
+			case "help":
+				fmt.Fprintln(out, "Allowed commands (regular expressions):")
+				for _, p := range patterns {
+					fmt.Fprintln(out, "  "+p)
+				}
+				continue
+			}
+			if !commandAllowed(patterns, line) {
+				infof("Refusing command for %s: %q is not allowed", sess.user.Name, line)
+				fmt.Fprintf(out, "Command not allowed: %s\n", line)
+				status = 1
+				continue
+			}
+			status = sess.runRestricted(line, out)
+		}
+		sendExitStatus(sess.ch, status)
+	})
+	return true
+}
+
+// runRestricted runs an allowed command line of the restricted shell and
+// returns its exit status.
+func (sess *session) runRestricted(line string, out io.Writer) int {
+	cmd := sess.command(line)
+	cmd.Stdout, cmd.Stderr = out, out
+	err := sess.limit(cmd)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintf(out, "%v\n", err)
+		return 127
+	}
+	return 0
+}
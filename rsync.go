@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Extensions carrying the rsync_only directory of a login and its
+// rsync_access mode.
+const (
+	permRsyncOnly   = "rsync-only"
+	permRsyncAccess = "rsync-access"
+)
+
+// rsyncOnly returns the directory an rsync_only login is confined to and
+// its access mode: "read-only", "write-only" or empty for both.
+func rsyncOnly(perms *ssh.Permissions) (dir, access string, ok bool) {
+	if perms == nil {
+		return "", "", false
+	}
+	dir, ok = perms.Extensions[permRsyncOnly]
+	return dir, perms.Extensions[permRsyncAccess], ok
+}
+
+// checkRsyncAccess validates an rsync_access setting.
+func checkRsyncAccess(access string) error {
+	switch access {
+	case "", "read-only", "write-only":
+		return nil
+	}
+	return fmt.Errorf("rsync_access: %q is not read-only or write-only", access)
+}
+
+// parseRsyncCommand recognises the command an rsync client runs on the
+// server, "rsync --server ...", and returns its words.
+func parseRsyncCommand(command string) ([]string, bool) {
+	args, err := shellSplit(command)
+	if err != nil || len(args) < 2 || path.Base(args[0]) != "rsync" || args[1] != "--server" {
+		return nil, false
+	}
+	return args, true
+}
+
+// rsyncShortOptions are the single-letter options rsync_only logins may
+// pass, as allowed by rrsync; e is followed by protocol flags, not options.
+const rsyncShortOptions = "ACDEHIJKLNORSUWXbcdgklmnopqrstuvxyz"
+
+// rsyncLongOptions are the long options rsync_only logins may pass, and
+// whether they take a value. Options naming server paths outside the
+// arguments, such as --log-file or --temp-dir, are not among them.
+var rsyncLongOptions = map[string]bool{
+	"append": false, "backup": false, "checksum": false, "delay-updates": false,
+	"delete": false, "delete-after": false, "delete-before": false,
+	"delete-delay": false, "delete-during": false, "delete-excluded": false,
+	"delete-missing-args": false, "existing": false, "fake-super": false,
+	"force": false, "from0": false, "fsync": false, "ignore-errors": false,
+	"ignore-existing": false, "ignore-missing-args": false, "ignore-times": false,
+	"inplace": false, "list-only": false, "munge-links": false,
+	"no-implied-dirs": false, "no-r": false, "no-relative": false, "no-W": false,
+	"no-whole-file": false, "numeric-ids": false, "omit-dir-times": false,
+	"omit-link-times": false, "partial": false, "preallocate": false,
+	"prune-empty-dirs": false, "remove-source-files": false, "safe-links": false,
+	"sender": false, "size-only": false, "sparse": false, "update": false,
+
+	"block-size": true, "bwlimit": true, "checksum-choice": true,
+	"checksum-seed": true, "chmod": true, "compress-choice": true,
+	"compress-level": true, "iconv": true, "max-alloc": true, "max-delete": true,
+	"max-size": true, "min-size": true, "modify-window": true, "stop-after": true,
+	"stop-at": true, "suffix": true, "timeout": true,
+}
+
+// restrictRsync applies rrsync's rules to the words of an rsync --server
+// command for an rsync_only login: only known options, reads or writes as
+// access allows, and every path taken as relative to dir. Symlinks are
+// munged so they cannot lead out of it. It returns the command to run.
+func restrictRsync(args []string, dir, access string) ([]string, error) {
+	// The server picks the binary, not the client's --rsync-path
+	out := []string{"rsync", "--server", "--munge-links"}
+	sender := false
+	i := 2
+	for ; i < len(args) && args[i] != "."; i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name, _, hasValue := strings.Cut(arg[2:], "=")
+			takesValue, ok := rsyncLongOptions[name]
+			if !ok || takesValue != hasValue {
+				return nil, fmt.Errorf("option %s is not allowed", arg)
+			}
+			if name == "sender" {
+				sender = true
+			}
+			// A read-only server is always the source, whose files this deletes
+			if name == "remove-source-files" && access == "read-only" {
+				return nil, fmt.Errorf("option %s is not allowed", arg)
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for _, c := range arg[1:] {
+				if c == 'e' {
+					break
+				}
+				if !strings.ContainsRune(rsyncShortOptions, c) {
+					return nil, fmt.Errorf("option -%c is not allowed", c)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+		out = append(out, arg)
+	}
+	if i == len(args) {
+		return nil, fmt.Errorf("no paths")
+	}
+	switch {
+	case access == "read-only" && !sender:
+		return nil, fmt.Errorf("writing is not allowed")
+	case access == "write-only" && sender:
+		return nil, fmt.Errorf("reading is not allowed")
+	}
+	out = append(out, ".")
+	for _, p := range args[i+1:] {
+		for _, part := range strings.Split(p, "/") {
+			if part == ".." {
+				return nil, fmt.Errorf("path %q leaves the directory", p)
+			}
+		}
+		// Keep a trailing slash, which rsync gives a meaning
+		rel := strings.TrimLeft(p, "/")
+		out = append(out, strings.TrimSuffix(dir, "/")+"/"+rel)
+	}
+	return out, nil
+}
+
+// runRsync serves an rsync --server command: rsync runs directly, with no
+// shell whose startup files could print into the protocol, and without a
+// PTY, which would mangle it. Without an rsync binary the command is left
+// to the shell, which reports it missing, except for rsync_only accounts.
+func (sess *session) runRsync(req *ssh.Request, command string, args []string) bool {
+	bin := args[0]
+	if !strings.Contains(bin, "/") {
+		p, err := exec.LookPath(bin)
+		if err != nil {
+			if _, _, ok := rsyncOnly(sess.conn.Permissions); ok {
+				warnf("No rsync for %s: %v", sess.user.Name, err)
+				return sess.refuse(req, "rsync: command not found")
+			}
+			return sess.runCommand(req, sess.command(command))
+		}
+		bin = p
+	}
+	cmd := sess.command(command)
+	cmd.Path, cmd.Args = bin, append([]string{"rsync"}, args[1:]...)
+	return sess.runCommand(req, cmd)
+}
+
+// runRsyncOnly serves an exec request of an rsync_only login, refusing any
+// command but a permitted rsync --server.
+func (sess *session) runRsyncOnly(req *ssh.Request, command, dir, access string) bool {
+	args, ok := parseRsyncCommand(command)
+	if !ok {
+		return sess.refuseCommand(req, command)
+	}
+	args, err := restrictRsync(args, dir, access)
+	if err != nil {
+		infof("Refusing rsync for %s: %v", sess.user.Name, err)
+		return sess.refuse(req, "rsync: "+err.Error())
+	}
+	infof("rsync for %s in %s: %s", sess.user.Name, dir, strings.Join(args, " "))
+	return sess.runRsync(req, command, args)
+}
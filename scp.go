@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpOptions is a parsed remote scp invocation: "scp -t <target>" receives
+// files from the client, "scp -f <paths>" sends them.
+type scpOptions struct {
+	sink      bool // -t
+	source    bool // -f
+	recursive bool // -r
+	preserve  bool // -p: modes and times
+	targetDir bool // -d: the target must be a directory
+	paths     []string
+}
+
+// parseSCPCommand recognises the command OpenSSH's scp runs on the server
+// in its legacy (scp -O) protocol mode. Anything else, including flags it
+// does not know, is left to the shell.
+func parseSCPCommand(command string) (*scpOptions, bool) {
+	args, err := shellSplit(command)
+	if err != nil || len(args) == 0 || path.Base(args[0]) != "scp" {
+		return nil, false
+	}
+	opts := &scpOptions{}
+	i := 1
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		for _, f := range arg[1:] {
+			switch f {
+			case 't':
+				opts.sink = true
+			case 'f':
+				opts.source = true
+			case 'r':
+				opts.recursive = true
+			case 'p':
+				opts.preserve = true
+			case 'd':
+				opts.targetDir = true
+			case 'v':
+			default:
+				return nil, false
+			}
+		}
+	}
+	opts.paths = args[i:]
+	if opts.sink == opts.source || len(opts.paths) == 0 {
+		return nil, false
+	}
+	return opts, true
+}
+
+// shellSplit splits a command line into words with sh quoting rules for
+// single quotes, double quotes and backslashes.
+func shellSplit(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\\\"$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// errSCPWarning is returned when the peer rejects a single file; the
+// transfer carries on with the next one.
+var errSCPWarning = errors.New("scp: file rejected")
+
+// scpConn runs one side of the scp protocol over a session channel.
+type scpConn struct {
+	opts *scpOptions
+	home string
+	r    *bufio.Reader
+	w    io.Writer
+	// failed records errors reported to the client, which make scp exit
+	// with status 1
+	failed bool
+}
+
+// runSCP serves an scp invocation in-process, so scp works without an scp
+// binary on the host. Sessions running as a system account use a helper
+// process with the account's privileges instead. It reports whether the
+// request was accepted.
+func (sess *session) runSCP(req *ssh.Request, command string, opts *scpOptions) bool {
+	if sess.account != nil {
+		infof("SCP by %s as system account: %s", sess.user.Name, command)
+		return sess.runHelper(req, "scp-server", command)
+	}
+	req.Reply(true, nil)
+	sess.background(nil, func() {
+		s := &scpConn{opts: opts, home: sess.home, r: bufio.NewReader(sess.ch), w: sess.ch}
+		sendExitStatus(sess.ch, s.serve(sess.user.Name))
+	})
+	return true
+}
+
+// serve runs the transfer and returns the exit status for the client.
+func (s *scpConn) serve(user string) int {
+	var err error
+	switch {
+	case s.opts.sink && len(s.opts.paths) > 1:
+		err = s.fatal("ambiguous target")
+	case s.opts.sink:
+		infof("SCP upload by %s to %s", user, s.opts.paths[0])
+		err = s.sink(s.resolve(s.opts.paths[0]))
+	default:
+		infof("SCP download by %s of %s", user, strings.Join(s.opts.paths, " "))
+		err = s.source()
+	}
+	if err != nil {
+		warnf("SCP for %s failed: %v", user, err)
+	}
+	if err != nil || s.failed {
+		return 1
+	}
+	return 0
+}
+
+// scpServerMain implements the "scp-server" helper subcommand, which serves
+// the scp command line in args on stdin and stdout. Its stderr goes to the
+// client, so it does not log.
+func scpServerMain(args []string) {
+	args = enterChroot(args)
+	if len(args) != 1 {
+		log.Fatalf("usage: scp-server <scp command>")
+	}
+	opts, ok := parseSCPCommand(args[0])
+	if !ok {
+		log.Fatalf("scp-server: unsupported command %q", args[0])
+	}
+	log.SetOutput(io.Discard)
+	s := &scpConn{opts: opts, r: bufio.NewReader(os.Stdin), w: os.Stdout}
+	os.Exit(s.serve(""))
+}
+
+// resolve makes p relative to the user's home, like a login shell would.
+func (s *scpConn) resolve(p string) string {
+	if p == "~" {
+		p = ""
+	} else if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		p = rest
+	}
+	if filepath.IsAbs(p) || s.home == "" {
+		if p == "" {
+			return "."
+		}
+		return p
+	}
+	return filepath.Join(s.home, p)
+}
+
+func (s *scpConn) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// warn reports a non-fatal error to the client.
+func (s *scpConn) warn(format string, args ...any) {
+	s.failed = true
+	fmt.Fprintf(s.w, "\x01scp: "+format+"\n", args...)
+}
+
+// fatal reports an error that ends the transfer.
+func (s *scpConn) fatal(format string, args ...any) error {
+	s.failed = true
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(s.w, "\x02scp: %s\n", msg)
+	return errors.New(msg)
+}
+
+// readAck reads the client's reply to a protocol message.
+func (s *scpConn) readAck() error {
+	code, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := s.r.ReadString('\n')
+		if code == 1 {
+			s.failed = true
+			return fmt.Errorf("%w: %s", errSCPWarning, strings.TrimSpace(msg))
+		}
+		return errors.New(strings.TrimSpace(msg))
+	}
+	return fmt.Errorf("unexpected reply %#x", code)
+}
+
+// source sends the requested paths to the client.
+func (s *scpConn) source() error {
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	for _, p := range s.opts.paths {
+		matches := []string{s.resolve(p)}
+		if strings.ContainsAny(p, "*?[") {
+			matches, _ = filepath.Glob(matches[0])
+			if len(matches) == 0 {
+				s.warn("%s: No such file or directory", p)
+				continue
+			}
+		}
+		for _, m := range matches {
+			if err := s.send(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// send sends one file, or a directory tree with -r.
+func (s *scpConn) send(name string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		s.warn("%s: %v", name, errors.Unwrap(err))
+		return nil
+	}
+	if info.IsDir() && !s.opts.recursive {
+		s.warn("%s: not a regular file", name)
+		return nil
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		s.warn("%s: not a regular file", name)
+		return nil
+	}
+	if s.opts.preserve {
+		fmt.Fprintf(s.w, "T%d 0 %d 0\n", info.ModTime().Unix(), accessTime(info).Unix())
+		if err := s.readAck(); err != nil {
+			return skipWarning(err)
+		}
+	}
+
+	if info.IsDir() {
+		fmt.Fprintf(s.w, "D%04o 0 %s\n", info.Mode().Perm(), info.Name())
+		if err := s.readAck(); err != nil {
+			return skipWarning(err)
+		}
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			s.warn("%s: %v", name, errors.Unwrap(err))
+		}
+		for _, e := range entries {
+			if err := s.send(filepath.Join(name, e.Name())); err != nil {
+				return err
+			}
+		}
+		fmt.Fprint(s.w, "E\n")
+		return skipWarning(s.readAck())
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		s.warn("%s: %v", name, errors.Unwrap(err))
+		return nil
+	}
+	defer f.Close()
+	fmt.Fprintf(s.w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), info.Name())
+	if err := s.readAck(); err != nil {
+		return skipWarning(err)
+	}
+	// The size is promised in the header, so a file that shrinks while it
+	// is sent is padded and a file that grows is truncated
+	n, err := io.CopyN(s.w, f, info.Size())
+	if err != nil {
+		if _, err := io.CopyN(s.w, zeroReader{}, info.Size()-n); err != nil {
+			return err
+		}
+		s.warn("%s: %v", name, err)
+	} else if _, err := s.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	return skipWarning(s.readAck())
+}
+
+// skipWarning turns a rejected file into success, so sending continues.
+func skipWarning(err error) error {
+	if errors.Is(err, errSCPWarning) {
+		return nil
+	}
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// scpDir is a directory being received, with the times to give it once
+// its contents are complete.
+type scpDir struct {
+	path  string
+	times []time.Time
+}
+
+// sink receives files from the client into target.
+func (s *scpConn) sink(target string) error {
+	info, err := os.Stat(target)
+	targetIsDir := err == nil && info.IsDir()
+	if s.opts.targetDir && !targetIsDir {
+		return s.fatal("%s: Not a directory", target)
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	var dirs []scpDir
+	var times []time.Time // from a preceding T message
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return s.fatal("protocol error: empty message")
+		}
+
+		switch line[0] {
+		case 1:
+			s.failed = true
+			infof("SCP client warning: %s", line[1:])
+			continue
+		case 2:
+			return fmt.Errorf("client error: %s", line[1:])
+		case 'T':
+			var mtime, mtimeUsec, atime, atimeUsec int64
+			if _, err := fmt.Sscanf(line[1:], "%d %d %d %d", &mtime, &mtimeUsec, &atime, &atimeUsec); err != nil {
+				return s.fatal("protocol error: bad times %q", line)
+			}
+			times = []time.Time{time.Unix(atime, atimeUsec*1000), time.Unix(mtime, mtimeUsec*1000)}
+			if err := s.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return s.fatal("protocol error: unexpected E")
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if d.times != nil {
+				_ = os.Chtimes(d.path, d.times[0], d.times[1])
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return s.fatal("protocol error: unexpected message %q", line)
+		}
+
+		mode, size, name, err := parseSCPHeader(line)
+		if err != nil {
+			return s.fatal("protocol error: %v", err)
+		}
+		dest := target
+		switch {
+		case len(dirs) > 0:
+			dest = filepath.Join(dirs[len(dirs)-1].path, name)
+		case targetIsDir:
+			dest = filepath.Join(target, name)
+		}
+		fileTimes := times
+		times = nil
+
+		if line[0] == 'D' {
+			if !s.opts.recursive {
+				return s.fatal("received directory without -r")
+			}
+			if info, err := os.Stat(dest); err == nil && !info.IsDir() {
+				return s.fatal("%s: Not a directory", dest)
+			} else if err != nil {
+				if err := os.Mkdir(dest, mode|0o700); err != nil {
+					return s.fatal("%s: %v", dest, errors.Unwrap(err))
+				}
+			}
+			if s.opts.preserve {
+				_ = os.Chmod(dest, mode)
+			}
+			dirs = append(dirs, scpDir{path: dest, times: fileTimes})
+			if err := s.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := s.receive(dest, mode, size, fileTimes); err != nil {
+			return err
+		}
+	}
+}
+
+// receive reads one file's contents into dest. Local errors are reported
+// to the client once the contents have been read, so the transfer can go on.
+func (s *scpConn) receive(dest string, mode fs.FileMode, size int64, times []time.Time) error {
+	if err := s.ack(); err != nil {
+		return err
+	}
+	out := &writeOnce{}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		out.err = errors.Unwrap(err)
+	} else {
+		defer f.Close()
+		out.w = f
+	}
+	if _, err := io.CopyN(out, s.r, size); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return skipWarning(err)
+	}
+	if out.err == nil && f != nil {
+		out.err = f.Close()
+	}
+	if out.err != nil {
+		s.warn("%s: %v", dest, out.err)
+		return nil
+	}
+	if s.opts.preserve {
+		_ = os.Chmod(dest, mode)
+	}
+	if times != nil {
+		_ = os.Chtimes(dest, times[0], times[1])
+	}
+	return s.ack()
+}
+
+// writeOnce writes to w until the first error, then discards the rest.
+type writeOnce struct {
+	w   io.Writer
+	err error
+}
+
+func (o *writeOnce) Write(p []byte) (int, error) {
+	if o.err == nil {
+		_, o.err = o.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// parseSCPHeader parses a "C<mode> <size> <name>" or "D<mode> 0 <name>"
+// message.
+func parseSCPHeader(line string) (fs.FileMode, int64, string, error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("bad header %q", line)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil || mode > 0o7777 {
+		return 0, 0, "", fmt.Errorf("bad mode %q", fields[0])
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("bad size %q", fields[1])
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return 0, 0, "", fmt.Errorf("unexpected filename %q", name)
+	}
+	return fs.FileMode(mode).Perm(), size, name, nil
+}
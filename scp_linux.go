@@ -0,0 +1,15 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the file's last access time.
+func accessTime(info fs.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return info.ModTime()
+}
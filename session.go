@@ -0,0 +1,529 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// session is a single "session" channel and the process it runs.
+type session struct {
+	conn *ssh.ServerConn
+	user *user
+	ch   ssh.Channel
+	// guest is the ephemeral account the session runs in, if any
+	guest *guestAccount
+
+	// acceptEnvPatterns are the variables env requests may set, and env
+	// the NAME=value pairs they set
+	acceptEnvPatterns []string
+	env               []string
+
+	ptyRequested bool
+	// ptyTerm is the TERM of the pty-req, or defaultTerm if it had none
+	ptyTerm     string
+	defaultTerm string
+	ptyCols     uint32
+	ptyRows     uint32
+	ptyModes    []termMode
+	ptyState
+	// onTerminal is set once the shell or command runs on the PTY, which
+	// admin broadcasts are then written to
+	onTerminal atomic.Bool
+
+	// process is the running shell or command, if any
+	process *os.Process
+	// breakSignal is sent by break requests; zero refuses them
+	breakSignal syscall.Signal
+	// maxDuration is how long the session may stay open, and execTimeout
+	// how long the process of an exec request may run; zero is no limit
+	maxDuration time.Duration
+	execTimeout time.Duration
+	// limits are the resource limits of its processes, and cgroup the
+	// cgroup they share, once created
+	limits *resourceLimits
+	cgroup *os.File
+	// logins records PTY sessions in utmp and wtmp, if enabled
+	logins *loginRecorder
+	// detach keeps PTY sessions for reattaching, if enabled, and terminal
+	// is the one the session is attached to
+	detach   *detachedSessions
+	terminal *terminalSession
+	// ending is set when the server ends the session, which is then not
+	// kept for reattaching
+	ending atomic.Bool
+	// recordings records the sessions of logins with record_sessions, if
+	// enabled, and recorded is the channel when this one is
+	recordings *sessionRecordings
+	recorded   *recordedChannel
+	// welcome is the MOTD and last login shown when an interactive shell
+	// starts
+	welcome string
+	// subsystems are the subsystems clients may start, by name
+	subsystems map[string]subsystemHandler
+	// agent is the socket of a forwarded agent, if any
+	agent *net.UnixListener
+	// account is the system account processes run as, if the server
+	// switches accounts, and chroot the directory they are confined to
+	account *systemAccount
+	chroot  string
+	// home is the directory processes start in, if known
+	home string
+	// container is the Docker container processes run in instead, if any
+	containers *containers
+	container  string
+	// git serves the commands of git logins, and bastion the jumps of
+	// bastion logins, if configured
+	git     *gitHost
+	bastion *bastion
+	// admin runs the admin commands of admin logins
+	admin func(args []string, w io.Writer) error
+
+	// started is when the channel was opened; who reports it and, under
+	// whoMu as it changes, what the session runs
+	started time.Time
+	whoMu   sync.Mutex
+	who     whoInfo
+}
+
+// serve handles the channel's requests until the channel is closed. Once a
+// shell or command has started it runs in the background, and requests such
+// as window-change and signal keep being handled.
+func (sess *session) serve(reqs <-chan *ssh.Request) {
+	defer sess.ch.Close()
+	defer sess.stopAgent()
+	defer sess.releaseCgroup()
+	defer sess.hangUp()
+	defer sess.recorded.stop(true)
+	if sess.maxDuration > 0 {
+		defer sess.enforceMaxDuration(sess.maxDuration)()
+	}
+
+	started := false
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			if !permitted(sess.conn.Permissions, permAllowPTY) {
+				req.Reply(false, nil)
+				continue
+			}
+			// Parse PTY request payload: term, cols, rows, width, height, modes
+			var p struct {
+				Term   string
+				Cols   uint32
+				Rows   uint32
+				Width  uint32
+				Height uint32
+				Modes  []byte
+			}
+			if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			sess.ptyRequested = true
+			sess.ptyTerm = p.Term
+			if sess.ptyTerm == "" || strings.ContainsRune(sess.ptyTerm, 0) {
+				sess.ptyTerm = sess.defaultTerm
+			}
+			sess.ptyCols = p.Cols
+			sess.ptyRows = p.Rows
+			sess.ptyModes = parseTermModes(p.Modes)
+			req.Reply(true, nil)
+
+		case "env":
+			sess.handleEnv(req)
+
+		case "window-change":
+			// cols, rows, width, height
+			var wc struct {
+				Cols   uint32
+				Rows   uint32
+				Width  uint32
+				Height uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &wc); err == nil {
+				sess.ptyCols = wc.Cols
+				sess.ptyRows = wc.Rows
+				sess.resizePTY()
+			}
+			// do not send a reply to window-change per RFC
+
+		case "shell":
+			if started || len(req.Payload) != 0 || !permitted(sess.conn.Permissions, permAllowShell) {
+				// We only support default shell (no command payload)
+				req.Reply(false, nil)
+				continue
+			}
+			sess.startRecording("(shell)")
+			started = sess.runShell(req)
+			if !started {
+				sess.recorded.stop(false)
+			}
+			sess.setCommand(started, "(shell)")
+
+		case "exec":
+			if started || !permitted(sess.conn.Permissions, permAllowExec) {
+				req.Reply(false, nil)
+				continue
+			}
+			var ex struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &ex); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			sess.execTimeout = execTimeout(sess.conn.Permissions)
+			sess.startRecording(ex.Command)
+			started = sess.runExec(req, ex.Command)
+			if !started {
+				sess.recorded.stop(false)
+			}
+			sess.setCommand(started, ex.Command)
+
+		case "subsystem":
+			if started || !permitted(sess.conn.Permissions, permAllowExec) {
+				req.Reply(false, nil)
+				continue
+			}
+			var sub struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &sub); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			started = sess.runSubsystem(req, sub.Name)
+			sess.setCommand(started, "(subsystem "+sub.Name+")")
+
+		case "signal":
+			sess.handleSignal(req)
+
+		case "break":
+			sess.handleBreak(req)
+
+		case "auth-agent-req@openssh.com":
+			if started {
+				req.Reply(false, nil)
+				continue
+			}
+			sess.handleAgentRequest(req)
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// command builds the process for a shell (command == "") or exec request,
+// honouring a forced command from the login's permissions.
+func (sess *session) command(command string) *exec.Cmd {
+	// Variables set by the client come first, so the server's own win
+	extraEnv := append([]string(nil), sess.env...)
+	if forced, ok := forcedCommand(sess.conn.Permissions); ok {
+		if command != "" {
+			extraEnv = append(extraEnv, "SSH_ORIGINAL_COMMAND="+command)
+		}
+		command = forced
+	}
+	if path, ok := sess.agentSocket(); ok {
+		extraEnv = append(extraEnv, "SSH_AUTH_SOCK="+path)
+	}
+	extraEnv = append(extraEnv, permittedEnv(sess.conn.Permissions)...)
+	extraEnv = append(extraEnv, sess.connectionEnv()...)
+	if sess.ptyRequested {
+		extraEnv = append(extraEnv, "TERM="+sess.ptyTerm)
+	}
+	if sess.container != "" {
+		return sess.containerCommand(command, extraEnv)
+	}
+
+	login := sess.user.LoginShell == nil || *sess.user.LoginShell
+	var cmd *exec.Cmd
+	if shell := sess.sessionShell(); shell == internalShell {
+		cmd = internalShellCommand(command)
+	} else {
+		cmd = shellCommand(shell, sess.user.ShellArgs, command, login)
+	}
+	cmd.Env = sessionEnviron()
+	sess.startAtHome(cmd)
+	if sess.account != nil {
+		sess.account.apply(cmd)
+		cmd.Env = append(cmd.Env, "SHELL="+cmd.Path)
+	}
+	if sess.chroot != "" {
+		sess.confine(cmd)
+	}
+	if path, ok := sandboxPath(sess.conn.Permissions); ok {
+		sandboxCommand(cmd, sess.user, path)
+	}
+	if len(extraEnv) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = sessionEnviron()
+		}
+		cmd.Env = append(cmd.Env, extraEnv...)
+	}
+	return cmd
+}
+
+// sessionEnviron returns the environment session commands start from: the
+// server's PATH and the few variables of sessionEnvKept, but none of its
+// others, which may hold secrets. The session then adds HOME, USER, the
+// SSH_* variables and those the client sent.
+func sessionEnviron() []string {
+	env := []string{"PATH=" + cmp.Or(os.Getenv("PATH"), defaultPath)}
+	for _, name := range sessionEnvKept {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// startAtHome makes cmd start in the session's home directory, with HOME
+// set to it. As with OpenSSH, a home that does not exist is reported to the
+// client and the command starts in / instead.
+func (sess *session) startAtHome(cmd *exec.Cmd) {
+	if sess.home == "" {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = sessionEnviron()
+	}
+	cmd.Env = append(cmd.Env, "HOME="+sess.home)
+	cmd.Dir = sess.home
+	if sess.chroot != "" {
+		// confine finds the home inside the chroot
+		return
+	}
+	if fi, err := os.Stat(sess.home); err != nil || !fi.IsDir() {
+		fmt.Fprintf(sess.ch.Stderr(), "Could not chdir to home directory %s\r\n", sess.home)
+		cmd.Dir = "/"
+	}
+}
+
+// runShell starts an interactive shell, on a PTY if one was requested. It
+// reports whether the request was accepted.
+func (sess *session) runShell(req *ssh.Request) bool {
+	if sftpAccount(sess.conn.Permissions) {
+		return sess.refuseShell(req)
+	}
+	if _, _, ok := rsyncOnly(sess.conn.Permissions); ok {
+		infof("Refusing shell for rsync-only account %s", sess.user.Name)
+		return sess.refuse(req, "This service allows rsync connections only.")
+	}
+	if _, ok := gitRepositories(sess.conn.Permissions); ok {
+		infof("Refusing shell for git account %s", sess.user.Name)
+		return sess.refuse(req, "fatal: Interactive git shell is not enabled.")
+	}
+	if sftpOnly(sess.conn.Permissions) {
+		return sess.runSFTP(req)
+	}
+	if patterns, ok := bastionTargets(sess.conn.Permissions); ok {
+		return sess.runBastion(req, "", patterns)
+	}
+	if patterns, ok := sess.restricted(); ok {
+		return sess.runRestrictedShell(req, patterns)
+	}
+	if sess.ptyRequested && sess.resumeDetached(req) {
+		return true
+	}
+	cmd := sess.command("")
+	if sess.ptyRequested {
+		// A forced command is not a login shell, so it is not greeted
+		welcome := sess.welcome
+		if _, forced := forcedCommand(sess.conn.Permissions); forced {
+			welcome = ""
+		}
+		return sess.runPTY(req, cmd, welcome)
+	}
+	return sess.runCommand(req, cmd)
+}
+
+// runExec executes a specific command, on a PTY if one was requested as with
+// "ssh -t host command". It reports whether the request was accepted.
+func (sess *session) runExec(req *ssh.Request, command string) bool {
+	if sftpAccount(sess.conn.Permissions) {
+		return sess.refuseShell(req)
+	}
+	if dir, access, ok := rsyncOnly(sess.conn.Permissions); ok {
+		return sess.runRsyncOnly(req, command, dir, access)
+	}
+	if patterns, ok := gitRepositories(sess.conn.Permissions); ok {
+		return sess.runGit(req, command, patterns)
+	}
+	if sftpOnly(sess.conn.Permissions) {
+		return sess.runSFTP(req)
+	}
+	if patterns, ok := bastionTargets(sess.conn.Permissions); ok {
+		return sess.runBastion(req, command, patterns)
+	}
+	// Admin commands are built in, so allowed_commands need not list them
+	_, forced := forcedCommand(sess.conn.Permissions)
+	if args, ok := parseAdminCommand(command); ok && !forced && permitted(sess.conn.Permissions, permAdmin) {
+		return sess.runAdmin(req, args)
+	}
+	if patterns, ok := sess.restricted(); ok && !commandAllowed(patterns, command) {
+		return sess.refuseCommand(req, command)
+	}
+	// scp and rsync are handled natively unless a forced command replaces
+	// them; sandboxed users and containers run their own, if any, so they
+	// stay confined
+	_, sandboxed := sandboxPath(sess.conn.Permissions)
+	native := !forced && !sandboxed && sess.container == ""
+	if opts, ok := parseSCPCommand(command); ok && native {
+		return sess.runSCP(req, command, opts)
+	}
+	if args, ok := parseRsyncCommand(command); ok && native {
+		return sess.runRsync(req, command, args)
+	}
+	cmd := sess.command(command)
+	if sess.ptyRequested {
+		return sess.runPTY(req, cmd, "")
+	}
+	return sess.runCommand(req, cmd)
+}
+
+// runCommand starts cmd with the channel as its stdin, stdout and stderr. It
+// reports whether the request was accepted.
+func (sess *session) runCommand(req *ssh.Request, cmd *exec.Cmd) bool {
+	// A pipe, so waiting for cmd does not also wait for the client to
+	// close its input
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		req.Reply(false, nil)
+		return false
+	}
+	// Pipes of our own for the output, so the end of it is seen even if
+	// cmd keeps running
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		req.Reply(false, nil)
+		return false
+	}
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
+		req.Reply(false, nil)
+		return false
+	}
+	cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+	if sess.execTimeout > 0 {
+		// A process group of its own, for the timeout to kill as a whole
+		newProcessSession(cmd)
+	}
+	err = sess.limit(cmd)
+	if err == nil {
+		err = cmd.Start()
+	}
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		warnf("Failed to start command for %s: %v", sess.user.Name, err)
+		req.Reply(false, nil)
+		return false
+	}
+	req.Reply(true, nil)
+	go func() {
+		if _, err := copyData(stdin, sess.ch); err != nil {
+			// cmd stopped reading; take the rest of the client's input
+			// anyway, so a client still sending it is not blocked
+			_, _ = io.Copy(io.Discard, sess.ch)
+		}
+		stdin.Close()
+	}()
+	output := sess.copyOutput(stdout, stderr)
+	sess.background(cmd, func() {
+		<-output
+		sess.wait(cmd, nil)
+	})
+	return true
+}
+
+// copyOutput copies stdout and stderr to the channel until both are closed,
+// then sends EOF, as is done once a command is through writing. The
+// returned channel is closed after that.
+func (sess *session) copyOutput(stdout, stderr *os.File) <-chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = copyData(sess.ch, stdout)
+		stdout.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = copyData(sess.ch.Stderr(), stderr)
+		stderr.Close()
+	}()
+	go func() {
+		wg.Wait()
+		_ = sess.ch.CloseWrite()
+		close(done)
+	}()
+	return done
+}
+
+// hangUp ends a shell or command still running when its channel closes,
+// as when the client disconnects or is disconnected for being idle.
+func (sess *session) hangUp() {
+	if sess.terminal != nil && !sess.ending.Load() && sess.terminal.detach(sess.ch) {
+		return
+	}
+	if sess.process != nil {
+		_ = sess.process.Signal(syscall.SIGHUP)
+	}
+	sess.closePTY()
+}
+
+// background runs fn, the rest of an accepted shell or command, while serve
+// goes on handling requests, and closes the channel once fn returns. cmd is
+// the process signal requests go to; in-process handlers have none.
+func (sess *session) background(cmd *exec.Cmd, fn func()) {
+	stop := func() {}
+	if cmd != nil {
+		sess.process = cmd.Process
+		if sess.execTimeout > 0 {
+			stop = sess.enforceExecTimeout(cmd, sess.execTimeout)
+		}
+	}
+	go func() {
+		defer sess.ch.Close()
+		defer stop()
+		fn()
+	}()
+}
+
+// wait waits for cmd to exit and reports its exit status to the client. If
+// output is not nil, it is closed once everything the command wrote has been
+// copied to the channel, which for a PTY can be after the command exits.
+func (sess *session) wait(cmd *exec.Cmd, output <-chan struct{}) {
+	err := cmd.Wait()
+	if output != nil {
+		// Processes left running may hold the terminal open
+		select {
+		case <-output:
+		case <-time.After(time.Second):
+		}
+	}
+	reportExit(sess.ch, err)
+}
+
+// sendExitStatus sends the SSH-specific exit-status request on the channel.
+func sendExitStatus(ch ssh.Channel, status int) {
+	// Per RFC 4254, exit-status uses a uint32 payload
+	type exitStatus struct{ Status uint32 }
+	payload := ssh.Marshal(exitStatus{Status: uint32(status)})
+	// Ignore reply; it's a one-way notification
+	_, _ = ch.SendRequest("exit-status", false, payload)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionWarning returns how long before max_session_duration the client
+// is warned: five minutes, or a tenth of short limits.
+func sessionWarning(limit time.Duration) time.Duration {
+	return min(5*time.Minute, limit/10)
+}
+
+// enforceMaxDuration ends the session once it has been open for limit,
+// warning the client beforehand. Messages go to stderr, which clients show
+// even for SFTP. The returned function stops the timers.
+func (sess *session) enforceMaxDuration(limit time.Duration) (stop func()) {
+	warn := sessionWarning(limit)
+	warning := time.AfterFunc(limit-warn, func() {
+		fmt.Fprintf(sess.ch.Stderr(), "\r\n*** Session time limit of %v reached in %v ***\r\n", limit, warn)
+	})
+	end := time.AfterFunc(limit, func() {
+		infof("Ending session of %s: time limit of %v reached", sess.user.Name, limit)
+		fmt.Fprintf(sess.ch.Stderr(), "\r\n*** Session time limit of %v reached, disconnecting ***\r\n", limit)
+		sess.ending.Store(true)
+		sess.ch.Close()
+	})
+	return func() {
+		warning.Stop()
+		end.Stop()
+	}
+}
+
+// permExecTimeout carries the exec_timeout of a login.
+const permExecTimeout = "exec-timeout"
+
+// execTimeout returns how long the login's exec commands may run, or zero.
+func execTimeout(perms *ssh.Permissions) time.Duration {
+	if perms == nil {
+		return 0
+	}
+	d, _ := time.ParseDuration(perms.Extensions[permExecTimeout])
+	return d
+}
+
+// enforceExecTimeout kills the process group of cmd, which leads one, once
+// it has run for limit, saying why on stderr; the client then gets the
+// exit-signal of the kill. The returned function stops the timer.
+func (sess *session) enforceExecTimeout(cmd *exec.Cmd, limit time.Duration) (stop func()) {
+	t := time.AfterFunc(limit, func() {
+		infof("Killing command of %s: exec timeout of %v reached", sess.user.Name, limit)
+		fmt.Fprintf(sess.ch.Stderr(), "\r\n*** Command time limit of %v reached, killing it ***\r\n", limit)
+		if err := killProcessGroup(cmd.Process); err != nil {
+			warnf("Failed to kill command of %s: %v", sess.user.Name, err)
+		}
+	})
+	return func() { t.Stop() }
+}
+
+// sessionCounts counts the open sessions of each user, for
+// max_user_sessions.
+type sessionCounts struct {
+	mu     sync.Mutex
+	byUser map[string]int
+}
+
+// acquire counts a new session of user, unless user already has max; zero
+// is no limit.
+func (c *sessionCounts) acquire(user string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.byUser[user] >= max {
+		return false
+	}
+	if c.byUser == nil {
+		c.byUser = make(map[string]int)
+	}
+	c.byUser[user]++
+	return true
+}
+
+func (c *sessionCounts) release(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byUser[user]--; c.byUser[user] <= 0 {
+		delete(c.byUser, user)
+	}
+}
+
+// liveSessions are the sessions being served, for admin commands that act
+// on them.
+type liveSessions struct {
+	mu  sync.Mutex
+	set map[*session]bool
+}
+
+// add records sess as live until the returned function is called.
+func (l *liveSessions) add(sess *session) (remove func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.set == nil {
+		l.set = make(map[*session]bool)
+	}
+	l.set[sess] = true
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.set, sess)
+	}
+}
+
+// list returns the live sessions.
+func (l *liveSessions) list() []*session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]*session, 0, len(l.set))
+	for sess := range l.set {
+		list = append(list, sess)
+	}
+	return list
+}
+
+// claimSession counts a new session of user on a connection with open
+// sessions already, returning the function to call once it has closed. It
+// fails with the reason for the client if max_sessions or
+// max_user_sessions is reached.
+func (s *server) claimSession(user string, open *atomic.Int32) (release func(), err error) {
+	policy := s.policy.Load()
+	if policy.maxSessions > 0 && open.Load() >= int32(policy.maxSessions) {
+		return nil, fmt.Errorf("too many sessions on this connection (at most %d)", policy.maxSessions)
+	}
+	if !s.sessions.acquire(user, policy.maxUserSessions) {
+		return nil, fmt.Errorf("too many sessions for %s (at most %d)", user, policy.maxUserSessions)
+	}
+	open.Add(1)
+	return func() {
+		open.Add(-1)
+		s.sessions.release(user)
+	}, nil
+}
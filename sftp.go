@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// internalSFTP is the forced command that restricts a login to SFTP, as
+// with OpenSSH's "ForceCommand internal-sftp".
+const internalSFTP = "internal-sftp"
+
+// permSFTPAccount marks the logins of sftp_only accounts.
+const permSFTPAccount = "sftp-account"
+
+// sftpOnly reports whether the login is restricted to SFTP.
+func sftpOnly(perms *ssh.Permissions) bool {
+	cmd, ok := forcedCommand(perms)
+	return ok && cmd == internalSFTP
+}
+
+// sftpAccount reports whether the login is of an sftp_only account, which
+// unlike internal-sftp refuses shells and commands instead of serving SFTP
+// on them.
+func sftpAccount(perms *ssh.Permissions) bool {
+	return permitted(perms, permSFTPAccount)
+}
+
+// refuseShell tells an sftp_only account that shells and commands are not
+// available.
+func (sess *session) refuseShell(req *ssh.Request) bool {
+	infof("Refusing shell or command for SFTP-only account %s", sess.user.Name)
+	return sess.refuse(req, "This service allows sftp connections only.")
+}
+
+// runSFTP serves SFTP on the channel, starting in the user's home
+// directory. Files are accessed with the server's own privileges, like the
+// commands it runs; sessions running as a system account use a helper
+// process with the account's privileges instead. It reports whether the
+// request was accepted.
+func (sess *session) runSFTP(req *ssh.Request) bool {
+	if _, ok := sandboxPath(sess.conn.Permissions); ok || sess.container != "" {
+		// The sandbox and containers only confine processes; SFTP would
+		// see the host
+		req.Reply(false, nil)
+		return false
+	}
+	if sess.account != nil {
+		infof("SFTP session started for %s as system account", sess.user.Name)
+		return sess.runHelper(req, "sftp-server")
+	}
+	var opts []sftp.ServerOption
+	if sess.home != "" {
+		opts = append(opts, sftp.WithServerWorkingDirectory(sess.home))
+	}
+	server, err := sftp.NewServer(sess.ch, opts...)
+	if err != nil {
+		warnf("Failed to start SFTP for %s: %v", sess.user.Name, err)
+		req.Reply(false, nil)
+		return false
+	}
+	req.Reply(true, nil)
+	infof("SFTP session started for %s", sess.user.Name)
+	sess.background(nil, func() {
+		// Closing the server closes the channel, so it waits for the exit status
+		defer server.Close()
+		err := server.Serve()
+		if err != nil && !errors.Is(err, io.EOF) {
+			warnf("SFTP session for %s failed: %v", sess.user.Name, err)
+			sendExitStatus(sess.ch, 1)
+			return
+		}
+		infof("SFTP session ended for %s", sess.user.Name)
+		sendExitStatus(sess.ch, 0)
+	})
+	return true
+}
+
+// sftpServerMain implements the "sftp-server" helper subcommand, which
+// serves SFTP on stdin and stdout in the current directory.
+func sftpServerMain(args []string) {
+	enterChroot(args)
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{os.Stdin, os.Stdout})
+	if err != nil {
+		log.Fatalf("sftp-server: %v", err)
+	}
+	if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+		log.Fatalf("sftp-server: %v", err)
+	}
+}
+
+func init() {
+	registerSubsystem("sftp", (*session).runSFTP)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ShadowConfig authenticates system accounts against /etc/shadow, so the
+// server can stand in for the system sshd. It needs to run as root to read
+// the shadow file.
+type ShadowConfig struct {
+	// ShadowFile and PasswdFile default to /etc/shadow and /etc/passwd.
+	ShadowFile string `yaml:"shadow_file"`
+	PasswdFile string `yaml:"passwd_file"`
+	// MinUID excludes system accounts below it; defaults to 1000. Set it
+	// to 0 to also allow root.
+	MinUID *int `yaml:"min_uid"`
+}
+
+// shadowProvider checks passwords against the system account files. Both
+// are re-read on every attempt, so password changes apply immediately.
+type shadowProvider struct {
+	cfg    ShadowConfig
+	minUID int
+}
+
+func newShadowProvider(cfg ShadowConfig) (*shadowProvider, error) {
+	if cfg.ShadowFile == "" {
+		cfg.ShadowFile = "/etc/shadow"
+	}
+	if cfg.PasswdFile == "" {
+		cfg.PasswdFile = "/etc/passwd"
+	}
+	p := &shadowProvider{cfg: cfg, minUID: 1000}
+	if cfg.MinUID != nil {
+		p.minUID = *cfg.MinUID
+	}
+	f, err := os.Open(cfg.ShadowFile)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) && os.Geteuid() != 0 {
+			return nil, fmt.Errorf("shadow: %v (the server must run as root)", err)
+		}
+		return nil, fmt.Errorf("shadow: %v", err)
+	}
+	f.Close()
+	return p, nil
+}
+
+// findEntry returns the colon-separated fields of name's line in file.
+func findEntry(file, name string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), ":")
+		if fields[0] == name {
+			return fields, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errUnknownUser
+}
+
+// shadowDay converts a shadow date field (days since the epoch).
+func shadowDay(field string) (int64, bool) {
+	if field == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(field, 10, 64)
+	return n, err == nil
+}
+
+// checkAccount applies the account and password expiry fields of a shadow
+// entry.
+func checkAccount(entry []string, now time.Time) error {
+	for len(entry) < 9 {
+		entry = append(entry, "")
+	}
+	today := now.Unix() / 86400
+	if expire, ok := shadowDay(entry[7]); ok && today >= expire {
+		return errors.New("shadow: account expired")
+	}
+	lastChange, ok := shadowDay(entry[2])
+	if ok && lastChange == 0 {
+		return errors.New("shadow: password change required")
+	}
+	if maxAge, hasMax := shadowDay(entry[4]); ok && hasMax && today > lastChange+maxAge {
+		return errors.New("shadow: password expired")
+	}
+	return nil
+}
+
+func (p *shadowProvider) authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	account, err := findEntry(p.cfg.PasswdFile, c.User())
+	if err != nil {
+		return nil, err
+	}
+	if len(account) < 7 {
+		return nil, fmt.Errorf("shadow: malformed %s entry", p.cfg.PasswdFile)
+	}
+	if uid, err := strconv.Atoi(account[2]); err != nil || uid < p.minUID {
+		return nil, errUnknownUser
+	}
+	entry, err := findEntry(p.cfg.ShadowFile, c.User())
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := ""
+	if len(entry) > 1 {
+		encoded = entry[1]
+	}
+	switch {
+	case encoded == "":
+		return nil, errors.New("shadow: empty passwords are not permitted")
+	case strings.HasPrefix(encoded, "!"), strings.HasPrefix(encoded, "*"):
+		return nil, errors.New("shadow: password login disabled")
+	}
+	h, err := parsePasswordHash(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("shadow: %v", err)
+	}
+	if !h.verify(pass) {
+		return nil, errors.New("shadow: wrong password")
+	}
+	if err := checkAccount(entry, time.Now()); err != nil {
+		return nil, err
+	}
+
+	perms := fullPermissions()
+	setExtension(perms, permHome, account[5])
+	setExtension(perms, permShell, account[6])
+	return perms, nil
+}
@@ -0,0 +1,1215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// internalShell names the built-in shell in a user's shell setting, for
+// systems without one such as scratch containers and appliances. It is
+// also the default on Unix where there is no /bin/sh.
+const internalShell = "internal-sh"
+
+// internalShellCommand builds the built-in shell, the server binary's
+// internal-sh helper, running command, or interactively if command is
+// empty.
+func internalShellCommand(command string) *exec.Cmd {
+	exe, err := os.Executable()
+	if err != nil {
+		// Fails to start, reporting the missing shell
+		exe = internalShell
+	}
+	if command != "" {
+		return exec.Command(exe, internalShell, "-c", command)
+	}
+	return exec.Command(exe, internalShell)
+}
+
+// internalShellMain implements the "internal-sh" helper subcommand, a small
+// POSIX-like shell: simple commands with variable assignments, quoting,
+// $VAR, ${VAR}, $(...), globs and ~, redirections, pipelines, "&&", "||"
+// and ";", plus the usual builtins. It has no control flow, functions or
+// job control.
+//
+//	internal-sh [-c command [name [arg...]] | script [arg...]]
+//
+// Without a command or script it reads commands from stdin, prompting if
+// that is a terminal.
+func internalShellMain(args []string) {
+	sh := newShell()
+	// $SHELL is the server binary, which is no shell without the subcommand
+	delete(sh.env, "SHELL")
+	switch {
+	case len(args) > 0 && args[0] == "-c":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "internal-sh: -c: option requires an argument")
+			os.Exit(2)
+		}
+		if len(args) > 2 {
+			sh.params = args[2:]
+		}
+		sh.run(args[1])
+	case len(args) > 0:
+		sh.params = args
+		if status, err := sh.source(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "internal-sh: %v\n", err)
+			os.Exit(127)
+		} else {
+			sh.status = status
+		}
+	default:
+		sh.interact(os.Stdin)
+	}
+	os.Exit(sh.status)
+}
+
+// stdio are the standard input, output and error of a command.
+type stdio [3]*os.File
+
+// shell is the state of the built-in shell. Its working directory and
+// exported variables are its own, not the process's, so that subshells
+// running at the same time, such as pipeline stages, keep theirs apart;
+// the commands it starts are given them.
+type shell struct {
+	vars   map[string]string // unexported variables
+	env    map[string]string // exported variables
+	dir    string            // working directory
+	params []string          // $0 and the positional parameters
+	status int               // of the last command, $?
+	exited bool
+	io     stdio
+}
+
+func newShell() *shell {
+	s := &shell{
+		vars:   make(map[string]string),
+		env:    make(map[string]string),
+		params: []string{internalShell},
+		io:     stdio{os.Stdin, os.Stdout, os.Stderr},
+	}
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			s.env[name] = value
+		}
+	}
+	s.dir, _ = os.Getwd()
+	return s
+}
+
+// clone returns a copy of s for a subshell: pipeline stages and command
+// substitutions, whose changes do not outlive them.
+func (s *shell) clone(fds stdio) *shell {
+	c := *s
+	c.vars, c.env = maps.Clone(s.vars), maps.Clone(s.env)
+	c.io, c.exited = fds, false
+	return &c
+}
+
+// environ returns the exported variables as NAME=value pairs.
+func (s *shell) environ() []string {
+	env := make([]string, 0, len(s.env))
+	for name, value := range s.env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// path returns name relative to the working directory, unless absolute.
+func (s *shell) path(name string) string {
+	if filepath.IsAbs(name) || s.dir == "" {
+		return name
+	}
+	return filepath.Join(s.dir, name)
+}
+
+// lookPath finds the executable for the command name as exec.LookPath
+// does, with the shell's PATH and working directory.
+func (s *shell) lookPath(name string) (string, error) {
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		return exec.LookPath(s.path(name))
+	}
+	for _, dir := range filepath.SplitList(s.get("PATH")) {
+		if path, err := exec.LookPath(filepath.Join(s.path(dir), name)); err == nil {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+func (s *shell) get(name string) string {
+	switch name {
+	case "?":
+		return strconv.Itoa(s.status)
+	case "$":
+		return strconv.Itoa(os.Getpid())
+	case "#":
+		return strconv.Itoa(len(s.params) - 1)
+	case "@", "*":
+		return strings.Join(s.params[1:], " ")
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < len(s.params) {
+			return s.params[n]
+		}
+		return ""
+	}
+	if v, ok := s.vars[name]; ok {
+		return v
+	}
+	return s.env[name]
+}
+
+// set assigns a variable, keeping it exported if it is.
+func (s *shell) set(name, value string) {
+	if _, exported := s.env[name]; exported {
+		s.env[name] = value
+		return
+	}
+	s.vars[name] = value
+}
+
+func (s *shell) errorf(format string, args ...any) {
+	fmt.Fprintf(s.io[2], "internal-sh: "+format+"\n", args...)
+}
+
+// interact reads commands from in until EOF or exit, prompting with PS1,
+// or user@host:dir$, if in is a terminal. Commands continue on the next
+// line while they are incomplete.
+func (s *shell) interact(in *os.File) {
+	tty := term.IsTerminal(int(in.Fd()))
+	var reading atomic.Bool
+	if tty {
+		// Interrupts end the command running; at the prompt they drop the line
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		go func() {
+			for range interrupts {
+				if reading.Load() {
+					fmt.Fprint(s.io[1], "\n"+s.prompt())
+				}
+			}
+		}()
+	}
+	r := &lineReader{f: in}
+	pending := ""
+	for !s.exited {
+		if tty {
+			if pending == "" {
+				fmt.Fprint(s.io[1], s.prompt())
+			} else {
+				fmt.Fprint(s.io[1], "> ")
+			}
+		}
+		reading.Store(true)
+		line, err := r.readLine()
+		reading.Store(false)
+		if err != nil {
+			if tty {
+				fmt.Fprintln(s.io[1])
+			}
+			return
+		}
+		src := pending + line
+		list, err := parseShell(src)
+		if errors.Is(err, errIncomplete) {
+			pending = src + "\n"
+			continue
+		}
+		pending = ""
+		if err != nil {
+			s.errorf("%v", err)
+			s.status = 2
+			continue
+		}
+		s.runList(list)
+	}
+}
+
+func (s *shell) prompt() string {
+	if ps1 := s.get("PS1"); ps1 != "" {
+		return ps1
+	}
+	host, _ := os.Hostname()
+	dir := s.dir
+	if home := s.get("HOME"); home != "" && (dir == home || strings.HasPrefix(dir, home+string(filepath.Separator))) {
+		dir = "~" + dir[len(home):]
+	}
+	sign := "$"
+	if os.Geteuid() == 0 {
+		sign = "#"
+	}
+	return fmt.Sprintf("%s@%s:%s%s ", s.get("USER"), host, dir, sign)
+}
+
+// lineReader reads lines a byte at a time, so commands the shell starts
+// can read the rest of its input.
+type lineReader struct {
+	f *os.File
+}
+
+func (r *lineReader) readLine() (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.f.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return strings.TrimSuffix(string(line), "\r"), nil
+			}
+			line = append(line, b[0])
+			continue
+		}
+		if err != nil {
+			if len(line) > 0 {
+				return string(line), nil
+			}
+			return "", err
+		}
+	}
+}
+
+// run parses and runs src, setting the status.
+func (s *shell) run(src string) {
+	list, err := parseShell(src)
+	if err != nil {
+		s.errorf("%v", err)
+		s.status = 2
+		return
+	}
+	s.runList(list)
+}
+
+// source runs the script at path, returning its status.
+func (s *shell) source(path string) (int, error) {
+	src, err := os.ReadFile(s.path(path))
+	if err != nil {
+		return 0, err
+	}
+	s.run(string(src))
+	return s.status, nil
+}
+
+// Parsed commands: a list of and-or lists of pipelines of simple commands.
+type (
+	shellList []andOrList
+	andOrList struct {
+		pipelines []pipeline
+		ops       []string // "&&" or "||" between pipelines
+	}
+	pipeline      []*simpleCommand
+	simpleCommand struct {
+		assigns []assignment
+		args    []shellWord
+		redirs  []redirection
+	}
+	assignment struct {
+		name  string
+		value shellWord
+	}
+	redirection struct {
+		fd     int
+		op     string // <, >, >>, <& or >&
+		target shellWord
+	}
+)
+
+// shellWord is a word as written, expanded when its command runs.
+type shellWord []wordPart
+
+type wordPart struct {
+	kind   partKind
+	text   string // the text, variable name or substituted command
+	quoted bool
+}
+
+type partKind int
+
+const (
+	partLiteral partKind = iota
+	partVar
+	partCommand
+)
+
+// errIncomplete is returned for input that continues on the next line:
+// open quotes and substitutions, trailing operators and backslashes.
+var errIncomplete = errors.New("unexpected end of input")
+
+// shellToken is a word, or an operator if op is set.
+type shellToken struct {
+	op    string
+	word  shellWord
+	redir redirection
+}
+
+// lexShell splits src into words and operators. Newlines separate commands
+// like ";".
+func lexShell(src string) ([]shellToken, error) {
+	var tokens []shellToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '\n' || c == ';':
+			tokens = append(tokens, shellToken{op: ";"})
+			i++
+		case strings.HasPrefix(src[i:], "&&"), strings.HasPrefix(src[i:], "||"):
+			tokens = append(tokens, shellToken{op: src[i : i+2]})
+			i += 2
+		case c == '|':
+			tokens = append(tokens, shellToken{op: "|"})
+			i++
+		case c == '&':
+			return nil, errors.New("syntax error: background jobs are not supported")
+		case c == '(' || c == ')':
+			return nil, fmt.Errorf("syntax error near %q: subshells are not supported", c)
+		case c == '<' || c == '>':
+			fd := 0
+			if c == '>' {
+				fd = 1
+			}
+			n, err := lexRedirection(src[i:], fd, &tokens)
+			if err != nil {
+				return nil, err
+			}
+			i += n
+		default:
+			w, n, err := lexWord(src[i:])
+			if err != nil {
+				return nil, err
+			}
+			i += n
+			// A lone digit before a redirection is its file descriptor
+			if len(w) == 1 && w[0].kind == partLiteral && !w[0].quoted && len(w[0].text) == 1 &&
+				w[0].text[0] >= '0' && w[0].text[0] <= '9' && i < len(src) && (src[i] == '<' || src[i] == '>') {
+				n, err := lexRedirection(src[i:], int(w[0].text[0]-'0'), &tokens)
+				if err != nil {
+					return nil, err
+				}
+				i += n
+				continue
+			}
+			tokens = append(tokens, shellToken{word: w})
+		}
+	}
+	return tokens, nil
+}
+
+// lexRedirection lexes the redirection at the start of src and its target
+// word, returning how much it took.
+func lexRedirection(src string, fd int, tokens *[]shellToken) (int, error) {
+	op := src[:1]
+	i := 1
+	if i < len(src) && (src[i] == '>' && op == ">" || src[i] == '&') {
+		op += src[i : i+1]
+		i++
+	}
+	for i < len(src) && (src[i] == ' ' || src[i] == '\t') {
+		i++
+	}
+	if i == len(src) || strings.ContainsRune("\n;|&<>", rune(src[i])) {
+		if i == len(src) {
+			return 0, errIncomplete
+		}
+		return 0, fmt.Errorf("syntax error: %s needs a target", op)
+	}
+	w, n, err := lexWord(src[i:])
+	if err != nil {
+		return 0, err
+	}
+	*tokens = append(*tokens, shellToken{op: "redir", redir: redirection{fd: fd, op: op, target: w}})
+	return i + n, nil
+}
+
+// lexWord lexes the word at the start of src, returning how much it took.
+func lexWord(src string) (shellWord, int, error) {
+	var w shellWord
+	lit := func(text string, quoted bool) {
+		if n := len(w); n > 0 && w[n-1].kind == partLiteral && w[n-1].quoted == quoted {
+			w[n-1].text += text
+			return
+		}
+		w = append(w, wordPart{kind: partLiteral, text: text, quoted: quoted})
+	}
+	i := 0
+	for i < len(src) && !strings.ContainsRune(" \t\n;|&<>()", rune(src[i])) {
+		switch c := src[i]; c {
+		case '\'':
+			end := strings.IndexByte(src[i+1:], '\'')
+			if end < 0 {
+				return nil, 0, errIncomplete
+			}
+			lit(src[i+1:i+1+end], true)
+			i += end + 2
+		case '"':
+			i++
+			for {
+				if i == len(src) {
+					return nil, 0, errIncomplete
+				}
+				c := src[i]
+				if c == '"' {
+					i++
+					break
+				}
+				switch {
+				case c == '\\' && i+1 < len(src) && strings.IndexByte("$`\"\\\n", src[i+1]) >= 0:
+					if src[i+1] != '\n' {
+						lit(src[i+1:i+2], true)
+					}
+					i += 2
+				case c == '$' || c == '`':
+					p, n, err := lexExpansion(src[i:])
+					if err != nil {
+						return nil, 0, err
+					}
+					if p.kind == partLiteral {
+						lit(p.text, true)
+					} else {
+						p.quoted = true
+						w = append(w, p)
+					}
+					i += n
+				default:
+					lit(src[i:i+1], true)
+					i++
+				}
+			}
+		case '\\':
+			if i+1 == len(src) {
+				return nil, 0, errIncomplete
+			}
+			if src[i+1] != '\n' {
+				lit(src[i+1:i+2], true)
+			}
+			i += 2
+		case '$', '`':
+			p, n, err := lexExpansion(src[i:])
+			if err != nil {
+				return nil, 0, err
+			}
+			if p.kind == partLiteral {
+				lit(p.text, false)
+			} else {
+				w = append(w, p)
+			}
+			i += n
+		default:
+			lit(src[i:i+1], false)
+			i++
+		}
+	}
+	if w == nil {
+		// An empty quoted word, as in ""
+		w = shellWord{{kind: partLiteral, quoted: true}}
+	}
+	return w, i, nil
+}
+
+// lexExpansion lexes the $ or ` expansion at the start of src. A $ not
+// starting one is literal.
+func lexExpansion(src string) (wordPart, int, error) {
+	if src[0] == '`' {
+		end := strings.IndexByte(src[1:], '`')
+		if end < 0 {
+			return wordPart{}, 0, errIncomplete
+		}
+		return wordPart{kind: partCommand, text: src[1 : 1+end]}, end + 2, nil
+	}
+	if len(src) == 1 {
+		return wordPart{kind: partLiteral, text: "$"}, 1, nil
+	}
+	switch c := src[1]; {
+	case c == '(':
+		end, err := matchParen(src[2:])
+		if err != nil {
+			return wordPart{}, 0, err
+		}
+		return wordPart{kind: partCommand, text: src[2 : 2+end]}, end + 3, nil
+	case c == '{':
+		end := strings.IndexByte(src, '}')
+		if end < 0 {
+			return wordPart{}, 0, errIncomplete
+		}
+		name := src[2:end]
+		if !validVarName(name) && !specialParam(name) {
+			return wordPart{}, 0, fmt.Errorf("%s: bad substitution", src[:end+1])
+		}
+		return wordPart{kind: partVar, text: name}, end + 1, nil
+	case specialParam(string(c)):
+		return wordPart{kind: partVar, text: string(c)}, 2, nil
+	case c == '_' || isLetter(c):
+		n := 2
+		for n < len(src) && (src[n] == '_' || isLetter(src[n]) || src[n] >= '0' && src[n] <= '9') {
+			n++
+		}
+		return wordPart{kind: partVar, text: src[1:n]}, n, nil
+	}
+	return wordPart{kind: partLiteral, text: "$"}, 1, nil
+}
+
+// matchParen returns the index in src of the ")" closing a "$(" just
+// before it, skipping quoted text and nested parentheses.
+func matchParen(src string) (int, error) {
+	depth := 0
+	for i := 0; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '\'':
+			end := strings.IndexByte(src[i+1:], '\'')
+			if end < 0 {
+				return 0, errIncomplete
+			}
+			i += end + 1
+		case '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return i, nil
+			}
+			depth--
+		}
+	}
+	return 0, errIncomplete
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+func specialParam(name string) bool {
+	return len(name) == 1 && (strings.Contains("?$#@*", name) || name[0] >= '0' && name[0] <= '9')
+}
+
+func validVarName(name string) bool {
+	if name == "" || name[0] != '_' && !isLetter(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if c := name[i]; c != '_' && !isLetter(c) && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseShell parses src into commands.
+func parseShell(src string) (shellList, error) {
+	tokens, err := lexShell(src)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		list shellList
+		ao   andOrList
+		pl   pipeline
+		cmd  *simpleCommand
+	)
+	// want is set after an operator needing a command to follow
+	want := ""
+	endCommand := func() error {
+		if cmd == nil {
+			if want != "" {
+				return fmt.Errorf("syntax error: %s needs a command", want)
+			}
+			return nil
+		}
+		pl = append(pl, cmd)
+		cmd = nil
+		return nil
+	}
+	for _, t := range tokens {
+		switch t.op {
+		case "":
+			if cmd == nil {
+				cmd = &simpleCommand{}
+			}
+			if name, value, ok := splitAssignment(t.word); ok && len(cmd.args) == 0 {
+				cmd.assigns = append(cmd.assigns, assignment{name, value})
+			} else {
+				cmd.args = append(cmd.args, t.word)
+			}
+			want = ""
+		case "redir":
+			if cmd == nil {
+				cmd = &simpleCommand{}
+			}
+			cmd.redirs = append(cmd.redirs, t.redir)
+			want = ""
+		case "|", "&&", "||":
+			if cmd == nil {
+				return nil, fmt.Errorf("syntax error near %q", t.op)
+			}
+			endCommand()
+			if t.op != "|" {
+				ao.pipelines = append(ao.pipelines, pl)
+				ao.ops = append(ao.ops, t.op)
+				pl = nil
+			}
+			want = t.op
+		case ";":
+			if want != "" {
+				// Commands may continue on the next line after an operator
+				continue
+			}
+			endCommand()
+			if pl != nil {
+				ao.pipelines = append(ao.pipelines, pl)
+				list = append(list, ao)
+			}
+			ao, pl = andOrList{}, nil
+		}
+	}
+	if want != "" {
+		return nil, errIncomplete
+	}
+	endCommand()
+	if pl != nil {
+		ao.pipelines = append(ao.pipelines, pl)
+		list = append(list, ao)
+	}
+	return list, nil
+}
+
+// splitAssignment splits a NAME=value word.
+func splitAssignment(w shellWord) (string, shellWord, bool) {
+	if len(w) == 0 || w[0].kind != partLiteral || w[0].quoted {
+		return "", nil, false
+	}
+	name, rest, ok := strings.Cut(w[0].text, "=")
+	if !ok || !validVarName(name) {
+		return "", nil, false
+	}
+	value := append(shellWord{{kind: partLiteral, text: rest}}, w[1:]...)
+	return name, value, true
+}
+
+func (s *shell) runList(list shellList) {
+	for _, ao := range list {
+		if s.exited {
+			return
+		}
+		s.status = s.runPipeline(ao.pipelines[0])
+		for i, op := range ao.ops {
+			if s.exited {
+				return
+			}
+			if (op == "&&") == (s.status == 0) {
+				s.status = s.runPipeline(ao.pipelines[i+1])
+			}
+		}
+	}
+}
+
+// runPipeline runs the commands of p connected by pipes and returns the
+// status of the last. A command on its own runs in the shell, so builtins
+// such as cd change its state; in pipelines they run in subshells.
+func (s *shell) runPipeline(p pipeline) int {
+	if len(p) == 1 {
+		return s.runCommand(p[0], s.io, nil)
+	}
+	statuses := make([]int, len(p))
+	var wg sync.WaitGroup
+	in := s.io[0]
+	for i, cmd := range p {
+		fds := stdio{in, s.io[1], s.io[2]}
+		var next *os.File
+		if i < len(p)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				s.errorf("%v", err)
+				break
+			}
+			fds[1], next = w, r
+		}
+		started := make(chan struct{})
+		go func() {
+			// The shell's ends of the pipes close once the stage has them,
+			// so the next sees EOF when it is done
+			<-started
+			if fds[0] != s.io[0] {
+				fds[0].Close()
+			}
+			if fds[1] != s.io[1] {
+				fds[1].Close()
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = s.clone(fds).runCommand(cmd, fds, started)
+		}()
+		in = next
+	}
+	wg.Wait()
+	return statuses[len(p)-1]
+}
+
+// runCommand expands and runs cmd with fds, after applying its
+// redirections, and returns its status. started, if set, is closed once
+// cmd no longer needs the shell's copies of fds.
+func (s *shell) runCommand(cmd *simpleCommand, fds stdio, started chan struct{}) int {
+	var opened []*os.File
+	defer func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}()
+	done := func() {
+		if started != nil {
+			close(started)
+			started = nil
+		}
+	}
+	defer done()
+
+	var args []string
+	for _, w := range cmd.args {
+		fields, err := s.expand(w, true)
+		if err != nil {
+			s.errorf("%v", err)
+			return 1
+		}
+		args = append(args, fields...)
+	}
+	var env []string
+	for _, a := range cmd.assigns {
+		value, err := s.expandString(a.value)
+		if err != nil {
+			s.errorf("%v", err)
+			return 1
+		}
+		if len(args) == 0 {
+			s.set(a.name, value)
+		} else {
+			env = append(env, a.name+"="+value)
+		}
+	}
+	for _, r := range cmd.redirs {
+		f, err := s.redirect(r, &fds)
+		if err != nil {
+			s.errorf("%v", err)
+			return 1
+		}
+		if f != nil {
+			opened = append(opened, f)
+		}
+	}
+	if len(args) == 0 {
+		return 0
+	}
+
+	if builtin, ok := shellBuiltins[args[0]]; ok {
+		saved := s.io
+		s.io = fds
+		defer func() { s.io = saved }()
+		return builtin(s, args)
+	}
+	path, err := s.lookPath(args[0])
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			s.errorf("%s: command not found", args[0])
+			return 127
+		}
+		s.errorf("%v", err)
+		return 126
+	}
+	c := exec.Command(path, args[1:]...)
+	c.Args[0] = args[0]
+	c.Stdin, c.Stdout, c.Stderr = fds[0], fds[1], fds[2]
+	c.Dir, c.Env = s.dir, append(s.environ(), env...)
+	if err := c.Start(); err != nil {
+		s.errorf("%s: %v", args[0], err)
+		return 126
+	}
+	done()
+	return exitCode(c.Wait())
+}
+
+// exitCode returns the status a shell gives for err from a command: its
+// exit status, or 128 plus the signal that killed it.
+func exitCode(err error) int {
+	var exit *exec.ExitError
+	if err == nil {
+		return 0
+	}
+	if !errors.As(err, &exit) {
+		return 1
+	}
+	if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exit.ExitCode()
+}
+
+// redirect applies r to fds, returning the file it opened, if any.
+func (s *shell) redirect(r redirection, fds *stdio) (*os.File, error) {
+	if r.fd > 2 {
+		return nil, fmt.Errorf("%d: file descriptors above 2 are not supported", r.fd)
+	}
+	target, err := s.expandString(r.target)
+	if err != nil {
+		return nil, err
+	}
+	switch r.op {
+	case "<&", ">&":
+		n, err := strconv.Atoi(target)
+		if err != nil || n < 0 || n > 2 {
+			return nil, fmt.Errorf("%s: bad file descriptor", target)
+		}
+		fds[r.fd] = fds[n]
+		return nil, nil
+	}
+	var f *os.File
+	target = s.path(target)
+	switch r.op {
+	case "<":
+		f, err = os.Open(target)
+	case ">":
+		f, err = os.Create(target)
+	case ">>":
+		f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fds[r.fd] = f
+	return f, nil
+}
+
+// expandString expands w to one string, without splitting or globs, as
+// for assignments and redirection targets.
+func (s *shell) expandString(w shellWord) (string, error) {
+	fields, err := s.expand(w, false)
+	return strings.Join(fields, " "), err
+}
+
+// expand expands the variables, command substitutions and leading ~ of w.
+// With fields set, unquoted expansions are split at white space and words
+// with unquoted glob characters replaced by the paths matching them, if
+// any; otherwise w makes one field.
+func (s *shell) expand(w shellWord, fields bool) ([]string, error) {
+	var (
+		out     []string
+		cur     strings.Builder
+		pattern strings.Builder // cur with quoted glob characters escaped
+		exists  bool            // cur is a field, even if empty
+		glob    bool
+	)
+	end := func() {
+		if !exists {
+			return
+		}
+		word := cur.String()
+		var matches []string
+		if glob {
+			matches = s.glob(pattern.String())
+		}
+		if len(matches) > 0 {
+			out = append(out, matches...)
+		} else {
+			out = append(out, word)
+		}
+		cur.Reset()
+		pattern.Reset()
+		exists, glob = false, false
+	}
+	add := func(text string, quoted bool) {
+		cur.WriteString(text)
+		if quoted || !fields {
+			for _, r := range text {
+				if strings.ContainsRune(`*?[\`, r) {
+					pattern.WriteByte('\\')
+				}
+				pattern.WriteRune(r)
+			}
+		} else {
+			pattern.WriteString(text)
+			glob = glob || strings.ContainsAny(text, "*?[")
+		}
+		exists = exists || quoted || text != ""
+	}
+	for i, p := range w {
+		var value string
+		switch p.kind {
+		case partLiteral:
+			text := p.text
+			if i == 0 && !p.quoted && (text == "~" || strings.HasPrefix(text, "~/")) {
+				text = s.get("HOME") + text[1:]
+			}
+			add(text, p.quoted)
+			continue
+		case partVar:
+			value = s.get(p.text)
+		case partCommand:
+			value = strings.TrimRight(s.capture(p.text), "\n")
+		}
+		if p.quoted || !fields {
+			add(value, true)
+			continue
+		}
+		for j, f := range strings.Fields(value) {
+			if j > 0 || strings.IndexAny(value, " \t\n") == 0 {
+				end()
+			}
+			add(f, true)
+		}
+		if value != "" && strings.LastIndexAny(value, " \t\n") == len(value)-1 {
+			end()
+		}
+	}
+	end()
+	if !fields && out == nil {
+		out = []string{""}
+	}
+	return out, nil
+}
+
+// glob returns the paths matching pattern, relative to the working
+// directory as given unless they are absolute.
+func (s *shell) glob(pattern string) []string {
+	if filepath.IsAbs(pattern) || s.dir == "" {
+		matches, _ := filepath.Glob(pattern)
+		return matches
+	}
+	dir := s.dir
+	if runtime.GOOS != "windows" {
+		// On Windows, \ separates paths rather than escaping
+		var escaped strings.Builder
+		for _, r := range dir {
+			if strings.ContainsRune(`*?[\`, r) {
+				escaped.WriteByte('\\')
+			}
+			escaped.WriteRune(r)
+		}
+		dir = escaped.String()
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+	for i, m := range matches {
+		matches[i], _ = filepath.Rel(s.dir, m)
+		// As written, so ./-f stays an operand
+		if strings.HasPrefix(pattern, "./") {
+			matches[i] = "./" + matches[i]
+		}
+	}
+	return matches
+}
+
+// capture runs src in a subshell and returns what it wrote to stdout.
+func (s *shell) capture(src string) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		s.errorf("%v", err)
+		return ""
+	}
+	var out strings.Builder
+	copied := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&out, r)
+		r.Close()
+		close(copied)
+	}()
+	sub := s.clone(stdio{s.io[0], w, s.io[2]})
+	sub.run(src)
+	w.Close()
+	<-copied
+	s.status = sub.status
+	return out.String()
+}
+
+// shellBuiltins run in the shell, with its stdio set to the command's.
+var shellBuiltins map[string]func(s *shell, args []string) int
+
+func init() {
+	shellBuiltins = map[string]func(s *shell, args []string) int{
+		"cd":     (*shell).cd,
+		"pwd":    (*shell).pwd,
+		"echo":   (*shell).echo,
+		"export": (*shell).export,
+		"unset":  (*shell).unset,
+		"exit":   (*shell).exit,
+		"type":   (*shell).typeOf,
+		"help":   (*shell).help,
+		".":      (*shell).sourceBuiltin,
+		"source": (*shell).sourceBuiltin,
+		"true":   func(*shell, []string) int { return 0 },
+		":":      func(*shell, []string) int { return 0 },
+		"false":  func(*shell, []string) int { return 1 },
+	}
+}
+
+func (s *shell) cd(args []string) int {
+	dir := s.get("HOME")
+	switch {
+	case len(args) > 2:
+		s.errorf("cd: too many arguments")
+		return 1
+	case len(args) == 2 && args[1] == "-":
+		dir = s.get("OLDPWD")
+		fmt.Fprintln(s.io[1], dir)
+	case len(args) == 2:
+		dir = args[1]
+	}
+	if dir == "" {
+		s.errorf("cd: HOME not set")
+		return 1
+	}
+	wd := filepath.Clean(s.path(dir))
+	if fi, err := os.Stat(wd); err != nil {
+		s.errorf("cd: %v", err)
+		return 1
+	} else if !fi.IsDir() {
+		s.errorf("cd: %s: not a directory", dir)
+		return 1
+	}
+	s.set("OLDPWD", s.dir)
+	s.set("PWD", wd)
+	s.dir = wd
+	return 0
+}
+
+func (s *shell) pwd(args []string) int {
+	fmt.Fprintln(s.io[1], s.dir)
+	return 0
+}
+
+func (s *shell) echo(args []string) int {
+	args = args[1:]
+	newline := true
+	if len(args) > 0 && args[0] == "-n" {
+		newline, args = false, args[1:]
+	}
+	out := strings.Join(args, " ")
+	if newline {
+		out += "\n"
+	}
+	_, err := io.WriteString(s.io[1], out)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// export exports the variables named, assigning those given as
+// NAME=value, or lists the exported ones.
+func (s *shell) export(args []string) int {
+	if len(args) == 1 {
+		for _, kv := range s.environ() {
+			name, value, _ := strings.Cut(kv, "=")
+			fmt.Fprintf(s.io[1], "export %s=%s\n", name, quoteShell(value))
+		}
+		return 0
+	}
+	status := 0
+	for _, arg := range args[1:] {
+		name, value, assigned := strings.Cut(arg, "=")
+		if !validVarName(name) {
+			s.errorf("export: %q: not a valid name", arg)
+			status = 1
+			continue
+		}
+		if !assigned {
+			value = s.get(name)
+		}
+		delete(s.vars, name)
+		s.env[name] = value
+	}
+	return status
+}
+
+func (s *shell) unset(args []string) int {
+	for _, name := range args[1:] {
+		delete(s.vars, name)
+		delete(s.env, name)
+	}
+	return 0
+}
+
+func (s *shell) exit(args []string) int {
+	status := s.status
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			s.errorf("exit: %s: numeric argument required", args[1])
+			n = 2
+		}
+		status = n & 0xff
+	}
+	s.exited = true
+	return status
+}
+
+// typeOf reports whether each name is a builtin or the command it runs.
+func (s *shell) typeOf(args []string) int {
+	status := 0
+	for _, name := range args[1:] {
+		if _, ok := shellBuiltins[name]; ok {
+			fmt.Fprintf(s.io[1], "%s is a shell builtin\n", name)
+		} else if path, err := s.lookPath(name); err == nil {
+			fmt.Fprintf(s.io[1], "%s is %s\n", name, path)
+		} else {
+			s.errorf("type: %s: not found", name)
+			status = 1
+		}
+	}
+	return status
+}
+
+func (s *shell) help(args []string) int {
+	var names []string
+	for name := range shellBuiltins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(s.io[1], "%s, the server's built-in shell. It runs simple commands with\n"+
+		"quotes, $VAR, $(...), globs, redirections, pipes, && and ||; there is no\n"+
+		"control flow or job control.\nBuiltins: %s\n", internalShell, strings.Join(names, " "))
+	return 0
+}
+
+func (s *shell) sourceBuiltin(args []string) int {
+	if len(args) < 2 {
+		s.errorf("%s: filename argument required", args[0])
+		return 2
+	}
+	status, err := s.source(args[1])
+	if err != nil {
+		s.errorf("%s: %v", args[0], err)
+		return 1
+	}
+	return status
+}
+
+// quoteShell quotes value for the shell, if it needs it.
+func quoteShell(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n'\"\\$`*?[]#~=&;|<>(){}!") {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultDrainTimeout is how long a shutdown waits for sessions to end by
+// default.
+const defaultDrainTimeout = 30 * time.Second
+
+// openConns are the connections being served, for shutdowns to wait for
+// and, once they have waited long enough, close.
+type openConns struct {
+	mu   sync.Mutex
+	set  map[net.Conn]bool // whether the client has authenticated
+	done sync.WaitGroup
+}
+
+// add records conn as open until the returned function is called.
+func (o *openConns) add(conn net.Conn) (remove func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.set == nil {
+		o.set = make(map[net.Conn]bool)
+	}
+	o.set[conn] = false
+	o.done.Add(1)
+	return func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		delete(o.set, conn)
+		o.done.Done()
+	}
+}
+
+// authenticated marks conn as past authentication, so a shutdown lets it
+// finish.
+func (o *openConns) authenticated(conn net.Conn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.set[conn]; ok {
+		o.set[conn] = true
+	}
+}
+
+// close closes the open connections, or only those that have not
+// authenticated yet, and returns how many it closed.
+func (o *openConns) close(all bool) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for conn, authed := range o.set {
+		if all || !authed {
+			conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// len returns the number of open connections.
+func (o *openConns) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.set)
+}
+
+// wait waits up to timeout for every connection to have ended.
+func (o *openConns) wait(timeout time.Duration, interrupt <-chan os.Signal) bool {
+	ended := make(chan struct{})
+	go func() {
+		o.done.Wait()
+		close(ended)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-ended:
+		return true
+	case <-t.C:
+	case <-interrupt:
+	}
+	return false
+}
+
+// drainOnTerm serves until SIGTERM or SIGINT, then shuts down gracefully:
+// it stops accepting connections, drops those still authenticating, tells
+// interactive sessions, and waits up to timeout for the others to end
+// before closing them. A second signal closes them at once. After a
+// restart it returns once the connections left to this server have ended.
+func (s *server) drainOnTerm(sockets []net.Listener, timeout time.Duration) {
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	var sig os.Signal
+	select {
+	case sig = <-term:
+	case <-s.retired:
+		infof("All connections ended after the restart; exiting")
+		return
+	}
+	infof("Received %v: shutting down, waiting up to %v for sessions to end", sig, timeout)
+	for _, socket := range sockets {
+		socket.Close()
+	}
+	s.conns.close(false)
+	if n := s.wall(fmt.Sprintf("The server is shutting down. Sessions still open in %v will be closed.", timeout)); n > 0 {
+		infof("Told %d interactive sessions of the shutdown", n)
+	}
+	if s.conns.wait(timeout, term) {
+		infof("All sessions ended; exiting")
+		return
+	}
+	infof("Closing %d remaining connections", s.conns.close(true))
+	// Let sessions hang up their processes and write their records
+	s.conns.wait(5*time.Second, term)
+}
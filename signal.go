@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSignals maps the signal names of RFC 4254 section 6.10, without the
+// "SIG" prefix, to the signals they stand for. USR1 and USR2 are added on
+// Unix, as Windows has no such signals.
+var sshSignals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+}
+
+// handleSignal handles a "signal" request, delivering the signal to the
+// running shell or command. In-process handlers such as SFTP have no
+// process to signal.
+func (sess *session) handleSignal(req *ssh.Request) {
+	var sig struct{ Signal string }
+	if err := ssh.Unmarshal(req.Payload, &sig); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	signum, ok := sshSignals[sig.Signal]
+	if !ok || sess.process == nil {
+		req.Reply(false, nil)
+		return
+	}
+	if err := sess.process.Signal(signum); err != nil {
+		warnf("Failed to send SIG%s for %s: %v", sig.Signal, sess.user.Name, err)
+		req.Reply(false, nil)
+		return
+	}
+	infof("Sent SIG%s to the command of %s", sig.Signal, sess.user.Name)
+	req.Reply(true, nil)
+}
+
+// parseBreakAction returns the signal for the break_action setting, or zero
+// for "none".
+func parseBreakAction(action string) (syscall.Signal, error) {
+	switch action {
+	case "":
+		return syscall.SIGINT, nil
+	case "none":
+		return 0, nil
+	}
+	sig, ok := sshSignals[strings.TrimPrefix(strings.ToUpper(action), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("break_action: unknown signal %q", action)
+	}
+	return sig, nil
+}
+
+// handleBreak handles an RFC 4335 "break" request. As a break on a serial
+// line with BRKINT set would, it signals the terminal's foreground process
+// group on PTY sessions, and the command itself otherwise. The requested
+// break length has no meaning here and is ignored.
+func (sess *session) handleBreak(req *ssh.Request) {
+	var brk struct{ Length uint32 }
+	if err := ssh.Unmarshal(req.Payload, &brk); err != nil || sess.breakSignal == 0 || sess.process == nil {
+		req.Reply(false, nil)
+		return
+	}
+	onPTY, err := sess.breakPTY()
+	if !onPTY {
+		err = sess.process.Signal(sess.breakSignal)
+	}
+	if err != nil {
+		warnf("Failed to deliver break for %s: %v", sess.user.Name, err)
+		req.Reply(false, nil)
+		return
+	}
+	infof("Break from %s sent %v to their command", sess.user.Name, sess.breakSignal)
+	req.Reply(true, nil)
+}
+
+// sendExitSignal sends the exit-signal request for a command killed by sig.
+// Signals without an SSH name are reported as exit status 128+n, as shells
+// do.
+func sendExitSignal(ch ssh.Channel, sig syscall.Signal, coreDumped bool) {
+	name := ""
+	for n, s := range sshSignals {
+		if s == sig {
+			name = n
+			break
+		}
+	}
+	if name == "" {
+		sendExitStatus(ch, 128+int(sig))
+		return
+	}
+	type exitSignal struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}
+	payload := ssh.Marshal(exitSignal{Signal: name, CoreDumped: coreDumped, Error: sig.String()})
+	_, _ = ch.SendRequest("exit-signal", false, payload)
+}
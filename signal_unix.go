@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+func init() {
+	sshSignals["USR1"] = syscall.SIGUSR1
+	sshSignals["USR2"] = syscall.SIGUSR2
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"golang.org/x/crypto/ssh"
+	_ "modernc.org/sqlite"
+)
+
+// SQLConfig configures authentication against a users table in SQLite or
+// PostgreSQL.
+type SQLConfig struct {
+	// Driver is "sqlite" or "postgres".
+	Driver string `yaml:"driver"`
+	// DSN is a file path for SQLite or a connection URL for PostgreSQL.
+	DSN string `yaml:"dsn"`
+	// Table defaults to "ssh_users".
+	Table string `yaml:"table"`
+
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+// sqlMigrations create and evolve the users table. They are applied in
+// order and recorded in ssh_schema_migrations; never edit a released entry,
+// append a new one. "%s" is replaced by the table name.
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS %s (
+		username      TEXT PRIMARY KEY,
+		password_hash TEXT,
+		public_keys   TEXT,
+		shell         TEXT
+	)`,
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqlProvider authenticates users stored in a SQL table. Password hashes use
+// the same bcrypt/argon2id formats as the config file; public_keys holds
+// authorized_keys lines.
+type sqlProvider struct {
+	db    *sql.DB
+	table string
+	// bind is the placeholder style of the driver
+	bind func(n int) string
+}
+
+func newSQLProvider(cfg SQLConfig) (*sqlProvider, error) {
+	if cfg.Table == "" {
+		cfg.Table = "ssh_users"
+	}
+	if !sqlIdentifier.MatchString(cfg.Table) {
+		return nil, fmt.Errorf("sql: invalid table name %q", cfg.Table)
+	}
+
+	p := &sqlProvider{table: cfg.Table}
+	switch cfg.Driver {
+	case "sqlite":
+		p.bind = func(int) string { return "?" }
+	case "postgres":
+		p.bind = func(n int) string { return fmt.Sprintf("$%d", n) }
+	default:
+		return nil, fmt.Errorf("sql: unsupported driver %q (use sqlite or postgres)", cfg.Driver)
+	}
+
+	db, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %v", err)
+	}
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sql: %v", err)
+	}
+	p.db = db
+
+	if err := p.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sql: migrate: %v", err)
+	}
+	return p, nil
+}
+
+// migrate applies any sqlMigrations not yet recorded in the database.
+func (p *sqlProvider) migrate() error {
+	if _, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS ssh_schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := p.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM ssh_schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for i := applied; i < len(sqlMigrations); i++ {
+		tx, err := p.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(sqlMigrations[i], p.table)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("version %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO ssh_schema_migrations (version) VALUES (`+p.bind(1)+`)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		infof("Applied SQL schema migration %d", i+1)
+	}
+	return nil
+}
+
+// sqlUser is one row of the users table.
+type sqlUser struct {
+	passwordHash string
+	publicKeys   string
+	shell        string
+}
+
+func (p *sqlProvider) lookup(username string) (*sqlUser, error) {
+	var (
+		u                 sqlUser
+		hash, keys, shell sql.NullString
+	)
+	err := p.db.QueryRow(
+		`SELECT password_hash, public_keys, shell FROM `+p.table+` WHERE username = `+p.bind(1),
+		username,
+	).Scan(&hash, &keys, &shell)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUnknownUser
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sql: %v", err)
+	}
+	u.passwordHash, u.publicKeys, u.shell = hash.String, keys.String, shell.String
+	return &u, nil
+}
+
+// permissions carries the row's shell to the session.
+func (u *sqlUser) permissions(perms *ssh.Permissions) *ssh.Permissions {
+	if perms == nil {
+		perms = fullPermissions()
+	}
+	if u.shell != "" {
+		setExtension(perms, permShell, u.shell)
+	}
+	return perms
+}
+
+func (p *sqlProvider) authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	u, err := p.lookup(c.User())
+	if err != nil {
+		return nil, err
+	}
+	if u.passwordHash == "" {
+		return nil, errors.New("sql: no password set")
+	}
+	h, err := parsePasswordHash(u.passwordHash)
+	if err != nil {
+		return nil, fmt.Errorf("sql: password_hash: %v", err)
+	}
+	if !h.verify(pass) {
+		return nil, errors.New("sql: wrong password")
+	}
+	return u.permissions(nil), nil
+}
+
+func (p *sqlProvider) authenticatePublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	u, err := p.lookup(c.User())
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseAuthorizedKeys([]byte(strings.TrimSpace(u.publicKeys)))
+	if err != nil {
+		return nil, fmt.Errorf("sql: public_keys: %v", err)
+	}
+	entry, ok := findAuthorizedKey(keys, key)
+	if !ok {
+		return nil, errors.New("sql: key not authorized")
+	}
+	perms, err := entry.permissions(c)
+	if err != nil {
+		return nil, err
+	}
+	return u.permissions(perms), nil
+}
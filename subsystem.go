@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// subsystemHandler serves a "subsystem" request on the session's channel.
+// Like runShell and runExec it replies to req and reports whether the
+// request was accepted, leaving any long-running work to sess.background.
+type subsystemHandler func(sess *session, req *ssh.Request) bool
+
+var subsystemTypes = map[string]subsystemHandler{}
+
+// registerSubsystem makes a built-in subsystem available to clients. It is
+// meant to be called from init functions.
+func registerSubsystem(name string, h subsystemHandler) {
+	if _, dup := subsystemTypes[name]; dup {
+		panic("duplicate subsystem " + name)
+	}
+	subsystemTypes[name] = h
+}
+
+// newSubsystems returns the built-in subsystems together with those of the
+// subsystems config section, which run a command each, like OpenSSH's
+// Subsystem directive. A configured name replaces a built-in one, so sftp
+// can be served by an external sftp-server.
+func newSubsystems(commands map[string]string) (map[string]subsystemHandler, error) {
+	subsystems := make(map[string]subsystemHandler, len(subsystemTypes)+len(commands))
+	for name, h := range subsystemTypes {
+		subsystems[name] = h
+	}
+	for name, command := range commands {
+		if name == "" || command == "" {
+			return nil, fmt.Errorf("subsystems: %q needs a name and a command", name)
+		}
+		subsystems[name] = func(sess *session, req *ssh.Request) bool {
+			return sess.runCommand(req, sess.command(command))
+		}
+	}
+	return subsystems, nil
+}
+
+// runSubsystem handles a "subsystem" request by dispatching to the handler
+// for name. sftp_only accounts and logins restricted to internal-sftp only
+// get the built-in sftp, rsync_only, git and bastion accounts none; a
+// forced command runs instead of any subsystem, as with OpenSSH.
+func (sess *session) runSubsystem(req *ssh.Request, name string) bool {
+	h, ok := sess.subsystems[name]
+	patterns, restricted := sess.restricted()
+	switch {
+	case sftpAccount(sess.conn.Permissions):
+		h, ok = subsystemTypes["sftp"], name == "sftp"
+	case permitted(sess.conn.Permissions, permRsyncOnly), permitted(sess.conn.Permissions, permGitRepositories),
+		permitted(sess.conn.Permissions, permBastionTargets):
+		ok = false // rsync, git and jumps run as commands
+	case restricted:
+		// Only the built-in sftp, and only if internal-sftp is allowed
+		h, ok = subsystemTypes["sftp"], name == "sftp" && commandAllowed(patterns, internalSFTP)
+	case sftpOnly(sess.conn.Permissions):
+		h, ok = subsystemTypes["sftp"], name == "sftp"
+	case ok:
+		if _, forced := forcedCommand(sess.conn.Permissions); forced {
+			return sess.runExec(req, "")
+		}
+	}
+	if !ok {
+		infof("Rejecting unsupported subsystem %q for %s", name, sess.user.Name)
+		req.Reply(false, nil)
+		return false
+	}
+	return h(sess, req)
+}
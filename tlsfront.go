@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ListenerTLSConfig wraps a listener's SSH in TLS, so that it can share
+// port 443 through firewalls that only let TLS out. TLS is terminated
+// before the SSH handshake; clients connect through a TLS tunnel, as
+//
+//	ssh -o ProxyCommand="openssl s_client -quiet -connect %h:443 -servername ssh.example.com" alice@ssh.example.com
+//
+// With server_names, only clients asking for those names by SNI get SSH;
+// the others are passed, still encrypted, to fallback, such as the web
+// server the port is shared with.
+//
+//	listeners:
+//	  - address: 0.0.0.0:443
+//	    tls:
+//	      cert_file: /etc/ssh-demo/tls.crt
+//	      key_file: /etc/ssh-demo/tls.key
+//	      server_names: [ssh.example.com]
+//	      fallback: 127.0.0.1:8443
+type ListenerTLSConfig struct {
+	// CertFile and KeyFile are the PEM certificate chain and private key
+	// presented to clients.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerNames, if set, are the SNI names SSH is served for.
+	ServerNames []string `yaml:"server_names"`
+	// Fallback is the host:port that connections for other names, or none,
+	// are passed to. Without it they are refused.
+	Fallback string `yaml:"fallback"`
+}
+
+// tlsHandshakeTimeout bounds how long a client has to complete the TLS
+// handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsFront terminates the TLS of a listener's connections.
+type tlsFront struct {
+	config   *tls.Config
+	names    map[string]bool
+	fallback string
+}
+
+func newTLSFront(cfg ListenerTLSConfig) (*tlsFront, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("cert_file and key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Fallback != "" {
+		if _, _, err := net.SplitHostPort(cfg.Fallback); err != nil {
+			return nil, fmt.Errorf("fallback: %q is not a host:port", cfg.Fallback)
+		}
+		if len(cfg.ServerNames) == 0 {
+			return nil, errors.New("fallback is set without server_names")
+		}
+	}
+	t := &tlsFront{config: &tls.Config{Certificates: []tls.Certificate{cert}}, fallback: cfg.Fallback}
+	if len(cfg.ServerNames) > 0 {
+		t.names = make(map[string]bool, len(cfg.ServerNames))
+		for _, name := range cfg.ServerNames {
+			t.names[name] = true
+		}
+	}
+	return t, nil
+}
+
+// errHelloRead stops the handshake peekServerName runs once it has the
+// ClientHello.
+var errHelloRead = errors.New("ClientHello read")
+
+// helloConn is a connection a handshake reads the ClientHello from and can
+// write nothing to.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// replayConn is a connection whose first bytes, already read, are read
+// again.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// peekServerName reads the TLS ClientHello of conn for the name the client
+// asked for, and returns conn as it was before.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var hello bytes.Buffer
+	var name string
+	err := tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return name, &replayConn{Conn: conn, r: io.MultiReader(&hello, conn)}, nil
+}
+
+// accept terminates the TLS of conn, returning the connection inside for
+// SSH, or nil once a connection for another name has been passed to the
+// fallback and closed.
+func (t *tlsFront) accept(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if t.names != nil {
+		name, replay, err := peekServerName(conn)
+		if err != nil {
+			return nil, fmt.Errorf("TLS: %v", err)
+		}
+		if !t.names[name] {
+			if t.fallback == "" {
+				return nil, fmt.Errorf("TLS: no SSH for server name %q", name)
+			}
+			conn.SetDeadline(time.Time{})
+			debugf("Passing TLS connection from %s for %q to %s", conn.RemoteAddr(), name, t.fallback)
+			return nil, t.passThrough(replay)
+		}
+		conn = replay
+	}
+	tc := tls.Server(conn, t.config)
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// passThrough copies conn to and from the fallback until either closes.
+func (t *tlsFront) passThrough(conn net.Conn) error {
+	backend, err := net.DialTimeout("tcp", t.fallback, tlsHandshakeTimeout)
+	if err != nil {
+		return fmt.Errorf("TLS fallback: %v", err)
+	}
+	defer backend.Close()
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(backend, conn)
+		if tc, ok := backend.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		close(done)
+	}()
+	_, _ = io.Copy(conn, backend)
+	conn.Close()
+	<-done
+	return nil
+}
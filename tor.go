@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/textproto"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TorConfig publishes the server as a Tor onion service through the
+// control port of a running Tor, for reachability without a public IP.
+// Clients connect with "torsocks ssh" or ProxyCommand "nc -X 5 -x
+// 127.0.0.1:9050 %h %p". Their connections arrive from Tor on the loopback
+// address, which access lists and rate limits see as one local client.
+//
+//	tor:
+//	  control_address: 127.0.0.1:9051
+//	  key_file: onion.key
+type TorConfig struct {
+	// ControlAddress is Tor's control port, or unix: and the path of its
+	// control socket; 127.0.0.1:9051 by default.
+	ControlAddress string `yaml:"control_address"`
+	// ControlPassword is the password of Tor's HashedControlPassword.
+	// Without it the control port must need no authentication, or cookie
+	// authentication with a cookie file the server can read.
+	ControlPassword string `yaml:"control_password"`
+	// KeyFile keeps the onion service's private key, created on first use,
+	// so its address outlives restarts. Without it each run gets a new
+	// address.
+	KeyFile string `yaml:"key_file"`
+	// Port is the port of the onion address; 22 by default.
+	Port int `yaml:"port"`
+	// Target is the listener, by address, that the onion service leads
+	// to; it is required. An unspecified host such as 0.0.0.0 is reached
+	// on the loopback address. Every onion client connects from loopback,
+	// so the listener should be one of their own, with the users, auth
+	// methods and permissions meant for them.
+	Target string `yaml:"target"`
+}
+
+const (
+	defaultTorControl = "127.0.0.1:9051"
+	// torTimeout bounds connecting to Tor and publishing the service.
+	torTimeout = 30 * time.Second
+	// torRetry is how long to wait before publishing again after Tor was
+	// unavailable or its control connection closed.
+	torRetry = 30 * time.Second
+)
+
+// onionService publishes the server on Tor for as long as it runs. Tor
+// withdraws a service when the control connection that added it closes,
+// so that connection is kept open, and the service added again when it
+// closes.
+type onionService struct {
+	control  string
+	password string
+	keyFile  string
+	port     int
+	target   string
+	key      string // as ADD_ONION takes it, such as ED25519-V3:base64
+}
+
+func newOnionService(cfg TorConfig, listeners []*listener) (*onionService, error) {
+	o := &onionService{control: cfg.ControlAddress, password: cfg.ControlPassword, keyFile: cfg.KeyFile, port: cfg.Port}
+	if o.control == "" {
+		o.control = defaultTorControl
+	}
+	if o.port == 0 {
+		o.port = 22
+	}
+	if o.port < 1 || o.port > 65535 {
+		return nil, fmt.Errorf("port: %d is not a port number", cfg.Port)
+	}
+	if cfg.Target == "" {
+		return nil, errors.New("target: required: the address of the listener onion clients reach, preferably one of their own")
+	}
+	var l *listener
+	for _, cl := range listeners {
+		if cl.address == cfg.Target {
+			l = cl
+			break
+		}
+	}
+	if l == nil {
+		return nil, fmt.Errorf("target: %q is not a listener address", cfg.Target)
+	}
+	var err error
+	if o.target, err = onionTarget(l); err != nil {
+		return nil, fmt.Errorf("target: %v", err)
+	}
+	if o.keyFile != "" {
+		data, err := os.ReadFile(o.keyFile)
+		switch {
+		case err == nil:
+			o.key = strings.TrimSpace(string(data))
+			if !strings.HasPrefix(o.key, "ED25519-V3:") {
+				return nil, fmt.Errorf("key_file: %s does not hold an ED25519-V3 onion key", o.keyFile)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("key_file: %v", err)
+		}
+	}
+	return o, nil
+}
+
+// onionTarget returns where Tor hands the service's connections to l.
+func onionTarget(l *listener) (string, error) {
+	if strings.HasPrefix(l.address, unixPrefix) {
+		return l.address, nil
+	}
+	host, port, err := net.SplitHostPort(l.address)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if l.network == "tcp6" {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// publish keeps the onion service published, for the life of the server.
+func (o *onionService) publish() {
+	for {
+		c, err := o.add()
+		if err != nil {
+			warnf("Tor: %v; trying again in %v", err, torRetry)
+		} else {
+			_, _ = io.Copy(io.Discard, c.R)
+			c.Close()
+			warnf("Tor: control connection closed, onion service withdrawn; publishing again in %v", torRetry)
+		}
+		time.Sleep(torRetry)
+	}
+}
+
+// add connects to Tor's control port and adds the onion service, returning
+// the connection that keeps it.
+func (o *onionService) add() (*textproto.Conn, error) {
+	network, address := "tcp", o.control
+	if path, ok := strings.CutPrefix(o.control, unixPrefix); ok {
+		network, address = "unix", path
+	}
+	nc, err := net.DialTimeout(network, address, torTimeout)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(torTimeout))
+	c := textproto.NewConn(nc)
+	if err := o.authenticate(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	key := o.key
+	if key == "" {
+		key = "NEW:ED25519-V3"
+	}
+	reply, err := torCommand(c, "ADD_ONION %s Port=%d,%s", key, o.port, o.target)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("ADD_ONION: %v", err)
+	}
+	id := torReplyValue(reply, "ServiceID")
+	if pk := torReplyValue(reply, "PrivateKey"); pk != "" {
+		o.key = pk
+		if o.keyFile != "" {
+			if err := os.WriteFile(o.keyFile, []byte(pk+"\n"), 0o600); err != nil {
+				warnf("Tor: failed to save the onion service key to %s: %v", o.keyFile, err)
+			} else {
+				infof("Tor: saved the onion service key to %s", o.keyFile)
+			}
+		}
+	}
+	nc.SetDeadline(time.Time{})
+	infof("Onion service published at %s.onion:%d (to %s)", id, o.port, o.target)
+	return c, nil
+}
+
+// authenticate authenticates the control connection in the first way Tor
+// accepts of those the configuration allows.
+func (o *onionService) authenticate(c *textproto.Conn) error {
+	reply, err := torCommand(c, "PROTOCOLINFO 1")
+	if err != nil {
+		return fmt.Errorf("PROTOCOLINFO: %v", err)
+	}
+	methods := make(map[string]bool)
+	var cookieFile string
+	for _, line := range strings.Split(reply, "\n") {
+		rest, ok := strings.CutPrefix(line, "AUTH METHODS=")
+		if !ok {
+			continue
+		}
+		list, cookie, _ := strings.Cut(rest, " COOKIEFILE=")
+		for _, m := range strings.Split(list, ",") {
+			methods[m] = true
+		}
+		if cookie != "" {
+			if cookieFile, err = strconv.Unquote(cookie); err != nil {
+				return fmt.Errorf("PROTOCOLINFO: bad COOKIEFILE %s", cookie)
+			}
+		}
+	}
+
+	var auth string
+	switch {
+	case o.password != "":
+		auth = "AUTHENTICATE " + strconv.Quote(o.password)
+	case methods["NULL"]:
+		auth = "AUTHENTICATE"
+	case methods["COOKIE"] && cookieFile != "":
+		cookie, err := os.ReadFile(cookieFile)
+		if err != nil {
+			return fmt.Errorf("cookie authentication: %v", err)
+		}
+		auth = "AUTHENTICATE " + hex.EncodeToString(cookie)
+	default:
+		return fmt.Errorf("the control port needs a control_password (it accepts %s)", strings.Join(slices.Sorted(maps.Keys(methods)), ", "))
+	}
+	if _, err := torCommand(c, "%s", auth); err != nil {
+		return fmt.Errorf("AUTHENTICATE: %v", err)
+	}
+	return nil
+}
+
+// torCommand sends a control port command and returns its reply lines,
+// without their 250 codes.
+func torCommand(c *textproto.Conn, format string, args ...any) (string, error) {
+	if err := c.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	_, msg, err := c.ReadResponse(250)
+	return msg, err
+}
+
+// torReplyValue returns the value of key in the key=value lines of reply.
+func torReplyValue(reply, key string) string {
+	for _, line := range strings.Split(reply, "\n") {
+		if v, ok := strings.CutPrefix(line, key+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+package main
+
+import "encoding/binary"
+
+// termMode is one encoded terminal mode of a pty-req (RFC 4254 section 8).
+type termMode struct {
+	op    uint8
+	value uint32
+}
+
+// parseTermModes decodes the terminal modes of a pty-req, in order. Parsing
+// stops at TTY_OP_END and at opcodes of 160 and above, whose arguments are
+// not defined.
+func parseTermModes(b []byte) []termMode {
+	var modes []termMode
+	for len(b) >= 5 && b[0] != 0 && b[0] < 160 {
+		modes = append(modes, termMode{op: b[0], value: binary.BigEndian.Uint32(b[1:5])})
+		b = b[5:]
+	}
+	return modes
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// The ioctls reading and setting a terminal's termios.
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
+
+// termChars maps the control character modes to their termios index.
+// VDSUSP, VSTATUS and VFLUSH have no Linux equivalent.
+var termChars = map[uint8]int{
+	ssh.VINTR: unix.VINTR, ssh.VQUIT: unix.VQUIT, ssh.VERASE: unix.VERASE,
+	ssh.VKILL: unix.VKILL, ssh.VEOF: unix.VEOF, ssh.VEOL: unix.VEOL,
+	ssh.VEOL2: unix.VEOL2, ssh.VSTART: unix.VSTART, ssh.VSTOP: unix.VSTOP,
+	ssh.VSUSP: unix.VSUSP, ssh.VREPRINT: unix.VREPRINT, ssh.VWERASE: unix.VWERASE,
+	ssh.VLNEXT: unix.VLNEXT, ssh.VSWTCH: unix.VSWTC, ssh.VDISCARD: unix.VDISCARD,
+}
+
+// The termios flag words of termFlags.
+const (
+	iflag = iota
+	oflag
+	cflag
+	lflag
+)
+
+// termFlags maps the boolean modes to the flag word and bit they set.
+var termFlags = map[uint8]struct {
+	word int
+	bit  uint32
+}{
+	ssh.IGNPAR: {iflag, unix.IGNPAR}, ssh.PARMRK: {iflag, unix.PARMRK},
+	ssh.INPCK: {iflag, unix.INPCK}, ssh.ISTRIP: {iflag, unix.ISTRIP},
+	ssh.INLCR: {iflag, unix.INLCR}, ssh.IGNCR: {iflag, unix.IGNCR},
+	ssh.ICRNL: {iflag, unix.ICRNL}, ssh.IUCLC: {iflag, unix.IUCLC},
+	ssh.IXON: {iflag, unix.IXON}, ssh.IXANY: {iflag, unix.IXANY},
+	ssh.IXOFF: {iflag, unix.IXOFF}, ssh.IMAXBEL: {iflag, unix.IMAXBEL},
+	ssh.IUTF8: {iflag, unix.IUTF8},
+
+	ssh.ISIG: {lflag, unix.ISIG}, ssh.ICANON: {lflag, unix.ICANON},
+	ssh.XCASE: {lflag, unix.XCASE}, ssh.ECHO: {lflag, unix.ECHO},
+	ssh.ECHOE: {lflag, unix.ECHOE}, ssh.ECHOK: {lflag, unix.ECHOK},
+	ssh.ECHONL: {lflag, unix.ECHONL}, ssh.NOFLSH: {lflag, unix.NOFLSH},
+	ssh.TOSTOP: {lflag, unix.TOSTOP}, ssh.IEXTEN: {lflag, unix.IEXTEN},
+	ssh.ECHOCTL: {lflag, unix.ECHOCTL}, ssh.ECHOKE: {lflag, unix.ECHOKE},
+	ssh.PENDIN: {lflag, unix.PENDIN},
+
+	ssh.OPOST: {oflag, unix.OPOST}, ssh.OLCUC: {oflag, unix.OLCUC},
+	ssh.ONLCR: {oflag, unix.ONLCR}, ssh.OCRNL: {oflag, unix.OCRNL},
+	ssh.ONOCR: {oflag, unix.ONOCR}, ssh.ONLRET: {oflag, unix.ONLRET},
+
+	ssh.CS7: {cflag, unix.CS7}, ssh.CS8: {cflag, unix.CS8},
+	ssh.PARENB: {cflag, unix.PARENB}, ssh.PARODD: {cflag, unix.PARODD},
+}
+
+// baudRates maps the speeds of TTY_OP_ISPEED and TTY_OP_OSPEED, in bits
+// per second, to their termios codes.
+var baudRates = map[uint32]uint32{
+	0: unix.B0, 50: unix.B50, 75: unix.B75, 110: unix.B110, 134: unix.B134,
+	150: unix.B150, 200: unix.B200, 300: unix.B300, 600: unix.B600,
+	1200: unix.B1200, 1800: unix.B1800, 2400: unix.B2400, 4800: unix.B4800,
+	9600: unix.B9600, 19200: unix.B19200, 38400: unix.B38400,
+	57600: unix.B57600, 115200: unix.B115200, 230400: unix.B230400,
+	460800: unix.B460800, 921600: unix.B921600,
+}
+
+// applyTermModes sets modes on the terminal settings t the way OpenSSH
+// does: in the order the client sent them, ignoring those Linux lacks.
+func applyTermModes(t *unix.Termios, modes []termMode) {
+	words := [...]*uint32{iflag: &t.Iflag, oflag: &t.Oflag, cflag: &t.Cflag, lflag: &t.Lflag}
+	for _, m := range modes {
+		if i, ok := termChars[m.op]; ok {
+			c := uint8(m.value)
+			if m.value == 255 {
+				c = 0 // _POSIX_VDISABLE
+			}
+			t.Cc[i] = c
+			continue
+		}
+		if f, ok := termFlags[m.op]; ok {
+			if m.value != 0 {
+				*words[f.word] |= f.bit
+			} else {
+				*words[f.word] &^= f.bit
+			}
+			continue
+		}
+		speed, ok := baudRates[m.value]
+		switch {
+		case !ok:
+		case m.op == ssh.TTY_OP_OSPEED:
+			t.Cflag = t.Cflag&^unix.CBAUD | speed
+		case m.op == ssh.TTY_OP_ISPEED:
+			t.Cflag = t.Cflag&^unix.CIBAUD | speed<<unix.IBSHIFT
+		}
+	}
+}
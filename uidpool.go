@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLoginUIDs are the uids given to logins without a system account
+// by default, below those of systemd's DynamicUser.
+const defaultLoginUIDs = "60000-60999"
+
+// uidPool hands out uids without a system account to logins that have
+// none of their own, such as anonymous ones, so that each runs apart from
+// the others and never as root. A uid is only handed out again once every
+// process left running as it has been killed.
+type uidPool struct {
+	first, last uint32
+
+	mu   sync.Mutex
+	next uint32
+	used map[uint32]bool
+}
+
+func newUIDPool(spec string) (*uidPool, error) {
+	if spec == "" {
+		spec = defaultLoginUIDs
+	}
+	lo, hi, ok := strings.Cut(spec, "-")
+	first, err1 := strconv.ParseUint(lo, 10, 32)
+	last, err2 := strconv.ParseUint(hi, 10, 32)
+	if !ok || err1 != nil || err2 != nil || first == 0 || first > last {
+		return nil, fmt.Errorf("login_uids: %q is not a range of uids such as %s", spec, defaultLoginUIDs)
+	}
+	// Without /proc, the processes left running as a uid cannot be found
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		return nil, fmt.Errorf("login_uids: processes cannot be found by uid without /proc: %v", err)
+	}
+	p := &uidPool{first: uint32(first), last: uint32(last), next: uint32(first), used: make(map[uint32]bool)}
+	if name, ok := p.passwdEntry(); ok {
+		return nil, fmt.Errorf("login_uids: %s uses uid in %s; the range must be left to logins without an account", name, spec)
+	}
+	return p, nil
+}
+
+// passwdEntry returns the name of an /etc/passwd account whose uid or gid
+// is in the pool's range, if any.
+func (p *uidPool) passwdEntry() (string, bool) {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), ":")
+		if len(fields) < 4 {
+			continue
+		}
+		for _, id := range fields[2:4] {
+			if n, err := strconv.ParseUint(id, 10, 32); err == nil && uint32(n) >= p.first && uint32(n) <= p.last {
+				return fields[0], true
+			}
+		}
+	}
+	return "", false
+}
+
+// take returns an account for the login name with a uid, and gid of the
+// same number, that no other login holds and no process runs as. It has no
+// supplementary groups, and home as its home.
+func (p *uidPool) take(name, home string) (*systemAccount, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for range p.last - p.first + 1 {
+		uid := p.next
+		if p.next++; p.next > p.last {
+			p.next = p.first
+		}
+		if p.used[uid] || len(processesOf(uid)) > 0 {
+			continue
+		}
+		p.used[uid] = true
+		return &systemAccount{name: name, uid: uid, gid: uid, home: home}, nil
+	}
+	return nil, fmt.Errorf("all %d login uids are in use", p.last-p.first+1)
+}
+
+// release kills whatever still runs as a's uid, including processes that
+// left their session, and returns the uid to the pool. A uid whose
+// processes could not all be killed is kept out of it.
+func (p *uidPool) release(a *systemAccount) {
+	for range 10 {
+		pids := processesOf(a.uid)
+		if len(pids) == 0 {
+			p.mu.Lock()
+			delete(p.used, a.uid)
+			p.mu.Unlock()
+			return
+		}
+		for _, pid := range pids {
+			if proc, err := os.FindProcess(pid); err == nil {
+				_ = proc.Kill()
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	warnf("Processes of uid %d (login %s) survived being killed; not reusing the uid", a.uid, a.name)
+}
+
+// processesOf lists the live processes whose real or effective uid is
+// uid. Zombies, which can do nothing and which killing cannot remove, are
+// left out.
+func processesOf(uid uint32) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	want := []byte(strconv.FormatUint(uint64(uid), 10))
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		status, err := os.ReadFile("/proc/" + e.Name() + "/status")
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(status, []byte("\nState:\tZ")) {
+			continue
+		}
+		// Uid: real effective saved filesystem
+		_, rest, ok := bytes.Cut(status, []byte("\nUid:"))
+		if !ok {
+			continue
+		}
+		line, _, _ := bytes.Cut(rest, []byte("\n"))
+		ids := bytes.Fields(line)
+		if len(ids) >= 2 && (bytes.Equal(ids[0], want) || bytes.Equal(ids[1], want)) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
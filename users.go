@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// user is a configured account together with its parsed public keys.
+type user struct {
+	UserConfig
+	keys    []authorizedKey
+	windows []*loginWindow
+	pins    map[string]bool
+
+	// mu guards the password, which can be changed at login
+	mu         sync.Mutex
+	hash       *passwordHash
+	mustChange bool
+}
+
+// userDB holds every configured account, keyed by username. A reload
+// replaces them all at once.
+type userDB struct {
+	mu    sync.RWMutex
+	users map[string]*user
+}
+
+// newUserDB validates the configured accounts and loads their keys. Users
+// without keys of their own get those of keysFile, if set and it exists,
+// with %u replaced by the username.
+func newUserDB(cfgs []UserConfig, keysFile string) (*userDB, error) {
+	db := &userDB{users: make(map[string]*user, len(cfgs))}
+	for _, uc := range cfgs {
+		if uc.Name == "" {
+			return nil, fmt.Errorf("user entry without a name")
+		}
+		if _, dup := db.users[uc.Name]; dup {
+			return nil, fmt.Errorf("user %q defined more than once", uc.Name)
+		}
+
+		u := &user{UserConfig: uc, mustChange: uc.MustChangePassword}
+		if uc.PasswordHash != "" {
+			h, err := parsePasswordHash(uc.PasswordHash)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: password_hash: %v", uc.Name, err)
+			}
+			u.hash = h
+		} else if uc.Password != "" {
+			warnf("User %q has a plaintext password; consider password_hash instead", uc.Name)
+		}
+		if len(uc.AuthorizedKeys) > 0 {
+			keys, err := parseAuthorizedKeys([]byte(strings.Join(uc.AuthorizedKeys, "\n")))
+			if err != nil {
+				return nil, fmt.Errorf("user %q: authorized_keys: %v", uc.Name, err)
+			}
+			u.keys = append(u.keys, keys...)
+		}
+		if uc.AuthorizedKeysFile != "" {
+			keys, err := loadAuthorizedKeys(uc.AuthorizedKeysFile)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %v", uc.Name, err)
+			}
+			u.keys = append(u.keys, keys...)
+		}
+		if len(u.keys) == 0 && keysFile != "" {
+			keys, err := loadAuthorizedKeys(strings.ReplaceAll(keysFile, "%u", uc.Name))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("user %q: %v", uc.Name, err)
+			}
+			u.keys = keys
+		}
+		for _, fp := range uc.PinnedKeys {
+			if !strings.HasPrefix(fp, "SHA256:") {
+				return nil, fmt.Errorf("user %q: pinned_keys: %q is not a SHA256 fingerprint", uc.Name, fp)
+			}
+			if u.pins == nil {
+				u.pins = make(map[string]bool)
+			}
+			u.pins[fp] = true
+		}
+		if err := checkPermissions(uc.Permissions); err != nil {
+			return nil, fmt.Errorf("user %q: %v", uc.Name, err)
+		}
+		for i, wc := range uc.LoginWindows {
+			w, err := parseLoginWindow(wc)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: login_windows[%d]: %v", uc.Name, i, err)
+			}
+			u.windows = append(u.windows, w)
+		}
+		db.users[uc.Name] = u
+	}
+	return db, nil
+}
+
+// externalUser builds the account for a user authenticated by a provider
+// other than the local database.
+func externalUser(name string, perms *ssh.Permissions) *user {
+	u := &user{UserConfig: UserConfig{Name: name}}
+	if perms != nil {
+		u.Shell = perms.Extensions[permShell]
+		u.Home = perms.Extensions[permHome]
+	}
+	return u
+}
+
+// lookup returns the account named name.
+func (db *userDB) lookup(name string) (*user, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	u, ok := db.users[name]
+	return u, ok
+}
+
+// names returns the usernames, sorted.
+func (db *userDB) names() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.users))
+	for name := range db.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replace swaps in the accounts of next, which is not used after.
+func (db *userDB) replace(next *userDB) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.users = next.users
+}
+
+// checkPassword reports whether pass is the configured password for u. A
+// password_hash takes precedence over a plaintext password; accounts with
+// neither cannot use password authentication.
+func (u *user) checkPassword(pass []byte) bool {
+	u.mu.Lock()
+	h := u.hash
+	u.mu.Unlock()
+	if h != nil {
+		return h.verify(pass)
+	}
+	return u.Password != "" && subtle.ConstantTimeCompare(pass, []byte(u.Password)) == 1
+}
+
+// needsPasswordChange reports whether u must set a new password before
+// logging in.
+func (u *user) needsPasswordChange() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.mustChange
+}
+
+// setPassword replaces u's password hash; a nil hash keeps the current one.
+func (u *user) setPassword(h *passwordHash, mustChange bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if h != nil {
+		u.hash = h
+	}
+	u.mustChange = mustChange
+}
+
+// findKey returns the authorized_keys entry for key, if u has one.
+func (u *user) findKey(key ssh.PublicKey) (*authorizedKey, bool) {
+	return findAuthorizedKey(u.keys, key)
+}
+
+// pinned reports whether u may log in with key. Any key is allowed for
+// users without pinned_keys; certificates are checked by their key.
+func (u *user) pinned(key ssh.PublicKey) bool {
+	if u.pins == nil {
+		return true
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	return u.pins[ssh.FingerprintSHA256(key)]
+}
+
+// shell returns the login shell for u, or the platform's default shell if
+// none is configured.
+func (u *user) shell() string {
+	if u.Shell != "" {
+		return u.Shell
+	}
+	return defaultShell()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// UtmpConfig makes PTY sessions show up in who, w and last on the host, as
+// OpenSSH's do. Files that do not exist are left alone, as glibc does.
+type UtmpConfig struct {
+	// UtmpFile lists current logins; defaults to /var/run/utmp.
+	UtmpFile string `yaml:"utmp_file"`
+	// WtmpFile logs logins and logouts; defaults to /var/log/wtmp.
+	WtmpFile string `yaml:"wtmp_file"`
+	// LastlogFile keeps the last login of each uid, for sessions with a
+	// system account; defaults to /var/log/lastlog.
+	LastlogFile string `yaml:"lastlog_file"`
+}
+
+// Record types of ut_type.
+const (
+	utmpUserProcess = 7
+	utmpDeadProcess = 8
+)
+
+// utmpRecord is glibc's struct utmp on Linux, 384 bytes with 32-bit times
+// on every architecture.
+type utmpRecord struct {
+	Type    int16
+	_       [2]byte
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Sec     int32
+	Usec    int32
+	Addr    [16]byte // network byte order
+	_       [20]byte
+}
+
+// lastlogRecord is struct lastlog, stored at uid * its size.
+type lastlogRecord struct {
+	Time int32
+	Line [32]byte
+	Host [256]byte
+}
+
+// loginRecorder writes login and logout records for PTY sessions.
+type loginRecorder struct {
+	cfg UtmpConfig
+}
+
+func newLoginRecorder(cfg UtmpConfig) *loginRecorder {
+	if cfg.UtmpFile == "" {
+		cfg.UtmpFile = "/var/run/utmp"
+	}
+	if cfg.WtmpFile == "" {
+		cfg.WtmpFile = "/var/log/wtmp"
+	}
+	if cfg.LastlogFile == "" {
+		cfg.LastlogFile = "/var/log/lastlog"
+	}
+	return &loginRecorder{cfg: cfg}
+}
+
+// newUtmpRecord fills in a record for the terminal tty, such as
+// /dev/pts/3. Its id is the last four characters of the line, as OpenSSH
+// uses.
+func newUtmpRecord(typ int16, tty string, pid int) utmpRecord {
+	line := strings.TrimPrefix(tty, "/dev/")
+	now := time.Now()
+	r := utmpRecord{Type: typ, Pid: int32(pid), Session: int32(pid),
+		Sec: int32(now.Unix()), Usec: int32(now.Nanosecond() / 1000)}
+	copy(r.Line[:], line)
+	copy(r.ID[:], line[max(0, len(line)-4):])
+	return r
+}
+
+// login records that user logged in from host on tty, with the session
+// leader pid, and returns the function recording the logout. uid is the
+// session's system account, or negative for none.
+func (l *loginRecorder) login(user, host, tty string, pid, uid int) func() {
+	r := newUtmpRecord(utmpUserProcess, tty, pid)
+	copy(r.User[:], user)
+	copy(r.Host[:], host)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Unmap().Is4() {
+			a := addr.Unmap().As4()
+			copy(r.Addr[:], a[:])
+		} else {
+			a := addr.As16()
+			copy(r.Addr[:], a[:])
+		}
+	}
+	l.write(r)
+	if uid >= 0 {
+		ll := lastlogRecord{Time: r.Sec}
+		copy(ll.Line[:], r.Line[:])
+		copy(ll.Host[:], host)
+		l.report(l.cfg.LastlogFile, writeLastlog(l.cfg.LastlogFile, uid, ll))
+	}
+	return func() { l.write(newUtmpRecord(utmpDeadProcess, tty, pid)) }
+}
+
+// write puts r in utmp, replacing the entry for its terminal, and appends it
+// to wtmp.
+func (l *loginRecorder) write(r utmpRecord) {
+	l.report(l.cfg.UtmpFile, putUtmp(l.cfg.UtmpFile, r))
+	l.report(l.cfg.WtmpFile, appendRecord(l.cfg.WtmpFile, r))
+}
+
+func (l *loginRecorder) report(file string, err error) {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		warnf("Failed to update %s: %v", file, err)
+	}
+}
+
+// putUtmp writes r over the entry with the same id, or appends it.
+func putUtmp(file string, r utmpRecord) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	size := int64(binary.Size(r))
+	var offset int64
+	for {
+		var e utmpRecord
+		if err := binary.Read(f, binary.NativeEndian, &e); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return err
+			}
+			break
+		}
+		if e.ID == r.ID && (e.Type == utmpUserProcess || e.Type == utmpDeadProcess) {
+			break
+		}
+		offset += size
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.NativeEndian, r)
+	_, err = f.WriteAt(buf.Bytes(), offset)
+	return err
+}
+
+// appendRecord adds r to the end of a wtmp file.
+func appendRecord(file string, r utmpRecord) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	return binary.Write(f, binary.NativeEndian, r)
+}
+
+// writeLastlog stores r as the last login of uid.
+func writeLastlog(file string, uid int, r lastlogRecord) error {
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.NativeEndian, r)
+	_, err = f.WriteAt(buf.Bytes(), int64(uid)*int64(buf.Len()))
+	return err
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes a write lock on all of f, as glibc does for these files.
+// Closing f releases it.
+func lockFile(f *os.File) error {
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &syscall.Flock_t{Type: syscall.F_WRLCK})
+}
+
+// recordLogin records the login of a session that started pid on the PTY
+// master f and returns the function recording its logout.
+func (sess *session) recordLogin(f *os.File, pid int) func() {
+	if sess.logins == nil {
+		return func() {}
+	}
+	tty, err := ptsName(f)
+	if err != nil {
+		warnf("Not recording login of %s: %v", sess.user.Name, err)
+		return func() {}
+	}
+	name, uid := sess.user.Name, -1
+	if sess.account != nil {
+		name, uid = sess.account.name, int(sess.account.uid)
+	}
+	return sess.logins.login(name, remoteIP(sess.conn.RemoteAddr()), tty, pid, uid)
+}
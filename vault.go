@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// VaultConfig fetches key material and credentials from HashiCorp Vault
+// instead of local files.
+type VaultConfig struct {
+	// Address and Token default to $VAULT_ADDR and $VAULT_TOKEN.
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+
+	// HostKeyPath is a KV secret (v1 or v2, e.g. "secret/data/ssh/host")
+	// whose HostKeyField (default "private_key") holds the PEM host key.
+	// It replaces id_rsa.
+	HostKeyPath  string `yaml:"host_key_path"`
+	HostKeyField string `yaml:"host_key_field"`
+
+	// UsersPath is a KV secret mapping usernames to bcrypt or argon2id
+	// hashes. It is re-read every RefreshInterval (default 5m).
+	UsersPath       string        `yaml:"users_path"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// vaultClient is a minimal client for the Vault HTTP API.
+type vaultClient struct {
+	cfg    VaultConfig
+	client *http.Client
+}
+
+// vaultEnv holds VAULT_ADDR and VAULT_TOKEN, which are taken out of the
+// server's environment as it starts so that no session or other child
+// inherits the token. Only a server replacing this one on a restart is
+// given them back.
+var vaultEnv = map[string]string{}
+
+func init() {
+	for _, name := range []string{"VAULT_ADDR", "VAULT_TOKEN"} {
+		if v, ok := os.LookupEnv(name); ok {
+			vaultEnv[name] = v
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// vaultEnviron returns vaultEnv as environment variables.
+func vaultEnviron() []string {
+	var env []string
+	for name, v := range vaultEnv {
+		env = append(env, name+"="+v)
+	}
+	return env
+}
+
+func newVaultClient(cfg VaultConfig) (*vaultClient, error) {
+	if cfg.Address == "" {
+		cfg.Address = vaultEnv["VAULT_ADDR"]
+	}
+	if cfg.Token == "" {
+		cfg.Token = vaultEnv["VAULT_TOKEN"]
+	}
+	if cfg.Address == "" || cfg.Token == "" {
+		return nil, errors.New("vault: address and token are required (or set VAULT_ADDR and VAULT_TOKEN)")
+	}
+	cfg.Address = strings.TrimSuffix(cfg.Address, "/")
+	if cfg.HostKeyField == "" {
+		cfg.HostKeyField = "private_key"
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = 5 * time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return &vaultClient{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}, nil
+}
+
+// vaultResponse covers the parts of Vault replies used here.
+type vaultResponse struct {
+	Data map[string]any `json:"data"`
+	Auth *struct {
+		LeaseDuration int  `json:"lease_duration"`
+		Renewable     bool `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// do sends an authenticated request to the API path (without /v1/).
+func (v *vaultClient) do(method, path string, body any) (*vaultResponse, error) {
+	var rd bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&rd).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, v.cfg.Address+"/v1/"+strings.TrimPrefix(path, "/"), &rd)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.cfg.Token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var vr vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil {
+		return nil, fmt.Errorf("%s %s: %s: %v", method, path, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.Join(vr.Errors, "; "))
+	}
+	return &vr, nil
+}
+
+// readSecret returns the string fields of a KV secret, unwrapping the
+// nested data of KV version 2.
+func (v *vaultClient) readSecret(path string) (map[string]string, error) {
+	vr, err := v.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	data := vr.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, v2 := data["metadata"]; v2 {
+			data = inner
+		}
+	}
+	fields := make(map[string]string, len(data))
+	for k, val := range data {
+		if s, ok := val.(string); ok {
+			fields[k] = s
+		}
+	}
+	return fields, nil
+}
+
+// hostKey reads the host private key.
+func (v *vaultClient) hostKey() (ssh.Signer, error) {
+	fields, err := v.readSecret(v.cfg.HostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	pem, ok := fields[v.cfg.HostKeyField]
+	if !ok {
+		return nil, fmt.Errorf("%s has no %q field", v.cfg.HostKeyPath, v.cfg.HostKeyField)
+	}
+	return ssh.ParsePrivateKey([]byte(pem))
+}
+
+// renewToken keeps a renewable token alive for the life of the server,
+// renewing it when half of its TTL has passed.
+func (v *vaultClient) renewToken() {
+	vr, err := v.do(http.MethodGet, "auth/token/lookup-self", nil)
+	if err != nil {
+		warnf("Vault token lookup failed: %v", err)
+		return
+	}
+	ttl, _ := vr.Data["ttl"].(float64)
+	if renewable, _ := vr.Data["renewable"].(bool); !renewable || ttl <= 0 {
+		// Root and periodic-less tokens without a TTL never expire
+		return
+	}
+
+	for {
+		time.Sleep(time.Duration(ttl) * time.Second / 2)
+		vr, err := v.do(http.MethodPost, "auth/token/renew-self", map[string]any{})
+		if err != nil || vr.Auth == nil {
+			warnf("Vault token renewal failed, retrying in 30s: %v", err)
+			ttl = 60
+			continue
+		}
+		ttl = float64(vr.Auth.LeaseDuration)
+		if !vr.Auth.Renewable || ttl <= 0 {
+			return
+		}
+	}
+}
+
+// vaultProvider checks passwords against hashes stored in Vault.
+type vaultProvider struct {
+	v *vaultClient
+
+	mu     sync.RWMutex
+	hashes map[string]*passwordHash
+}
+
+func newVaultProvider(v *vaultClient) (*vaultProvider, error) {
+	p := &vaultProvider{v: v}
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(v.cfg.RefreshInterval) {
+			if err := p.refresh(); err != nil {
+				warnf("Keeping previous Vault credentials: %v", err)
+			}
+		}
+	}()
+	return p, nil
+}
+
+// refresh re-reads the credentials secret.
+func (p *vaultProvider) refresh() error {
+	fields, err := p.v.readSecret(p.v.cfg.UsersPath)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]*passwordHash, len(fields))
+	for name, encoded := range fields {
+		h, err := parsePasswordHash(encoded)
+		if err != nil {
+			return fmt.Errorf("user %q: %v", name, err)
+		}
+		hashes[name] = h
+	}
+	p.mu.Lock()
+	p.hashes = hashes
+	p.mu.Unlock()
+	return nil
+}
+
+// count returns the number of loaded credentials.
+func (p *vaultProvider) count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.hashes)
+}
+
+func (p *vaultProvider) authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	p.mu.RLock()
+	h, ok := p.hashes[c.User()]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, errUnknownUser
+	}
+	if !h.verify(pass) {
+		return nil, errors.New("wrong password")
+	}
+	return nil, nil
+}
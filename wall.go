@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// wallMessage frames msg the way wall(1) does, for a terminal in raw mode.
+func wallMessage(msg string, now time.Time) string {
+	return fmt.Sprintf("\r\n\a*** Broadcast message from the administrator (%s) ***\r\n\r\n%s\r\n",
+		now.Format("Mon Jan 2 15:04:05 2006"), strings.ReplaceAll(msg, "\n", "\r\n"))
+}
+
+// wall writes msg to the terminal of every session running on a PTY and
+// returns how many there were. The writes happen in the background, so a
+// client that stopped reading holds up only its own.
+func (s *server) wall(msg string) int {
+	text := wallMessage(msg, time.Now())
+	n := 0
+	for _, sess := range s.live.list() {
+		if !sess.onTerminal.Load() {
+			continue
+		}
+		n++
+		go func() { _, _ = io.WriteString(sess.ch, text) }()
+	}
+	return n
+}
+
+func init() {
+	registerAdminCommand("wall", "wall <message>", "write a message to every interactive session", func(s *server, args []string, w io.Writer) error {
+		if len(args) == 0 {
+			return errors.New("usage: wall <message>")
+		}
+		msg := strings.Join(args, " ")
+		n := s.wall(msg)
+		infof("Admin broadcast to %d sessions: %s", n, msg)
+		fmt.Fprintf(w, "sent to %d sessions\n", n)
+		return nil
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// WebhookConfig configures an HTTP endpoint that makes auth decisions.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Headers are added to every request, e.g. an Authorization token.
+	Headers map[string]string `yaml:"headers"`
+	// Timeout defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// webhookRequest is the JSON body POSTed for each attempt. Password attempts
+// carry the password; public key attempts carry the key's type and SHA256
+// fingerprint.
+type webhookRequest struct {
+	Username    string `json:"username"`
+	Method      string `json:"method"`
+	RemoteAddr  string `json:"remote_addr"`
+	Password    string `json:"password,omitempty"`
+	KeyType     string `json:"key_type,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// webhookResponse is the expected reply. Unknown users should be answered
+// with allow=false and unknown=true so later providers are consulted.
+// Command, if set, is forced on the login like a key's command= option.
+type webhookResponse struct {
+	Allow   bool   `json:"allow"`
+	Unknown bool   `json:"unknown"`
+	Reason  string `json:"reason"`
+	Command string `json:"command"`
+}
+
+// webhookProvider delegates auth decisions to an HTTP service.
+type webhookProvider struct {
+	cfg    WebhookConfig
+	client *http.Client
+}
+
+func newWebhookProvider(cfg WebhookConfig) (*webhookProvider, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("webhook: url is required")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	return &webhookProvider{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}, nil
+}
+
+func (p *webhookProvider) authenticatePassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	return p.ask(webhookRequest{
+		Username:   c.User(),
+		Method:     "password",
+		RemoteAddr: c.RemoteAddr().String(),
+		Password:   string(pass),
+	})
+}
+
+func (p *webhookProvider) authenticatePublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	return p.ask(webhookRequest{
+		Username:    c.User(),
+		Method:      "publickey",
+		RemoteAddr:  c.RemoteAddr().String(),
+		KeyType:     key.Type(),
+		Fingerprint: ssh.FingerprintSHA256(key),
+	})
+}
+
+// ask POSTs the attempt and interprets the reply. Transport errors and
+// non-200 replies deny the attempt.
+func (p *webhookProvider) ask(body webhookRequest) (*ssh.Permissions, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+
+	var reply webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("webhook: bad reply: %v", err)
+	}
+	switch {
+	case reply.Allow && reply.Command != "":
+		perms := fullPermissions()
+		setExtension(perms, permForcedCommand, reply.Command)
+		return perms, nil
+	case reply.Allow:
+		return nil, nil
+	case reply.Unknown:
+		return nil, errUnknownUser
+	case reply.Reason != "":
+		return nil, fmt.Errorf("webhook: denied: %s", reply.Reason)
+	}
+	return nil, errors.New("webhook: denied")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// whoInfo is what a session runs, as who shows it.
+type whoInfo struct {
+	tty     string
+	command string
+}
+
+// setCommand records command as what the session runs, if it started.
+func (sess *session) setCommand(started bool, command string) {
+	if !started {
+		return
+	}
+	sess.whoMu.Lock()
+	defer sess.whoMu.Unlock()
+	sess.who.command = command
+}
+
+// setTTY records the terminal the session's process runs on.
+func (sess *session) setTTY(tty string) {
+	sess.whoMu.Lock()
+	defer sess.whoMu.Unlock()
+	sess.who.tty = tty
+}
+
+func (sess *session) currentWho() whoInfo {
+	sess.whoMu.Lock()
+	defer sess.whoMu.Unlock()
+	return sess.who
+}
+
+// writeWho lists the live sessions, oldest first.
+func (s *server) writeWho(w io.Writer) {
+	sessions := s.live.list()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].started.Before(sessions[j].started) })
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tFROM\tSINCE\tTTY\tCOMMAND")
+	for _, sess := range sessions {
+		info := sess.currentWho()
+		tty, command := info.tty, info.command
+		if tty == "" {
+			tty = "-"
+		}
+		if command == "" {
+			command = "(starting)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", sess.user.Name, remoteIP(sess.conn.RemoteAddr()),
+			sess.started.Format(time.RFC3339), tty, command)
+	}
+	tw.Flush()
+}
+
+func init() {
+	registerAdminCommand("who", "who", "list active sessions", func(s *server, args []string, w io.Writer) error {
+		s.writeWho(w)
+		return nil
+	})
+}
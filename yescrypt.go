@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// A pure Go yescrypt ("$y$"), the crypt(3) format Debian, Ubuntu, Fedora
+// and Arch write to /etc/shadow by default, following the reference
+// implementation in libxcrypt. Only what crypt(3) can produce is supported:
+// the classic scrypt and WORM modes and the one pwxform flavour of the RW
+// mode, without ROMs or hash upgrades.
+
+// Flags as encoded in the setting's flavor.
+const (
+	yescryptWORM       = 0x001
+	yescryptRW         = 0x002
+	yescryptFlavorMask = 0x3fc
+	// 6 pwxform rounds, gathers of 4, simple 2 and 12 KiB S-boxes
+	yescryptRWDefault = yescryptRW | 0x004 | 0x010 | 0x020 | 0x080
+)
+
+// The pwxform parameters of yescryptRWDefault.
+const (
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	sWidth    = 8
+
+	pwxWords  = pwxGather * pwxSimple * 2 // 32-bit words per pwxform block
+	sWords64  = (1 << sWidth) * pwxSimple // 64-bit words per S-box
+	sMask     = ((1 << sWidth) - 1) * pwxSimple * 8
+	sBytes    = 3 * sWords64 * 8
+	sBoxWords = sBytes / 4
+)
+
+// yescryptMaxMemory bounds the memory a setting may ask for, so that a
+// stray hash cannot exhaust the server's at every login.
+const yescryptMaxMemory = 1 << 30
+
+type yescryptParams struct {
+	flags uint32
+	n     uint64
+	r, p  uint32
+	t     uint32
+}
+
+// parseYescrypt splits a yescrypt setting into its parameters, the prefix
+// up to and including the salt and the decoded salt.
+func parseYescrypt(setting string) (yescryptParams, string, []byte, error) {
+	params := yescryptParams{p: 1}
+	rest, _ := strings.CutPrefix(setting, "$y$")
+
+	flavor, rest, ok := yescryptDecodeUint32(rest, 0)
+	switch {
+	case !ok:
+		return params, "", nil, errors.New("malformed yescrypt parameters")
+	case flavor < yescryptRW:
+		params.flags = flavor
+	case flavor <= yescryptRW+yescryptFlavorMask>>2:
+		params.flags = yescryptRW + (flavor-yescryptRW)<<2
+	default:
+		return params, "", nil, fmt.Errorf("unknown yescrypt flavor %d", flavor)
+	}
+	nLog2, rest, ok1 := yescryptDecodeUint32(rest, 1)
+	r, rest, ok2 := yescryptDecodeUint32(rest, 1)
+	if !ok1 || !ok2 || nLog2 > 63 {
+		return params, "", nil, errors.New("malformed yescrypt parameters")
+	}
+	params.n, params.r = 1<<nLog2, r
+	if rest != "" && rest[0] != '$' {
+		have, after, ok := yescryptDecodeUint32(rest, 1)
+		if ok && have&1 != 0 {
+			params.p, after, ok = yescryptDecodeUint32(after, 2)
+		}
+		if ok && have&2 != 0 {
+			params.t, after, ok = yescryptDecodeUint32(after, 1)
+		}
+		if !ok {
+			return params, "", nil, errors.New("malformed yescrypt parameters")
+		}
+		if have&(4|8) != 0 {
+			return params, "", nil, errors.New("yescrypt hash upgrades and ROMs are not supported")
+		}
+		rest = after
+	}
+	rest, ok = strings.CutPrefix(rest, "$")
+	if !ok {
+		return params, "", nil, errors.New("malformed yescrypt parameters")
+	}
+
+	saltStr := rest
+	if i := strings.LastIndexByte(rest, '$'); i >= 0 {
+		saltStr = rest[:i]
+	}
+	salt, ok := yescryptDecode64(saltStr)
+	if !ok || len(salt) > 64 {
+		return params, "", nil, errors.New("malformed yescrypt salt")
+	}
+	prefix := setting[:len(setting)-len(rest)+len(saltStr)]
+
+	switch params.flags {
+	case 0:
+		if params.t != 0 {
+			return params, "", nil, errors.New("yescrypt: classic scrypt takes no time parameter")
+		}
+	case yescryptWORM, yescryptRWDefault:
+	default:
+		return params, "", nil, fmt.Errorf("unsupported yescrypt flavor %d", flavor)
+	}
+	n, r64, p := params.n, uint64(params.r), uint64(params.p)
+	if n <= 1 || params.flags&yescryptRW != 0 && n/p <= 1 ||
+		r64 > yescryptMaxMemory/128/p || n > yescryptMaxMemory/128/r64 {
+		return params, "", nil, fmt.Errorf("unsupported yescrypt cost N=%d r=%d p=%d", n, r64, p)
+	}
+	return params, prefix, salt, nil
+}
+
+// yescryptCrypt hashes pass with the parameters and salt of setting and
+// returns the full "$y$" hash.
+func yescryptCrypt(pass []byte, setting string) (string, error) {
+	params, prefix, salt, err := parseYescrypt(setting)
+	if err != nil {
+		return "", err
+	}
+	key := yescryptKDF(pass, salt, params)
+	out := []byte(prefix + "$")
+	for i := 0; i+3 <= len(key); i += 3 {
+		out = cryptEncode(out, key[i+2], key[i+1], key[i], 4)
+	}
+	return string(cryptEncode(out, 0, key[31], key[30], 3)), nil
+}
+
+// yescryptKDF derives the 32-byte key of a hash, first pre-hashing the
+// password with a 64th of the cost when the parameters are large enough.
+func yescryptKDF(pass, salt []byte, params yescryptParams) []byte {
+	n, r, p := params.n, uint64(params.r), uint64(params.p)
+	if params.flags&yescryptRW != 0 && n/p >= 0x100 && n/p*r >= 0x20000 {
+		pass = yescryptKDFBody(pass, salt, params.flags, n>>6, params.r, params.p, 0, true)
+	}
+	return yescryptKDFBody(pass, salt, params.flags, n, params.r, params.p, params.t, false)
+}
+
+func yescryptKDFBody(pass, salt []byte, flags uint32, n uint64, r, p, t uint32, prehash bool) []byte {
+	if flags != 0 {
+		key := "yescrypt"
+		if prehash {
+			key = "yescrypt-prehash"
+		}
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(pass)
+		pass = mac.Sum(nil)
+	}
+
+	b, _ := pbkdf2.Key(sha256.New, string(pass), salt, 1, 128*int(r)*int(p))
+	if flags != 0 {
+		// From here on the password is the head of B, which smix folds
+		// into an HMAC of the S-boxes' seed.
+		pass = append([]byte(nil), b[:32]...)
+	}
+
+	v := make([]uint32, 32*uint64(r)*n)
+	xy := make([]uint32, 64*r)
+	if p == 1 || flags&yescryptRW != 0 {
+		var s []uint32
+		if flags&yescryptRW != 0 {
+			s = make([]uint32, sBoxWords*int(p))
+		}
+		yescryptSMix(b, int(r), n, p, t, flags, v, xy, s, pass)
+	} else {
+		for i := range int(p) {
+			yescryptSMix(b[128*int(r)*i:128*int(r)*(i+1)], int(r), n, 1, t, flags, v, xy, nil, nil)
+		}
+	}
+
+	dk, _ := pbkdf2.Key(sha256.New, string(pass), b, 1, 32)
+	if flags != 0 && !prehash {
+		// The SCRAM (RFC 5802) ClientKey and StoredKey steps
+		mac := hmac.New(sha256.New, dk)
+		mac.Write([]byte("Client Key"))
+		stored := sha256.Sum256(mac.Sum(nil))
+		dk = stored[:]
+	}
+	return dk
+}
+
+// pwxformCtx holds the S-boxes of one of yescrypt's p lanes.
+type pwxformCtx struct {
+	s0, s1, s2 []uint32
+	w          int
+}
+
+func yescryptSMix(b []byte, r int, n uint64, p, t, flags uint32, v, xy, s []uint32, pass []byte) {
+	nChunk := n / uint64(p)
+	nLoopAll := nChunk
+	if flags&yescryptRW != 0 {
+		if t <= 1 {
+			if t != 0 {
+				nLoopAll *= 2
+			}
+			nLoopAll = (nLoopAll + 2) / 3
+		} else {
+			nLoopAll *= uint64(t - 1)
+		}
+	} else if t != 0 {
+		if t == 1 {
+			nLoopAll += (nLoopAll + 1) / 2
+		}
+		nLoopAll *= uint64(t)
+	}
+	var nLoopRW uint64
+	if flags&yescryptRW != 0 {
+		nLoopRW = nLoopAll / uint64(p)
+	}
+	nChunk &^= 1
+	nLoopAll = (nLoopAll + 1) &^ 1
+	nLoopRW = (nLoopRW + 1) &^ 1
+
+	ctxs := make([]pwxformCtx, p)
+	lane := func(i int) (bp []byte, ctx *pwxformCtx) {
+		if flags&yescryptRW != 0 {
+			ctx = &ctxs[i]
+		}
+		return b[128*r*i : 128*r*(i+1)], ctx
+	}
+	vChunk := uint64(0)
+	for i := range int(p) {
+		np := nChunk
+		if i == int(p)-1 {
+			np = n - vChunk
+		}
+		vp := v[32*uint64(r)*vChunk:]
+		bp, ctx := lane(i)
+		if ctx != nil {
+			sbox := s[sBoxWords*i : sBoxWords*(i+1)]
+			yescryptSMix1(bp, 1, sBytes/128, 0, sbox, xy, nil)
+			ctx.s2 = sbox[:2*sWords64]
+			ctx.s1 = sbox[2*sWords64 : 4*sWords64]
+			ctx.s0 = sbox[4*sWords64:]
+			if i == 0 {
+				mac := hmac.New(sha256.New, bp[len(bp)-64:])
+				mac.Write(pass)
+				copy(pass, mac.Sum(nil))
+			}
+		}
+		yescryptSMix1(bp, r, np, flags, vp, xy, ctx)
+		yescryptSMix2(bp, r, p2floor(np), nLoopRW, flags, vp, xy, ctx)
+		vChunk += nChunk
+	}
+	for i := range int(p) {
+		bp, ctx := lane(i)
+		yescryptSMix2(bp, r, n, nLoopAll-nLoopRW, flags&^yescryptRW, v, xy, ctx)
+	}
+}
+
+// yescryptLoad and yescryptStore move B between its little-endian bytes and
+// the SIMD-shuffled words the block functions work on.
+func yescryptLoad(x []uint32, b []byte) {
+	for k := range len(x) / 16 {
+		for i := range 16 {
+			x[k*16+i] = binary.LittleEndian.Uint32(b[(k*16+i*5%16)*4:])
+		}
+	}
+}
+
+func yescryptStore(b []byte, x []uint32) {
+	for k := range len(x) / 16 {
+		for i := range 16 {
+			binary.LittleEndian.PutUint32(b[(k*16+i*5%16)*4:], x[k*16+i])
+		}
+	}
+}
+
+func yescryptSMix1(b []byte, r int, n uint64, flags uint32, v, xy []uint32, ctx *pwxformCtx) {
+	s := uint64(32 * r)
+	x, y := xy[:s], xy[s:2*s]
+	yescryptLoad(x, b)
+	for i := range n {
+		copy(v[i*s:(i+1)*s], x)
+		if flags&yescryptRW != 0 && i > 1 {
+			j := wrap(integerify(x, r), i)
+			xorWords(x, v[j*s:(j+1)*s])
+		}
+		blockmix(x, y, r, ctx)
+	}
+	yescryptStore(b, x)
+}
+
+func yescryptSMix2(b []byte, r int, n, nLoop uint64, flags uint32, v, xy []uint32, ctx *pwxformCtx) {
+	s := uint64(32 * r)
+	x, y := xy[:s], xy[s:2*s]
+	yescryptLoad(x, b)
+	for range nLoop {
+		j := integerify(x, r) & (n - 1)
+		xorWords(x, v[j*s:(j+1)*s])
+		if flags&yescryptRW != 0 {
+			copy(v[j*s:(j+1)*s], x)
+		}
+		blockmix(x, y, r, ctx)
+	}
+	yescryptStore(b, x)
+}
+
+// integerify returns the first 64 bits of the last block of x, the second
+// word of which is the 13th after shuffling.
+func integerify(x []uint32, r int) uint64 {
+	last := x[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+// p2floor returns the largest power of two not above x.
+func p2floor(x uint64) uint64 {
+	for y := x & (x - 1); y != 0; y = x & (x - 1) {
+		x = y
+	}
+	return x
+}
+
+func wrap(x, i uint64) uint64 {
+	n := p2floor(i)
+	return x&(n-1) + (i - n)
+}
+
+func xorWords(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// blockmix is BlockMix_pwxform with ctx, and scrypt's BlockMix_salsa20/8
+// with y as scratch space without.
+func blockmix(x, y []uint32, r int, ctx *pwxformCtx) {
+	if ctx == nil {
+		var t [16]uint32
+		copy(t[:], x[(2*r-1)*16:])
+		for i := range 2 * r {
+			xorWords(t[:], x[i*16:(i+1)*16])
+			salsa20(t[:], 8)
+			copy(y[i*16:(i+1)*16], t[:])
+		}
+		for i := range r {
+			copy(x[i*16:(i+1)*16], y[2*i*16:])
+			copy(x[(i+r)*16:(i+r+1)*16], y[(2*i+1)*16:])
+		}
+		return
+	}
+
+	r1 := 128 * r / (pwxWords * 4)
+	var t [pwxWords]uint32
+	copy(t[:], x[(r1-1)*pwxWords:])
+	for i := range r1 {
+		if r1 > 1 {
+			xorWords(t[:], x[i*pwxWords:(i+1)*pwxWords])
+		}
+		ctx.pwxform(t[:])
+		copy(x[i*pwxWords:(i+1)*pwxWords], t[:])
+	}
+	i := (r1 - 1) * pwxWords / 16
+	salsa20(x[i*16:(i+1)*16], 2)
+	for i++; i < 2*r; i++ {
+		xorWords(x[i*16:(i+1)*16], x[(i-1)*16:i*16])
+		salsa20(x[i*16:(i+1)*16], 2)
+	}
+}
+
+// pwxform transforms a block with the S-boxes, writing to S2 as it goes,
+// and then rotates them.
+func (c *pwxformCtx) pwxform(b []uint32) {
+	s0, s1, s2, w := c.s0, c.s1, c.s2, c.w
+	for i := range pwxRounds {
+		for j := range pwxGather {
+			x := b[j*pwxSimple*2 : (j+1)*pwxSimple*2]
+			p0 := s0[(x[0]&sMask)/4:]
+			p1 := s1[(x[1]&sMask)/4:]
+			for k := range pwxSimple {
+				v := uint64(x[2*k+1]) * uint64(x[2*k])
+				v += uint64(p0[2*k+1])<<32 | uint64(p0[2*k])
+				v ^= uint64(p1[2*k+1])<<32 | uint64(p1[2*k])
+				x[2*k], x[2*k+1] = uint32(v), uint32(v>>32)
+				if i != 0 && i != pwxRounds-1 {
+					s2[2*w], s2[2*w+1] = uint32(v), uint32(v>>32)
+					w++
+				}
+			}
+		}
+	}
+	c.s0, c.s1, c.s2 = s2, s0, s1
+	c.w = w & (sWords64 - 1)
+}
+
+// salsa20 applies the Salsa20 core of the given rounds to a shuffled block.
+func salsa20(b []uint32, rounds int) {
+	var x [16]uint32
+	for i := range 16 {
+		x[i*5%16] = b[i]
+	}
+	rotl := bits.RotateLeft32
+	for i := 0; i < rounds; i += 2 {
+		x[4] ^= rotl(x[0]+x[12], 7)
+		x[8] ^= rotl(x[4]+x[0], 9)
+		x[12] ^= rotl(x[8]+x[4], 13)
+		x[0] ^= rotl(x[12]+x[8], 18)
+		x[9] ^= rotl(x[5]+x[1], 7)
+		x[13] ^= rotl(x[9]+x[5], 9)
+		x[1] ^= rotl(x[13]+x[9], 13)
+		x[5] ^= rotl(x[1]+x[13], 18)
+		x[14] ^= rotl(x[10]+x[6], 7)
+		x[2] ^= rotl(x[14]+x[10], 9)
+		x[6] ^= rotl(x[2]+x[14], 13)
+		x[10] ^= rotl(x[6]+x[2], 18)
+		x[3] ^= rotl(x[15]+x[11], 7)
+		x[7] ^= rotl(x[3]+x[15], 9)
+		x[11] ^= rotl(x[7]+x[3], 13)
+		x[15] ^= rotl(x[11]+x[7], 18)
+
+		x[1] ^= rotl(x[0]+x[3], 7)
+		x[2] ^= rotl(x[1]+x[0], 9)
+		x[3] ^= rotl(x[2]+x[1], 13)
+		x[0] ^= rotl(x[3]+x[2], 18)
+		x[6] ^= rotl(x[5]+x[4], 7)
+		x[7] ^= rotl(x[6]+x[5], 9)
+		x[4] ^= rotl(x[7]+x[6], 13)
+		x[5] ^= rotl(x[4]+x[7], 18)
+		x[11] ^= rotl(x[10]+x[9], 7)
+		x[8] ^= rotl(x[11]+x[10], 9)
+		x[9] ^= rotl(x[8]+x[11], 13)
+		x[10] ^= rotl(x[9]+x[8], 18)
+		x[12] ^= rotl(x[15]+x[14], 7)
+		x[13] ^= rotl(x[12]+x[15], 9)
+		x[14] ^= rotl(x[13]+x[12], 13)
+		x[15] ^= rotl(x[14]+x[13], 18)
+	}
+	for i := range 16 {
+		b[i] += x[i*5%16]
+	}
+}
+
+// yescryptDecodeUint32 decodes one of the variable-length integers of a
+// yescrypt setting, whose first character tells how many follow.
+func yescryptDecodeUint32(s string, min uint32) (uint32, string, bool) {
+	if s == "" {
+		return 0, s, false
+	}
+	c := strings.IndexByte(cryptAlphabet, s[0])
+	if c < 0 {
+		return 0, s, false
+	}
+	s = s[1:]
+	start, end, chars, shift := uint32(0), uint32(47), 1, 0
+	v := min
+	for uint32(c) > end {
+		v += (end + 1 - start) << shift
+		start = end + 1
+		end = start + (62-end)/2
+		chars++
+		shift += 6
+	}
+	v += (uint32(c) - start) << shift
+	for ; chars > 1; chars-- {
+		if s == "" {
+			return 0, s, false
+		}
+		c := strings.IndexByte(cryptAlphabet, s[0])
+		if c < 0 {
+			return 0, s, false
+		}
+		s = s[1:]
+		shift -= 6
+		v += uint32(c) << shift
+	}
+	return v, s, true
+}
+
+// yescryptDecode64 decodes yescrypt's base64, which packs groups of up to
+// three bytes little-endian into four characters, low bits first.
+func yescryptDecode64(s string) ([]byte, bool) {
+	var out []byte
+	for s != "" {
+		n := min(len(s), 4)
+		if n == 1 {
+			return nil, false
+		}
+		var v uint32
+		for i := range n {
+			c := strings.IndexByte(cryptAlphabet, s[i])
+			if c < 0 {
+				return nil, false
+			}
+			v |= uint32(c) << (6 * i)
+		}
+		s = s[n:]
+		for b := 6 * n; b >= 8; b -= 8 {
+			out = append(out, byte(v))
+			v >>= 8
+		}
+		if v != 0 {
+			return nil, false
+		}
+	}
+	return out, true
+}